@@ -2,6 +2,7 @@ package cli
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/0xfe/microstellar"
@@ -52,6 +53,7 @@ func (cli *CLI) buildAccountNewCmd() *cobra.Command {
 				return
 			}
 
+			cli.unindexAccount(name)
 			err = cli.SetVar(fmt.Sprintf("account:%s:address", name), pair.Address)
 
 			if err != nil {
@@ -65,6 +67,11 @@ func (cli *CLI) buildAccountNewCmd() *cobra.Command {
 				showError(logrus.Fields{"cmd": "account", "subcmd": "new"}, "could not save keypair: %s", name)
 				return
 			}
+
+			if err := cli.indexAccount(name); err != nil {
+				showError(logrus.Fields{"cmd": "account", "subcmd": "new"}, "could not index keypair: %s", name)
+				return
+			}
 		},
 	}
 
@@ -79,6 +86,7 @@ func (cli *CLI) buildAccountSetCmd() *cobra.Command {
 		Args:  cobra.MinimumNArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			name := args[0]
+			cli.unindexAccount(name)
 
 			for i := range args {
 				if i == 0 {
@@ -105,6 +113,11 @@ func (cli *CLI) buildAccountSetCmd() *cobra.Command {
 					return
 				}
 			}
+
+			if err := cli.indexAccount(name); err != nil {
+				cli.error(logrus.Fields{"cmd": "account", "subcmd": "set"}, "could not index account: %s", name)
+				return
+			}
 		},
 	}
 }
@@ -156,6 +169,7 @@ func (cli *CLI) buildAccountDelCmd() *cobra.Command {
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			name := args[0]
+			cli.unindexAccount(name)
 
 			err := cli.DelVar(fmt.Sprintf("account:%s:seed", name))
 			err = cli.DelVar(fmt.Sprintf("account:%s:address", name))
@@ -164,6 +178,31 @@ func (cli *CLI) buildAccountDelCmd() *cobra.Command {
 				cli.error(logrus.Fields{"cmd": "account", "subcmd": "del"}, "could not delete account: %s", name)
 				return
 			}
+
+			// A parent namespace might still have it
+			cli.indexAccount(name)
 		},
 	}
 }
+
+// listAccounts returns the names of all accounts in the current namespace,
+// including the ones it inherits.
+func (cli *CLI) listAccounts() ([]string, error) {
+	vars, err := cli.effectiveVars("account:")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for key := range vars {
+		parts := strings.Split(strings.TrimPrefix(key, "account:"), ":")
+		if len(parts) == 2 && (parts[1] == "address" || parts[1] == "seed") && !seen[parts[0]] {
+			seen[parts[0]] = true
+			names = append(names, parts[0])
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,291 @@
+package cli
+
+// This file maintains a reverse index from addresses and assets to their names
+// in the namespace, so output can say "GABC... (mo)" instead of just "GABC...".
+// The index lives under rev:, is kept up to date by the account and asset
+// commands (and ns import), and is rebuilt from scratch if it's missing. Each
+// namespace has its own index, which includes the aliases it inherits from its
+// parents.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/sirupsen/logrus"
+)
+
+func revAccountPrefix(address string) string {
+	return "rev:account:" + address + ":"
+}
+
+func revAssetPrefix(code string, issuer string) string {
+	return "rev:asset:" + code + ":" + issuer + ":"
+}
+
+// accountRev returns the reverse index key for account alias name, or false
+// if it isn't indexed (e.g., it's a federation address.)
+func (cli *CLI) accountRev(name string) (string, bool) {
+	if address, ok := cli.aliasAddress(name); ok {
+		return revAccountPrefix(address) + name, true
+	}
+
+	return "", false
+}
+
+// assetRev returns the reverse index key for asset alias name, or false if it
+// isn't indexed.
+func (cli *CLI) assetRev(name string) (string, bool) {
+	if _, err := cli.GetVar(fmt.Sprintf("asset:%s:issuer", name)); err != nil {
+		return "", false
+	}
+
+	if asset, err := cli.ResolveAsset(name); err == nil && !asset.IsNative() {
+		return revAssetPrefix(asset.Code, asset.Issuer) + name, true
+	}
+
+	return "", false
+}
+
+// indexAccount adds account alias name to the reverse index. Aliases of
+// federation addresses aren't indexed.
+func (cli *CLI) indexAccount(name string) error {
+	if rev, ok := cli.accountRev(name); ok {
+		return cli.updateAliasIndexes("account:"+name+":", rev, name)
+	}
+
+	return nil
+}
+
+// unindexAccount removes account alias name from the reverse index. Call it
+// before the alias changes.
+func (cli *CLI) unindexAccount(name string) {
+	if rev, ok := cli.accountRev(name); ok {
+		cli.updateAliasIndexes("account:"+name+":", rev, "")
+	}
+}
+
+// indexAsset adds asset alias name to the reverse index.
+func (cli *CLI) indexAsset(name string) error {
+	if rev, ok := cli.assetRev(name); ok {
+		return cli.updateAliasIndexes("asset:"+name+":", rev, name)
+	}
+
+	return nil
+}
+
+// unindexAsset removes asset alias name from the reverse index. Call it before
+// the alias changes.
+func (cli *CLI) unindexAsset(name string) {
+	if rev, ok := cli.assetRev(name); ok {
+		cli.updateAliasIndexes("asset:"+name+":", rev, "")
+	}
+}
+
+// aliasOwner returns the namespace that ns gets the alias with keys under
+// prefix (e.g., "account:mo:") from, or "" if it doesn't have it.
+func (cli *CLI) aliasOwner(ns string, prefix string) string {
+	for _, owner := range cli.nsChain(ns) {
+		if keys, err := cli.store.Keys(owner + ":" + prefix); err == nil && len(keys) > 0 {
+			return owner
+		}
+	}
+
+	return ""
+}
+
+// updateAliasIndexes sets the reverse index entry rev to name (or deletes it
+// if name is "") in the current namespace, and in the built indexes of the
+// namespaces that inherit the same alias from it. Unbuilt indexes are left to
+// be built when they're needed.
+func (cli *CLI) updateAliasIndexes(prefix string, rev string, name string) error {
+	owner := cli.aliasOwner(cli.ns, prefix)
+	for _, ns := range append([]string{cli.ns}, cli.nsDescendants(cli.ns)...) {
+		if ns != cli.ns {
+			if _, err := cli.store.Get(ns + ":rev:built"); err != nil || cli.aliasOwner(ns, prefix) != owner {
+				continue
+			}
+		}
+
+		key := fmt.Sprintf("%s:%s", ns, rev)
+		if name == "" {
+			cli.store.Delete(key)
+		} else if err := cli.store.Set(key, name, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildAliasIndex replaces the reverse index with one built from the
+// accounts and assets in the namespace.
+func (cli *CLI) rebuildAliasIndex() error {
+	keys, err := cli.store.Keys(cli.ns + ":rev:")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		cli.store.Delete(key)
+	}
+
+	accounts, err := cli.listAccounts()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range accounts {
+		if rev, ok := cli.accountRev(name); ok {
+			if err := cli.SetVar(rev, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	assets, err := cli.listAssets()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range assets {
+		if rev, ok := cli.assetRev(name); ok {
+			if err := cli.SetVar(rev, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cli.SetVar("rev:built", "true")
+}
+
+// invalidateAliasIndexes drops the reverse indexes of ns and the namespaces
+// that inherit from it, so they're rebuilt on the next lookup. Use it when
+// what ns inherits changes.
+func (cli *CLI) invalidateAliasIndexes(ns string) {
+	cli.store.Delete(ns + ":rev:built")
+	for _, descendant := range cli.nsDescendants(ns) {
+		cli.store.Delete(descendant + ":rev:built")
+	}
+}
+
+// reverseLookup returns the names in the reverse index under prefix, building
+// the index first if it's missing.
+func (cli *CLI) reverseLookup(prefix string) []string {
+	// The index is per-namespace, so don't inherit the marker.
+	if _, err := cli.store.Get(cli.ns + ":rev:built"); err != nil {
+		if err := cli.rebuildAliasIndex(); err != nil {
+			debugf(logrus.Fields{"method": "reverseLookup"}, "could not build alias index: %v", err)
+			return nil
+		}
+	}
+
+	prefix = fmt.Sprintf("%s:%s", cli.ns, prefix)
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, prefix))
+	}
+
+	return names
+}
+
+// aliasNamer annotates addresses and assets in output with their names. A nil
+// aliasNamer leaves them alone.
+type aliasNamer struct {
+	cli *CLI
+}
+
+// namer returns an aliasNamer for output, or nil if --raw is set.
+func (cli *CLI) namer() *aliasNamer {
+	if raw, _ := cli.rootCmd.Flags().GetBool("raw"); raw {
+		return nil
+	}
+
+	return &aliasNamer{cli}
+}
+
+// names returns the account aliases of address.
+func (n *aliasNamer) names(address string) []string {
+	if n == nil || microstellar.ValidAddress(address) != nil {
+		return nil
+	}
+
+	return n.cli.reverseLookup(revAccountPrefix(address))
+}
+
+// address returns "ADDRESS (NAME, ...)", or just the address if it has no
+// names.
+func (n *aliasNamer) address(address string) string {
+	if names := n.names(address); len(names) > 0 {
+		return fmt.Sprintf("%s (%s)", address, strings.Join(names, ", "))
+	}
+
+	return address
+}
+
+// assetNames returns the asset aliases of code and issuer.
+func (n *aliasNamer) assetNames(code string, issuer string) []string {
+	if n == nil || issuer == "" {
+		return nil
+	}
+
+	return n.cli.reverseLookup(revAssetPrefix(code, issuer))
+}
+
+// asset returns "CODE (NAME, ...)" for the asset aliases of code and issuer
+// that aren't just the code, or "CODE".
+func (n *aliasNamer) asset(code string, issuer string) string {
+	var names []string
+	for _, name := range n.assetNames(code, issuer) {
+		if name != code {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) > 0 {
+		return fmt.Sprintf("%s (%s)", code, strings.Join(names, ", "))
+	}
+
+	return code
+}
+
+// namedAccount is an account with the names of its address, signers, and
+// assets, for "lumen info".
+type namedAccount struct {
+	microstellar.Account
+	Aliases  []string       `json:"aliases,omitempty"`
+	Balances []namedBalance `json:"balances"`
+	Signers  []namedSigner  `json:"signers"`
+}
+
+type namedBalance struct {
+	microstellar.Balance
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+type namedSigner struct {
+	microstellar.Signer
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// account returns account with the names of its address, signers, and assets.
+func (n *aliasNamer) account(account *microstellar.Account) *namedAccount {
+	named := &namedAccount{Account: *account, Aliases: n.names(account.Address)}
+
+	named.Balances = []namedBalance{}
+	for _, balance := range account.Balances {
+		named.Balances = append(named.Balances, namedBalance{balance, n.assetNames(balance.Asset.Code, balance.Asset.Issuer)})
+	}
+
+	named.Signers = []namedSigner{}
+	for _, signer := range account.Signers {
+		named.Signers = append(named.Signers, namedSigner{signer, n.names(signer.PublicKey)})
+	}
+
+	return named
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestAliases(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new citibank")
+	cli.TestCommand("account new signer")
+	cli.TestCommand("asset set USD citibank")
+	cli.TestCommand("asset set dollars citibank --code USD")
+	issuer := strings.TrimSpace(cli.TestCommand("account address citibank"))
+	signer := strings.TrimSpace(cli.TestCommand("account address signer"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/accounts/"+issuer {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": 404, "title": "Resource Missing"}`))
+			return
+		}
+
+		fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "100", `+
+			`"balances": [{"balance": "10.0000000", "asset_type": "credit_alphanum4", "asset_code": "USD", "asset_issuer": "%s"}], `+
+			`"signers": [{"public_key": "%s", "key": "%s", "weight": 1, "type": "ed25519_public_key"}, `+
+			`{"public_key": "%s", "key": "%s", "weight": 2, "type": "ed25519_public_key"}]}`,
+			issuer, issuer, issuer, issuer, issuer, signer, signer)
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	expectOutput(t, cli, "address:"+issuer+" (citibank) weight:1\naddress:"+signer+" (signer) weight:2", "signer list citibank")
+	expectOutput(t, cli, "address:"+issuer+" weight:1\naddress:"+signer+" weight:2", "signer list citibank --raw")
+
+	info := cli.TestCommand("info citibank")
+	for _, want := range []string{`"aliases": [`, `"citibank"`, `"signer"`, `"USD"`, `"dollars"`} {
+		if !strings.Contains(info, want) {
+			t.Errorf("info: want %s, got %v", want, info)
+		}
+	}
+
+	if info := cli.TestCommand("info citibank --raw"); strings.Contains(info, "aliases") {
+		t.Errorf("info --raw: unexpected aliases: %v", info)
+	}
+
+	// The index follows aliases as they change
+	cli.TestCommand("account set boss " + issuer)
+	expectOutput(t, cli, "address:"+issuer+" (boss, citibank) weight:1\naddress:"+signer+" (signer) weight:2", "signer list citibank")
+
+	cli.TestCommand("account set boss " + signer)
+	expectOutput(t, cli, "address:"+issuer+" (citibank) weight:1\naddress:"+signer+" (boss, signer) weight:2", "signer list citibank")
+
+	cli.TestCommand("account del boss")
+	cli.TestCommand("account new signer")
+	expectOutput(t, cli, "address:"+issuer+" (citibank) weight:1\naddress:"+signer+" weight:2", "signer list citibank")
+
+	names := cli.namer()
+	if got := names.asset("USD", issuer); got != "USD (dollars)" {
+		t.Errorf("want USD (dollars), got %v", got)
+	}
+
+	cli.TestCommand("asset del dollars")
+	cli.TestCommand("asset set greenbacks citibank --code USD")
+	if got := names.asset("USD", issuer); got != "USD (greenbacks)" {
+		t.Errorf("want USD (greenbacks), got %v", got)
+	}
+
+	// A missing index is rebuilt on the next lookup
+	for _, key := range []string{"rev:built", revAccountPrefix(issuer) + "citibank"} {
+		cli.DelVar(key)
+	}
+	if got := names.address(issuer); got != issuer+" (citibank)" {
+		t.Errorf("want rebuilt index, got %v", got)
+	}
+
+	// Inherited aliases are updated in place in the child namespaces' indexes,
+	// except where a child has its own alias with the same name
+	cli.TestCommand("ns create child --parent test")
+	cli.TestCommand("ns create shadow --parent test")
+	cli.TestCommand("ns shadow")
+	cli.TestCommand("account set vault " + signer)
+	names.names(signer)
+	cli.TestCommand("ns child")
+	names.names(issuer)
+
+	cli.TestCommand("ns test")
+	cli.TestCommand("account set vault " + issuer)
+	expectIndexBuilt(t, cli, "child", "shadow")
+	cli.TestCommand("ns child")
+	if got := strings.Join(names.names(issuer), ","); got != "citibank,vault" {
+		t.Errorf("want inherited alias in child index, got %v", got)
+	}
+	cli.TestCommand("ns shadow")
+	if got := strings.Join(names.names(issuer), ","); got != "citibank" {
+		t.Errorf("want shadowed alias left out, got %v", got)
+	}
+
+	// So are imported aliases
+	cli.TestCommand("ns copy shadow child --on-conflict overwrite")
+	expectIndexBuilt(t, cli, "child")
+	cli.TestCommand("ns child")
+	if got := strings.Join(names.names(signer), ","); got != "vault" {
+		t.Errorf("want imported alias in index, got %v", got)
+	}
+	if got := strings.Join(names.names(issuer), ","); got != "citibank" {
+		t.Errorf("want overwritten alias out of index, got %v", got)
+	}
+
+	var raw *aliasNamer
+	if got := raw.address(issuer); got != issuer {
+		t.Errorf("nil namer: want %s, got %v", issuer, got)
+	}
+}
+
+func expectIndexBuilt(t *testing.T, cli *CLI, namespaces ...string) {
+	for _, ns := range namespaces {
+		if _, err := cli.store.Get(ns + ":rev:built"); err != nil {
+			t.Errorf("index of %s was dropped", ns)
+		}
+	}
+}
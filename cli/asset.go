@@ -2,6 +2,8 @@ package cli
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/0xfe/microstellar"
 
@@ -11,12 +13,12 @@ import (
 
 func (cli *CLI) buildAssetCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "asset [set|del|code|issuer|type]",
+		Use:   "asset [set|del|code|issuer|type|info|issue]",
 		Short: "manage stellar assets",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) > 0 {
-				cli.error(logrus.Fields{"cmd": "asset"}, "unrecognized asset command: %s, expecting: set|del|code|issuer|type", args[0])
+				cli.error(logrus.Fields{"cmd": "asset"}, "unrecognized asset command: %s, expecting: set|del|code|issuer|type|info|issue", args[0])
 				return
 			}
 		},
@@ -27,6 +29,8 @@ func (cli *CLI) buildAssetCmd() *cobra.Command {
 	cmd.AddCommand(cli.buildAssetIssuerCmd())
 	cmd.AddCommand(cli.buildAssetTypeCmd())
 	cmd.AddCommand(cli.buildAssetDelCmd())
+	cmd.AddCommand(cli.buildAssetInfoCmd())
+	cmd.AddCommand(cli.buildAssetIssueCmd())
 
 	return cmd
 }
@@ -41,6 +45,7 @@ func (cli *CLI) buildAssetSetCmd() *cobra.Command {
 			issuer := args[1]
 			code := name
 			assetType := string(microstellar.NativeType)
+			cli.unindexAsset(name)
 
 			for _, part := range []string{"issuer", "code", "type"} {
 				key := fmt.Sprintf("asset:%s:%s", name, part)
@@ -98,6 +103,11 @@ func (cli *CLI) buildAssetSetCmd() *cobra.Command {
 					return
 				}
 			}
+
+			if err := cli.indexAsset(name); err != nil {
+				cli.error(logrus.Fields{"cmd": "asset", "subcmd": "set"}, "could not index asset: %s", name)
+				return
+			}
 		},
 	}
 
@@ -180,12 +190,35 @@ func (cli *CLI) buildAssetDelCmd() *cobra.Command {
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			name := args[0]
+			cli.unindexAsset(name)
 			for _, part := range []string{"issuer", "code", "type"} {
 				key := fmt.Sprintf("asset:%s:%s", name, part)
 				cli.DelVar(key)
 			}
+
+			// A parent namespace might still have it
+			cli.indexAsset(name)
 		},
 	}
 
 	return cmd
 }
+
+// listAssets returns the names of all assets in the current namespace,
+// including the ones it inherits.
+func (cli *CLI) listAssets() ([]string, error) {
+	vars, err := cli.effectiveVars("asset:")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for key := range vars {
+		if strings.HasSuffix(key, ":issuer") {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(key, "asset:"), ":issuer"))
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
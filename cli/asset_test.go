@@ -1,6 +1,13 @@
 package cli
 
-import "testing"
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
 
 // Note: add -v to any of these commands to enable verbose logging
 
@@ -35,3 +42,75 @@ func TestAssets(t *testing.T) {
 	expectOutput(t, cli, "credit_alphanum4", "asset type USD:citibank")
 	expectOutput(t, cli, "credit_alphanum12", "asset type USD:citibank:credit_alphanum12")
 }
+
+func TestAssetInfo(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new citibank")
+	cli.TestCommand("asset set USD citibank")
+	cli.TestCommand("asset set dollars citibank --code USD")
+	cli.TestCommand("asset set EUR citibank")
+	issuer := strings.TrimSpace(cli.TestCommand("account address citibank"))
+
+	var mutex sync.Mutex
+	homeDomain := ""
+	stellarTomlFile := ""
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.URL.Path == "/.well-known/stellar.toml":
+			w.Write([]byte(stellarTomlFile))
+		case r.URL.Path == "/assets":
+			if r.URL.Query().Get("asset_code") != "USD" || r.URL.Query().Get("asset_issuer") != issuer {
+				w.Write([]byte(`{"_embedded": {"records": []}}`))
+				return
+			}
+			w.Write([]byte(`{"_embedded": {"records": [{"asset_type": "credit_alphanum4", "asset_code": "USD", "amount": "1500.0000000", ` +
+				`"num_accounts": 12, "flags": {"auth_required": true, "auth_revocable": false, "auth_immutable": true}}]}}`))
+		case r.URL.Path == "/accounts/"+issuer:
+			fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "100", "balances": [], `+
+				`"signers": [{"public_key": "%s", "key": "%s", "weight": 0, "type": "ed25519_public_key"}], "flags": {"auth_revocable": true, "auth_immutable": true}, "home_domain": "%s"}`,
+				issuer, issuer, issuer, issuer, homeDomain)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": 404, "title": "Resource Missing"}`))
+		}
+	}))
+	defer server.Close()
+
+	oldURL := stellarTomlURL
+	stellarTomlURL = func(domain string) string { return server.URL + "/.well-known/stellar.toml" }
+	defer func() { stellarTomlURL = oldURL }()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	header := "code: USD\ntype: credit_alphanum4\nissuer: " + issuer + " (citibank)\namount issued: 1500.0000000\nholders: 12\n" +
+		"flags: auth_required auth_immutable\nlocked: yes (no more can be issued)\naliases: USD, dollars\n"
+	expectOutput(t, cli, header+"home domain: none", "asset info dollars")
+
+	mutex.Lock()
+	homeDomain = "citi.com"
+	stellarTomlFile = "[[CURRENCIES]]\ncode = \"EUR\"\nissuer = \"" + issuer + "\"\n"
+	mutex.Unlock()
+	expectOutput(t, cli, header+"home domain: citi.com\nstellar.toml: citi.com doesn't list USD", "asset info USD:"+issuer)
+
+	mutex.Lock()
+	stellarTomlFile += "[[CURRENCIES]]\ncode = \"USD\"\nissuer = \"" + issuer + "\"\nname = \"US Dollar\"\ndesc = \"Redeemable 1:1\"\n" +
+		"is_asset_anchored = true\nanchor_asset_type = \"fiat\"\nanchor_asset = \"USD\"\nimage = \"https://citi.com/usd.png\"\n"
+	mutex.Unlock()
+	expectOutput(t, cli, header+"home domain: citi.com\nname: US Dollar\ndescription: Redeemable 1:1\nimage: https://citi.com/usd.png\nanchored to: fiat USD", "asset info USD")
+
+	// Nobody holds EUR yet, so the flags come from the issuer
+	out := cli.TestCommand("asset info EUR")
+	if !strings.Contains(out, "amount issued: 0.0000000\nholders: 0\nflags: auth_revocable auth_immutable\n") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "asset info native")
+	expectOutput(t, cli, "error", "asset info GBP:GBY7XDYKXBDHQ2B523SF7K6BNJNRYHVQMWY7AYAEKTYLCQMYVFHL57UM")
+}
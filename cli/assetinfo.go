@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// assetStats is a record from horizon's /assets endpoint.
+type assetStats struct {
+	Amount      string             `json:"amount"`
+	NumAccounts int                `json:"num_accounts"`
+	Flags       microstellar.Flags `json:"flags"`
+}
+
+// loadAssetStats returns the amount issued, number of holders, and issuer
+// flags of asset. It returns nil if no account holds the asset.
+func loadAssetStats(ctx context.Context, horizon string, asset *microstellar.Asset) (*assetStats, error) {
+	query := url.Values{"asset_code": {asset.Code}, "asset_issuer": {asset.Issuer}}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/assets?%s", strings.TrimRight(horizon, "/"), query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not load asset %s: got %s", asset.Code, resp.Status)
+	}
+
+	var page struct {
+		Embedded struct {
+			Records []assetStats `json:"records"`
+		} `json:"_embedded"`
+	}
+
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, errors.Wrapf(err, "could not parse asset %s", asset.Code)
+	}
+
+	if len(page.Embedded.Records) == 0 {
+		return nil, nil
+	}
+
+	return &page.Embedded.Records[0], nil
+}
+
+// loadAccountFlags returns the auth flags of the account at address. Accounts
+// loaded with microstellar don't have auth_immutable, so this asks horizon.
+func loadAccountFlags(ctx context.Context, horizon string, address string) (microstellar.Flags, error) {
+	var account struct {
+		Flags microstellar.Flags `json:"flags"`
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/accounts/%s", strings.TrimRight(horizon, "/"), address), nil)
+	if err != nil {
+		return account.Flags, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return account.Flags, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return account.Flags, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return account.Flags, errors.Errorf("could not load account %s: got %s", address, resp.Status)
+	}
+
+	if err := json.Unmarshal(body, &account); err != nil {
+		return account.Flags, errors.Wrapf(err, "could not parse account %s", address)
+	}
+
+	return account.Flags, nil
+}
+
+func (cli *CLI) buildAssetInfoCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "info [name]",
+		Short: "show what the network knows about asset [name]",
+		Long: `Show the amount issued, number of holders, and issuer flags of asset [name], the
+issuer's home domain and stellar.toml entry for the asset, and the local aliases
+for the asset and its issuer. [name] can be an alias or CODE:ISSUER.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "asset", "subcmd": "info"}
+			name := args[0]
+
+			asset, err := cli.ResolveAsset(name)
+			if err != nil {
+				debugf(logFields, "%v", err)
+				cli.error(logFields, "could not load asset: %s", name)
+				return
+			}
+
+			if asset.IsNative() {
+				cli.error(logFields, "native lumens have no issuer: %s", name)
+				return
+			}
+
+			issuer, err := cli.ms.LoadAccount(asset.Issuer)
+			if err != nil {
+				cli.error(logFields, "could not load issuer %s: %v", asset.Issuer, microstellar.ErrorString(err))
+				return
+			}
+
+			stats, err := loadAssetStats(cli.ctx, cli.horizonURL(), asset)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if stats == nil {
+				flags, err := loadAccountFlags(cli.ctx, cli.horizonURL(), asset.Issuer)
+				if err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+				stats = &assetStats{Amount: "0.0000000", Flags: flags}
+			}
+
+			assetNames := cli.reverseLookup(revAssetPrefix(asset.Code, asset.Issuer))
+			accountNames := cli.reverseLookup(revAccountPrefix(asset.Issuer))
+			issuerDesc := asset.Issuer
+			if len(accountNames) > 0 {
+				issuerDesc += fmt.Sprintf(" (%s)", strings.Join(accountNames, ", "))
+			}
+
+			var flags []string
+			for _, flag := range []struct {
+				name string
+				set  bool
+			}{
+				{"auth_required", stats.Flags.AuthRequired},
+				{"auth_revocable", stats.Flags.AuthRevocable},
+				{"auth_immutable", stats.Flags.AuthImmutable},
+			} {
+				if flag.set {
+					flags = append(flags, flag.name)
+				}
+			}
+			if len(flags) == 0 {
+				flags = []string{"none"}
+			}
+
+			showSuccess("code: %s", asset.Code)
+			showSuccess("type: %s", asset.Type)
+			showSuccess("issuer: %s", issuerDesc)
+			showSuccess("amount issued: %s", stats.Amount)
+			showSuccess("holders: %d", stats.NumAccounts)
+			showSuccess("flags: %s", strings.Join(flags, " "))
+			if isLocked(issuer) {
+				showSuccess("locked: yes (no more can be issued)")
+			}
+
+			if len(assetNames) > 0 {
+				showSuccess("aliases: %s", strings.Join(assetNames, ", "))
+			}
+
+			if issuer.HomeDomain == "" {
+				showSuccess("home domain: none")
+				return
+			}
+			showSuccess("home domain: %s", issuer.HomeDomain)
+
+			st, err := fetchStellarToml(issuer.HomeDomain)
+			if err != nil {
+				debugf(logFields, "%v", err)
+				showSuccess("stellar.toml: %v", err)
+				return
+			}
+
+			var currency *stellarTomlCurrency
+			for i := range st.Currencies {
+				if st.Currencies[i].Code == asset.Code && st.Currencies[i].Issuer == asset.Issuer {
+					currency = &st.Currencies[i]
+				}
+			}
+
+			if currency == nil {
+				showSuccess("stellar.toml: %s doesn't list %s", issuer.HomeDomain, asset.Code)
+				return
+			}
+
+			for _, field := range []struct{ name, value string }{
+				{"name", currency.Name},
+				{"description", currency.Desc},
+				{"status", currency.Status},
+				{"conditions", currency.Conditions},
+				{"image", currency.Image},
+				{"anchored to", strings.TrimSpace(currency.AnchorAssetType + " " + currency.AnchorAsset)},
+				{"redemption", currency.RedemptionInstructions},
+			} {
+				if field.value != "" {
+					showSuccess("%s: %s", field.name, field.value)
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// reconnectBackoffBase is the delay before the first reconnect of a dropped
+// stream (or retry of a failed poll.)
+var reconnectBackoffBase = time.Second
+
+// backoff computes exponentially increasing delays with jitter, for retries and
+// reconnects.
+type backoff struct {
+	base    time.Duration // first delay
+	max     time.Duration // longest delay
+	attempt int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+// next returns the delay before the next attempt, which is a random duration
+// between half and all of base * 2^attempt (capped at max.)
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.base << uint(b.attempt); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+
+	b.attempt++
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// reset starts over from the base delay.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// sleepContext waits for delay, returning false if ctx is done first.
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -61,7 +61,12 @@ func (cli *CLI) buildInfoCmd() *cobra.Command {
 				return
 			}
 
-			info, _ := json.MarshalIndent(*account, "", "  ")
+			var info []byte
+			if names := cli.namer(); names != nil {
+				info, _ = json.MarshalIndent(names.account(account), "", "  ")
+			} else {
+				info, _ = json.MarshalIndent(*account, "", "  ")
+			}
 			showSuccess(string(info))
 		},
 	}
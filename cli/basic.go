@@ -44,6 +44,14 @@ func (cli *CLI) buildNSCmd() *cobra.Command {
 			}
 		},
 	}
+
+	cmd.AddCommand(cli.buildNSCreateCmd())
+	cmd.AddCommand(cli.buildNSShowCmd())
+	cmd.AddCommand(cli.buildNSExportCmd())
+	cmd.AddCommand(cli.buildNSImportCmd())
+	cmd.AddCommand(cli.buildNSCopyCmd())
+	cmd.AddCommand(cli.buildNSRenameCmd())
+	cmd.AddCommand(cli.buildNSDeleteCmd())
 	return cmd
 }
 
@@ -109,7 +117,7 @@ func (cli *CLI) buildDelCmd() *cobra.Command {
 func (cli *CLI) buildFriendbotCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "friendbot [address]",
-		Short: "fund [address] on the test network with friendbot",
+		Short: "fund [address] with the network's friendbot",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			name := args[0]
@@ -122,7 +130,7 @@ func (cli *CLI) buildFriendbotCmd() *cobra.Command {
 				return
 			}
 
-			response, err := microstellar.FundWithFriendBot(address)
+			response, err := cli.fundWithFriendbot(address)
 
 			if err != nil {
 				cli.error(logFields, "friendbot error: %v", err)
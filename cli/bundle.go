@@ -0,0 +1,194 @@
+package cli
+
+// This file contains support for transaction bundles, which carry everything
+// an offline machine needs to review and sign a transaction.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/xdr"
+)
+
+// txBundle is the on-disk format of a prepared transaction.
+type txBundle struct {
+	Version    string                  `json:"version"`
+	Network    string                  `json:"network"`
+	Passphrase string                  `json:"passphrase"`
+	Envelope   string                  `json:"envelope"`
+	Source     string                  `json:"source"`
+	Sequence   string                  `json:"sequence"`
+	Signers    []microstellar.Signer   `json:"signers"`
+	Thresholds microstellar.Thresholds `json:"thresholds"`
+	PreparedOn time.Time               `json:"prepared_on"`
+
+	// SignersUnknown is set when the bundle was prepared with --seq, which
+	// skips loading the account, so Signers and Thresholds are empty.
+	SignersUnknown bool `json:"signers_unknown,omitempty"`
+}
+
+func readBundle(fileName string) (*txBundle, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read bundle")
+	}
+
+	var bundle txBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, errors.Errorf("invalid bundle %s: %v", fileName, err)
+	}
+
+	if bundle.Envelope == "" || bundle.Passphrase == "" {
+		return nil, errors.Errorf("incomplete bundle %s: missing envelope or passphrase", fileName)
+	}
+
+	return &bundle, nil
+}
+
+func (bundle *txBundle) write(fileName string) error {
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal bundle")
+	}
+
+	return errors.Wrapf(ioutil.WriteFile(fileName, data, 0600), "could not write bundle")
+}
+
+// describe returns a human readable summary of the bundle, including which
+// of the account's signers have signed it.
+func (bundle *txBundle) describe() ([]string, error) {
+	txe, err := microstellar.DecodeTx(bundle.Envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{fmt.Sprintf("network: %s", bundle.Passphrase)}
+	lines = append(lines, describeTx(txe)...)
+
+	if bundle.SignersUnknown {
+		return append(lines, "signers: unknown (prepared with --seq)"), nil
+	}
+
+	signedWeight := int32(0)
+	for _, signer := range bundle.Signers {
+		status := "unsigned"
+		if hasSignatureFrom(txe, signer.PublicKey) {
+			status = "signed"
+			signedWeight += signer.Weight
+		}
+		lines = append(lines, fmt.Sprintf("signer: %s weight:%d (%s)", signer.PublicKey, signer.Weight, status))
+	}
+
+	lines = append(lines, fmt.Sprintf("thresholds: low:%d medium:%d high:%d (signed weight: %d)",
+		bundle.Thresholds.Low, bundle.Thresholds.Medium, bundle.Thresholds.High, signedWeight))
+
+	return lines, nil
+}
+
+// hasSignatureFrom returns true if one of the signatures on txe has address's hint.
+func hasSignatureFrom(txe *xdr.TransactionEnvelope, address string) bool {
+	kp, err := keypair.Parse(address)
+	if err != nil {
+		return false
+	}
+
+	hint := kp.Hint()
+	for _, sig := range txe.Signatures {
+		if sig.Hint == xdr.SignatureHint(hint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describeTx returns a human readable summary of the transaction envelope.
+func describeTx(txe *xdr.TransactionEnvelope) []string {
+	tx := txe.Tx
+
+	lines := []string{
+		fmt.Sprintf("source: %s", tx.SourceAccount.Address()),
+		fmt.Sprintf("sequence: %d", tx.SeqNum),
+		fmt.Sprintf("fee: %d stroops", tx.Fee),
+	}
+
+	switch tx.Memo.Type {
+	case xdr.MemoTypeMemoText:
+		lines = append(lines, fmt.Sprintf("memo: text %q", *tx.Memo.Text))
+	case xdr.MemoTypeMemoId:
+		lines = append(lines, fmt.Sprintf("memo: id %d", *tx.Memo.Id))
+	case xdr.MemoTypeMemoHash:
+		lines = append(lines, fmt.Sprintf("memo: hash %x", *tx.Memo.Hash))
+	case xdr.MemoTypeMemoReturn:
+		lines = append(lines, fmt.Sprintf("memo: return %x", *tx.Memo.RetHash))
+	}
+
+	if tx.TimeBounds != nil {
+		timeFormat := "2006-01-02 15:04:05"
+		lines = append(lines, fmt.Sprintf("valid: %s to %s UTC",
+			time.Unix(int64(tx.TimeBounds.MinTime), 0).UTC().Format(timeFormat),
+			time.Unix(int64(tx.TimeBounds.MaxTime), 0).UTC().Format(timeFormat)))
+	}
+
+	for i, op := range tx.Operations {
+		line := fmt.Sprintf("op %d: %s", i+1, describeOp(op))
+		if op.SourceAccount != nil {
+			line += fmt.Sprintf(" (source: %s)", op.SourceAccount.Address())
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, fmt.Sprintf("signatures: %d", len(txe.Signatures)))
+	return lines
+}
+
+// describeOp returns a one-line summary of a transaction operation.
+func describeOp(op xdr.Operation) string {
+	body := op.Body
+
+	switch body.Type {
+	case xdr.OperationTypeCreateAccount:
+		return fmt.Sprintf("create_account %s with %s XLM",
+			body.CreateAccountOp.Destination.Address(), microstellar.ToAmountString(int64(body.CreateAccountOp.StartingBalance)))
+	case xdr.OperationTypePayment:
+		return fmt.Sprintf("payment %s %s to %s",
+			microstellar.ToAmountString(int64(body.PaymentOp.Amount)), xdrAssetString(body.PaymentOp.Asset), body.PaymentOp.Destination.Address())
+	case xdr.OperationTypePathPayment:
+		return fmt.Sprintf("path_payment %s %s to %s with at most %s %s",
+			microstellar.ToAmountString(int64(body.PathPaymentOp.DestAmount)), xdrAssetString(body.PathPaymentOp.DestAsset),
+			body.PathPaymentOp.Destination.Address(),
+			microstellar.ToAmountString(int64(body.PathPaymentOp.SendMax)), xdrAssetString(body.PathPaymentOp.SendAsset))
+	case xdr.OperationTypeManageOffer:
+		return fmt.Sprintf("manage_offer (%d) selling %s %s for %s at %d/%d",
+			body.ManageOfferOp.OfferId, microstellar.ToAmountString(int64(body.ManageOfferOp.Amount)),
+			xdrAssetString(body.ManageOfferOp.Selling), xdrAssetString(body.ManageOfferOp.Buying),
+			body.ManageOfferOp.Price.N, body.ManageOfferOp.Price.D)
+	case xdr.OperationTypeChangeTrust:
+		return fmt.Sprintf("change_trust %s limit %s",
+			xdrAssetString(body.ChangeTrustOp.Line), microstellar.ToAmountString(int64(body.ChangeTrustOp.Limit)))
+	case xdr.OperationTypeAllowTrust:
+		return fmt.Sprintf("allow_trust %s authorize:%v", body.AllowTrustOp.Trustor.Address(), body.AllowTrustOp.Authorize)
+	case xdr.OperationTypeAccountMerge:
+		return fmt.Sprintf("account_merge into %s", body.Destination.Address())
+	case xdr.OperationTypeManageData:
+		return fmt.Sprintf("manage_data %s", body.ManageDataOp.DataName)
+	}
+
+	return strings.TrimPrefix(strings.ToLower(body.Type.String()), "operationtype")
+}
+
+// xdrAssetString formats an XDR asset as CODE:ISSUER (or XLM.)
+func xdrAssetString(asset xdr.Asset) string {
+	var assetType, code, issuer string
+	if err := asset.Extract(&assetType, &code, &issuer); err != nil || asset.Type == xdr.AssetTypeAssetTypeNative {
+		return "XLM"
+	}
+
+	return code + ":" + issuer
+}
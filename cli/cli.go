@@ -2,15 +2,21 @@ package cli
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 
 	"github.com/0xfe/lumen/store"
 	"github.com/0xfe/microstellar"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stellar/go/build"
 )
 
 // CLI represents a command-line interface. This class is
@@ -18,11 +24,20 @@ import (
 type CLI struct {
 	store       store.API
 	ms          *microstellar.MicroStellar
-	ns          string // namespace
+	ns          string      // namespace
+	network     string      // network spec
+	networkDef  *networkDef // registered network in use (nil for built-in networks)
 	rootCmd     *cobra.Command
 	version     string
 	testing     bool
-	stopWatcher func()
+	nested      int             // depth of commands run with runNested
+	lastErr     error           // last error reported by a nested command
+	args        []string        // command line arguments, for the journal
+	ctx         context.Context // canceled on --timeout or Ctrl-C
+	cancel      context.CancelFunc
+	stopWatcher func()     // guarded by watcherLock
+	watcherLock sync.Mutex // StopWatcher can be called from another goroutine
+	indexFile   string     // the history index database
 }
 
 // NewCLI returns an initialized CLI
@@ -31,9 +46,13 @@ func NewCLI() *CLI {
 		store:       nil,
 		ms:          nil,
 		ns:          "",
+		network:     "",
+		networkDef:  nil,
 		rootCmd:     nil,
 		version:     "v0.0",
 		testing:     false,
+		ctx:         context.Background(),
+		cancel:      func() {},
 		stopWatcher: func() {},
 	}
 
@@ -43,6 +62,7 @@ func NewCLI() *CLI {
 
 // Execute parses the command line and processes it.
 func (cli *CLI) Execute() {
+	cli.args = os.Args[1:]
 	cli.rootCmd.Execute()
 }
 
@@ -60,25 +80,80 @@ func (cli *CLI) Embeddable() *CLI {
 
 // Run executes CLI with the given arguments. Used for testing. Not thread safe.
 func (cli *CLI) Run(args ...string) string {
+	return captureOutput(func() {
+		cli.args = args
+		cli.rootCmd.SetArgs(args)
+		cli.rootCmd.Execute()
+		cli.buildRootCmd()
+	})
+}
+
+// captureOutput runs fn and returns everything it wrote to stdout.
+func captureOutput(fn func()) string {
 	oldStdout := os.Stdout
 
 	r, w, _ := os.Pipe()
-
 	os.Stdout = w
 
-	cli.rootCmd.SetArgs(args)
-	cli.rootCmd.Execute()
-	cli.buildRootCmd()
+	var stdOut bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&stdOut, r)
+		close(done)
+	}()
 
-	w.Close()
+	fn()
 
+	w.Close()
 	os.Stdout = oldStdout
+	<-done
 
-	var stdOut bytes.Buffer
-	io.Copy(&stdOut, r)
 	return stdOut.String()
 }
 
+// runNested executes args with a fresh command tree from inside a running
+// command. Global flags set on the running command are passed on, unless args
+// overrides them. Errors are returned instead of exiting.
+func (cli *CLI) runNested(args ...string) error {
+	parent := cli.rootCmd
+
+	parent.PersistentFlags().Visit(func(flag *pflag.Flag) {
+		for _, arg := range args {
+			if arg == "--"+flag.Name || strings.HasPrefix(arg, "--"+flag.Name+"=") {
+				return
+			}
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", flag.Name, flag.Value.String()))
+	})
+
+	logrus.WithFields(logrus.Fields{"type": "cli", "method": "runNested"}).Debugf("running: %v", args)
+
+	cli.rootCmd = nil
+	cli.buildRootCmd()
+	cli.nested++
+	cli.lastErr = nil
+
+	ctx, cancel := cli.ctx, cli.cancel
+	transport := http.DefaultClient.Transport
+	parentArgs := cli.args
+
+	defer func() {
+		cli.nested--
+		cli.rootCmd = parent
+		cli.ctx, cli.cancel = ctx, cancel
+		http.DefaultClient.Transport = transport
+		cli.args = parentArgs
+	}()
+
+	cli.args = args
+	cli.rootCmd.SetArgs(args)
+	if err := cli.rootCmd.Execute(); err != nil {
+		return err
+	}
+
+	return cli.lastErr
+}
+
 // RunCommand is a helper that lets you send a full command line to Run, so you don't
 // have to break up your arguments.
 func (cli *CLI) RunCommand(command string) string {
@@ -97,10 +172,19 @@ func (cli *CLI) TestCommand(command string) string {
 
 // Stop an existing watcher from streaming.
 func (cli *CLI) StopWatcher() {
+	cli.watcherLock.Lock()
+	defer cli.watcherLock.Unlock()
 	cli.stopWatcher()
 	cli.stopWatcher = func() {}
 }
 
+// setStopWatcher makes StopWatcher call stop.
+func (cli *CLI) setStopWatcher(stop func()) {
+	cli.watcherLock.Lock()
+	defer cli.watcherLock.Unlock()
+	cli.stopWatcher = stop
+}
+
 // SetGlobalVar writes the kv pair to the global namespace in the storage backend
 func (cli *CLI) SetGlobalVar(key string, value string) error {
 	key = fmt.Sprintf("global:%s", key)
@@ -122,10 +206,26 @@ func (cli *CLI) SetVar(key string, value string) error {
 	return cli.store.Set(key, value, 0)
 }
 
+// GetVar reads var "key" from the current namespace. Aliases and variables
+// that aren't set there are read from its parent namespaces.
 func (cli *CLI) GetVar(key string) (string, error) {
-	key = fmt.Sprintf("%s:%s", cli.ns, key)
-	logrus.WithFields(logrus.Fields{"type": "cli", "method": "GetVar"}).Debugf("getting %s", key)
-	return cli.store.Get(key)
+	chain := []string{cli.ns}
+	if isInheritedKey(key) {
+		chain = cli.nsChain(cli.ns)
+	}
+
+	var err error
+	for _, ns := range chain {
+		nsKey := fmt.Sprintf("%s:%s", ns, key)
+		logrus.WithFields(logrus.Fields{"type": "cli", "method": "GetVar"}).Debugf("getting %s", nsKey)
+
+		var val string
+		if val, err = cli.store.Get(nsKey); err == nil {
+			return val, nil
+		}
+	}
+
+	return "", err
 }
 
 func (cli *CLI) DelVar(key string) error {
@@ -169,6 +269,44 @@ func (cli *CLI) setup(cmd *cobra.Command, args []string) {
 	cli.setupStore(config.storageDriver, config.storageParams)
 	cli.setupNameSpace()
 	cli.setupNetwork()
+	cli.setupContext(cmd)
+	cli.setupTransport(config)
+	cli.indexFile = config.indexFile
+}
+
+// setupContext creates the context that network requests run under. It's
+// canceled when --timeout expires or the user hits Ctrl-C.
+func (cli *CLI) setupContext(cmd *cobra.Command) {
+	parent := context.Background()
+	if cli.nested > 0 {
+		parent = cli.ctx
+	}
+
+	cli.ctx, cli.cancel = context.WithCancel(parent)
+	if timeout, _ := cmd.Flags().GetDuration("timeout"); timeout > 0 {
+		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("command timeout: %v", timeout)
+		cli.ctx, cli.cancel = context.WithTimeout(parent, timeout)
+	}
+
+	if cli.testing || cli.nested > 0 {
+		return
+	}
+
+	// The first Ctrl-C cancels pending requests, the second one exits.
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt)
+	go func(cancel context.CancelFunc) {
+		<-interrupts
+		fmt.Fprintln(os.Stderr, "interrupted, canceling (hit Ctrl-C again to quit)")
+		cancel()
+		<-interrupts
+		os.Exit(130)
+	}(cli.cancel)
+}
+
+// teardown gets called by Cobra after a command is executed.
+func (cli *CLI) teardown(cmd *cobra.Command, args []string) {
+	cli.cancel()
 }
 
 // setupStore sets up the storage backend.
@@ -180,13 +318,7 @@ func (cli *CLI) setupStore(driver, params string) {
 
 	parseStoreParams := func(store string) {
 		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("using store %s", store)
-		parts := strings.Split(store, ",")
-		driver = strings.TrimSpace(parts[0])
-		if len(parts) > 1 {
-			params = strings.TrimSpace(parts[1])
-		} else {
-			params = ""
-		}
+		driver, params = parseStoreSpec(store)
 		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("selecting store driver: %s params: %s", driver, params)
 	}
 
@@ -236,16 +368,36 @@ func (cli *CLI) setupNameSpace() {
 
 // setupNetwork ensures that lumen is operating on the correct network.
 func (cli *CLI) setupNetwork() {
+	network := "test"
+
 	if cli.rootCmd.Flag("network").Changed {
-		network, _ := cli.rootCmd.Flags().GetString("network")
+		network, _ = cli.rootCmd.Flags().GetString("network")
 		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("using horizon network: %s", network)
-		cli.ms = microstellar.NewFromSpec(network)
-	} else {
-		network, err := cli.GetVar("vars:config:network")
-		if err != nil {
-			cli.ms = microstellar.NewFromSpec("test")
-		} else {
-			cli.ms = microstellar.NewFromSpec(network)
+	} else if storedNetwork, err := cli.GetVar("vars:config:network"); err == nil {
+		network = storedNetwork
+	}
+
+	cli.networkDef = nil
+	if !builtinNetworks[network] && !strings.Contains(network, ";") {
+		if def, err := cli.getNetwork(network); err == nil {
+			logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("using registered network %s: %s", network, def.spec())
+			cli.networkDef = def
+			network = def.spec()
 		}
 	}
+
+	if cli.rootCmd.Flag("passphrase").Changed && network != "fake" {
+		passphrase, _ := cli.rootCmd.Flags().GetString("passphrase")
+		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("using network passphrase: %s", passphrase)
+		network = networkSpecWithPassphrase(network, passphrase)
+	}
+
+	cli.network = network
+	cli.ms = microstellar.NewFromSpec(network)
+
+	// Every transaction microstellar builds pays the network's base fee.
+	build.DefaultBaseFee = defaultBaseFee
+	if fee := cli.baseFee(); fee > 0 {
+		build.DefaultBaseFee = uint64(fee)
+	}
 }
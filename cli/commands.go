@@ -14,10 +14,11 @@ func (cli *CLI) buildRootCmd() {
 	}
 
 	rootCmd := &cobra.Command{
-		Use:              "lumen",
-		Short:            "Lumen is a commandline client for the Stellar blockchain",
-		Run:              cli.help,
-		PersistentPreRun: cli.setup,
+		Use:               "lumen",
+		Short:             "Lumen is a commandline client for the Stellar blockchain",
+		Run:               cli.help,
+		PersistentPreRun:  cli.setup,
+		PersistentPostRun: cli.teardown,
 	}
 	cli.rootCmd = rootCmd
 
@@ -27,6 +28,12 @@ func (cli *CLI) buildRootCmd() {
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "verbose output (false)")
 	rootCmd.PersistentFlags().Bool("nosubmit", false, "display transaction without submitting")
 	rootCmd.PersistentFlags().String("network", "test", "network to use (test)")
+	rootCmd.PersistentFlags().String("passphrase", "", "override the network passphrase")
+	rootCmd.PersistentFlags().Uint64("seq", 0, "sequence number for the transaction (skips loading it from horizon)")
+	rootCmd.PersistentFlags().Bool("offline", false, "never contact the network")
+	rootCmd.PersistentFlags().Bool("raw", false, "show addresses and assets without their alias names")
+	rootCmd.PersistentFlags().Bool("no-cache", false, "don't use cached federation lookups (fresh ones are still cached)")
+	rootCmd.PersistentFlags().Duration("timeout", 0, "give up on the network after this long, e.g., 30s (no limit)")
 	rootCmd.PersistentFlags().String("ns", "default", "namespace to use (default)")
 	rootCmd.PersistentFlags().String("store", fmt.Sprintf("file:%s/.lumen-data.yml", home), "namespace to use (default)")
 
@@ -43,14 +50,28 @@ func (cli *CLI) buildRootCmd() {
 	rootCmd.AddCommand(cli.buildSignerCmd()) // signer
 	rootCmd.AddCommand(cli.buildDexCmd())    // dex
 	rootCmd.AddCommand(cli.buildTxCmd())     // tx
+	rootCmd.AddCommand(cli.buildURICmd())    // uri
 
 	// Aux commands
-	rootCmd.AddCommand(cli.buildFriendbotCmd()) // friendbot
-	rootCmd.AddCommand(cli.buildInfoCmd())      // info
-	rootCmd.AddCommand(cli.buildBalanceCmd())   // balance
-	rootCmd.AddCommand(cli.buildWatchCmd())     // watch
-	rootCmd.AddCommand(cli.buildFlagsCmd())     // flags
-	rootCmd.AddCommand(cli.buildDataCmd())      // data
+	rootCmd.AddCommand(cli.buildFriendbotCmd())  // friendbot
+	rootCmd.AddCommand(cli.buildInfoCmd())       // info
+	rootCmd.AddCommand(cli.buildBalanceCmd())    // balance
+	rootCmd.AddCommand(cli.buildWatchCmd())      // watch
+	rootCmd.AddCommand(cli.buildFlagsCmd())      // flags
+	rootCmd.AddCommand(cli.buildDataCmd())       // data
+	rootCmd.AddCommand(cli.buildNetworkCmd())    // network
+	rootCmd.AddCommand(cli.buildJournalCmd())    // journal
+	rootCmd.AddCommand(cli.buildIndexCmd())      // index
+	rootCmd.AddCommand(cli.buildMonitorCmd())    // monitor
+	rootCmd.AddCommand(cli.buildScheduleCmd())   // schedule
+	rootCmd.AddCommand(cli.buildMacroCmd())      // macro
+	rootCmd.AddCommand(cli.buildInvoiceCmd())    // invoice
+	rootCmd.AddCommand(cli.buildSubledgerCmd())  // subledger
+	rootCmd.AddCommand(cli.buildTomlCmd())       // toml
+	rootCmd.AddCommand(cli.buildFederationCmd()) // federation
+	rootCmd.AddCommand(cli.buildResolveCmd())    // resolve
+	rootCmd.AddCommand(cli.buildCacheCmd())      // cache
+	rootCmd.AddCommand(cli.buildStoreCmd())      // store
 
 	// Alias commands
 	rootCmd.AddCommand(cli.buildAccountCmd()) // account
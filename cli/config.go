@@ -3,6 +3,7 @@ package cli
 import (
 	"fmt"
 	"os"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/sirupsen/logrus"
@@ -13,16 +14,30 @@ type config struct {
 	storageDriver string
 	storageParams string
 	verbose       bool
+
+	// Horizon client settings
+	horizonTimeout time.Duration // per request
+	horizonRetries int
+	proxy          string
+	caFile         string
+
+	indexFile string // the history index database
 }
 
 func readConfig(env string) config {
 	homeDir, _ := homedir.Dir()
 	filePath := fmt.Sprintf("%s%s%s", homeDir, string(os.PathSeparator), ".lumen-data.json")
+	indexPath := fmt.Sprintf("%s%s%s", homeDir, string(os.PathSeparator), ".lumen-index.jsonl")
 
 	config := config{
 		storageDriver: "file",
 		storageParams: filePath,
 		verbose:       false,
+
+		horizonTimeout: 30 * time.Second,
+		horizonRetries: 3,
+
+		indexFile: indexPath,
 	}
 
 	switch env {
@@ -46,6 +61,21 @@ func readConfig(env string) config {
 		config.storageDriver = viper.GetString("storage.driver")
 		config.storageParams = viper.GetString("storage.params")
 		config.verbose = viper.GetBool("verbose")
+
+		if viper.IsSet("horizon.timeout") {
+			config.horizonTimeout = viper.GetDuration("horizon.timeout")
+		}
+
+		if viper.IsSet("horizon.retries") {
+			config.horizonRetries = viper.GetInt("horizon.retries")
+		}
+
+		config.proxy = viper.GetString("horizon.proxy")
+		config.caFile = viper.GetString("horizon.ca_file")
+
+		if viper.IsSet("index.file") {
+			config.indexFile = viper.GetString("index.file")
+		}
 	}
 
 	return config
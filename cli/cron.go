@@ -0,0 +1,193 @@
+package cli
+
+// This file contains a parser for crontab schedules.
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronSchedule is a parsed crontab schedule (minute hour day-of-month month
+// day-of-week), with a set of allowed values for each field.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+
+	// Like cron, if both days and weekdays are restricted, a time matches
+	// either of them.
+	anyDay, anyWeekday bool
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseCron parses a five-field crontab schedule, like "0 9 1 * *", or one of
+// the @daily style shortcuts. Fields can have lists (1,15), ranges (1-5),
+// steps (*/15), and month and day names.
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := cronShortcuts[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("bad cron schedule: %q, expecting: minute hour day-of-month month day-of-week", spec)
+	}
+
+	schedule := &cronSchedule{}
+	for _, field := range []struct {
+		name     string
+		value    string
+		min, max int
+		set      *map[int]bool
+	}{
+		{"minute", fields[0], 0, 59, &schedule.minutes},
+		{"hour", fields[1], 0, 23, &schedule.hours},
+		{"day-of-month", fields[2], 1, 31, &schedule.days},
+		{"month", fields[3], 1, 12, &schedule.months},
+		{"day-of-week", fields[4], 0, 7, &schedule.weekdays},
+	} {
+		set, err := parseCronField(field.value, field.min, field.max)
+		if err != nil {
+			return nil, errors.Errorf("bad cron %s: %s: %v", field.name, field.value, err)
+		}
+		*field.set = set
+	}
+
+	// Sunday is 0 or 7
+	if schedule.weekdays[7] {
+		schedule.weekdays[0] = true
+	}
+
+	schedule.anyDay = fields[2] == "*"
+	schedule.anyWeekday = fields[4] == "*"
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+
+	parseValue := func(value string) (int, error) {
+		if n, ok := cronNames[strings.ToLower(value)]; ok {
+			return n, nil
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return 0, errors.Errorf("expecting %d-%d", min, max)
+		}
+		return n, nil
+	}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return nil, errors.Errorf("bad step: %s", part[i+1:])
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = parseValue(bounds[0]); err != nil {
+				return nil, err
+			}
+
+			if high, err = parseValue(bounds[1]); err != nil {
+				return nil, err
+			}
+
+			if low > high {
+				return nil, errors.Errorf("bad range: %s", part)
+			}
+		default:
+			value, err := parseValue(part)
+			if err != nil {
+				return nil, err
+			}
+
+			// A step on a single value runs to the end of the range (like cron.)
+			low = value
+			if step == 1 {
+				high = value
+			}
+		}
+
+		for n := low; n <= high; n += step {
+			set[n] = true
+		}
+	}
+
+	return set, nil
+}
+
+// matchDay checks the day of the month and the day of the week.
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[int(t.Weekday())]
+
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+
+	return day || weekday
+}
+
+// next returns the first time the schedule fires after t, in t's location. It
+// returns the zero time if it never does (e.g., on February 30th.)
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Schedules repeat at least every four years (leap days.)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
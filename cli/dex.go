@@ -149,6 +149,7 @@ func (cli *CLI) buildDexListCmd() *cobra.Command {
 			}
 
 			format, err := cmd.Flags().GetString("format")
+			names := cli.namer()
 
 			for _, offer := range offers {
 				if format == "json" {
@@ -174,7 +175,8 @@ func (cli *CLI) buildDexListCmd() *cobra.Command {
 					}
 
 					showSuccess("(%v) selling %s %s for %s at %s %s/%s",
-						offer.ID, offer.Amount, sellingCode, buyingCode, offer.Price, buyingCode, sellingCode)
+						offer.ID, offer.Amount, names.asset(sellingCode, offer.Selling.Issuer), names.asset(buyingCode, offer.Buying.Issuer),
+						offer.Price, buyingCode, sellingCode)
 				}
 			}
 		},
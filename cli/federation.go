@@ -0,0 +1,421 @@
+package cli
+
+// This file implements a SEP-2 federation server backed by the account aliases
+// in a namespace.
+//
+// https://github.com/stellar/stellar-protocol/blob/master/ecosystem/sep-0002.md
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stellar/go/protocols/federation"
+)
+
+// federationServer answers federation queries for a domain. Access to the store
+// is serialized, because requests are handled concurrently.
+type federationServer struct {
+	cli     *CLI
+	lock    sync.Mutex
+	domain  string
+	forward string // alias of the account that receives forwarded payments
+	cors    string // Access-Control-Allow-Origin, or "" for none
+	create  bool   // hand out memo IDs for new forwarding details
+}
+
+// forwardFields lists the fields of each SEP-2 forward_type that the server
+// accepts. All of them are required, and they make up the forwarding details
+// that a memo ID stands for.
+var forwardFields = map[string][]string{
+	"bank_account": {"swift", "acct"},
+}
+
+// maxForwardField bounds the length of forward field values.
+const maxForwardField = 64
+
+// federationError is an error with an HTTP status code.
+type federationError struct {
+	status int
+	detail string
+}
+
+func (e *federationError) Error() string {
+	return e.detail
+}
+
+func federationErrorf(status int, format string, args ...interface{}) error {
+	return &federationError{status, fmt.Sprintf(format, args...)}
+}
+
+// parseFederationMemo validates a memo mapping, and returns it as stored:
+// "TYPE:VALUE".
+func parseFederationMemo(memoType string, value string) (string, error) {
+	switch memoType {
+	case "id":
+		if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+			return "", errors.Errorf("bad memo ID: %s", value)
+		}
+	case "text":
+		if len(value) > 28 {
+			return "", errors.Errorf("memo text too long (28 bytes max): %s", value)
+		}
+	case "hash":
+		if hash, err := base64.StdEncoding.DecodeString(value); err != nil || len(hash) != 32 {
+			return "", errors.Errorf("bad memo hash (expecting 32 bytes, base64 encoded): %s", value)
+		}
+	default:
+		return "", errors.Errorf("bad memo type: %s, expecting: id|text|hash", memoType)
+	}
+
+	return memoType + ":" + value, nil
+}
+
+// aliasAddress returns the address of the local account alias name, deriving
+// it from the seed if that's all there is. Aliases of federated addresses are
+// not served.
+func (cli *CLI) aliasAddress(name string) (string, bool) {
+	if address, err := cli.GetVar(fmt.Sprintf("account:%s:address", name)); err == nil && microstellar.ValidAddress(address) == nil {
+		return address, true
+	}
+
+	if seed, err := cli.GetVar(fmt.Sprintf("account:%s:seed", name)); err == nil {
+		if address, err := addressOf(seed); err == nil {
+			return address, true
+		}
+	}
+
+	return "", false
+}
+
+// lookupName answers a "name" query for NAME*DOMAIN.
+func (s *federationServer) lookupName(q string) (*federation.NameResponse, error) {
+	i := strings.LastIndex(q, "*")
+	if i < 1 {
+		return nil, federationErrorf(http.StatusBadRequest, "bad federation address: %s", q)
+	}
+
+	name, domain := q[:i], q[i+1:]
+	if !strings.EqualFold(domain, s.domain) {
+		return nil, federationErrorf(http.StatusNotFound, "unknown domain: %s", domain)
+	}
+
+	address, ok := s.cli.aliasAddress(name)
+	if !ok {
+		return nil, federationErrorf(http.StatusNotFound, "not found: %s", q)
+	}
+
+	resp := &federation.NameResponse{AccountID: address}
+	if memo, err := s.cli.GetVar("federation:memo:" + name); err == nil {
+		parts := strings.SplitN(memo, ":", 2)
+		resp.MemoType, resp.Memo.Value = parts[0], parts[1]
+	}
+
+	return resp, nil
+}
+
+// lookupID answers an "id" query with the first alias (by name) for address.
+func (s *federationServer) lookupID(address string) (*federation.IDResponse, error) {
+	if microstellar.ValidAddress(address) != nil {
+		return nil, federationErrorf(http.StatusBadRequest, "bad address: %s", address)
+	}
+
+	names, err := s.cli.listAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if a, ok := s.cli.aliasAddress(name); ok && a == address {
+			return &federation.IDResponse{Address: name + "*" + s.domain}, nil
+		}
+	}
+
+	return nil, federationErrorf(http.StatusNotFound, "not found: %s", address)
+}
+
+// lookupForward answers a "forward" query with the forwarding account and a
+// memo ID that's unique to the forwarding details. Memo IDs are only created
+// for new details if s.create is set.
+func (s *federationServer) lookupForward(params url.Values) (*federation.NameResponse, error) {
+	if s.forward == "" {
+		return nil, federationErrorf(http.StatusNotImplemented, "forward queries not supported")
+	}
+
+	forwardType := params.Get("forward_type")
+	if forwardType == "" {
+		return nil, federationErrorf(http.StatusBadRequest, "missing forward_type")
+	}
+
+	fields, ok := forwardFields[forwardType]
+	if !ok {
+		return nil, federationErrorf(http.StatusBadRequest, "unsupported forward_type: %s", forwardType)
+	}
+
+	details := url.Values{"forward_type": {forwardType}}
+	for _, field := range fields {
+		value := params.Get(field)
+		if value == "" || len(value) > maxForwardField || len(params[field]) > 1 {
+			return nil, federationErrorf(http.StatusBadRequest, "bad or missing %s for forward_type %s", field, forwardType)
+		}
+		details.Set(field, value)
+	}
+
+	for key := range params {
+		if _, ok := details[key]; !ok && key != "type" {
+			return nil, federationErrorf(http.StatusBadRequest, "unexpected parameter for forward_type %s: %s", forwardType, key)
+		}
+	}
+
+	address, ok := s.cli.aliasAddress(s.forward)
+	if !ok {
+		return nil, errors.Errorf("no forwarding account: %s", s.forward)
+	}
+
+	query := details.Encode() // sorted by key
+
+	memo, err := s.cli.GetVar("federation:forward-query:" + query)
+	if err != nil {
+		if !s.create {
+			return nil, federationErrorf(http.StatusNotFound, "no forwarding for: %s", query)
+		}
+
+		memo, err = newMemoID(func(id string) bool {
+			_, err := s.cli.GetVar("federation:forward:" + id)
+			return err == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.cli.SetVar("federation:forward:"+memo, query); err != nil {
+			return nil, err
+		}
+		if err := s.cli.SetVar("federation:forward-query:"+query, memo); err != nil {
+			return nil, err
+		}
+		debugf(logrus.Fields{"cmd": "federation", "subcmd": "serve"}, "forwarding memo %s: %s", memo, query)
+	}
+
+	resp := &federation.NameResponse{AccountID: address, MemoType: "id"}
+	resp.Memo.Value = memo
+	return resp, nil
+}
+
+func (s *federationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logFields := logrus.Fields{"cmd": "federation", "subcmd": "serve"}
+
+	w.Header().Set("Content-Type", "application/json")
+	if s.cors != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.cors)
+	}
+
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	params := r.URL.Query()
+	s.lock.Lock()
+	var resp interface{}
+	var err error
+	switch params.Get("type") {
+	case "name":
+		resp, err = s.lookupName(params.Get("q"))
+	case "id":
+		resp, err = s.lookupID(params.Get("q"))
+	case "forward":
+		resp, err = s.lookupForward(params)
+	default:
+		err = federationErrorf(http.StatusBadRequest, "bad query type: %s, expecting: name|id|forward", params.Get("type"))
+	}
+	s.lock.Unlock()
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if ferr, ok := err.(*federationError); ok {
+			status = ferr.status
+		}
+		debugf(logFields, "%s: %v", r.URL.RawQuery, err)
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"detail": err.Error()})
+		return
+	}
+
+	debugf(logFields, "%s: ok", r.URL.RawQuery)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (cli *CLI) buildFederationCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "federation [serve|memo|forwards]",
+		Short: "serve federation addresses for your account aliases",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "federation"}, "unrecognized federation command: %s, expecting: serve|memo|forwards", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildFederationServeCmd())
+	cmd.AddCommand(cli.buildFederationMemoCmd())
+	cmd.AddCommand(cli.buildFederationForwardsCmd())
+
+	return cmd
+}
+
+func (cli *CLI) buildFederationServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "answer federation queries for --domain from the account aliases in this namespace",
+		Long: `Answer SEP-2 federation queries for --domain from the account aliases in this
+namespace: NAME*DOMAIN resolves to the address of the account alias NAME (derived
+from its seed if it only has one), with the memo set by "lumen federation memo".
+Forward queries are answered with the --forward account and a memo ID that's
+unique to the forwarding details (see "lumen federation forwards".) The only
+supported forward_type is bank_account, with swift and acct. New memo IDs are only
+handed out with --create-forwards; otherwise the server never writes to the store.
+Publish the server's URL as FEDERATION_SERVER in your stellar.toml.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "federation", "subcmd": "serve"}
+
+			domain, _ := cmd.Flags().GetString("domain")
+			listen, _ := cmd.Flags().GetString("listen")
+			server := &federationServer{cli: cli, domain: domain}
+			server.forward, _ = cmd.Flags().GetString("forward")
+			server.cors, _ = cmd.Flags().GetString("cors")
+			server.create, _ = cmd.Flags().GetBool("create-forwards")
+
+			if domain == "" {
+				cli.error(logFields, "missing --domain")
+				return
+			}
+
+			if server.forward != "" {
+				if _, ok := cli.aliasAddress(server.forward); !ok {
+					cli.error(logFields, "invalid --forward account: %s", server.forward)
+					return
+				}
+			}
+
+			listener, err := net.Listen("tcp", listen)
+			if err != nil {
+				cli.error(logFields, "could not listen on %s: %v", listen, err)
+				return
+			}
+
+			httpServer := &http.Server{Handler: server}
+			go func() {
+				<-cli.ctx.Done()
+				httpServer.Close()
+			}()
+
+			showSuccess("serving federation for %s on %s", domain, listener.Addr())
+			if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				cli.error(logFields, "federation server failed: %v", err)
+				return
+			}
+
+			debugf(logFields, "stopped serving: %v", cli.ctx.Err())
+		},
+	}
+
+	cmd.Flags().String("domain", "", "the domain of the federation addresses (NAME*DOMAIN)")
+	cmd.Flags().String("listen", ":8000", "address to listen on")
+	cmd.Flags().String("forward", "", "account that receives forwarded payments (forward queries are rejected without it)")
+	cmd.Flags().String("cors", "*", "Access-Control-Allow-Origin header (empty for none)")
+	cmd.Flags().Bool("create-forwards", false, "hand out memo IDs for new forwarding details (writes to the store)")
+
+	return cmd
+}
+
+func (cli *CLI) buildFederationMemoCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "memo [set|del]",
+		Short: "set the memo that's returned for an account alias",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "federation", "subcmd": "memo"}, "unrecognized memo command: %s, expecting: set|del", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set [name] [id|text|hash] [value]",
+		Short: "return memo [value] with the address of account alias [name]",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "federation", "subcmd": "memo"}
+
+			if _, ok := cli.aliasAddress(args[0]); !ok {
+				cli.error(logFields, "no such account: %s", args[0])
+				return
+			}
+
+			memo, err := parseFederationMemo(args[1], args[2])
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if err := cli.SetVar("federation:memo:"+args[0], memo); err != nil {
+				cli.error(logFields, "could not save memo: %v", err)
+				return
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "del [name]",
+		Short: "stop returning a memo for account alias [name]",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cli.DelVar("federation:memo:" + args[0]); err != nil {
+				cli.error(logrus.Fields{"cmd": "federation", "subcmd": "memo"}, "could not delete memo: %s", args[0])
+				return
+			}
+		},
+	})
+
+	return cmd
+}
+
+func (cli *CLI) buildFederationForwardsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "forwards",
+		Short: "list the memo IDs handed out for forward queries, and where to forward them",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			prefix := fmt.Sprintf("%s:federation:forward:", cli.ns)
+			keys, err := cli.store.Keys(prefix)
+			if err != nil {
+				cli.error(logrus.Fields{"cmd": "federation", "subcmd": "forwards"}, "could not list forwards: %v", err)
+				return
+			}
+
+			sort.Strings(keys)
+			for _, key := range keys {
+				memo := strings.TrimPrefix(key, prefix)
+				if query, err := cli.GetVar("federation:forward:" + memo); err == nil {
+					showSuccess("%s %s", memo, query)
+				}
+			}
+		},
+	}
+}
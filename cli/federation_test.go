@@ -0,0 +1,118 @@
+package cli
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestFederationServer(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new alice")
+	cli.TestCommand("account new bob")
+	cli.TestCommand("account new ops")
+	alice := strings.TrimSpace(cli.TestCommand("account address alice"))
+	bobSeed := strings.TrimSpace(cli.TestCommand("account seed bob"))
+	bob := strings.TrimSpace(cli.TestCommand("account address bob"))
+	ops := strings.TrimSpace(cli.TestCommand("account address ops"))
+
+	// carol only has a seed, and dave is somebody else's federation address
+	cli.TestCommand("account set carol " + bobSeed)
+	cli.TestCommand("account set dave dave*other.com")
+
+	expectOutput(t, cli, "", "federation memo set alice id 42")
+	expectOutput(t, cli, "error", "federation memo set alice id abc")
+	expectOutput(t, cli, "error", "federation memo set alice text this-memo-is-way-too-long-for-stellar")
+	expectOutput(t, cli, "error", "federation memo set alice hash abc")
+	expectOutput(t, cli, "error", "federation memo set alice blob 42")
+	expectOutput(t, cli, "error", "federation memo set nobody id 42")
+	expectOutput(t, cli, "", "federation memo set bob text hello")
+
+	fs := &federationServer{cli: cli, domain: "example.com", cors: "*"}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	query := func(params string) (int, map[string]string) {
+		resp, err := server.Client().Get(server.URL + "/federation?" + params)
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Header.Get("Access-Control-Allow-Origin") != fs.cors {
+			t.Errorf("%s: want CORS header %q, got %q", params, fs.cors, resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+
+		var body map[string]string
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	expect := func(params string, status int, want map[string]string) {
+		gotStatus, got := query(params)
+		if gotStatus != status {
+			t.Errorf("%s: want status %d, got %d (%v)", params, status, gotStatus, got)
+			return
+		}
+
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: want %s=%q, got %q", params, k, v, got[k])
+			}
+		}
+	}
+
+	expect("type=name&q=alice*example.com", 200, map[string]string{"account_id": alice, "memo_type": "id", "memo": "42"})
+	expect("type=name&q=bob*EXAMPLE.com", 200, map[string]string{"account_id": bob, "memo_type": "text", "memo": "hello"})
+	expect("type=name&q=carol*example.com", 200, map[string]string{"account_id": bob, "memo_type": ""})
+	expect("type=name&q=dave*example.com", 404, nil)
+	expect("type=name&q=alice*other.com", 404, nil)
+	expect("type=name&q=alice", 400, nil)
+	expect("type=id&q="+alice, 200, map[string]string{"stellar_address": "alice*example.com"})
+	expect("type=id&q="+bob, 200, map[string]string{"stellar_address": "bob*example.com"})
+	expect("type=id&q=GBY7XDYKXBDHQ2B523SF7K6BNJNRYHVQMWY7AYAEKTYLCQMYVFHL57UM", 404, nil)
+	expect("type=txid&q=abc", 400, nil)
+
+	forward := "type=forward&forward_type=bank_account&swift=BOPBPHMM&acct=2382376"
+	expect(forward, 501, nil)
+
+	fs.forward = "ops"
+	expect(forward, 404, nil)
+
+	fs.create = true
+	_, first := query(forward)
+	if first["account_id"] != ops || first["memo_type"] != "id" || first["memo"] == "" {
+		t.Errorf("unexpected forward: %v", first)
+	}
+	expect("acct=2382376&swift=BOPBPHMM&forward_type=bank_account&type=forward", 200, map[string]string{"memo": first["memo"]})
+	expect("type=forward&swift=BOPBPHMM", 400, nil)
+	expect("type=forward&forward_type=bank_account&swift=BOPBPHMM", 400, nil)
+	expect("type=forward&forward_type=crypto&address=abc", 400, nil)
+	expect(forward+"&nonce=1", 400, nil)
+	expect(forward+"&acct=2", 400, nil)
+	expect("type=forward&forward_type=bank_account&swift=BOPBPHMM&acct="+strings.Repeat("1", 65), 400, nil)
+	expectOutput(t, cli, first["memo"]+" acct=2382376&forward_type=bank_account&swift=BOPBPHMM", "federation forwards")
+
+	// Without create, the server only hands out existing memos
+	fs.create = false
+	fs.cors = ""
+	expect(forward, 200, map[string]string{"memo": first["memo"]})
+	expect("type=forward&forward_type=bank_account&swift=BOPBPHMM&acct=1", 404, nil)
+
+	cli.TestCommand("federation memo del alice")
+	expect("type=name&q="+url.QueryEscape("alice*example.com"), 200, map[string]string{"account_id": alice, "memo_type": ""})
+
+	out := cli.TestCommand("federation serve --domain example.com --listen 127.0.0.1:0 --timeout 100ms")
+	if !strings.HasPrefix(out, "serving federation for example.com on 127.0.0.1:") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "federation serve --listen 127.0.0.1:0 --timeout 100ms")
+	expectOutput(t, cli, "error", "federation serve --domain example.com --forward nobody --listen 127.0.0.1:0 --timeout 100ms")
+}
@@ -0,0 +1,240 @@
+package cli
+
+// This file contains the filters for watch streams.
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// watchFilter decides which entries a watcher emits. The zero value matches
+// everything.
+type watchFilter struct {
+	direction    string // "in" or "out", relative to the watched account
+	asset        *microstellar.Asset
+	minAmount    int64 // in stroops, -1 for no minimum
+	maxAmount    int64 // in stroops, -1 for no maximum
+	memoType     string
+	memo         *regexp.Regexp
+	counterparty string // address
+	opTypes      map[string]bool
+}
+
+// paymentSides has who a payment-like operation is from and to, and what it's for.
+type paymentSides struct {
+	from, to string
+	amount   string
+	asset    *microstellar.Asset
+}
+
+func buildFlagsForWatchFilter(cmd *cobra.Command) {
+	cmd.Flags().String("direction", "", "only show entries to (in) or from (out) the watched account")
+	cmd.Flags().String("asset", "", "only show payments of this asset")
+	cmd.Flags().String("min-amount", "", "only show payments of at least this amount")
+	cmd.Flags().String("max-amount", "", "only show payments of at most this amount")
+	cmd.Flags().String("memo-type", "", "only show entries with this memo type (none, text, id, hash, return)")
+	cmd.Flags().String("memo", "", "only show entries with memos that match this regular expression")
+	cmd.Flags().String("counterparty", "", "only show payments to or from this account")
+	cmd.Flags().StringSlice("op-type", []string{}, "only show these operation types (e.g., payment,create_account)")
+}
+
+// genWatchFilter returns the filter requested on the command line for entity.
+func (cli *CLI) genWatchFilter(cmd *cobra.Command, logFields logrus.Fields, entity string) (*watchFilter, error) {
+	filter := &watchFilter{minAmount: -1, maxAmount: -1}
+	var used []string
+
+	if direction, _ := cmd.Flags().GetString("direction"); direction != "" {
+		if direction != "in" && direction != "out" {
+			return nil, errors.Errorf("bad --direction: %s, expecting: in|out", direction)
+		}
+		filter.direction = direction
+		used = append(used, "direction")
+	}
+
+	if asset, _ := cmd.Flags().GetString("asset"); asset != "" {
+		resolved, err := cli.ResolveAsset(asset)
+		if err != nil {
+			return nil, errors.Errorf("bad --asset: %s", asset)
+		}
+		filter.asset = resolved
+		used = append(used, "asset")
+	}
+
+	for _, bound := range []struct {
+		flag  string
+		value *int64
+	}{{"min-amount", &filter.minAmount}, {"max-amount", &filter.maxAmount}} {
+		if amount, _ := cmd.Flags().GetString(bound.flag); amount != "" {
+			stroops, err := microstellar.ParseAmount(amount)
+			if err != nil || stroops < 0 {
+				return nil, errors.Errorf("bad --%s: %s", bound.flag, amount)
+			}
+			*bound.value = stroops
+			used = append(used, bound.flag)
+		}
+	}
+
+	if memoType, _ := cmd.Flags().GetString("memo-type"); memoType != "" {
+		switch memoType {
+		case "none", "text", "id", "hash", "return":
+			filter.memoType = memoType
+		default:
+			return nil, errors.Errorf("bad --memo-type: %s, expecting: none|text|id|hash|return", memoType)
+		}
+		used = append(used, "memo-type")
+	}
+
+	if memo, _ := cmd.Flags().GetString("memo"); memo != "" {
+		re, err := regexp.Compile(memo)
+		if err != nil {
+			return nil, errors.Errorf("bad --memo: %v", err)
+		}
+		filter.memo = re
+		used = append(used, "memo")
+	}
+
+	if counterparty, _ := cmd.Flags().GetString("counterparty"); counterparty != "" {
+		address, err := cli.ResolveAccount(logFields, counterparty, "address")
+		if err == nil {
+			address, err = addressOf(address)
+		}
+
+		if err != nil {
+			return nil, errors.Errorf("bad --counterparty: %s", counterparty)
+		}
+		filter.counterparty = address
+		used = append(used, "counterparty")
+	}
+
+	if opTypes, _ := cmd.Flags().GetStringSlice("op-type"); len(opTypes) > 0 {
+		filter.opTypes = map[string]bool{}
+		for _, opType := range opTypes {
+			filter.opTypes[strings.ToLower(opType)] = true
+		}
+		used = append(used, "op-type")
+	}
+
+	// Not everything can be filtered on every stream.
+	supported := map[string]string{
+		"payments":     "direction,asset,min-amount,max-amount,memo-type,memo,counterparty,op-type",
+		"transactions": "direction,memo-type,memo",
+	}
+
+	for _, flag := range used {
+		if !strings.Contains(","+supported[entity]+",", ","+flag+",") {
+			return nil, errors.Errorf("can't filter %s by --%s", entity, flag)
+		}
+	}
+
+	return filter, nil
+}
+
+// match returns true if the entry, from a stream on account, passes the filter.
+func (filter *watchFilter) match(account string, entry interface{}) bool {
+	switch entry := entry.(type) {
+	case *microstellar.Payment:
+		return filter.matchPayment(account, entry)
+	case *microstellar.Transaction:
+		return filter.matchDirection(account, entry.Account, "") && filter.matchMemo(entry.MemoType, entry.Memo)
+	}
+
+	return true
+}
+
+func (filter *watchFilter) matchPayment(account string, payment *microstellar.Payment) bool {
+	if len(filter.opTypes) > 0 && !filter.opTypes[payment.Type] {
+		return false
+	}
+
+	sides := sidesOf(payment)
+	if !filter.matchDirection(account, sides.from, sides.to) {
+		return false
+	}
+
+	if filter.counterparty != "" {
+		other := sides.to
+		if sides.to == account {
+			other = sides.from
+		}
+
+		if other != filter.counterparty {
+			return false
+		}
+	}
+
+	if filter.asset != nil && (sides.asset == nil || !sameAsset(sides.asset, filter.asset)) {
+		return false
+	}
+
+	if filter.minAmount >= 0 || filter.maxAmount >= 0 {
+		amount, err := microstellar.ParseAmount(sides.amount)
+		if err != nil {
+			return false
+		}
+
+		if (filter.minAmount >= 0 && amount < filter.minAmount) || (filter.maxAmount >= 0 && amount > filter.maxAmount) {
+			return false
+		}
+	}
+
+	return filter.matchMemo(payment.Memo.Type, payment.Memo.Value)
+}
+
+// matchDirection checks which way the entry goes. Anything not from the account
+// is considered incoming.
+func (filter *watchFilter) matchDirection(account string, from string, to string) bool {
+	switch filter.direction {
+	case "in":
+		return from != account || to == account
+	case "out":
+		return from == account
+	}
+
+	return true
+}
+
+func (filter *watchFilter) matchMemo(memoType string, memo string) bool {
+	if filter.memoType != "" && memoType != filter.memoType {
+		return false
+	}
+
+	if filter.memo != nil && (memoType == "none" || !filter.memo.MatchString(memo)) {
+		return false
+	}
+
+	return true
+}
+
+// sidesOf returns who a payment-like operation is from and to, and what it's for.
+func sidesOf(payment *microstellar.Payment) paymentSides {
+	switch payment.Type {
+	case "create_account":
+		return paymentSides{from: payment.Funder, to: payment.Account, amount: payment.StartingBalance, asset: microstellar.NativeAsset}
+	case "account_merge":
+		return paymentSides{from: payment.Account, to: payment.Into}
+	}
+
+	sides := paymentSides{from: payment.From, to: payment.To, amount: payment.Amount}
+	if payment.AssetType == "native" {
+		sides.asset = microstellar.NativeAsset
+	} else {
+		sides.asset = microstellar.NewAsset(payment.AssetCode, payment.AssetIssuer, microstellar.AssetType(payment.AssetType))
+	}
+
+	return sides
+}
+
+// sameAsset compares asset codes and issuers (but not types, which lumen
+// sometimes guesses.)
+func sameAsset(a *microstellar.Asset, b *microstellar.Asset) bool {
+	if a.IsNative() || b.IsNative() {
+		return a.IsNative() && b.IsNative()
+	}
+
+	return a.Code == b.Code && a.Issuer == b.Issuer
+}
@@ -0,0 +1,852 @@
+package cli
+
+// This file contains the local history index: operations, effects, and trades
+// pulled from horizon into a file, so they can be queried offline.
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// indexKinds are the histories that get indexed, by horizon endpoint.
+var indexKinds = []string{"operations", "effects", "trades"}
+
+// indexRecord is an indexed operation, effect, or trade, from the point of
+// view of one account. The common fields are pulled out of the horizon record
+// (in Data) for queries.
+type indexRecord struct {
+	Kind        string          `json:"kind"` // operation, effect, or trade
+	ID          string          `json:"id"`
+	Network     string          `json:"network"` // passphrase
+	Account     string          `json:"account"` // the indexed account
+	PagingToken string          `json:"paging_token"`
+	Type        string          `json:"type,omitempty"`
+	Time        time.Time       `json:"time"`
+	From        string          `json:"from,omitempty"`
+	To          string          `json:"to,omitempty"`
+	Amount      string          `json:"amount,omitempty"`
+	Asset       string          `json:"asset,omitempty"` // code, or native
+	AssetIssuer string          `json:"asset_issuer,omitempty"`
+	Data        json.RawMessage `json:"data"`
+}
+
+func (r *indexRecord) key() string {
+	return strings.Join([]string{r.Network, r.Account, r.Kind, r.ID}, "|")
+}
+
+// historyIndex is an append-only file of index records, one JSON object per
+// line, loaded into memory.
+type historyIndex struct {
+	fileName string
+	mutex    sync.Mutex
+	records  []*indexRecord
+	seen     map[string]bool
+	cursors  map[string]string // network|account|kind => paging token of the last record
+}
+
+func cursorKey(network string, account string, kind string) string {
+	return strings.Join([]string{network, account, kind}, "|")
+}
+
+// openIndex loads the index in fileName, which doesn't have to exist yet.
+func openIndex(fileName string) (*historyIndex, error) {
+	index := &historyIndex{fileName: fileName, seen: map[string]bool{}, cursors: map[string]string{}}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read index")
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		record := &indexRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			// The last line may be cut short by a crash, and gets synced again.
+			if i == len(lines)-1 {
+				logrus.WithFields(logrus.Fields{"type": "index"}).Warnf("skipping partial record at the end of %s", fileName)
+				continue
+			}
+			return nil, errors.Errorf("bad record on line %d of %s: %v", i+1, fileName, err)
+		}
+
+		index.insert(record)
+	}
+
+	return index, nil
+}
+
+// insert adds record to the in-memory index, and returns false if it was
+// already there. Call with mutex held.
+func (index *historyIndex) insert(record *indexRecord) bool {
+	index.cursors[cursorKey(record.Network, record.Account, record.Kind)] = record.PagingToken
+	if index.seen[record.key()] {
+		return false
+	}
+
+	index.seen[record.key()] = true
+	index.records = append(index.records, record)
+	return true
+}
+
+// add appends the records that aren't already indexed to the file, and returns
+// how many there were.
+func (index *historyIndex) add(records []*indexRecord) (int, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	var buf bytes.Buffer
+	added := 0
+	for _, record := range records {
+		if !index.insert(record) {
+			continue
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not encode record")
+		}
+
+		buf.Write(append(line, '\n'))
+		added++
+	}
+
+	if added == 0 {
+		return 0, nil
+	}
+
+	file, err := os.OpenFile(index.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not open index")
+	}
+	defer file.Close()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return 0, errors.Wrapf(err, "could not write index")
+	}
+
+	return added, nil
+}
+
+// cursor returns the paging token of the last record indexed for the account's
+// history of kind (an endpoint, like operations), or "" if there isn't one.
+func (index *historyIndex) cursor(network string, account string, kind string) string {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return index.cursors[cursorKey(network, account, strings.TrimSuffix(kind, "s"))]
+}
+
+// newIndexRecord pulls the common fields out of a horizon operation, effect, or
+// trade (the kind is the endpoint it came from.)
+func newIndexRecord(network string, account string, kind string, data []byte) (*indexRecord, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errors.Wrapf(err, "bad %s record", kind)
+	}
+
+	str := func(key string) string {
+		if value, ok := fields[key].(string); ok {
+			return value
+		}
+		return ""
+	}
+
+	record := &indexRecord{
+		Kind:        strings.TrimSuffix(kind, "s"),
+		ID:          str("id"),
+		Network:     network,
+		Account:     account,
+		PagingToken: str("paging_token"),
+		Type:        str("type"),
+		Data:        json.RawMessage(data),
+	}
+
+	setAsset := func(prefix string) {
+		if str(prefix+"asset_type") == "native" {
+			record.Asset = "native"
+		} else {
+			record.Asset = str(prefix + "asset_code")
+			record.AssetIssuer = str(prefix + "asset_issuer")
+		}
+	}
+
+	closedAt := str("created_at")
+	switch {
+	case kind == "trades":
+		closedAt = str("ledger_close_time")
+		record.Type = "trade"
+		record.From, record.To, record.Amount = str("base_account"), str("counter_account"), str("base_amount")
+		setAsset("base_")
+	case record.Type == "create_account":
+		record.From, record.To, record.Amount, record.Asset = str("funder"), str("account"), str("starting_balance"), "native"
+	case record.Type == "account_merge":
+		record.From, record.To = str("account"), str("into")
+	case record.Type == "account_credited":
+		record.To, record.Amount = str("account"), str("amount")
+		setAsset("")
+	case record.Type == "account_debited":
+		record.From, record.Amount = str("account"), str("amount")
+		setAsset("")
+	case str("from") != "" || str("to") != "":
+		record.From, record.To, record.Amount = str("from"), str("to"), str("amount")
+		setAsset("")
+	}
+
+	if record.ID == "" || record.PagingToken == "" {
+		return nil, errors.Errorf("bad %s record: no id or paging token", kind)
+	}
+
+	if closedAt != "" {
+		t, err := time.Parse(time.RFC3339, closedAt)
+		if err != nil {
+			return nil, errors.Errorf("bad %s record %s: bad time: %s", kind, record.ID, closedAt)
+		}
+		record.Time = t.UTC()
+	}
+
+	return record, nil
+}
+
+// syncHistory pages through the account's history of kind on horizon, from
+// after the last indexed record, and adds it to the index.
+func (cli *CLI) syncHistory(ctx context.Context, index *historyIndex, address string, kind string) (int, error) {
+	network := cli.networkPassphrase()
+	query := url.Values{"order": {"asc"}, "limit": {"200"}}
+	total := 0
+
+	for {
+		cursor := index.cursor(network, address, kind)
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		endpoint := fmt.Sprintf("%s/accounts/%s/%s?%s", strings.TrimRight(cli.horizonURL(), "/"), address, kind, query.Encode())
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return total, err
+		}
+
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return total, err
+		}
+
+		var page struct {
+			Embedded struct {
+				Records []json.RawMessage `json:"records"`
+			} `json:"_embedded"`
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return total, err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			return total, errors.Errorf("account not found: %s", address)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return total, errors.Errorf("could not load %s: got %s", kind, resp.Status)
+		}
+
+		if err := json.Unmarshal(body, &page); err != nil {
+			return total, errors.Wrapf(err, "could not parse %s", kind)
+		}
+
+		if len(page.Embedded.Records) == 0 {
+			return total, nil
+		}
+
+		var records []*indexRecord
+		for _, data := range page.Embedded.Records {
+			record, err := newIndexRecord(network, address, kind, data)
+			if err != nil {
+				return total, err
+			}
+			records = append(records, record)
+		}
+
+		added, err := index.add(records)
+		total += added
+		if err != nil {
+			return total, err
+		}
+
+		if index.cursor(network, address, kind) == cursor {
+			return total, errors.Errorf("could not page through %s: stuck at %s", kind, cursor)
+		}
+	}
+}
+
+// followHistory streams the account's history of kind into the index until ctx
+// is done, reconnecting (with backoff) when the stream drops.
+func (cli *CLI) followHistory(ctx context.Context, index *historyIndex, address string, kind string) error {
+	logFields := logrus.Fields{"cmd": "index", "subcmd": "sync", "account": address, "kind": kind}
+	network := cli.networkPassphrase()
+	endpoint := fmt.Sprintf("%s/accounts/%s/%s", strings.TrimRight(cli.horizonURL(), "/"), address, kind)
+	delays := newBackoff(reconnectBackoffBase, time.Minute)
+
+	for {
+		var addErr error
+		received := false
+		cursor := index.cursor(network, address, kind)
+		if cursor == "" {
+			cursor = "now"
+		}
+
+		// Stop the stream as soon as a record can't be indexed.
+		streamCtx, cancel := context.WithCancel(ctx)
+		err := streamEntries(streamCtx, endpoint, cursor, func(token string, data []byte) {
+			received = true
+			if addErr != nil {
+				return
+			}
+
+			record, err := newIndexRecord(network, address, kind, data)
+			if err == nil {
+				_, err = index.add([]*indexRecord{record})
+			}
+
+			if err != nil {
+				addErr = err
+				cancel()
+			} else {
+				debugf(logFields, "indexed %s %s", record.Kind, record.ID)
+			}
+		})
+		cancel()
+
+		if addErr != nil {
+			return addErr
+		}
+
+		if err != nil {
+			debugf(logFields, "connection closed: %v", err)
+		}
+
+		if received {
+			delays.reset()
+		}
+
+		if !sleepContext(ctx, delays.next()) {
+			return nil
+		}
+	}
+}
+
+// indexAccounts returns the addresses of the accounts named in args, or of
+// every account in the namespace if there aren't any, along with their names.
+func (cli *CLI) indexAccounts(logFields logrus.Fields, args []string) ([]string, map[string]string, error) {
+	names := args
+	if len(names) == 0 {
+		var err error
+		if names, err = cli.listAccounts(); err != nil {
+			return nil, nil, errors.Wrapf(err, "could not list accounts")
+		}
+	}
+
+	var addresses []string
+	aliases := cli.accountAliases(logFields)
+	for _, name := range names {
+		address, err := cli.ResolveAccount(logFields, name, "address")
+		if err == nil {
+			address, err = addressOf(address)
+		}
+
+		if err != nil {
+			return nil, nil, errors.Errorf("invalid account: %s", name)
+		}
+
+		addresses = append(addresses, address)
+	}
+
+	return addresses, aliases, nil
+}
+
+// accountAliases returns the names of the namespace's accounts by address.
+func (cli *CLI) accountAliases(logFields logrus.Fields) map[string]string {
+	aliases := map[string]string{}
+	names, _ := cli.listAccounts()
+	for _, name := range names {
+		address, err := cli.ResolveAccount(logFields, name, "address")
+		if err == nil {
+			address, err = addressOf(address)
+		}
+
+		if err == nil {
+			aliases[address] = name
+		}
+	}
+
+	return aliases
+}
+
+// indexQuery selects index records.
+type indexQuery struct {
+	network      string
+	accounts     map[string]bool // the accounts whose records are selected
+	kind         string
+	types        map[string]bool
+	direction    string // in or out, relative to the record's account
+	counterparty string
+	asset        *microstellar.Asset
+	since, until time.Time
+}
+
+func (q *indexQuery) match(record *indexRecord) bool {
+	if record.Network != q.network || !q.accounts[record.Account] || record.Kind != q.kind {
+		return false
+	}
+
+	if len(q.types) > 0 && !q.types[record.Type] {
+		return false
+	}
+
+	if (!q.since.IsZero() && record.Time.Before(q.since)) || (!q.until.IsZero() && !record.Time.Before(q.until)) {
+		return false
+	}
+
+	if (q.direction == "in" && record.To != record.Account) || (q.direction == "out" && record.From != record.Account) {
+		return false
+	}
+
+	if q.counterparty != "" && counterpartyOf(record) != q.counterparty {
+		return false
+	}
+
+	if q.asset != nil {
+		if q.asset.IsNative() != (record.Asset == "native") {
+			return false
+		}
+
+		if !q.asset.IsNative() && (record.Asset != q.asset.Code || record.AssetIssuer != q.asset.Issuer) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// counterpartyOf returns the other side of a record, from its account's point
+// of view.
+func counterpartyOf(record *indexRecord) string {
+	if record.To == record.Account {
+		return record.From
+	}
+
+	return record.To
+}
+
+// parseQueryTime parses dates (2018-03-01) and times (RFC3339.)
+func parseQueryTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// indexFlow sums the amounts in and out of the selected accounts for a group
+// of records.
+type indexFlow struct {
+	Key   string `json:"key"`
+	Asset string `json:"asset"`
+	In    int64  `json:"-"`
+	Out   int64  `json:"-"`
+	Count int    `json:"count"`
+}
+
+func (f *indexFlow) MarshalJSON() ([]byte, error) {
+	type flow indexFlow
+	return json.Marshal(struct {
+		*flow
+		In  string `json:"in"`
+		Out string `json:"out"`
+		Net string `json:"net"`
+	}{(*flow)(f), microstellar.ToAmountString(f.In), microstellar.ToAmountString(f.Out), microstellar.ToAmountString(f.In - f.Out)})
+}
+
+// groupRecords sums the records' flows by groupBy (counterparty, asset, type,
+// day, or month) and asset, in order of the keys.
+func groupRecords(records []*indexRecord, groupBy string, name func(string) string) ([]*indexFlow, error) {
+	flows := map[string]*indexFlow{}
+	var keys []string
+
+	for _, record := range records {
+		var key string
+		switch groupBy {
+		case "counterparty":
+			key = name(counterpartyOf(record))
+		case "asset":
+			key = record.Asset
+		case "type":
+			key = record.Type
+		case "day":
+			key = record.Time.Format("2006-01-02")
+		case "month":
+			key = record.Time.Format("2006-01")
+		default:
+			return nil, errors.Errorf("bad --group-by: %s, expecting: counterparty|asset|type|day|month", groupBy)
+		}
+
+		flowKey := key + "|" + record.Asset
+		flow, ok := flows[flowKey]
+		if !ok {
+			flow = &indexFlow{Key: key, Asset: record.Asset}
+			flows[flowKey] = flow
+			keys = append(keys, flowKey)
+		}
+
+		flow.Count++
+		if amount, err := microstellar.ParseAmount(record.Amount); err == nil {
+			if record.To == record.Account {
+				flow.In += amount
+			} else {
+				flow.Out += amount
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	var result []*indexFlow
+	for _, key := range keys {
+		result = append(result, flows[key])
+	}
+
+	return result, nil
+}
+
+func (cli *CLI) buildIndexCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "index [sync|query]",
+		Short: "index account history locally, and query it offline",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "index"}, "unrecognized index command: %s, expecting: sync|query", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.PersistentFlags().String("db", "", "the index file (default: index.file in the config, or ~/.lumen-index.jsonl)")
+	cmd.AddCommand(cli.buildIndexSyncCmd())
+	cmd.AddCommand(cli.buildIndexQueryCmd())
+
+	return cmd
+}
+
+// openIndexFromFlags opens the index file selected with --db or the config.
+func (cli *CLI) openIndexFromFlags(cmd *cobra.Command) (*historyIndex, error) {
+	fileName, _ := cmd.Flags().GetString("db")
+	if fileName == "" {
+		fileName = cli.indexFile
+	}
+
+	if fileName == "" {
+		return nil, errors.Errorf("no index file, use --db")
+	}
+
+	return openIndex(fileName)
+}
+
+func (cli *CLI) buildIndexSyncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync [accounts...] [--follow]",
+		Short: "index the operations, effects, and trades of the accounts (default: all accounts in the namespace)",
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "index", "subcmd": "sync"}
+
+			if name, _, _ := parseNetworkSpec(cli.network); name == "fake" {
+				cli.error(logFields, "can't index the fake network")
+				return
+			}
+
+			addresses, aliases, err := cli.indexAccounts(logFields, args)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			index, err := cli.openIndexFromFlags(cmd)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			for _, address := range addresses {
+				var counts []string
+				for _, kind := range indexKinds {
+					added, err := cli.syncHistory(cli.ctx, index, address, kind)
+					if err != nil {
+						cli.error(logFields, "could not sync %s: %v", kind, err)
+						return
+					}
+					counts = append(counts, fmt.Sprintf("%d %s", added, kind))
+				}
+
+				name := address
+				if alias, ok := aliases[address]; ok {
+					name = alias
+				}
+				showSuccess("%s: %s", name, strings.Join(counts, ", "))
+			}
+
+			if follow, _ := cmd.Flags().GetBool("follow"); !follow {
+				return
+			}
+
+			// Keep the index current until stopped.
+			var wg sync.WaitGroup
+			errs := make(chan error, len(addresses)*len(indexKinds))
+			ctx, cancel := context.WithCancel(cli.ctx)
+			defer cancel()
+
+			for _, address := range addresses {
+				for _, kind := range indexKinds {
+					wg.Add(1)
+					go func(address string, kind string) {
+						defer wg.Done()
+						if err := cli.followHistory(ctx, index, address, kind); err != nil {
+							errs <- err
+							cancel()
+						}
+					}(address, kind)
+				}
+			}
+			wg.Wait()
+
+			select {
+			case err := <-errs:
+				cli.error(logFields, "could not follow history: %v", err)
+			default:
+			}
+		},
+	}
+
+	cmd.Flags().Bool("follow", false, "keep streaming new history into the index")
+	return cmd
+}
+
+func (cli *CLI) buildIndexQueryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "query [accounts...] [--direction in|out] [--counterparty name] [--asset asset] [--since date] [--until date] [--group-by key]",
+		Short: "query the indexed history of the accounts (default: all accounts in the namespace)",
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "index", "subcmd": "query"}
+
+			addresses, aliases, err := cli.indexAccounts(logFields, args)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			kind, _ := cmd.Flags().GetString("kind")
+			if kind != "operation" && kind != "effect" && kind != "trade" {
+				cli.error(logFields, "bad --kind: %s, expecting: operation|effect|trade", kind)
+				return
+			}
+
+			query := &indexQuery{network: cli.networkPassphrase(), accounts: map[string]bool{}, kind: kind, types: map[string]bool{}}
+			for _, address := range addresses {
+				query.accounts[address] = true
+			}
+
+			types, _ := cmd.Flags().GetStringSlice("type")
+			for _, t := range types {
+				query.types[t] = true
+			}
+
+			query.direction, _ = cmd.Flags().GetString("direction")
+			if query.direction != "" && query.direction != "in" && query.direction != "out" {
+				cli.error(logFields, "bad --direction: %s, expecting: in|out", query.direction)
+				return
+			}
+
+			if counterparty, _ := cmd.Flags().GetString("counterparty"); counterparty != "" {
+				address, err := cli.ResolveAccount(logFields, counterparty, "address")
+				if err == nil {
+					address, err = addressOf(address)
+				}
+
+				if err != nil {
+					cli.error(logFields, "bad --counterparty: %s", counterparty)
+					return
+				}
+				query.counterparty = address
+			}
+
+			if asset, _ := cmd.Flags().GetString("asset"); asset != "" {
+				if query.asset, err = cli.ResolveAsset(asset); err != nil {
+					cli.error(logFields, "bad --asset: %s", asset)
+					return
+				}
+			}
+
+			for _, bound := range []struct {
+				flag  string
+				value *time.Time
+			}{{"since", &query.since}, {"until", &query.until}} {
+				if value, _ := cmd.Flags().GetString(bound.flag); value != "" {
+					if *bound.value, err = parseQueryTime(value); err != nil {
+						cli.error(logFields, "bad --%s: %s, expecting a date (2018-03-01) or RFC3339 time", bound.flag, value)
+						return
+					}
+				}
+			}
+
+			index, err := cli.openIndexFromFlags(cmd)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			var records []*indexRecord
+			for _, record := range index.records {
+				if query.match(record) {
+					records = append(records, record)
+				}
+			}
+
+			sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+			name := func(address string) string {
+				if alias, ok := aliases[address]; ok {
+					return alias
+				}
+				return address
+			}
+
+			format, _ := cmd.Flags().GetString("format")
+			if groupBy, _ := cmd.Flags().GetString("group-by"); groupBy != "" {
+				flows, err := groupRecords(records, groupBy, name)
+				if err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+
+				if err := showFlows(flows, format); err != nil {
+					cli.error(logFields, "%v", err)
+				}
+				return
+			}
+
+			if err := showRecords(records, format, name); err != nil {
+				cli.error(logFields, "%v", err)
+			}
+		},
+	}
+
+	cmd.Flags().String("kind", "operation", "what to query (operation, effect, trade)")
+	cmd.Flags().StringSlice("type", []string{}, "only these types (e.g., payment,create_account)")
+	cmd.Flags().String("direction", "", "only records to (in) or from (out) the accounts")
+	cmd.Flags().String("counterparty", "", "only records to or from this account")
+	cmd.Flags().String("asset", "", "only records of this asset")
+	cmd.Flags().String("since", "", "only records at or after this date or time")
+	cmd.Flags().String("until", "", "only records before this date or time")
+	cmd.Flags().String("group-by", "", "show the flow in and out, by counterparty, asset, type, day, or month")
+	cmd.Flags().String("format", "line", "output format (line, json, csv)")
+	return cmd
+}
+
+func showRecords(records []*indexRecord, format string, name func(string) string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if records == nil {
+			data = []byte("[]")
+		}
+		showSuccess("%s", string(data))
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"time", "kind", "type", "account", "from", "to", "amount", "asset", "asset_issuer", "id"})
+		for _, r := range records {
+			w.Write([]string{r.Time.Format(time.RFC3339), r.Kind, r.Type, name(r.Account), name(r.From), name(r.To), r.Amount, r.Asset, r.AssetIssuer, r.ID})
+		}
+		w.Flush()
+		showSuccess("%s", strings.TrimSuffix(buf.String(), "\n"))
+	case "line":
+		for _, r := range records {
+			line := fmt.Sprintf("%s %s", r.Time.Format(time.RFC3339), r.Type)
+			if r.Amount != "" {
+				line += fmt.Sprintf(" %s %s", r.Amount, r.Asset)
+			}
+
+			if r.From != "" {
+				line += " from " + name(r.From)
+			}
+
+			if r.To != "" {
+				line += " to " + name(r.To)
+			}
+			showSuccess("%s", line)
+		}
+	default:
+		return errors.Errorf("bad --format: %s, expecting: line|json|csv", format)
+	}
+
+	return nil
+}
+
+func showFlows(flows []*indexFlow, format string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(flows, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if flows == nil {
+			data = []byte("[]")
+		}
+		showSuccess("%s", string(data))
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"key", "asset", "in", "out", "net", "count"})
+		for _, f := range flows {
+			w.Write([]string{f.Key, f.Asset, microstellar.ToAmountString(f.In), microstellar.ToAmountString(f.Out),
+				microstellar.ToAmountString(f.In - f.Out), fmt.Sprintf("%d", f.Count)})
+		}
+		w.Flush()
+		showSuccess("%s", strings.TrimSuffix(buf.String(), "\n"))
+	case "line":
+		for _, f := range flows {
+			showSuccess("%s %s in:%s out:%s net:%s count:%d", f.Key, f.Asset, microstellar.ToAmountString(f.In),
+				microstellar.ToAmountString(f.Out), microstellar.ToAmountString(f.In-f.Out), f.Count)
+		}
+	default:
+		return errors.Errorf("bad --format: %s, expecting: line|json|csv", format)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestIndex(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mary")
+	cli.TestCommand("account new bob")
+	cli.TestCommand("account new kelly")
+	cli.TestCommand("asset set USD kelly")
+	mary := strings.TrimSpace(cli.TestCommand("account address mary"))
+	bob := strings.TrimSpace(cli.TestCommand("account address bob"))
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+
+	payment := func(id int, from string, to string, amount string, date string) string {
+		return fmt.Sprintf(`{"id": "%d", "paging_token": "%d", "type": "payment", "from": "%s", "to": "%s", "amount": "%s", `+
+			`"asset_type": "credit_alphanum4", "asset_code": "USD", "asset_issuer": "%s", "created_at": "%sT00:00:00Z"}`, id, id, from, to, amount, kelly, date)
+	}
+
+	operations := []string{
+		fmt.Sprintf(`{"id": "1", "paging_token": "1", "type": "create_account", "funder": "%s", "account": "%s", `+
+			`"starting_balance": "100.0000000", "created_at": "2018-02-01T00:00:00Z"}`, bob, mary),
+		payment(2, bob, mary, "10.0000000", "2018-03-05"),
+		payment(3, mary, bob, "3.0000000", "2018-03-10"),
+		payment(4, kelly, mary, "5.0000000", "2018-03-20"),
+		payment(5, bob, mary, "7.0000000", "2018-04-02"),
+	}
+
+	var mutex sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		mutex.Lock()
+		requests = append(requests, r.URL.Path+"?cursor="+cursor)
+		mutex.Unlock()
+
+		if r.Header.Get("Accept") == "text/event-stream" {
+			if r.URL.Path == "/accounts/"+mary+"/operations" && cursor == "5" {
+				fmt.Fprintf(w, "data: %s\n\n", payment(6, bob, mary, "1.0000000", "2018-04-10"))
+				w.(http.Flusher).Flush()
+			}
+			if r.URL.Path == "/accounts/"+mary+"/operations" && cursor == "6" {
+				fmt.Fprintf(w, "data: {\"paging_token\": \"7\"}\n\n")
+				w.(http.Flusher).Flush()
+			}
+			<-r.Context().Done()
+			return
+		}
+
+		var records []string
+		switch r.URL.Path {
+		case "/accounts/" + mary + "/operations":
+			// Two pages
+			switch cursor {
+			case "":
+				records = operations[:3]
+			case "3":
+				records = operations[3:]
+			}
+		case "/accounts/" + mary + "/effects", "/accounts/" + mary + "/trades":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		fmt.Fprintf(w, `{"_embedded": {"records": [%s]}}`, strings.Join(records, ","))
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	dir, _ := ioutil.TempDir("", "lumen-index")
+	defer os.RemoveAll(dir)
+	db := " --db " + filepath.Join(dir, "index.jsonl")
+
+	expectOutput(t, cli, "mary: 5 operations, 0 effects, 0 trades", "index sync mary"+db)
+	expectOutput(t, cli, "error", "index sync bob"+db)
+
+	// Syncs pick up after the last record
+	mutex.Lock()
+	requests = nil
+	mutex.Unlock()
+	expectOutput(t, cli, "mary: 0 operations, 0 effects, 0 trades", "index sync mary"+db)
+	if len(requests) != 3 || requests[0] != "/accounts/"+mary+"/operations?cursor=5" {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	// All USD received by mary from bob in March
+	expectOutput(t, cli, "2018-03-05T00:00:00Z payment 10.0000000 USD from bob to mary",
+		"index query mary --direction in --counterparty bob --asset USD --since 2018-03-01 --until 2018-04-01"+db)
+
+	// Net flow per counterparty
+	expectOutput(t, cli, "bob USD in:17.0000000 out:3.0000000 net:14.0000000 count:3\nkelly USD in:5.0000000 out:0.0000000 net:5.0000000 count:1",
+		"index query mary --asset USD --group-by counterparty"+db)
+
+	expectOutput(t, cli, "key,asset,in,out,net,count\n2018-02,native,100.0000000,0.0000000,100.0000000,1",
+		"index query mary --type create_account --group-by month --format csv"+db)
+
+	var records []indexRecord
+	out := cli.TestCommand("index query mary --direction out --format json" + db)
+	if err := json.Unmarshal([]byte(out), &records); err != nil || len(records) != 1 || records[0].ID != "3" || records[0].To != bob {
+		t.Errorf("unexpected records: %v", out)
+	}
+
+	expectOutput(t, cli, "[]", "index query mary --kind trade --format json"+db)
+	expectOutput(t, cli, "error", "index query mary --since March"+db)
+	expectOutput(t, cli, "error", "index query mary --group-by year"+db)
+	expectOutput(t, cli, "error", "index query mary --kind ledger"+db)
+
+	// Following streams new records into the index
+	cli.TestCommand("index sync mary --follow --timeout 300ms" + db)
+	out = cli.TestCommand("index query mary --since 2018-04-01" + db)
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "2018-04-10T00:00:00Z payment 1.0000000 USD") {
+		t.Errorf("unexpected records: %v", out)
+	}
+
+	// Nothing indexed twice
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "index.jsonl"))
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 6 {
+		t.Errorf("want 6 records in the index, got %d", len(lines))
+	}
+
+	// Following stops when a record can't be indexed
+	start := time.Now()
+	out = cli.TestCommand("index sync mary --follow --timeout 20s" + db)
+	if elapsed := time.Since(start); !strings.HasSuffix(out, "error\n") || elapsed > 5*time.Second {
+		t.Errorf("follow took %v to stop after a bad record: %v", elapsed, out)
+	}
+}
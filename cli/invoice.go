@@ -0,0 +1,487 @@
+package cli
+
+// This file contains invoices: payment requests with unique memo IDs, and a
+// watcher that matches incoming payments to them.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Invoice statuses
+const (
+	invoiceOpen     = "open"
+	invoicePartial  = "partial"
+	invoicePaid     = "paid"
+	invoiceOverpaid = "overpaid"
+)
+
+// invoice is a request for a payment to one of our accounts, identified by its
+// memo ID. It's stored as JSON at invoice:id:ID in the namespace.
+type invoice struct {
+	ID          string            `json:"id"` // the memo ID
+	To          string            `json:"to"` // the name given to create
+	Address     string            `json:"address"`
+	Amount      string            `json:"amount"`
+	Asset       string            `json:"asset"`
+	AssetCode   string            `json:"asset_code,omitempty"`
+	AssetIssuer string            `json:"asset_issuer,omitempty"`
+	Description string            `json:"description,omitempty"`
+	CreatedOn   time.Time         `json:"created_on"`
+	Status      string            `json:"status"`
+	Received    string            `json:"received"`
+	PaidOn      time.Time         `json:"paid_on,omitempty"`
+	Payments    []*invoicePayment `json:"payments,omitempty"`
+}
+
+// invoicePayment is a payment matched to an invoice.
+type invoicePayment struct {
+	ID     string    `json:"id"` // the operation ID
+	TxHash string    `json:"tx_hash"`
+	From   string    `json:"from"`
+	Amount string    `json:"amount"`
+	Time   time.Time `json:"time"`
+}
+
+func invoiceKey(id string) string {
+	return "invoice:id:" + id
+}
+
+func invoiceCursorKey(address string) string {
+	return "invoice:cursor:" + address
+}
+
+func (cli *CLI) getInvoice(id string) (*invoice, error) {
+	data, err := cli.GetVar(invoiceKey(id))
+	if err != nil {
+		return nil, errors.Errorf("no such invoice: %s", id)
+	}
+
+	inv := &invoice{}
+	if err := json.Unmarshal([]byte(data), inv); err != nil {
+		return nil, errors.Errorf("bad invoice %s: %v", id, err)
+	}
+
+	return inv, nil
+}
+
+func (cli *CLI) saveInvoice(inv *invoice) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+
+	return cli.SetVar(invoiceKey(inv.ID), string(data))
+}
+
+// invoices returns the namespace's invoices, oldest first.
+func (cli *CLI) invoices() ([]*invoice, error) {
+	prefix := fmt.Sprintf("%s:%s", cli.ns, invoiceKey(""))
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var invoices []*invoice
+	for _, key := range keys {
+		inv, err := cli.getInvoice(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, inv)
+	}
+
+	sort.Slice(invoices, func(i, j int) bool {
+		if invoices[i].CreatedOn.Equal(invoices[j].CreatedOn) {
+			return invoices[i].ID < invoices[j].ID
+		}
+		return invoices[i].CreatedOn.Before(invoices[j].CreatedOn)
+	})
+
+	return invoices, nil
+}
+
+// due returns the amount left to pay (negative if overpaid.)
+func (inv *invoice) due() int64 {
+	amount, _ := microstellar.ParseAmount(inv.Amount)
+	received, _ := microstellar.ParseAmount(inv.Received)
+	return amount - received
+}
+
+// text returns payment instructions for the customer.
+func (inv *invoice) text() string {
+	asset := inv.AssetCode
+	if inv.AssetIssuer == "" {
+		asset = "XLM"
+	} else {
+		asset += " (issued by " + inv.AssetIssuer + ")"
+	}
+
+	return fmt.Sprintf("Please pay %s %s to %s with memo ID %s. Payments without the memo can't be matched.", inv.Amount, asset, inv.Address, inv.ID)
+}
+
+// describe returns a summary of the invoice on one line.
+func (inv *invoice) describe() string {
+	line := fmt.Sprintf("%s %s %s %s to %s received:%s", inv.ID, inv.Status, inv.Amount, inv.Asset, inv.To, inv.Received)
+	if inv.Description != "" {
+		line += " " + inv.Description
+	}
+	return line
+}
+
+// invoiceWatcher matches payments to the namespace's invoices.
+type invoiceWatcher struct {
+	cli   *CLI
+	names *aliasNamer
+	lock  sync.Mutex // for the store, which the streams for each account share
+}
+
+// apply matches the payment to address with an invoice, and updates it. Payments
+// that are already recorded are ignored.
+func (w *invoiceWatcher) apply(ctx context.Context, address string, data []byte) error {
+	p := &paymentRecord{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return errors.Wrapf(err, "bad payment")
+	}
+
+	if p.normalize(); p.To != address {
+		return nil
+	}
+	from := w.names.address(p.From)
+
+	memoType, memo, err := loadMemo(ctx, w.cli.horizonURL(), p.TxHash)
+	if err != nil {
+		return err
+	}
+
+	if memoType != "id" {
+		showSuccess("unmatched payment %s: %s %s from %s has no memo ID", p.ID, p.Amount, p.asset(), from)
+		return nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	inv, err := w.cli.getInvoice(memo)
+	if err != nil || inv.Address != address {
+		showSuccess("unmatched payment %s: %s %s from %s has unknown memo ID %s", p.ID, p.Amount, p.asset(), from, memo)
+		return nil
+	}
+
+	if p.AssetCode != inv.AssetCode || p.AssetIssuer != inv.AssetIssuer {
+		showSuccess("invoice %s: ignoring payment %s in %s, expecting %s", inv.ID, p.ID, p.asset(), inv.Asset)
+		return nil
+	}
+
+	for _, payment := range inv.Payments {
+		if payment.ID == p.ID {
+			return nil
+		}
+	}
+
+	amount, err := microstellar.ParseAmount(p.Amount)
+	if err != nil {
+		return errors.Errorf("bad amount in payment %s: %s", p.ID, p.Amount)
+	}
+
+	received, _ := microstellar.ParseAmount(inv.Received)
+	inv.Received = microstellar.ToAmountString(received + amount)
+	inv.Payments = append(inv.Payments, &invoicePayment{ID: p.ID, TxHash: p.TxHash, From: p.From, Amount: p.Amount, Time: p.CreatedAt})
+
+	wasPaid := inv.Status == invoicePaid || inv.Status == invoiceOverpaid
+	due := inv.due()
+	switch {
+	case due > 0:
+		inv.Status = invoicePartial
+		showSuccess("invoice %s: received %s %s from %s, %s due", inv.ID, p.Amount, inv.Asset, from, microstellar.ToAmountString(due))
+	case due == 0:
+		inv.Status = invoicePaid
+		showSuccess("invoice %s: received %s %s from %s, paid", inv.ID, p.Amount, inv.Asset, from)
+	default:
+		inv.Status = invoiceOverpaid
+		showSuccess("invoice %s: received %s %s from %s, overpaid by %s", inv.ID, p.Amount, inv.Asset, from, microstellar.ToAmountString(-due))
+	}
+
+	if !wasPaid && due <= 0 {
+		inv.PaidOn = p.CreatedAt
+	}
+
+	return w.cli.saveInvoice(inv)
+}
+
+// watch matches payments to address until ctx is done. It resumes after the
+// last payment it saw.
+func (w *invoiceWatcher) watch(ctx context.Context, address string, cursor string) error {
+	if cursor == "" {
+		cursor, _ = w.cli.GetVar(invoiceCursorKey(address))
+	}
+
+	return followPayments(ctx, w.cli.horizonURL(), address, cursor, func(token string, data []byte) error {
+		if err := w.apply(ctx, address, data); err != nil {
+			return err
+		}
+
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.cli.SetVar(invoiceCursorKey(address), token)
+	})
+}
+
+func (cli *CLI) buildInvoiceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "invoice [create|list|show|watch]",
+		Short: "request payments, and match them by memo ID",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "invoice"}, "unrecognized invoice command: %s, expecting: create|list|show|watch", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildInvoiceCreateCmd())
+	cmd.AddCommand(cli.buildInvoiceListCmd())
+	cmd.AddCommand(cli.buildInvoiceShowCmd())
+	cmd.AddCommand(cli.buildInvoiceWatchCmd())
+	return cmd
+}
+
+func (cli *CLI) buildInvoiceCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create --to [account] --amount [amount] [--asset asset] [--desc text]",
+		Short: "create an invoice, and show the payment instructions and SEP-7 URI",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "invoice", "subcmd": "create"}
+
+			to, _ := cmd.Flags().GetString("to")
+			address, err := cli.ResolveAccount(logFields, to, "address")
+			if err == nil {
+				address, err = addressOf(address)
+			}
+
+			if err != nil {
+				cli.error(logFields, "bad --to address: %s", to)
+				return
+			}
+
+			amount, _ := cmd.Flags().GetString("amount")
+			if value, err := microstellar.ParseAmount(amount); err != nil || value <= 0 {
+				cli.error(logFields, "bad amount: %s", amount)
+				return
+			}
+
+			assetName, _ := cmd.Flags().GetString("asset")
+			asset, err := cli.ResolveAsset(assetName)
+			if err != nil {
+				debugf(logFields, "could not get asset %s: %v", assetName, err)
+				cli.error(logFields, "bad asset: %s", assetName)
+				return
+			}
+
+			id, err := newMemoID(func(id string) bool {
+				_, err := cli.GetVar(invoiceKey(id))
+				return err == nil
+			})
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			desc, _ := cmd.Flags().GetString("desc")
+			inv := &invoice{
+				ID:          id,
+				To:          to,
+				Address:     address,
+				Amount:      amount,
+				Asset:       assetName,
+				Description: desc,
+				CreatedOn:   time.Now().UTC(),
+				Status:      invoiceOpen,
+				Received:    "0",
+			}
+
+			if !asset.IsNative() {
+				inv.AssetCode, inv.AssetIssuer = asset.Code, asset.Issuer
+			}
+
+			if err := cli.saveInvoice(inv); err != nil {
+				cli.error(logFields, "could not save invoice: %v", err)
+				return
+			}
+
+			showSuccess("invoice: %s", inv.ID)
+			showSuccess("%s", inv.text())
+
+			if msg, _ := cmd.Flags().GetString("msg"); msg == "" && desc != "" {
+				cmd.Flags().Set("msg", desc)
+			}
+
+			params := []uriParam{{"destination", address}, {"amount", amount}}
+			if !asset.IsNative() {
+				params = append(params, uriParam{"asset_code", asset.Code}, uriParam{"asset_issuer", asset.Issuer})
+			}
+			params = append(params, uriParam{"memo", id}, uriParam{"memo_type", "MEMO_ID"})
+
+			cli.showURI(cmd, logFields, "pay", params)
+		},
+	}
+
+	buildFlagsForURI(cmd)
+	cmd.Flags().String("to", "", "account to be paid")
+	cmd.Flags().String("amount", "", "amount due")
+	cmd.Flags().String("asset", "native", "asset due")
+	cmd.Flags().String("desc", "", "what the invoice is for (also the URI's message, unless --msg is set)")
+	cmd.MarkFlagRequired("to")
+	cmd.MarkFlagRequired("amount")
+	return cmd
+}
+
+func (cli *CLI) buildInvoiceListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list [--status open|partial|paid|overpaid|unpaid]",
+		Short: "list invoices, oldest first",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "invoice", "subcmd": "list"}
+			status, _ := cmd.Flags().GetString("status")
+
+			invoices, err := cli.invoices()
+			if err != nil {
+				cli.error(logFields, "could not load invoices: %v", err)
+				return
+			}
+
+			for _, inv := range invoices {
+				if status == "" || status == inv.Status || status == "unpaid" && inv.due() > 0 {
+					showSuccess("%s", inv.describe())
+				}
+			}
+		},
+	}
+
+	cmd.Flags().String("status", "", "only show invoices with this status (unpaid is open or partial)")
+	return cmd
+}
+
+func (cli *CLI) buildInvoiceShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show [id]",
+		Short: "show an invoice and its payments",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "invoice", "subcmd": "show"}
+
+			inv, err := cli.getInvoice(args[0])
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+				data, _ := json.MarshalIndent(inv, "", "  ")
+				showSuccess("%s", string(data))
+				return
+			}
+
+			showSuccess("%s", inv.describe())
+			names := cli.namer()
+			for _, payment := range inv.Payments {
+				showSuccess("  %s %s from %s (tx %s)", payment.Time.Format(time.RFC3339), payment.Amount, names.address(payment.From), payment.TxHash)
+			}
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "show the invoice as JSON")
+	return cmd
+}
+
+func (cli *CLI) buildInvoiceWatchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch [accounts...] [--cursor token]",
+		Short: "match payments to invoices as they arrive (for the accounts with unpaid invoices, by default)",
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "invoice", "subcmd": "watch"}
+			cursor, _ := cmd.Flags().GetString("cursor")
+
+			var addresses []string
+			seen := map[string]bool{}
+			add := func(address string) {
+				if !seen[address] {
+					seen[address] = true
+					addresses = append(addresses, address)
+				}
+			}
+
+			for _, name := range args {
+				address, err := cli.ResolveAccount(logFields, name, "address")
+				if err == nil {
+					address, err = addressOf(address)
+				}
+
+				if err != nil {
+					cli.error(logFields, "bad account: %s", name)
+					return
+				}
+				add(address)
+			}
+
+			if len(args) == 0 {
+				invoices, err := cli.invoices()
+				if err != nil {
+					cli.error(logFields, "could not load invoices: %v", err)
+					return
+				}
+
+				for _, inv := range invoices {
+					if inv.due() > 0 {
+						add(inv.Address)
+					}
+				}
+			}
+
+			if len(addresses) == 0 {
+				cli.error(logFields, "no unpaid invoices to watch")
+				return
+			}
+
+			ctx, cancel := context.WithCancel(cli.ctx)
+			defer cancel()
+			cli.setStopWatcher(cancel)
+
+			watcher := &invoiceWatcher{cli: cli, names: cli.namer()}
+			errs := make(chan error, len(addresses))
+			var wg sync.WaitGroup
+			for _, address := range addresses {
+				wg.Add(1)
+				go func(address string) {
+					defer wg.Done()
+					if err := watcher.watch(ctx, address, cursor); err != nil {
+						errs <- errors.Wrapf(err, "%s", address)
+						cancel()
+					}
+				}(address)
+			}
+
+			wg.Wait()
+			close(errs)
+			if err := <-errs; err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().String("cursor", "", "start after this paging token (default: where the last watch left off, or now)")
+	return cmd
+}
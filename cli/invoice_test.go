@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestInvoices(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new ops")
+	cli.TestCommand("account new customer")
+	cli.TestCommand("account new issuer")
+	cli.TestCommand("asset set USD issuer")
+	ops := strings.TrimSpace(cli.TestCommand("account address ops"))
+	customer := strings.TrimSpace(cli.TestCommand("account address customer"))
+	issuer := strings.TrimSpace(cli.TestCommand("account address issuer"))
+	named := customer + " (customer)"
+
+	var mutex sync.Mutex
+	var cursors []string
+	memos := map[string]string{}
+	var payments []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.URL.Path == "/accounts/"+ops+"/payments":
+			cursor := r.URL.Query().Get("cursor")
+			cursors = append(cursors, cursor)
+			if cursor == "now" {
+				for _, payment := range payments {
+					fmt.Fprintf(w, "data: %s\n\n", payment)
+				}
+				w.(http.Flusher).Flush()
+			}
+
+			mutex.Unlock()
+			<-r.Context().Done()
+			mutex.Lock()
+		case strings.HasPrefix(r.URL.Path, "/transactions/"):
+			memo := memos[strings.TrimPrefix(r.URL.Path, "/transactions/")]
+			if memo == "fail" {
+				w.WriteHeader(http.StatusNotFound)
+			} else if memo == "" {
+				fmt.Fprintf(w, `{"memo_type": "none"}`)
+			} else {
+				fmt.Fprintf(w, `{"memo_type": "id", "memo": "%s"}`, memo)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	create := func(command string) (string, []string) {
+		lines := strings.Split(strings.TrimSpace(cli.TestCommand(command)), "\n")
+		return strings.TrimPrefix(lines[0], "invoice: "), lines
+	}
+
+	rent, lines := create("invoice create --to ops --amount 25 --asset USD --desc rent")
+	if len(lines) != 3 ||
+		lines[1] != fmt.Sprintf("Please pay 25 USD (issued by %s) to %s with memo ID %s. Payments without the memo can't be matched.", issuer, ops, rent) ||
+		lines[2] != fmt.Sprintf("web+stellar:pay?destination=%s&amount=25&asset_code=USD&asset_issuer=%s&memo=%s&memo_type=MEMO_ID&msg=rent&network_passphrase=local", ops, issuer, rent) {
+		t.Errorf("unexpected output: %v", lines)
+	}
+
+	tip, _ := create("invoice create --to ops --amount 2")
+	if rent == tip {
+		t.Errorf("memo IDs not unique: %s", rent)
+	}
+
+	payment := func(id int, amount string, asset string) string {
+		assetFields := `"asset_type": "native"`
+		if asset != "native" {
+			assetFields = fmt.Sprintf(`"asset_type": "credit_alphanum4", "asset_code": "%s", "asset_issuer": "%s"`, asset, issuer)
+		}
+		return fmt.Sprintf(`{"id": "%d", "paging_token": "%d", "type": "payment", "from": "%s", "to": "%s", "amount": "%s", %s, `+
+			`"transaction_hash": "tx%d", "created_at": "2018-03-01T00:00:0%dZ"}`, id, id, customer, ops, amount, assetFields, id, id)
+	}
+
+	mutex.Lock()
+	payments = []string{
+		payment(1, "10.0000000", "USD"),
+		payment(2, "1.0000000", "USD"),    // no memo
+		payment(3, "3.0000000", "USD"),    // tip is in lumens
+		payment(4, "15.0000000", "USD"),   // rent is paid
+		payment(5, "3.0000000", "native"), // tip is overpaid
+		payment(6, "1.0000000", "native"), // unknown memo
+	}
+	memos = map[string]string{"tx1": rent, "tx3": tip, "tx4": rent, "tx5": tip, "tx6": "42"}
+	mutex.Unlock()
+
+	out := cli.TestCommand("invoice watch --timeout 300ms")
+	want := []string{
+		"invoice " + rent + ": received 10.0000000 USD from " + named + ", 15.0000000 due",
+		"unmatched payment 2: 1.0000000 USD from " + named + " has no memo ID",
+		"invoice " + tip + ": ignoring payment 3 in USD, expecting native",
+		"invoice " + rent + ": received 15.0000000 USD from " + named + ", paid",
+		"invoice " + tip + ": received 3.0000000 native from " + named + ", overpaid by 1.0000000",
+		"unmatched payment 6: 1.0000000 native from " + named + " has unknown memo ID 42",
+	}
+	if strings.TrimSpace(out) != strings.Join(want, "\n") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	expectOutput(t, cli, rent+" paid 25 USD to ops received:25.0000000 rent\n"+tip+" overpaid 2 native to ops received:3.0000000", "invoice list")
+	expectOutput(t, cli, rent+" paid 25 USD to ops received:25.0000000 rent", "invoice list --status paid")
+	expectOutput(t, cli, rent+" paid 25 USD to ops received:25.0000000 rent\n"+
+		"  2018-03-01T00:00:01Z 10.0000000 from "+named+" (tx tx1)\n"+
+		"  2018-03-01T00:00:04Z 15.0000000 from "+named+" (tx tx4)", "invoice show "+rent)
+
+	var inv invoice
+	if err := json.Unmarshal([]byte(cli.TestCommand("invoice show --json "+rent)), &inv); err != nil || len(inv.Payments) != 2 || inv.PaidOn.IsZero() {
+		t.Errorf("unexpected invoice: %+v", inv)
+	}
+
+	// Nothing left to watch
+	expectOutput(t, cli, "error", "invoice watch")
+
+	// Watching picks up after the last payment, and payments aren't counted twice
+	mutex.Lock()
+	cursors = nil
+	mutex.Unlock()
+	cli.TestCommand("invoice watch ops --timeout 200ms")
+	cli.TestCommand("invoice watch ops --cursor now --timeout 200ms")
+	if len(cursors) != 2 || cursors[0] != "6" || cursors[1] != "now" {
+		t.Errorf("unexpected cursors: %v", cursors)
+	}
+	expectOutput(t, cli, rent+" paid 25 USD to ops received:25.0000000 rent", "invoice list --status paid")
+
+	// A child namespace shares the accounts and network, but not the invoices or
+	// the cursor
+	cli.TestCommand("ns create child --parent test")
+	cli.TestCommand("ns child")
+	mutex.Lock()
+	cursors = nil
+	mutex.Unlock()
+	out = cli.TestCommand("invoice watch ops --timeout 300ms")
+	if len(cursors) != 1 || cursors[0] != "now" ||
+		!strings.Contains(out, "unmatched payment 1: 10.0000000 USD from "+named+" has unknown memo ID "+rent) {
+		t.Errorf("child watched parent's invoices: %v (cursors: %v)", out, cursors)
+	}
+	expectOutput(t, cli, "", "invoice list")
+	expectOutput(t, cli, "error", "invoice show "+rent)
+	cli.TestCommand("ns test")
+	expectOutput(t, cli, rent+" paid 25 USD to ops received:25.0000000 rent", "invoice list --status paid")
+
+	// A payment that can't be matched stops the watch, instead of leaving it
+	// running and dropping every payment after it
+	mutex.Lock()
+	payments = append(payments, payment(7, "1.0000000", "native"))
+	memos["tx7"] = "fail"
+	mutex.Unlock()
+	start := time.Now()
+	if out := cli.TestCommand("invoice watch ops --cursor now --timeout 20s"); !strings.HasSuffix(out, "error\n") || time.Since(start) > 5*time.Second {
+		t.Errorf("watch didn't fail: %v (after %v)", out, time.Since(start))
+	}
+
+	expectOutput(t, cli, "error", "invoice create --to ops --amount -5")
+	expectOutput(t, cli, "error", "invoice create --to ops --amount 5 --asset EUR")
+	expectOutput(t, cli, "error", "invoice create --to nobody --amount 5")
+	expectOutput(t, cli, "error", "invoice show 42")
+}
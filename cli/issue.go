@@ -0,0 +1,366 @@
+package cli
+
+// This file contains the asset issuance workflow: accounts, funding, flags,
+// trustline, supply, and lock, in one command that's safe to rerun.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stellar/go/clients/horizon"
+)
+
+// issueStep is one step of an issuance plan. Steps that are already done (on
+// the network, or in the store) are skipped.
+type issueStep struct {
+	desc string
+	done bool
+	run  func() error
+}
+
+// issueAccount is the issuer or distribution account of an issuance.
+type issueAccount struct {
+	role    string // "issuer" or "distributor"
+	alias   string
+	address string
+	seed    string
+	isNew   bool                  // the alias doesn't exist yet
+	account *microstellar.Account // nil if the account isn't funded
+}
+
+// isNotFound returns true if err is a 404 from horizon.
+func isNotFound(err error) bool {
+	herr, ok := errors.Cause(err).(*horizon.Error)
+	return ok && herr.Problem.Status == 404
+}
+
+// loadIssueAccount looks up the alias, making up a new keypair if it doesn't
+// exist, and loads the account from the network if it's there.
+func (cli *CLI) loadIssueAccount(role string, alias string) (*issueAccount, error) {
+	a := &issueAccount{role: role, alias: alias}
+
+	if address, err := cli.GetVar(fmt.Sprintf("account:%s:address", alias)); err == nil {
+		seed, err := cli.GetVar(fmt.Sprintf("account:%s:seed", alias))
+		if err != nil || microstellar.ValidSeed(seed) != nil {
+			return nil, errors.Errorf("no seed found for %s: %s", role, alias)
+		}
+		a.address, a.seed = address, seed
+	} else {
+		pair, err := cli.ms.CreateKeyPair()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not create keypair for %s", role)
+		}
+		a.address, a.seed, a.isNew = pair.Address, pair.Seed, true
+		return a, nil
+	}
+
+	account, err := cli.ms.LoadAccount(a.address)
+	if err != nil && !isNotFound(err) {
+		return nil, errors.Errorf("could not load %s: %v", role, microstellar.ErrorString(err))
+	}
+
+	// Without auth_immutable, reruns would try to set it again (and fail.)
+	if account != nil {
+		if account.Flags, err = loadAccountFlags(cli.ctx, cli.horizonURL(), a.address); err != nil {
+			return nil, errors.Errorf("could not load %s flags: %v", role, err)
+		}
+	}
+
+	a.account = account
+	return a, nil
+}
+
+// balance returns the account's balance of asset, or 0 if it has no trustline.
+func (a *issueAccount) balance(asset *microstellar.Asset) (int64, bool) {
+	if a.account == nil {
+		return 0, false
+	}
+
+	for _, balance := range a.account.Balances {
+		if balance.Asset.Code == asset.Code && balance.Asset.Issuer == asset.Issuer {
+			amount, _ := microstellar.ParseAmount(balance.Amount)
+			return amount, true
+		}
+	}
+
+	return 0, false
+}
+
+// masterWeight returns the weight of the account's own key.
+func (a *issueAccount) masterWeight() int32 {
+	if a.account == nil {
+		return 1
+	}
+
+	for _, signer := range a.account.Signers {
+		if signer.PublicKey == a.address {
+			return signer.Weight
+		}
+	}
+
+	return 1
+}
+
+// issueTxOptions returns the options for the transactions of an issuance, which
+// are journaled.
+func (cli *CLI) issueTxOptions() *microstellar.Options {
+	return microstellar.Opts().WithContext(cli.ctx).On(microstellar.EvBeforeSubmit, cli.journalTx(false))
+}
+
+// issueAccountSteps returns the steps that create and fund the account.
+func (cli *CLI) issueAccountSteps(a *issueAccount, funder string, startingBalance string) []*issueStep {
+	fundDesc := fmt.Sprintf("fund %s %s with friendbot", a.role, a.alias)
+	if funder != "" {
+		fundDesc = fmt.Sprintf("fund %s %s with %s lumens from %s", a.role, a.alias, startingBalance, funder)
+	}
+
+	return []*issueStep{
+		{
+			desc: fmt.Sprintf("create %s account %s (%s)", a.role, a.alias, a.address),
+			done: !a.isNew,
+			run: func() error {
+				if err := cli.SetVar(fmt.Sprintf("account:%s:address", a.alias), a.address); err != nil {
+					return err
+				}
+				if err := cli.SetVar(fmt.Sprintf("account:%s:seed", a.alias), a.seed); err != nil {
+					return err
+				}
+				return cli.indexAccount(a.alias)
+			},
+		},
+		{
+			desc: fundDesc,
+			done: a.account != nil,
+			run: func() error {
+				if funder == "" {
+					_, err := cli.fundWithFriendbot(a.address)
+					return err
+				}
+
+				seed, err := cli.ResolveAccount(logrus.Fields{"cmd": "asset", "subcmd": "issue"}, funder, "seed")
+				if err != nil {
+					return errors.Errorf("no seed found for funder: %s", funder)
+				}
+				return cli.ms.FundAccount(seed, a.address, startingBalance, cli.issueTxOptions())
+			},
+		},
+	}
+}
+
+func (cli *CLI) buildAssetIssueCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "issue [code] --supply [amount] [--plan]",
+		Short: "issue an asset: create and fund accounts, set flags, create the trustline, mint the supply, and add the asset alias",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "asset", "subcmd": "issue"}
+			code := args[0]
+
+			if len(code) < 1 || len(code) > 12 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789") != "" {
+				cli.error(logFields, "bad asset code: %s", code)
+				return
+			}
+
+			supply, _ := cmd.Flags().GetString("supply")
+			supplyAmount, err := microstellar.ParseAmount(supply)
+			if err != nil || supplyAmount <= 0 {
+				cli.error(logFields, "bad --supply: %s", supply)
+				return
+			}
+
+			name, _ := cmd.Flags().GetString("name")
+			if name == "" {
+				name = code
+			}
+
+			issuerAlias, _ := cmd.Flags().GetString("issuer")
+			if issuerAlias == "" {
+				issuerAlias = strings.ToLower(code) + "-issuer"
+			}
+
+			distributorAlias, _ := cmd.Flags().GetString("distributor")
+			if distributorAlias == "" {
+				distributorAlias = strings.ToLower(code) + "-distributor"
+			}
+
+			// Flags are set one at a time (SetOptions takes one flag per operation.)
+			type issueFlag struct {
+				name  string
+				value microstellar.AccountFlags
+				isSet func(microstellar.Flags) bool
+			}
+
+			var flags []issueFlag
+			for _, flag := range []issueFlag{
+				{"auth_required", microstellar.FlagAuthRequired, func(f microstellar.Flags) bool { return f.AuthRequired }},
+				{"auth_revocable", microstellar.FlagAuthRevocable, func(f microstellar.Flags) bool { return f.AuthRevocable }},
+				{"auth_immutable", microstellar.FlagAuthImmutable, func(f microstellar.Flags) bool { return f.AuthImmutable }},
+			} {
+				if set, _ := cmd.Flags().GetBool(strings.Replace(flag.name, "_", "-", -1)); set {
+					flags = append(flags, flag)
+				}
+			}
+
+			funder, _ := cmd.Flags().GetString("funder")
+			startingBalance, _ := cmd.Flags().GetString("starting-balance")
+			homeDomain, _ := cmd.Flags().GetString("home-domain")
+			lock, _ := cmd.Flags().GetBool("lock")
+
+			issuer, err := cli.loadIssueAccount("issuer", issuerAlias)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			distributor, err := cli.loadIssueAccount("distributor", distributorAlias)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			asset := microstellar.NewAsset(code, issuer.address, microstellar.Credit4Type)
+			if len(code) > 4 {
+				asset = microstellar.NewAsset(code, issuer.address, microstellar.Credit12Type)
+			}
+
+			// Don't clobber an alias for some other asset.
+			registered := false
+			if existing, err := cli.ResolveAsset(name); err == nil {
+				if existing.Code != asset.Code || existing.Issuer != asset.Issuer {
+					cli.error(logFields, "asset %s already exists with issuer %s", name, existing.Issuer)
+					return
+				}
+				registered = true
+			}
+
+			// The distributor may have paid some of the supply out since, so go by
+			// the amount the network says is issued, not the distributor's balance.
+			_, trusted := distributor.balance(asset)
+			var issued int64
+			if issuer.account != nil {
+				stats, err := loadAssetStats(cli.ctx, cli.horizonURL(), asset)
+				if err != nil {
+					cli.error(logFields, "could not load issued amount: %v", err)
+					return
+				}
+
+				if stats != nil {
+					if issued, err = microstellar.ParseAmount(stats.Amount); err != nil {
+						cli.error(logFields, "bad issued amount for %s: %s", code, stats.Amount)
+						return
+					}
+				}
+			}
+
+			minted := issued >= supplyAmount
+			mint := microstellar.ToAmountString(supplyAmount)
+			if !minted {
+				mint = microstellar.ToAmountString(supplyAmount - issued)
+			}
+
+			steps := cli.issueAccountSteps(issuer, funder, startingBalance)
+			steps = append(steps, cli.issueAccountSteps(distributor, funder, startingBalance)...)
+
+			authRequired := false
+			for _, flag := range flags {
+				flag := flag
+				authRequired = authRequired || flag.value == microstellar.FlagAuthRequired
+				steps = append(steps, &issueStep{
+					desc: fmt.Sprintf("set %s on issuer", flag.name),
+					done: issuer.account != nil && flag.isSet(issuer.account.Flags),
+					run:  func() error { return cli.ms.SetFlags(issuer.seed, flag.value, cli.issueTxOptions()) },
+				})
+			}
+
+			if homeDomain != "" {
+				steps = append(steps, &issueStep{
+					desc: fmt.Sprintf("set issuer home domain to %s", homeDomain),
+					done: issuer.account != nil && issuer.account.HomeDomain == homeDomain,
+					run:  func() error { return cli.ms.SetHomeDomain(issuer.seed, homeDomain, cli.issueTxOptions()) },
+				})
+			}
+
+			steps = append(steps, &issueStep{
+				desc: fmt.Sprintf("create %s trustline from %s", code, distributorAlias),
+				done: trusted,
+				run:  func() error { return cli.ms.CreateTrustLine(distributor.seed, asset, "", cli.issueTxOptions()) },
+			})
+
+			if authRequired {
+				steps = append(steps, &issueStep{
+					desc: fmt.Sprintf("authorize %s to hold %s", distributorAlias, code),
+					done: minted,
+					run: func() error {
+						return cli.ms.AllowTrust(issuer.seed, distributor.address, code, true, cli.issueTxOptions())
+					},
+				})
+			}
+
+			steps = append(steps, &issueStep{
+				desc: fmt.Sprintf("mint %s %s to %s", mint, code, distributorAlias),
+				done: minted,
+				run:  func() error { return cli.ms.Pay(issuer.seed, distributor.address, mint, asset, cli.issueTxOptions()) },
+			})
+
+			if lock {
+				steps = append(steps, &issueStep{
+					desc: "lock issuer (set its master weight to 0, so no more can be minted, ever)",
+					done: issuer.masterWeight() == 0,
+					run:  func() error { return cli.ms.SetMasterWeight(issuer.seed, 0, cli.issueTxOptions()) },
+				})
+			}
+
+			steps = append(steps, &issueStep{
+				desc: fmt.Sprintf("add asset %s (%s issued by %s)", name, code, issuerAlias),
+				done: registered,
+				run: func() error {
+					return cli.runNested("asset", "set", name, issuer.address, "--code", code, "--type", string(asset.Type))
+				},
+			})
+
+			if plan, _ := cmd.Flags().GetBool("plan"); plan {
+				for _, step := range steps {
+					status := "todo"
+					if step.done {
+						status = "done"
+					}
+					showSuccess("[%s] %s", status, step.desc)
+				}
+				return
+			}
+
+			for _, step := range steps {
+				if step.done {
+					debugf(logFields, "skipping: %s", step.desc)
+					continue
+				}
+
+				if err := step.run(); err != nil {
+					cli.error(logFields, "could not %s: %v", step.desc, microstellar.ErrorString(err))
+					return
+				}
+				showSuccess("%s", step.desc)
+			}
+		},
+	}
+
+	cmd.Flags().String("supply", "", "amount to mint to the distribution account")
+	cmd.Flags().String("name", "", "name for the asset alias (default: the code)")
+	cmd.Flags().String("issuer", "", "issuing account alias, created if it doesn't exist (default: code-issuer)")
+	cmd.Flags().String("distributor", "", "distribution account alias, created if it doesn't exist (default: code-distributor)")
+	cmd.Flags().String("funder", "", "fund new accounts from this account (default: use friendbot)")
+	cmd.Flags().String("starting-balance", "5", "lumens to fund new accounts with")
+	cmd.Flags().Bool("auth-required", false, "set auth_required on the issuer")
+	cmd.Flags().Bool("auth-revocable", false, "set auth_revocable on the issuer")
+	cmd.Flags().Bool("auth-immutable", false, "set auth_immutable on the issuer")
+	cmd.Flags().String("home-domain", "", "set the issuer's home domain (for stellar.toml)")
+	cmd.Flags().Bool("lock", false, "lock the issuer after minting, fixing the supply")
+	cmd.Flags().Bool("plan", false, "show the steps, without running them")
+	cmd.MarkFlagRequired("supply")
+
+	return cmd
+}
@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestAssetIssue(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new treasury")
+	treasury := strings.TrimSpace(cli.TestCommand("account address treasury"))
+
+	var mutex sync.Mutex
+	submits := 0
+	minted := "" // the distributor's USD balance, once issued
+	issued := "" // the amount of USD issued, if different
+	locked := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if r.Method == "POST" && r.URL.Path == "/transactions" {
+			submits++
+			w.Write([]byte(`{"hash": "ok", "ledger": 10}`))
+			return
+		}
+
+		if r.URL.Path == "/assets" {
+			records := ""
+			if minted != "" {
+				amount := minted
+				if issued != "" {
+					amount = issued
+				}
+				records = fmt.Sprintf(`{"amount": "%s", "num_accounts": 1, "flags": {}}`, amount)
+			}
+			fmt.Fprintf(w, `{"_embedded": {"records": [%s]}}`, records)
+			return
+		}
+
+		address := strings.TrimPrefix(r.URL.Path, "/accounts/")
+		issuer, _ := cli.GetVar("account:usd-issuer:address")
+		distributor, _ := cli.GetVar("account:usd-distributor:address")
+
+		balances := `{"balance": "1000.0000000", "asset_type": "native"}`
+		signers := fmt.Sprintf(`{"public_key": "%s", "key": "%s", "weight": 1, "type": "ed25519_public_key"}`, address, address)
+		flags, domain := `{}`, ""
+
+		switch {
+		case address == treasury:
+		case minted == "" && submits < 2:
+			// Not funded yet
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": 404, "title": "Resource Missing"}`))
+			return
+		case minted != "" && address == issuer:
+			flags, domain = `{"auth_required": true, "auth_revocable": true, "auth_immutable": true}`, "example.com"
+			if locked {
+				signers = strings.Replace(signers, `"weight": 1`, `"weight": 0`, 1)
+			}
+		case minted != "" && address == distributor:
+			balances += fmt.Sprintf(`, {"balance": "%s", "limit": "922337203685.4775807", "asset_type": "credit_alphanum4", "asset_code": "USD", "asset_issuer": "%s"}`, minted, issuer)
+		}
+
+		fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "100", "balances": [%s], "signers": [%s], "flags": %s, "home_domain": "%s"}`,
+			address, address, balances, signers, flags, domain)
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	issue := "asset issue USD --supply 1000 --funder treasury --auth-required --auth-revocable --home-domain example.com --lock"
+
+	out := cli.TestCommand(issue + " --plan")
+	want := []string{
+		"[todo] create issuer account usd-issuer",
+		"[todo] fund issuer usd-issuer with 5 lumens from treasury",
+		"[todo] create distributor account usd-distributor",
+		"[todo] fund distributor usd-distributor with 5 lumens from treasury",
+		"[todo] set auth_required on issuer",
+		"[todo] set auth_revocable on issuer",
+		"[todo] set issuer home domain to example.com",
+		"[todo] create USD trustline from usd-distributor",
+		"[todo] authorize usd-distributor to hold USD",
+		"[todo] mint 1000.0000000 USD to usd-distributor",
+		"[todo] lock issuer (set its master weight to 0, so no more can be minted, ever)",
+		"[todo] add asset USD (USD issued by usd-issuer)",
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("unexpected plan: %v", out)
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("want %q, got %q", want[i], lines[i])
+		}
+	}
+
+	// Planning doesn't change anything
+	expectOutput(t, cli, "error", "account address usd-issuer")
+	if submits != 0 {
+		t.Errorf("plan submitted %d transactions", submits)
+	}
+
+	out = cli.TestCommand(issue)
+	if strings.Contains(out, "error") || len(strings.Split(strings.TrimSpace(out), "\n")) != len(want) {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if submits != 9 {
+		t.Errorf("want 9 transactions, got %d", submits)
+	}
+
+	issuer := strings.TrimSpace(cli.TestCommand("account address usd-issuer"))
+	expectOutput(t, cli, issuer, "asset issuer USD")
+	expectOutput(t, cli, "USD", "asset code USD")
+
+	// A partial issuance picks up where it left off
+	mutex.Lock()
+	minted = "400.0000000"
+	mutex.Unlock()
+	out = cli.TestCommand(issue + " --plan")
+	if !strings.Contains(out, "[done] create USD trustline from usd-distributor\n[todo] authorize usd-distributor to hold USD\n[todo] mint 600.0000000 USD to usd-distributor\n[todo] lock issuer") {
+		t.Errorf("unexpected plan: %v", out)
+	}
+
+	// Once it's all done, reruns do nothing
+	mutex.Lock()
+	minted, locked, submits = "1000.0000000", true, 0
+	mutex.Unlock()
+	out = cli.TestCommand(issue + " --plan")
+	if strings.Contains(out, "[todo]") {
+		t.Errorf("unexpected plan: %v", out)
+	}
+	expectOutput(t, cli, "", issue)
+	if submits != 0 {
+		t.Errorf("rerun submitted %d transactions", submits)
+	}
+
+	// Including auth_immutable, which microstellar doesn't load
+	expectOutput(t, cli, "", issue+" --auth-immutable")
+	if submits != 0 {
+		t.Errorf("rerun submitted %d transactions", submits)
+	}
+
+	// Reruns don't mint again after the distributor pays some out
+	mutex.Lock()
+	minted, issued = "250.0000000", "1000.0000000"
+	mutex.Unlock()
+	out = cli.TestCommand(issue + " --plan")
+	if strings.Contains(out, "[todo]") {
+		t.Errorf("unexpected plan: %v", out)
+	}
+	expectOutput(t, cli, "", issue)
+	if submits != 0 {
+		t.Errorf("rerun submitted %d transactions", submits)
+	}
+
+	cli.TestCommand("asset set EUR treasury")
+	expectOutput(t, cli, "error", "asset issue USD --supply 1000 --name EUR")
+	expectOutput(t, cli, "error", "asset issue US$ --supply 1000")
+	expectOutput(t, cli, "error", "asset issue USD --supply none")
+}
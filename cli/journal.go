@@ -0,0 +1,548 @@
+package cli
+
+// This file contains the transaction journal, which records every transaction
+// lumen submits (or builds with --nosubmit) so you can find out what happened
+// to it later.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/xdr"
+)
+
+// Journal entry statuses
+const (
+	journalUnsubmitted = "unsubmitted" // built with --nosubmit
+	journalPending     = "pending"     // submitted, no response yet
+	journalUnknown     = "unknown"     // submission failed without a result from horizon
+	journalConfirmed   = "confirmed"   // in the ledger
+	journalFailed      = "failed"      // rejected, or can never be applied
+	journalExpired     = "expired"     // not in the ledger, and past its max time
+)
+
+// journalEntry is a transaction in the journal. Entries are stored as JSON in
+// the namespace they were made in, under journal:HASH.
+type journalEntry struct {
+	Hash        string    `json:"hash"`
+	Namespace   string    `json:"namespace"`
+	Network     string    `json:"network"`
+	Passphrase  string    `json:"passphrase"`
+	Command     string    `json:"command"`
+	Envelope    string    `json:"envelope"`
+	Status      string    `json:"status"`
+	Ledger      int32     `json:"ledger,omitempty"`
+	ResultCodes []string  `json:"result_codes,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CreatedOn   time.Time `json:"created_on"`
+	UpdatedOn   time.Time `json:"updated_on"`
+}
+
+// hashEnvelope returns the hex-encoded hash of a base64-encoded transaction
+// envelope on the network with passphrase.
+func hashEnvelope(envelope string, passphrase string) (string, *xdr.TransactionEnvelope, error) {
+	var txe xdr.TransactionEnvelope
+	if err := xdr.SafeUnmarshalBase64(envelope, &txe); err != nil {
+		return "", nil, errors.Wrapf(err, "bad transaction")
+	}
+
+	hash, err := network.HashTransaction(&txe.Tx, passphrase)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "could not hash transaction")
+	}
+
+	return hex.EncodeToString(hash[:]), &txe, nil
+}
+
+// commandLine returns the command being run, with any seeds removed.
+func (cli *CLI) commandLine() string {
+	words := []string{"lumen"}
+	for _, arg := range cli.args {
+		if microstellar.ValidSeed(arg) == nil {
+			arg = "[seed]"
+		} else if i := strings.Index(arg, "="); i >= 0 && microstellar.ValidSeed(arg[i+1:]) == nil {
+			arg = arg[:i+1] + "[seed]"
+		}
+		words = append(words, arg)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// newJournalEntry returns a journal entry for envelope on the current network.
+func (cli *CLI) newJournalEntry(envelope string, status string) (*journalEntry, error) {
+	passphrase := cli.networkPassphrase()
+	hash, _, err := hashEnvelope(envelope, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	networkName, _, _ := parseNetworkSpec(cli.network)
+	if cli.networkDef != nil {
+		networkName = cli.networkDef.name
+	}
+
+	now := time.Now().UTC()
+	return &journalEntry{
+		Hash:       hash,
+		Namespace:  cli.ns,
+		Network:    networkName,
+		Passphrase: passphrase,
+		Command:    cli.commandLine(),
+		Envelope:   envelope,
+		Status:     status,
+		CreatedOn:  now,
+		UpdatedOn:  now,
+	}, nil
+}
+
+// recordTx adds the transaction to the journal. Failing to record it is logged
+// but doesn't stop the command.
+func (cli *CLI) recordTx(envelope string, status string) *journalEntry {
+	logFields := logrus.Fields{"type": "journal", "method": "recordTx"}
+
+	entry, err := cli.newJournalEntry(envelope, status)
+	if err != nil {
+		logrus.WithFields(logFields).Warnf("not journaling transaction: %v", err)
+		return nil
+	}
+
+	// Keep the original command if the transaction was built earlier.
+	if existing, err := cli.getJournalEntry(entry.Hash); err == nil {
+		entry.Command = existing.Command
+		entry.CreatedOn = existing.CreatedOn
+	}
+
+	if err := cli.saveJournalEntry(entry); err != nil {
+		logrus.WithFields(logFields).Warnf("could not journal transaction %s: %v", entry.Hash, err)
+		return nil
+	}
+
+	logrus.WithFields(logFields).Debugf("journaled %s (%s)", entry.Hash, status)
+	return entry
+}
+
+func (cli *CLI) getJournalEntry(hash string) (*journalEntry, error) {
+	data, err := cli.GetVar("journal:" + hash)
+	if err != nil {
+		return nil, errors.Errorf("no such transaction in journal: %s", hash)
+	}
+
+	var entry journalEntry
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		return nil, errors.Errorf("bad journal entry %s: %v", hash, err)
+	}
+
+	return &entry, nil
+}
+
+func (cli *CLI) saveJournalEntry(entry *journalEntry) error {
+	entry.UpdatedOn = time.Now().UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return cli.SetVar("journal:"+entry.Hash, string(data))
+}
+
+// findJournalEntry looks up an entry by hash, or a unique prefix of one.
+func (cli *CLI) findJournalEntry(prefix string) (*journalEntry, error) {
+	entries, err := cli.journalEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *journalEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Hash, strings.ToLower(prefix)) {
+			if found != nil {
+				return nil, errors.Errorf("ambiguous transaction hash: %s", prefix)
+			}
+			found = entry
+		}
+	}
+
+	if found == nil {
+		return nil, errors.Errorf("no such transaction in journal: %s", prefix)
+	}
+
+	return found, nil
+}
+
+// journalEntries returns all entries in the current namespace, oldest first.
+func (cli *CLI) journalEntries() ([]*journalEntry, error) {
+	prefix := fmt.Sprintf("%s:journal:", cli.ns)
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*journalEntry
+	for _, key := range keys {
+		entry, err := cli.getJournalEntry(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"type": "journal", "method": "journalEntries"}).Warnf("skipping: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedOn.Before(entries[j].CreatedOn) })
+	return entries, nil
+}
+
+// journalTx returns a presubmit handler that journals transactions built with
+// --nosubmit. Submissions to horizon are journaled (with their results) by
+// journalTransport.
+func (cli *CLI) journalTx(nosubmit bool) *microstellar.TxHandler {
+	handler := func(args ...interface{}) (bool, error) {
+		envelope := args[0].(string)
+
+		// Transactions on the fake network aren't real, so there's nothing to record.
+		if name, _, _ := parseNetworkSpec(cli.network); name != "fake" && nosubmit {
+			cli.recordTx(envelope, journalUnsubmitted)
+		}
+
+		if nosubmit {
+			showSuccess("%s", envelope)
+			return false, nil
+		}
+
+		return true, nil
+	}
+
+	txHandler := microstellar.TxHandler(handler)
+	return &txHandler
+}
+
+// journalTransport journals transactions submitted to horizon, along with
+// their results.
+type journalTransport struct {
+	next http.RoundTripper
+	cli  *CLI
+}
+
+func (t *journalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/transactions") || req.Body == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	values, _ := url.ParseQuery(string(body))
+	entry := t.cli.recordTx(values.Get("tx"), journalPending)
+
+	resp, err := t.next.RoundTrip(req)
+	if entry == nil {
+		return resp, err
+	}
+
+	if err != nil {
+		entry.Status = journalUnknown
+		entry.Error = err.Error()
+	} else {
+		data, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+		if readErr == nil {
+			entry.applySubmitResponse(resp.StatusCode, data)
+		} else {
+			entry.Status = journalUnknown
+			entry.Error = readErr.Error()
+		}
+	}
+
+	if saveErr := t.cli.saveJournalEntry(entry); saveErr != nil {
+		logrus.WithFields(logrus.Fields{"type": "journal", "method": "RoundTrip"}).Warnf("could not journal transaction %s: %v", entry.Hash, saveErr)
+	}
+
+	return resp, err
+}
+
+// horizonTxResponse has the parts of horizon's submission (and transaction)
+// responses that go in the journal.
+type horizonTxResponse struct {
+	Hash       string `json:"hash"`
+	Ledger     int32  `json:"ledger"`
+	Successful *bool  `json:"successful"`
+	Extras     struct {
+		ResultCodes struct {
+			Transaction string   `json:"transaction"`
+			Operations  []string `json:"operations"`
+		} `json:"result_codes"`
+	} `json:"extras"`
+}
+
+// applySubmitResponse updates the entry with horizon's response to its submission.
+func (entry *journalEntry) applySubmitResponse(status int, data []byte) {
+	var resp horizonTxResponse
+	json.Unmarshal(data, &resp)
+
+	switch {
+	case status == http.StatusOK:
+		entry.Status = journalConfirmed
+		entry.Ledger = resp.Ledger
+		entry.Error = ""
+	case status == http.StatusBadRequest && resp.Extras.ResultCodes.Transaction != "":
+		entry.Status = journalFailed
+		entry.ResultCodes = append([]string{resp.Extras.ResultCodes.Transaction}, resp.Extras.ResultCodes.Operations...)
+		entry.Error = ""
+	default:
+		// e.g., a timeout, which doesn't mean the transaction won't make it.
+		entry.Status = journalUnknown
+		entry.Error = fmt.Sprintf("horizon returned %d", status)
+	}
+}
+
+// reconcile asks horizon what happened to a pending or unknown transaction,
+// and updates its status. Returns true if the status changed.
+func (cli *CLI) reconcile(entry *journalEntry) (bool, error) {
+	oldStatus := entry.Status
+
+	resp, err := http.Get(cli.horizonURL() + "/transactions/" + entry.Hash)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var tx horizonTxResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tx); err != nil {
+			return false, errors.Wrapf(err, "bad response from horizon")
+		}
+
+		entry.Ledger = tx.Ledger
+		entry.Error = ""
+		entry.Status = journalConfirmed
+		if tx.Successful != nil && !*tx.Successful {
+			entry.Status = journalFailed
+		}
+	case http.StatusNotFound:
+		// Not in the ledger. Find out if it can still get there.
+		_, txe, err := hashEnvelope(entry.Envelope, entry.Passphrase)
+		if err != nil {
+			return false, err
+		}
+
+		if txe.Tx.TimeBounds != nil && txe.Tx.TimeBounds.MaxTime != 0 &&
+			time.Now().After(time.Unix(int64(txe.Tx.TimeBounds.MaxTime), 0)) {
+			entry.Status = journalExpired
+			break
+		}
+
+		account, err := cli.ms.LoadAccount(txe.Tx.SourceAccount.Address())
+		if err != nil {
+			return false, errors.Errorf("could not load source account: %v", microstellar.ErrorString(err))
+		}
+
+		if seq, err := strconv.ParseInt(account.Sequence, 10, 64); err == nil && seq >= int64(txe.Tx.SeqNum) {
+			entry.Status = journalFailed
+			entry.Error = "sequence number used by another transaction"
+		}
+	default:
+		return false, errors.Errorf("horizon returned %s", resp.Status)
+	}
+
+	if entry.Status == oldStatus {
+		return false, nil
+	}
+
+	return true, cli.saveJournalEntry(entry)
+}
+
+// describe returns a one-line summary of the entry.
+func (entry *journalEntry) describe() string {
+	line := fmt.Sprintf("%s %s %s %s", entry.Hash[:12], entry.CreatedOn.Local().Format("2006-01-02 15:04:05"), entry.Status, entry.Network)
+	if entry.Ledger != 0 {
+		line += fmt.Sprintf(" ledger:%d", entry.Ledger)
+	}
+
+	if len(entry.ResultCodes) > 0 {
+		line += " " + strings.Join(entry.ResultCodes, ",")
+	}
+
+	return line + " " + entry.Command
+}
+
+func (cli *CLI) buildJournalCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "journal [list|show|reconcile]",
+		Short: "browse and reconcile the transactions submitted by lumen",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "journal"}, "unrecognized journal command: %s, expecting: list|show|reconcile", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildJournalListCmd())
+	cmd.AddCommand(cli.buildJournalShowCmd())
+	cmd.AddCommand(cli.buildJournalReconcileCmd())
+
+	return cmd
+}
+
+func (cli *CLI) buildJournalListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list [--status status] [--limit n]",
+		Short: "list journaled transactions, oldest first",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "journal", "subcmd": "list"}
+			status, _ := cmd.Flags().GetString("status")
+			limit, _ := cmd.Flags().GetInt("limit")
+
+			entries, err := cli.journalEntries()
+			if err != nil {
+				cli.error(logFields, "could not read journal: %v", err)
+				return
+			}
+
+			var lines []string
+			for _, entry := range entries {
+				if status == "" || entry.Status == status {
+					lines = append(lines, entry.describe())
+				}
+			}
+
+			// Show the most recent ones
+			if limit > 0 && len(lines) > limit {
+				lines = lines[len(lines)-limit:]
+			}
+
+			for _, line := range lines {
+				showSuccess("%s", line)
+			}
+		},
+	}
+
+	cmd.Flags().String("status", "", "only show transactions with this status (unsubmitted, pending, unknown, confirmed, failed, expired)")
+	cmd.Flags().Int("limit", 0, "only show the last n transactions")
+	return cmd
+}
+
+func (cli *CLI) buildJournalShowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show [hash]",
+		Short: "show a journaled transaction (the hash can be abbreviated)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "journal", "subcmd": "show"}
+
+			entry, err := cli.findJournalEntry(args[0])
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			lines := []string{
+				fmt.Sprintf("hash: %s", entry.Hash),
+				fmt.Sprintf("status: %s", entry.Status),
+			}
+
+			if entry.Ledger != 0 {
+				lines = append(lines, fmt.Sprintf("ledger: %d", entry.Ledger))
+			}
+
+			if len(entry.ResultCodes) > 0 {
+				lines = append(lines, fmt.Sprintf("result codes: %s", strings.Join(entry.ResultCodes, ", ")))
+			}
+
+			if entry.Error != "" {
+				lines = append(lines, fmt.Sprintf("error: %s", entry.Error))
+			}
+
+			lines = append(lines,
+				fmt.Sprintf("command: %s", entry.Command),
+				fmt.Sprintf("namespace: %s", entry.Namespace),
+				fmt.Sprintf("network: %s (%s)", entry.Network, entry.Passphrase),
+				fmt.Sprintf("created: %s", entry.CreatedOn.Local().Format(time.RFC3339)),
+				fmt.Sprintf("updated: %s", entry.UpdatedOn.Local().Format(time.RFC3339)),
+			)
+
+			if _, txe, err := hashEnvelope(entry.Envelope, entry.Passphrase); err == nil {
+				lines = append(lines, describeTx(txe)...)
+			}
+
+			lines = append(lines, fmt.Sprintf("envelope: %s", entry.Envelope))
+			showSuccess("%s", strings.Join(lines, "\n"))
+		},
+	}
+
+	return cmd
+}
+
+func (cli *CLI) buildJournalReconcileCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "ask horizon what happened to pending transactions on the current network",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "journal", "subcmd": "reconcile"}
+
+			if name, _, _ := parseNetworkSpec(cli.network); name == "fake" {
+				cli.error(logFields, "can't reconcile on the fake network")
+				return
+			}
+
+			entries, err := cli.journalEntries()
+			if err != nil {
+				cli.error(logFields, "could not read journal: %v", err)
+				return
+			}
+
+			passphrase := cli.networkPassphrase()
+			skipped := 0
+			for _, entry := range entries {
+				if entry.Status != journalPending && entry.Status != journalUnknown {
+					continue
+				}
+
+				if entry.Passphrase != passphrase {
+					skipped++
+					continue
+				}
+
+				changed, err := cli.reconcile(entry)
+				if err != nil {
+					cli.error(logFields, "could not reconcile %s: %v", entry.Hash, err)
+					return
+				}
+
+				if changed {
+					showSuccess("%s", entry.describe())
+				}
+			}
+
+			if skipped > 0 {
+				logrus.WithFields(logFields).Warnf("skipped %d transactions on other networks", skipped)
+			}
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestJournal(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	seed := strings.TrimSpace(cli.TestCommand("account seed mo"))
+
+	expectOutput(t, cli, "", "journal list")
+
+	envelope := strings.TrimSpace(cli.TestCommand("pay 1 --from " + seed + " --to kelly --memotext one --seq 100 --nosubmit --offline"))
+	cli.TestCommand("pay 2 --from mo --to kelly --seq 101 --nosubmit --offline")
+
+	lines := strings.Split(strings.TrimSpace(cli.TestCommand("journal list")), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 journal entries, got: %v", lines)
+	}
+
+	if !strings.Contains(lines[0], " unsubmitted test ") || !strings.HasSuffix(lines[0], "lumen pay 1 --from [seed] --to kelly --memotext one --seq 100 --nosubmit --offline") {
+		t.Errorf("bad journal entry: %v", lines[0])
+	}
+
+	expectOutput(t, cli, lines[1], "journal list --limit 1")
+	expectOutput(t, cli, "", "journal list --status confirmed")
+
+	out := cli.TestCommand("journal show " + strings.Fields(lines[0])[0])
+	if !strings.Contains(out, "status: unsubmitted") || !strings.Contains(out, `memo: text "one"`) || !strings.Contains(out, "envelope: "+envelope) {
+		t.Errorf("bad journal entry: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "journal show ffffffffffff")
+
+	// Nothing to record on the fake network
+	cli.TestCommand("pay 3 --from mo --to kelly --nosubmit --network fake")
+	if out := strings.TrimSpace(cli.TestCommand("journal list")); len(strings.Split(out, "\n")) != 2 {
+		t.Errorf("fake transaction journaled: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "journal reconcile --network fake")
+}
+
+func TestJournalReconcile(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+
+	submitResponse := ""
+	var confirmedHash string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/transactions":
+			if strings.Contains(submitResponse, "extras") || submitResponse == "{}" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte(submitResponse))
+		case r.URL.Path == "/transactions/"+confirmedHash:
+			w.Write([]byte(`{"hash": "` + confirmedHash + `", "ledger": 12, "successful": true}`))
+		case r.URL.Path == "/accounts/"+mo:
+			w.Write([]byte(`{"id": "` + mo + `", "account_id": "` + mo + `", "sequence": "104"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	submitResponse = `{"hash": "ok", "ledger": 10}`
+	cli.TestCommand("pay 1 --from mo --to kelly --seq 100")
+
+	submitResponse = `{"extras": {"result_codes": {"transaction": "tx_failed", "operations": ["op_underfunded"]}}}`
+	expectOutput(t, cli, "error", "pay 2 --from mo --to kelly --seq 101")
+
+	// Neither of these get a result from horizon.
+	submitResponse = "{}"
+	expectOutput(t, cli, "error", "pay 3 --from mo --to kelly --seq 102")
+	expectOutput(t, cli, "error", "pay 4 --from mo --to kelly --seq 104")
+
+	lines := strings.Split(strings.TrimSpace(cli.TestCommand("journal list")), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("want 4 journal entries, got: %v", lines)
+	}
+
+	if !strings.Contains(lines[0], " confirmed local ledger:10 lumen pay 1") {
+		t.Errorf("bad journal entry: %v", lines[0])
+	}
+
+	if !strings.Contains(lines[1], " failed local tx_failed,op_underfunded lumen pay 2") {
+		t.Errorf("bad journal entry: %v", lines[1])
+	}
+
+	if !strings.Contains(lines[2], " unknown local lumen pay 3") || !strings.Contains(lines[3], " unknown local lumen pay 4") {
+		t.Errorf("bad journal entries: %v", lines[2:])
+	}
+
+	// The first one made it into the ledger, and the second one never will
+	// because its sequence number was used up.
+	entry, _ := cli.findJournalEntry(strings.Fields(lines[2])[0])
+	confirmedHash = entry.Hash
+
+	out := strings.Split(strings.TrimSpace(cli.TestCommand("journal reconcile")), "\n")
+	if len(out) != 2 || !strings.Contains(out[0], " confirmed local ledger:12 lumen pay 3") || !strings.Contains(out[1], " failed local lumen pay 4") {
+		t.Errorf("bad reconciliation: %v", out)
+	}
+
+	out = strings.Split(strings.TrimSpace(cli.TestCommand("journal show "+strings.Fields(lines[3])[0])), "\n")
+	if out[1] != "status: failed" || out[2] != "error: sequence number used by another transaction" {
+		t.Errorf("bad journal entry: %v", out)
+	}
+
+	// Nothing left to do
+	expectOutput(t, cli, "", "journal reconcile")
+}
@@ -0,0 +1,245 @@
+package cli
+
+// This file contains macros: saved lumen commands with {parameters}.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var macroParamRE = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_-]*)\}`)
+
+// macroParams returns the names of the parameters in the macro, in the order
+// they first appear.
+func macroParams(template string) []string {
+	var params []string
+	seen := map[string]bool{}
+	for _, match := range macroParamRE.FindAllStringSubmatch(template, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			params = append(params, match[1])
+		}
+	}
+
+	return params
+}
+
+// expandMacro replaces the parameters in args with their values. Values are
+// never expanded themselves, and always stay in the argument they're in.
+func expandMacro(args []string, values map[string]string) []string {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = macroParamRE.ReplaceAllStringFunc(arg, func(param string) string {
+			return values[param[1:len(param)-1]]
+		})
+	}
+
+	return expanded
+}
+
+// parseMacroArgs parses the name=value pairs passed to a macro, and checks that
+// they're exactly the macro's parameters.
+func parseMacroArgs(params []string, pairs []string) (map[string]string, error) {
+	known := map[string]bool{}
+	for _, param := range params {
+		known[param] = true
+	}
+
+	values := map[string]string{}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("bad parameter: %s, expecting: name=value", pair)
+		}
+
+		if !known[kv[0]] {
+			return nil, errors.Errorf("unknown parameter: %s, expecting: %s", kv[0], strings.Join(params, ", "))
+		}
+
+		if _, ok := values[kv[0]]; ok {
+			return nil, errors.Errorf("parameter given twice: %s", kv[0])
+		}
+
+		values[kv[0]] = kv[1]
+	}
+
+	var missing []string
+	for _, param := range params {
+		if _, ok := values[param]; !ok {
+			missing = append(missing, param)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, errors.Errorf("missing parameters: %s", strings.Join(missing, ", "))
+	}
+
+	return values, nil
+}
+
+// macros returns the names of the namespace's macros.
+func (cli *CLI) macros() ([]string, error) {
+	prefix := fmt.Sprintf("%s:macro:", cli.ns)
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, prefix))
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (cli *CLI) buildMacroCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "macro [save|run|list|show|del]",
+		Short: "save and run lumen commands with parameters",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "macro"}, "unrecognized macro command: %s, expecting: save|run|list|show|del", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "save [name] [command]",
+		Short: "save a command with {parameters}, e.g., save fx \"pay {amount} USD --from ops --to {to} --with EUR --max {max}\"",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "macro", "subcmd": "save"}
+			name := args[0]
+
+			if name == "" || strings.ContainsAny(name, ": ") {
+				cli.error(logFields, "bad macro name: %s", name)
+				return
+			}
+
+			command := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args[1]), "lumen "))
+			commandArgs, err := splitCommand(command)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			// Macros can be scheduled, but can't run macros (or themselves.)
+			if len(commandArgs) == 0 || commandArgs[0] == "macro" {
+				cli.error(logFields, "bad command: %s", command)
+				return
+			}
+
+			if found, _, err := cli.rootCmd.Find(commandArgs); err != nil || found == cli.rootCmd {
+				cli.error(logFields, "unknown command: %s", commandArgs[0])
+				return
+			}
+
+			if err := cli.SetVar("macro:"+name, command); err != nil {
+				cli.error(logFields, "could not save macro: %v", err)
+				return
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "run [name] [param=value]...",
+		Short: "run a macro, e.g., run fx amount=10 to=bob max=6",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "macro", "subcmd": "run"}
+
+			command, err := cli.GetVar("macro:" + args[0])
+			if err != nil {
+				cli.error(logFields, "no such macro: %s", args[0])
+				return
+			}
+
+			values, err := parseMacroArgs(macroParams(command), args[1:])
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			commandArgs, err := splitCommand(command)
+			if err != nil {
+				cli.error(logFields, "bad macro %s: %v", args[0], err)
+				return
+			}
+
+			commandArgs = expandMacro(commandArgs, values)
+			debugf(logFields, "running macro %s: %v", args[0], commandArgs)
+			if err := cli.runNested(commandArgs...); err != nil {
+				cli.error(logFields, "macro %s failed: %v", args[0], err)
+				return
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "list macros",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "macro", "subcmd": "list"}
+
+			names, err := cli.macros()
+			if err != nil {
+				cli.error(logFields, "could not load macros: %v", err)
+				return
+			}
+
+			for _, name := range names {
+				command, _ := cli.GetVar("macro:" + name)
+				showSuccess("%s: %s", name, command)
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show [name]",
+		Short: "show a macro and its parameters",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "macro", "subcmd": "show"}
+
+			command, err := cli.GetVar("macro:" + args[0])
+			if err != nil {
+				cli.error(logFields, "no such macro: %s", args[0])
+				return
+			}
+
+			showSuccess("command: %s", command)
+			showSuccess("params: %s", strings.Join(macroParams(command), " "))
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "del [name]",
+		Short: "delete a macro",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "macro", "subcmd": "del"}
+
+			if _, err := cli.GetVar("macro:" + args[0]); err != nil {
+				cli.error(logFields, "no such macro: %s", args[0])
+				return
+			}
+
+			if err := cli.DelVar("macro:" + args[0]); err != nil {
+				cli.error(logFields, "could not delete macro: %v", err)
+				return
+			}
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestMacros(t *testing.T) {
+	cli, memStore := newTestCLI()
+	cli.TestCommand("ns test")
+	cli.TestCommand("set config:network fake")
+
+	cli.TestCommand("account new ops")
+	cli.TestCommand("account new bob")
+	cli.TestCommand("account new issuer")
+	cli.TestCommand("asset set USD issuer")
+
+	// TestCommand splits on spaces, which the macros have.
+	run := func(args ...string) string {
+		cli.testing = true
+		defer func() { cli.testing = false }()
+		return cli.Run(args...)
+	}
+
+	run("macro", "save", "pay-usd", "lumen pay {amount} USD --from ops --to {to} --memotext '{memo}'")
+	run("macro", "save", "note", "set note:{name} \"{text} ({name})\"")
+
+	expectOutput(t, cli, "note: set note:{name} \"{text} ({name})\"\npay-usd: pay {amount} USD --from ops --to {to} --memotext '{memo}'", "macro list")
+	expectOutput(t, cli, "command: set note:{name} \"{text} ({name})\"\nparams: name text", "macro show note")
+
+	expectOutput(t, cli, "", "macro run pay-usd amount=10 to=bob memo=rent")
+
+	// Values stay in their argument, and aren't expanded themselves
+	if out := run("macro", "run", "note", "name=bob", "text=pays {name} rent"); out != "" {
+		t.Errorf("unexpected output: %v", out)
+	}
+	expectOutput(t, cli, "pays {name} rent (bob)", "get note:bob")
+
+	expectOutput(t, cli, "error", "macro run pay-usd amount=10 to=bob")
+	expectOutput(t, cli, "error", "macro run pay-usd amount=10 to=bob memo=rent max=5")
+	expectOutput(t, cli, "error", "macro run pay-usd amount=10 amount=20 to=bob memo=rent")
+	expectOutput(t, cli, "error", "macro run pay-usd 10 bob rent")
+	expectOutput(t, cli, "error", "macro run pay-usd amount=10 to=nobody memo=rent")
+	expectOutput(t, cli, "error", "macro run nothing")
+
+	if out := run("macro", "save", "loop", "macro run loop"); !strings.Contains(out, "error") {
+		t.Errorf("recursive macro saved: %v", out)
+	}
+	if out := run("macro", "save", "bad", "frobnicate {x}"); !strings.Contains(out, "error") {
+		t.Errorf("unknown command saved: %v", out)
+	}
+	if out := run("macro", "save", "bad", "pay 'unterminated"); !strings.Contains(out, "error") {
+		t.Errorf("bad command saved: %v", out)
+	}
+
+	// Macros live in the store, so they're shared with other lumens using it
+	other := NewCLI()
+	other.SetStore(memStore)
+	other.TestCommand("ns test")
+	expectOutput(t, other, "command: pay {amount} USD --from ops --to {to} --memotext '{memo}'\nparams: amount to memo", "macro show pay-usd")
+
+	cli.TestCommand("macro del note")
+	expectOutput(t, cli, "pay-usd: pay {amount} USD --from ops --to {to} --memotext '{memo}'", "macro list")
+	expectOutput(t, cli, "error", "macro del note")
+}
@@ -0,0 +1,529 @@
+package cli
+
+// This file contains the balance monitor, which keeps accounts within bounds.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// monitorRule keeps the balance of an asset in an account between Min and Max.
+// Amounts are strings, as entered.
+type monitorRule struct {
+	Account   string `json:"account"` // name
+	Asset     string `json:"asset"`   // name
+	Min       string `json:"min,omitempty"`
+	Max       string `json:"max,omitempty"`
+	Target    string `json:"target,omitempty"`     // what to top up or sweep to
+	TopUpFrom string `json:"topup_from,omitempty"` // account name
+	SweepTo   string `json:"sweep_to,omitempty"`   // account name
+	DailyCap  string `json:"daily_cap,omitempty"`  // for top-ups and sweeps, per UTC day
+}
+
+func monitorRuleKey(account string, asset string) string {
+	return fmt.Sprintf("monitor:rule:%s:%s", account, asset)
+}
+
+// monitorAlert is sent to the monitor's sinks when a balance crosses a bound,
+// or the monitor moves funds.
+type monitorAlert struct {
+	Account string `json:"account"`
+	Asset   string `json:"asset"`
+	Balance string `json:"balance"`
+	Min     string `json:"min,omitempty"`
+	Max     string `json:"max,omitempty"`
+	Status  string `json:"status"`           // ok, low, or high
+	Action  string `json:"action,omitempty"` // topup, sweep, or capped
+	Amount  string `json:"amount,omitempty"` // moved by the action
+	Error   string `json:"error,omitempty"`  // if the action failed
+}
+
+// validate checks the rule's amounts, and that it has what its actions need.
+func (r *monitorRule) validate() error {
+	amounts := map[string]int64{}
+	for _, field := range []struct {
+		flag  string
+		value string
+	}{{"min", r.Min}, {"max", r.Max}, {"target", r.Target}, {"daily-cap", r.DailyCap}} {
+		if field.value == "" {
+			continue
+		}
+
+		amount, err := microstellar.ParseAmount(field.value)
+		if err != nil || amount < 0 {
+			return errors.Errorf("bad --%s: %s", field.flag, field.value)
+		}
+		amounts[field.flag] = amount
+	}
+
+	if r.Min == "" && r.Max == "" {
+		return errors.Errorf("need --min or --max")
+	}
+
+	if r.Min != "" && r.Max != "" && amounts["min"] > amounts["max"] {
+		return errors.Errorf("--min is more than --max")
+	}
+
+	if r.Target != "" && ((r.Min != "" && amounts["target"] < amounts["min"]) || (r.Max != "" && amounts["target"] > amounts["max"])) {
+		return errors.Errorf("--target is out of bounds")
+	}
+
+	if r.TopUpFrom != "" && r.Min == "" {
+		return errors.Errorf("--topup-from needs --min")
+	}
+
+	if r.SweepTo != "" && r.Max == "" {
+		return errors.Errorf("--sweep-to needs --max")
+	}
+
+	return nil
+}
+
+// target returns what the rule tops up or sweeps to: Target if it's set, the
+// middle of the bounds if both are set, or the one bound that is.
+func (r *monitorRule) target() int64 {
+	if r.Target != "" {
+		amount, _ := microstellar.ParseAmount(r.Target)
+		return amount
+	}
+
+	min, _ := microstellar.ParseAmount(r.Min)
+	max, _ := microstellar.ParseAmount(r.Max)
+	switch {
+	case r.Min != "" && r.Max != "":
+		return (min + max) / 2
+	case r.Min != "":
+		return min
+	}
+
+	return max
+}
+
+func (r *monitorRule) describe() string {
+	parts := []string{r.Account, r.Asset}
+	for _, field := range []struct{ name, value string }{
+		{"min", r.Min}, {"max", r.Max}, {"target", r.Target}, {"topup-from", r.TopUpFrom}, {"sweep-to", r.SweepTo}, {"daily-cap", r.DailyCap},
+	} {
+		if field.value != "" {
+			parts = append(parts, field.name+":"+field.value)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// monitorRules returns the rules in the namespace, by account and asset.
+func (cli *CLI) monitorRules() ([]*monitorRule, error) {
+	keys, err := cli.store.Keys(fmt.Sprintf("%s:monitor:rule:", cli.ns))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	var rules []*monitorRule
+	for _, key := range keys {
+		data, err := cli.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		rule := &monitorRule{}
+		if err := json.Unmarshal([]byte(data), rule); err != nil {
+			return nil, errors.Errorf("bad monitor rule %s: %v", key, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// spentKey is where the amount moved for a rule on day is kept.
+func (cli *CLI) spentKey(rule *monitorRule, day time.Time) string {
+	return fmt.Sprintf("%s:monitor:spent:%s:%s:%s", cli.ns, rule.Account, rule.Asset, day.UTC().Format("2006-01-02"))
+}
+
+// spentToday returns the amount moved for the rule today (UTC), in stroops.
+func (cli *CLI) spentToday(rule *monitorRule) int64 {
+	data, err := cli.store.Get(cli.spentKey(rule, time.Now()))
+	if err != nil {
+		return 0
+	}
+
+	amount, _ := microstellar.ParseAmount(data)
+	return amount
+}
+
+// addSpent records that amount was moved for the rule today. The records
+// expire once they can't matter anymore.
+func (cli *CLI) addSpent(rule *monitorRule, amount int64) error {
+	total := cli.spentToday(rule) + amount
+	return cli.store.Set(cli.spentKey(rule, time.Now()), microstellar.ToAmountString(total), 48*time.Hour)
+}
+
+// balanceMonitor checks rules, and remembers their status between checks so
+// it only alerts when a bound is crossed.
+type balanceMonitor struct {
+	cli      *CLI
+	cmd      *cobra.Command // for the transaction options, e.g., --nosubmit
+	sinks    []*sinkDelivery
+	statuses map[string]string // by rule key
+}
+
+// check compares the rule's account balance against its bounds, and tops up
+// or sweeps it if the rule says to. accounts caches loaded accounts by name.
+func (m *balanceMonitor) check(rule *monitorRule, accounts map[string]*microstellar.Account) error {
+	cli := m.cli
+	fields := logrus.Fields{"cmd": "monitor", "subcmd": "run", "account": rule.Account, "asset": rule.Asset}
+
+	asset, err := cli.ResolveAsset(rule.Asset)
+	if err != nil {
+		return errors.Errorf("%s: bad asset: %s", rule.Account, rule.Asset)
+	}
+
+	account, ok := accounts[rule.Account]
+	if !ok {
+		address, err := cli.ResolveAccount(fields, rule.Account, "address")
+		if err == nil {
+			address, err = addressOf(address)
+		}
+
+		if err != nil {
+			return errors.Errorf("%s: bad account", rule.Account)
+		}
+
+		if account, err = cli.ms.LoadAccount(address); err != nil {
+			return errors.Errorf("%s: can't load account: %v", rule.Account, microstellar.ErrorString(err))
+		}
+		accounts[rule.Account] = account
+	}
+
+	balanceStr := account.GetBalance(asset)
+	if balanceStr == "" {
+		return errors.Errorf("%s: no balance for %s", rule.Account, rule.Asset)
+	}
+
+	balance, err := microstellar.ParseAmount(balanceStr)
+	if err != nil {
+		return errors.Errorf("%s: bad balance for %s: %s", rule.Account, rule.Asset, balanceStr)
+	}
+
+	alert := &monitorAlert{Account: rule.Account, Asset: rule.Asset, Balance: microstellar.ToAmountString(balance), Min: rule.Min, Max: rule.Max, Status: "ok"}
+	min, _ := microstellar.ParseAmount(rule.Min)
+	max, _ := microstellar.ParseAmount(rule.Max)
+
+	if rule.Min != "" && balance < min {
+		alert.Status = "low"
+		m.log(fields, "%s %s: balance %s is below min %s", rule.Account, rule.Asset, alert.Balance, microstellar.ToAmountString(min))
+	} else if rule.Max != "" && balance > max {
+		alert.Status = "high"
+		m.log(fields, "%s %s: balance %s is above max %s", rule.Account, rule.Asset, alert.Balance, microstellar.ToAmountString(max))
+	}
+
+	key := monitorRuleKey(rule.Account, rule.Asset)
+	crossed := m.statuses[key] != alert.Status && (alert.Status != "ok" || m.statuses[key] != "")
+	m.statuses[key] = alert.Status
+
+	if alert.Status == "low" && rule.TopUpFrom != "" {
+		m.move(fields, rule, alert, "topup", rule.TopUpFrom, rule.Account, rule.target()-balance, asset)
+		delete(accounts, rule.Account)
+		delete(accounts, rule.TopUpFrom)
+	} else if alert.Status == "high" && rule.SweepTo != "" {
+		m.move(fields, rule, alert, "sweep", rule.Account, rule.SweepTo, balance-rule.target(), asset)
+		delete(accounts, rule.Account)
+		delete(accounts, rule.SweepTo)
+	} else if alert.Status == "ok" && crossed {
+		m.log(fields, "%s %s: balance %s is back within bounds", rule.Account, rule.Asset, alert.Balance)
+	}
+
+	if !crossed && alert.Action == "" {
+		return nil
+	}
+
+	event := &watchEvent{Type: "monitor", Account: account.Address, Alias: rule.Account,
+		PagingToken: fmt.Sprintf("%s:%s:%d", rule.Account, rule.Asset, time.Now().UnixNano()), Data: alert}
+
+	for _, sink := range m.sinks {
+		if err := sink.deliver(cli.ctx, fields, event); err != nil {
+			logrus.WithFields(fields).Errorf("could not send alert: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// move pays amount (in stroops) of asset from one account to another, within
+// the rule's daily cap, and records what happened in the alert.
+func (m *balanceMonitor) move(fields logrus.Fields, rule *monitorRule, alert *monitorAlert, action string, from string, to string, amount int64, asset *microstellar.Asset) {
+	cli := m.cli
+	alert.Action = action
+
+	if rule.DailyCap != "" {
+		dailyCap, _ := microstellar.ParseAmount(rule.DailyCap)
+		if left := dailyCap - cli.spentToday(rule); left < amount {
+			amount = left
+		}
+
+		if amount <= 0 {
+			alert.Action = "capped"
+			m.log(fields, "%s %s: daily cap of %s reached, not moving funds", rule.Account, rule.Asset, rule.DailyCap)
+			return
+		}
+	}
+
+	if amount <= 0 {
+		alert.Action = ""
+		return
+	}
+
+	alert.Amount = microstellar.ToAmountString(amount)
+	source, err := cli.ResolveAccount(fields, from, "seed")
+	if err != nil {
+		alert.Error = fmt.Sprintf("no seed for %s", from)
+	}
+
+	target := ""
+	if err == nil {
+		target, err = cli.ResolveAccount(fields, to, "address")
+		if err == nil {
+			target, err = addressOf(target)
+		}
+
+		if err != nil {
+			alert.Error = fmt.Sprintf("bad account: %s", to)
+		}
+	}
+
+	var opts *microstellar.Options
+	if err == nil {
+		if opts, err = cli.genTxOptions(m.cmd, fields); err != nil {
+			alert.Error = err.Error()
+		}
+	}
+
+	if err == nil {
+		if err = cli.ms.Pay(source, target, alert.Amount, asset, opts.WithMemoText("lumen monitor "+action)); err != nil {
+			alert.Error = microstellar.ErrorString(err)
+		}
+	}
+
+	if alert.Error != "" {
+		logrus.WithFields(fields).Errorf("%s %s: %s of %s failed: %s", rule.Account, rule.Asset, action, alert.Amount, alert.Error)
+		showSuccess("%s %s: %s of %s failed: %s", rule.Account, rule.Asset, action, alert.Amount, alert.Error)
+		return
+	}
+
+	// The signed transaction was printed instead of submitted, so nothing moved
+	if nosubmit, _ := cli.rootCmd.Flags().GetBool("nosubmit"); nosubmit {
+		m.log(fields, "%s %s: %s of %s not submitted", rule.Account, rule.Asset, action, alert.Amount)
+		return
+	}
+
+	if err := cli.addSpent(rule, amount); err != nil {
+		logrus.WithFields(fields).Errorf("could not record daily total: %v", err)
+	}
+
+	if action == "topup" {
+		m.log(fields, "%s %s: topped up %s from %s", rule.Account, rule.Asset, alert.Amount, from)
+	} else {
+		m.log(fields, "%s %s: swept %s to %s", rule.Account, rule.Asset, alert.Amount, to)
+	}
+}
+
+// log shows what the monitor saw or did, and logs it.
+func (m *balanceMonitor) log(fields logrus.Fields, msg string, args ...interface{}) {
+	logrus.WithFields(fields).Infof(msg, args...)
+	showSuccess(msg, args...)
+}
+
+func (cli *CLI) buildMonitorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "monitor [set|del|list|run]",
+		Short: "keep account balances within bounds",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "monitor"}, "unrecognized monitor command: %s, expecting: set|del|list|run", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildMonitorSetCmd())
+	cmd.AddCommand(cli.buildMonitorDelCmd())
+	cmd.AddCommand(cli.buildMonitorListCmd())
+	cmd.AddCommand(cli.buildMonitorRunCmd())
+
+	return cmd
+}
+
+func (cli *CLI) buildMonitorSetCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "set [account] [asset] [--min amount] [--max amount] [--topup-from account] [--sweep-to account] [--daily-cap amount]",
+		Short: "set the bounds for an asset's balance in an account",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "monitor", "subcmd": "set"}
+			rule := &monitorRule{Account: args[0], Asset: args[1]}
+
+			if _, err := cli.ResolveAccount(logFields, rule.Account, "address"); err != nil {
+				cli.error(logFields, "invalid account: %s", rule.Account)
+				return
+			}
+
+			if _, err := cli.ResolveAsset(rule.Asset); err != nil {
+				cli.error(logFields, "invalid asset: %s", rule.Asset)
+				return
+			}
+
+			rule.Min, _ = cmd.Flags().GetString("min")
+			rule.Max, _ = cmd.Flags().GetString("max")
+			rule.Target, _ = cmd.Flags().GetString("target")
+			rule.TopUpFrom, _ = cmd.Flags().GetString("topup-from")
+			rule.SweepTo, _ = cmd.Flags().GetString("sweep-to")
+			rule.DailyCap, _ = cmd.Flags().GetString("daily-cap")
+
+			if err := rule.validate(); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if rule.TopUpFrom != "" {
+				if _, err := cli.ResolveAccount(logFields, rule.TopUpFrom, "seed"); err != nil {
+					cli.error(logFields, "no seed for --topup-from: %s", rule.TopUpFrom)
+					return
+				}
+			}
+
+			if rule.SweepTo != "" {
+				if _, err := cli.ResolveAccount(logFields, rule.SweepTo, "address"); err != nil {
+					cli.error(logFields, "invalid --sweep-to: %s", rule.SweepTo)
+					return
+				}
+			}
+
+			data, _ := json.Marshal(rule)
+			if err := cli.SetVar(monitorRuleKey(rule.Account, rule.Asset), string(data)); err != nil {
+				cli.error(logFields, "could not save rule: %v", err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().String("min", "", "alert (and top up) when the balance is below this")
+	cmd.Flags().String("max", "", "alert (and sweep) when the balance is above this")
+	cmd.Flags().String("target", "", "top up or sweep to this balance (default: halfway between --min and --max)")
+	cmd.Flags().String("topup-from", "", "top up from this account when the balance is low")
+	cmd.Flags().String("sweep-to", "", "sweep the excess into this account when the balance is high")
+	cmd.Flags().String("daily-cap", "", "move at most this much a day (UTC) for this rule")
+	return cmd
+}
+
+func (cli *CLI) buildMonitorDelCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "del [account] [asset]",
+		Short: "stop monitoring an asset's balance in an account",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "monitor", "subcmd": "del"}
+			key := monitorRuleKey(args[0], args[1])
+
+			if _, err := cli.GetVar(key); err != nil {
+				cli.error(logFields, "no rule for %s %s", args[0], args[1])
+				return
+			}
+
+			if err := cli.DelVar(key); err != nil {
+				cli.error(logFields, "could not delete rule: %v", err)
+				return
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildMonitorListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "list the monitored balances",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "monitor", "subcmd": "list"}
+
+			rules, err := cli.monitorRules()
+			if err != nil {
+				cli.error(logFields, "could not load rules: %v", err)
+				return
+			}
+
+			for _, rule := range rules {
+				showSuccess("%s", rule.describe())
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildMonitorRunCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run [--interval 1m] [--once] [--webhook url] [--exec command]",
+		Short: "check the monitored balances every interval, alerting and moving funds as needed",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "monitor", "subcmd": "run"}
+
+			sinks, err := cli.watchSinks(cmd)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			interval, _ := cmd.Flags().GetDuration("interval")
+			once, _ := cmd.Flags().GetBool("once")
+			monitor := &balanceMonitor{cli: cli, cmd: cmd, sinks: sinks, statuses: map[string]string{}}
+
+			for {
+				rules, err := cli.monitorRules()
+				if err != nil {
+					cli.error(logFields, "could not load rules: %v", err)
+					return
+				}
+
+				if len(rules) == 0 {
+					cli.error(logFields, "nothing to monitor, see: lumen monitor set")
+					return
+				}
+
+				failed := false
+				accounts := map[string]*microstellar.Account{}
+				for _, rule := range rules {
+					if err := monitor.check(rule, accounts); err != nil {
+						logrus.WithFields(logFields).Errorf("%v", err)
+						failed = true
+					}
+				}
+
+				if once {
+					if failed {
+						cli.error(logFields, "some balances could not be checked")
+					}
+					return
+				}
+
+				if !sleepContext(cli.ctx, interval) {
+					debugf(logFields, "stopped monitoring: %v", cli.ctx.Err())
+					return
+				}
+			}
+		},
+	}
+
+	cmd.Flags().Duration("interval", time.Minute, "time between checks")
+	cmd.Flags().Bool("once", false, "check once and exit")
+	buildFlagsForSinks(cmd, "skip the alert")
+	return cmd
+}
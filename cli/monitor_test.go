@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestMonitor(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new hot")
+	cli.TestCommand("account new treasury")
+	cli.TestCommand("account new cold")
+	cli.TestCommand("asset set USD treasury")
+	hot := strings.TrimSpace(cli.TestCommand("account address hot"))
+	treasury := strings.TrimSpace(cli.TestCommand("account address treasury"))
+
+	var mutex sync.Mutex
+	submits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/transactions":
+			mutex.Lock()
+			submits++
+			mutex.Unlock()
+			w.Write([]byte(`{"hash": "ok", "ledger": 10}`))
+		case r.URL.Path == "/accounts/"+hot:
+			fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "100", "balances": [`+
+				`{"balance": "5.0000000", "asset_type": "credit_alphanum4", "asset_code": "USD", "asset_issuer": "%s"}, `+
+				`{"balance": "300.0000000", "asset_type": "native"}]}`, hot, hot, treasury)
+		case r.URL.Path == "/accounts/"+treasury:
+			fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "200", "balances": [{"balance": "1000.0000000", "asset_type": "native"}]}`, treasury, treasury)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	expectOutput(t, cli, "error", "monitor run --once")
+
+	// Nothing is submitted or counted against the daily cap with --nosubmit
+	cli.TestCommand("monitor set hot USD --min 10 --max 50 --topup-from treasury --daily-cap 30")
+	out := cli.TestCommand("monitor run --once --nosubmit")
+	if !strings.Contains(out, "hot USD: topup of 25.0000000 not submitted") || submits != 0 {
+		t.Errorf("unexpected output: %v (%d submits)", out, submits)
+	}
+	if out := cli.TestCommand("journal list --status unsubmitted"); strings.Count(out, "\n") != 1 {
+		t.Errorf("want 1 unsubmitted journal entry, got: %v", out)
+	}
+
+	cli.TestCommand("monitor set hot USD --min 10 --max 50 --topup-from treasury --daily-cap 30")
+	cli.TestCommand("monitor set hot native --max 100 --sweep-to cold")
+	expectOutput(t, cli, "hot USD min:10 max:50 topup-from:treasury daily-cap:30\nhot native max:100 sweep-to:cold", "monitor list")
+
+	dir, _ := ioutil.TempDir("", "lumen-monitor")
+	defer os.RemoveAll(dir)
+	alerts := filepath.Join(dir, "alerts")
+
+	// TestCommand splits on spaces, which the shell command has.
+	cli.testing = true
+	out = cli.Run("monitor", "run", "--once", "--exec", "printenv LUMEN_ALIAS LUMEN_ASSET LUMEN_STATUS LUMEN_ACTION LUMEN_AMOUNT >> "+alerts)
+	cli.testing = false
+
+	want := []string{
+		"hot USD: balance 5.0000000 is below min 10.0000000",
+		"hot USD: topped up 25.0000000 from treasury",
+		"hot native: balance 300.0000000 is above max 100.0000000",
+		"hot native: swept 200.0000000 to cold",
+	}
+	if strings.TrimSpace(out) != strings.Join(want, "\n") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if submits != 2 {
+		t.Errorf("want 2 payments, got %d", submits)
+	}
+
+	data, _ := ioutil.ReadFile(alerts)
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "hot USD low topup 25.0000000 hot native high sweep 200.0000000" {
+		t.Errorf("unexpected alerts: %v", got)
+	}
+
+	// The payments are journaled
+	if lines := strings.Split(strings.TrimSpace(cli.TestCommand("journal list --status confirmed")), "\n"); len(lines) != 2 {
+		t.Errorf("want 2 journal entries, got: %v", lines)
+	}
+
+	// The balance is still low (the fake horizon doesn't move money), so the
+	// top-ups stop at the daily cap.
+	out = cli.TestCommand("monitor run --once")
+	if !strings.Contains(out, "hot USD: topped up 5.0000000 from treasury") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	out = cli.TestCommand("monitor run --once")
+	if !strings.Contains(out, "hot USD: daily cap of 30 reached, not moving funds") || !strings.Contains(out, "hot native: swept 200.0000000 to cold") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "monitor set hot USD")
+	expectOutput(t, cli, "error", "monitor set hot USD --min 10 --max 5")
+	expectOutput(t, cli, "error", "monitor set hot USD --max 5 --topup-from treasury")
+	expectOutput(t, cli, "error", "monitor set hot USD --min 5 --target 1")
+	expectOutput(t, cli, "error", "monitor set hot USD --min lots")
+	expectOutput(t, cli, "error", "monitor set nobody USD --min 5")
+
+	cli.TestCommand("monitor del hot USD")
+	expectOutput(t, cli, "hot native max:100 sweep-to:cold", "monitor list")
+	expectOutput(t, cli, "error", "monitor del hot USD")
+}
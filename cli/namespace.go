@@ -0,0 +1,425 @@
+package cli
+
+// This file implements namespace inheritance. A namespace can have a parent,
+// stored in the global var ns:NAME:parent, and GetVar falls back to the parent
+// (and its parent, and so on) for aliases and configuration that aren't set
+// locally. Writes always go to the current namespace.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// inheritedPrefixes are the keys that namespaces inherit from their parents.
+// Everything else (cursors, invoices, ledgers, caches, etc.) is state that
+// belongs to a single namespace.
+var inheritedPrefixes = []string{"account:", "asset:", "vars:"}
+
+func isInheritedKey(key string) bool {
+	for _, prefix := range inheritedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nsParentKey(ns string) string {
+	return fmt.Sprintf("ns:%s:parent", ns)
+}
+
+// nsChain returns ns followed by its ancestors, nearest first. It stops at
+// the first namespace it has already seen, in case the store has a loop.
+func (cli *CLI) nsChain(ns string) []string {
+	var chain []string
+	seen := map[string]bool{}
+	for !seen[ns] {
+		seen[ns] = true
+		chain = append(chain, ns)
+
+		parent, err := cli.GetGlobalVar(nsParentKey(ns))
+		if err != nil {
+			break
+		}
+		ns = parent
+	}
+
+	return chain
+}
+
+// setNSParent makes parent the parent of ns, or removes the parent of ns if
+// parent is empty.
+func (cli *CLI) setNSParent(ns string, parent string) error {
+	if parent == "" {
+		return cli.store.Delete("global:" + nsParentKey(ns))
+	}
+
+	for _, ancestor := range cli.nsChain(parent) {
+		if ancestor == ns {
+			return errors.Errorf("%s can't inherit from %s: %s already inherits from %s", ns, parent, parent, ns)
+		}
+	}
+
+	return cli.SetGlobalVar(nsParentKey(ns), parent)
+}
+
+// effectiveVars returns the keys under prefix that GetVar can see (without the
+// namespace), mapped to the namespace that each one comes from.
+func (cli *CLI) effectiveVars(prefix string) (map[string]string, error) {
+	vars := map[string]string{}
+	for i, ns := range cli.nsChain(cli.ns) {
+		keys, err := cli.store.Keys(fmt.Sprintf("%s:%s", ns, prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			key = strings.TrimPrefix(key, ns+":")
+			if i > 0 && !isInheritedKey(key) {
+				continue
+			}
+
+			if _, ok := vars[key]; !ok {
+				vars[key] = ns
+			}
+		}
+	}
+
+	return vars, nil
+}
+
+func validNSName(ns string) error {
+	if ns == "" || strings.ContainsAny(ns, ": ") {
+		return errors.Errorf("invalid namespace: %q", ns)
+	}
+
+	// Global keys (like the namespace parents) are stored as if "global" were
+	// a namespace.
+	if ns == "global" {
+		return errors.Errorf("reserved namespace: %s", ns)
+	}
+
+	return nil
+}
+
+func (cli *CLI) buildNSCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create [namespace]",
+		Short: "create [namespace], optionally inheriting from another namespace",
+		Long: `Create [namespace]. With --parent, accounts, assets, and variables (including
+configuration) that aren't set in [namespace] are read from the parent namespace
+(and its parents), so shared ones only need to be set once. Writes always stay
+in [namespace], and everything else, like invoices, sub-accounts, and watch
+checkpoints, isn't inherited.
+
+Running create on an existing namespace replaces its parent.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "create"}
+			ns := args[0]
+			parent, _ := cmd.Flags().GetString("parent")
+
+			if err := validNSName(ns); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if parent != "" {
+				if err := validNSName(parent); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+			}
+
+			if err := cli.setNSParent(ns, parent); err != nil {
+				cli.error(logFields, "could not create namespace: %v", err)
+				return
+			}
+
+			// Inherited aliases change, so descendants need new reverse indexes
+			cli.invalidateAliasIndexes(ns)
+			debugf(logFields, "created %s (parent: %q)", ns, parent)
+		},
+	}
+
+	cmd.Flags().String("parent", "", "namespace to inherit keys from")
+	return cmd
+}
+
+func (cli *CLI) buildNSShowCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show [namespace]",
+		Short: "show the effective keys in [namespace] (default: current) and where they come from",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "show"}
+			if len(args) > 0 {
+				defer func(ns string) { cli.ns = ns }(cli.ns)
+				cli.ns = args[0]
+			}
+
+			vars, err := cli.effectiveVars("")
+			if err != nil {
+				cli.error(logFields, "could not list keys: %v", err)
+				return
+			}
+
+			var keys []string
+			for key := range vars {
+				// The reverse alias index is local bookkeeping, not a setting
+				if !strings.HasPrefix(key, "rev:") {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+
+			showSuccess("namespace: %s", strings.Join(cli.nsChain(cli.ns), " -> "))
+			for _, key := range keys {
+				value, err := cli.store.Get(fmt.Sprintf("%s:%s", vars[key], key))
+				if err != nil {
+					continue
+				}
+
+				if microstellar.ValidSeed(value) == nil {
+					value = "(seed)"
+				}
+				showSuccess("%s: %s (%s)", key, value, vars[key])
+			}
+		},
+	}
+}
+
+// nsDescendants returns the namespaces that inherit from ns, directly or
+// through other namespaces.
+func (cli *CLI) nsDescendants(ns string) []string {
+	keys, err := cli.store.Keys("global:ns:")
+	if err != nil {
+		return nil
+	}
+
+	var descendants []string
+	for _, key := range keys {
+		child := strings.TrimSuffix(strings.TrimPrefix(key, "global:ns:"), ":parent")
+		if child == ns || !strings.HasSuffix(key, ":parent") {
+			continue
+		}
+
+		for _, ancestor := range cli.nsChain(child)[1:] {
+			if ancestor == ns {
+				descendants = append(descendants, child)
+				break
+			}
+		}
+	}
+
+	return descendants
+}
+
+// childNamespaces returns the namespaces whose parent is ns.
+func (cli *CLI) childNamespaces(ns string) ([]string, error) {
+	keys, err := cli.store.Keys("global:ns:")
+	if err != nil {
+		return nil, err
+	}
+
+	var children []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ":parent") {
+			continue
+		}
+
+		if parent, err := cli.store.Get(key); err == nil && parent == ns {
+			children = append(children, strings.TrimSuffix(strings.TrimPrefix(key, "global:ns:"), ":parent"))
+		}
+	}
+
+	return children, nil
+}
+
+// deleteNS deletes every key in namespace ns, and its parent.
+func (cli *CLI) deleteNS(ns string) error {
+	keys, err := cli.store.Keys(ns + ":")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := cli.store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return cli.setNSParent(ns, "")
+}
+
+// copyNS copies the keys (including seeds) and parent of namespace from to
+// namespace to. See writeNSKeys for onConflict.
+func (cli *CLI) copyNS(from string, to string, onConflict string) (int, error) {
+	for _, ns := range []string{from, to} {
+		if err := validNSName(ns); err != nil {
+			return 0, err
+		}
+	}
+
+	if from == to {
+		return 0, errors.Errorf("can't copy %s to itself", from)
+	}
+
+	vars, expires, err := cli.nsKeys(from, true)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := cli.writeNSKeys(to, vars, expires, onConflict)
+	if err != nil {
+		return 0, err
+	}
+
+	parent, err := cli.GetGlobalVar(nsParentKey(from))
+	if err != nil {
+		return n, nil
+	}
+
+	// Keep the parent that to already has, if any
+	if _, err := cli.GetGlobalVar(nsParentKey(to)); err == nil {
+		return n, nil
+	}
+
+	return n, cli.setNSParent(to, parent)
+}
+
+func (cli *CLI) buildNSCopyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "copy [from] [to]",
+		Short: "copy the keys (including seeds) in namespace [from] to namespace [to]",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "copy"}
+			onConflict, _ := cmd.Flags().GetString("on-conflict")
+
+			n, err := cli.copyNS(args[0], args[1], onConflict)
+			if err != nil {
+				cli.error(logFields, "could not copy %s: %v", args[0], err)
+				return
+			}
+
+			showSuccess("copied %d keys from %s to %s", n, args[0], args[1])
+		},
+	}
+
+	cmd.Flags().String("on-conflict", "fail", "what to do with keys [to] already has: fail, skip, or overwrite")
+	return cmd
+}
+
+func (cli *CLI) buildNSRenameCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "rename [from] [to]",
+		Short: "rename namespace [from] to [to], which must be empty",
+		Long: `Rename namespace [from] to [to], which must be empty. Namespaces that inherit from
+[from] inherit from [to] instead, and if [from] is the current namespace, [to]
+becomes the current namespace.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "rename"}
+			from, to := args[0], args[1]
+
+			for _, ns := range []string{from, to} {
+				if err := validNSName(ns); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+			}
+
+			if keys, err := cli.store.Keys(to + ":"); err != nil || len(keys) > 0 {
+				cli.error(logFields, "namespace %s isn't empty", to)
+				return
+			}
+
+			children, err := cli.childNamespaces(from)
+			if err != nil {
+				cli.error(logFields, "could not list namespaces: %v", err)
+				return
+			}
+
+			if _, err := cli.copyNS(from, to, "fail"); err != nil {
+				cli.error(logFields, "could not rename %s: %v", from, err)
+				return
+			}
+
+			for _, child := range children {
+				if err := cli.SetGlobalVar(nsParentKey(child), to); err != nil {
+					cli.error(logFields, "could not move %s to %s: %v", child, to, err)
+					return
+				}
+			}
+
+			if err := cli.deleteNS(from); err != nil {
+				cli.error(logFields, "copied %s to %s, but could not delete %s: %v", from, to, from, err)
+				return
+			}
+
+			if current, err := cli.GetGlobalVar("ns"); err == nil && current == from {
+				cli.SetGlobalVar("ns", to)
+			}
+
+			if cli.ns == from {
+				cli.ns = to
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildNSDeleteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delete [namespace]",
+		Short: "delete all the keys (including seeds) in [namespace]",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "delete"}
+			ns := args[0]
+
+			if err := validNSName(ns); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			children, err := cli.childNamespaces(ns)
+			if err != nil {
+				cli.error(logFields, "could not list namespaces: %v", err)
+				return
+			}
+
+			if len(children) > 0 {
+				cli.error(logFields, "can't delete %s: %s inherit from it", ns, strings.Join(children, ", "))
+				return
+			}
+
+			keys, err := cli.store.Keys(ns + ":")
+			if err != nil {
+				cli.error(logFields, "could not list keys: %v", err)
+				return
+			}
+
+			question := fmt.Sprintf("Delete namespace %s and its %d keys?", ns, len(keys))
+			if yes, _ := cmd.Flags().GetBool("yes"); !yes && !confirm(question) {
+				cli.error(logFields, "cancelled")
+				return
+			}
+
+			if err := cli.deleteNS(ns); err != nil {
+				cli.error(logFields, "could not delete %s: %v", ns, err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().Bool("yes", false, "don't ask for confirmation")
+	return cmd
+}
@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestNamespaces(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns company")
+	cli.TestCommand("set config:network fake")
+	cli.TestCommand("account new citibank")
+	cli.TestCommand("asset set USD citibank")
+	issuer := strings.TrimSpace(cli.TestCommand("account address citibank"))
+
+	expectOutput(t, cli, "", "ns create team-a --parent company")
+	expectOutput(t, cli, "", "ns create alice --parent team-a")
+	expectOutput(t, cli, "error", "ns create company --parent alice")
+	expectOutput(t, cli, "error", "ns create team-b --parent a:b")
+	expectOutput(t, cli, "error", "ns create global --parent company")
+	expectOutput(t, cli, "error", "ns create team-b --parent global")
+
+	// Reads fall back to the parents
+	cli.TestCommand("ns alice")
+	expectOutput(t, cli, issuer, "account address citibank")
+	expectOutput(t, cli, "USD", "asset code USD")
+	expectOutput(t, cli, "fake", "get config:network")
+	if accounts, _ := cli.listAccounts(); strings.Join(accounts, ",") != "citibank" {
+		t.Errorf("want inherited accounts, got %v", accounts)
+	}
+	if assets, _ := cli.listAssets(); strings.Join(assets, ",") != "USD" {
+		t.Errorf("want inherited assets, got %v", assets)
+	}
+
+	// Writes stay local
+	cli.TestCommand("ns team-a")
+	cli.TestCommand("set config:network test")
+	cli.TestCommand("account set boss " + issuer)
+	expectOutput(t, cli, "test", "get config:network")
+	if accounts, _ := cli.listAccounts(); strings.Join(accounts, ",") != "boss,citibank" {
+		t.Errorf("want local and inherited accounts, got %v", accounts)
+	}
+
+	cli.TestCommand("ns company")
+	expectOutput(t, cli, "fake", "get config:network")
+	expectOutput(t, cli, "error", "account address boss")
+
+	cli.TestCommand("ns alice")
+	expectOutput(t, cli, "test", "get config:network")
+	if names := cli.namer().names(issuer); strings.Join(names, ",") != "boss,citibank" {
+		t.Errorf("want inherited names, got %v", names)
+	}
+
+	// Deleting an inherited key only deletes the local copy
+	cli.TestCommand("ns team-a")
+	cli.TestCommand("account set citibank GBY7XDYKXBDHQ2B523SF7K6BNJNRYHVQMWY7AYAEKTYLCQMYVFHL57UM")
+	expectOutput(t, cli, "GBY7XDYKXBDHQ2B523SF7K6BNJNRYHVQMWY7AYAEKTYLCQMYVFHL57UM", "account address citibank")
+	cli.TestCommand("account del citibank")
+	expectOutput(t, cli, issuer, "account address citibank")
+
+	expectOutput(t, cli, "namespace: alice -> team-a -> company\n"+
+		"account:boss:address: "+issuer+" (team-a)\n"+
+		"account:citibank:address: "+issuer+" (company)\n"+
+		"account:citibank:seed: (seed) (company)\n"+
+		"asset:USD:code: USD (company)\n"+
+		"asset:USD:issuer: "+issuer+" (company)\n"+
+		"asset:USD:type: credit_alphanum4 (company)\n"+
+		"vars:config:network: test (team-a)", "ns show alice")
+	expectOutput(t, cli, "team-a", "ns")
+
+	// Dropping the parent stops the fallback
+	cli.TestCommand("ns create team-a")
+	expectOutput(t, cli, "error", "account address citibank")
+	cli.TestCommand("ns alice")
+	expectOutput(t, cli, "error", "account address citibank")
+	expectOutput(t, cli, issuer, "account address boss")
+}
+
+func TestNamespaceCopy(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns company")
+	cli.TestCommand("account new citibank")
+	citibank := strings.TrimSpace(cli.TestCommand("account address citibank"))
+	cli.TestCommand("ns create prod --parent company")
+	cli.TestCommand("ns prod")
+	cli.TestCommand("account new mo")
+	cli.TestCommand("set config:network public")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	seed := strings.TrimSpace(cli.TestCommand("account seed mo"))
+
+	expectOutput(t, cli, "copied 3 keys from prod to staging", "ns copy prod staging")
+	expectOutput(t, cli, "error", "ns copy prod staging")
+	expectOutput(t, cli, "error", "ns copy prod prod")
+	expectOutput(t, cli, "error", "ns copy prod global")
+	expectOutput(t, cli, "error", "ns copy global prod")
+	cli.TestCommand("ns staging")
+	expectOutput(t, cli, seed, "account seed mo")
+	expectOutput(t, cli, "public", "get config:network")
+	expectOutput(t, cli, citibank, "account address citibank")
+
+	cli.TestCommand("ns create child --parent prod")
+	expectOutput(t, cli, "error", "ns rename prod staging")
+	expectOutput(t, cli, "", "ns rename prod live")
+	expectOutput(t, cli, "staging", "ns")
+
+	cli.TestCommand("ns child")
+	expectOutput(t, cli, mo, "account address mo")
+	if out := cli.TestCommand("ns show"); !strings.HasPrefix(out, "namespace: child -> live -> company\n") {
+		t.Errorf("want child moved to live, got %v", out)
+	}
+
+	cli.TestCommand("ns live")
+	expectOutput(t, cli, "", "ns rename live prod")
+	expectOutput(t, cli, "prod", "ns")
+	expectOutput(t, cli, seed, "account seed mo")
+	expectOutput(t, cli, "error", "ns delete live --yes")
+
+	expectOutput(t, cli, "error", "ns delete prod --yes")
+	expectOutput(t, cli, "error", "ns rename prod global")
+	expectOutput(t, cli, "error", "ns rename global other")
+	expectOutput(t, cli, "error", "ns delete global --yes")
+	expectOutput(t, cli, "prod", "ns")
+	cli.TestCommand("ns delete child --yes")
+	expectOutput(t, cli, "", "ns delete prod --yes")
+	expectOutput(t, cli, "error", "account address mo")
+	expectOutput(t, cli, "error", "account address citibank")
+}
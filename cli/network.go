@@ -0,0 +1,372 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stellar/go/build"
+	"github.com/stellar/go/network"
+)
+
+// Horizon servers for the built-in networks.
+const (
+	publicHorizonURL = "https://horizon.stellar.org"
+	testHorizonURL   = "https://horizon-testnet.stellar.org"
+)
+
+// parseNetworkSpec splits a network spec (as accepted by microstellar.NewFromSpec)
+// into its name, horizon URL, and passphrase.
+//
+//	"test" => test, https://horizon-testnet.stellar.org, "Test SDF Network ; September 2015"
+//	"custom;https://foobar.com;passphrase" => custom, https://foobar.com, passphrase
+func parseNetworkSpec(spec string) (name string, url string, passphrase string) {
+	parts := strings.SplitN(spec, ";", 3)
+	name = parts[0]
+
+	switch name {
+	case "public":
+		return name, publicHorizonURL, network.PublicNetworkPassphrase
+	case "custom":
+		if len(parts) == 3 {
+			return name, parts[1], parts[2]
+		}
+	}
+
+	// microstellar falls back to the test network for anything it doesn't know about
+	return name, testHorizonURL, network.TestNetworkPassphrase
+}
+
+// networkSpecWithPassphrase returns a custom network spec that talks to the same
+// horizon server as spec, but signs with passphrase.
+func networkSpecWithPassphrase(spec string, passphrase string) string {
+	_, url, _ := parseNetworkSpec(spec)
+	return strings.Join([]string{"custom", url, passphrase}, ";")
+}
+
+// networkPassphrase returns the passphrase of the network lumen is operating on.
+func (cli *CLI) networkPassphrase() string {
+	_, _, passphrase := parseNetworkSpec(cli.network)
+	return passphrase
+}
+
+// horizonURL returns the URL of the horizon server lumen is operating on.
+func (cli *CLI) horizonURL() string {
+	_, url, _ := parseNetworkSpec(cli.network)
+	return url
+}
+
+// networkDef is a named network registered with "lumen network add". Networks
+// are stored in the global namespace, under network:NAME:*.
+type networkDef struct {
+	name       string
+	horizon    []string // the first URL is the primary
+	passphrase string
+	friendbot  string
+	baseFee    uint32 // in stroops per operation, 0 for default
+}
+
+// builtinNetworks can't be redefined.
+var builtinNetworks = map[string]bool{"public": true, "test": true, "fake": true, "custom": true}
+
+// spec returns the microstellar network spec for the network.
+func (def *networkDef) spec() string {
+	return strings.Join([]string{"custom", def.horizon[0], def.passphrase}, ";")
+}
+
+// getNetwork loads the registered network called name.
+func (cli *CLI) getNetwork(name string) (*networkDef, error) {
+	def := &networkDef{name: name}
+
+	horizon, err := cli.GetGlobalVar(fmt.Sprintf("network:%s:horizon", name))
+	if err != nil {
+		return nil, errors.Errorf("no such network: %s", name)
+	}
+	def.horizon = strings.Split(horizon, ",")
+
+	def.passphrase, err = cli.GetGlobalVar(fmt.Sprintf("network:%s:passphrase", name))
+	if err != nil {
+		return nil, errors.Errorf("no passphrase for network: %s", name)
+	}
+
+	def.friendbot, _ = cli.GetGlobalVar(fmt.Sprintf("network:%s:friendbot", name))
+
+	if fee, err := cli.GetGlobalVar(fmt.Sprintf("network:%s:fee", name)); err == nil {
+		baseFee, _ := strconv.ParseUint(fee, 10, 32)
+		def.baseFee = uint32(baseFee)
+	}
+
+	return def, nil
+}
+
+// saveNetwork registers (or updates) def.
+func (cli *CLI) saveNetwork(def *networkDef) error {
+	fields := map[string]string{
+		"horizon":    strings.Join(def.horizon, ","),
+		"passphrase": def.passphrase,
+		"friendbot":  def.friendbot,
+		"fee":        fmt.Sprintf("%d", def.baseFee),
+	}
+
+	for field, value := range fields {
+		key := fmt.Sprintf("network:%s:%s", def.name, field)
+		if value == "" || value == "0" {
+			cli.store.Delete("global:" + key)
+			continue
+		}
+
+		if err := cli.SetGlobalVar(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteNetwork removes the registered network called name.
+func (cli *CLI) deleteNetwork(name string) error {
+	if _, err := cli.getNetwork(name); err != nil {
+		return err
+	}
+
+	keys, err := cli.store.Keys(fmt.Sprintf("global:network:%s:", name))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := cli.store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listNetworks returns the names of all registered networks.
+func (cli *CLI) listNetworks() ([]string, error) {
+	keys, err := cli.store.Keys("global:network:")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, "global:network:"), ":")
+		if len(parts) == 2 && parts[1] == "horizon" && !seen[parts[0]] {
+			seen[parts[0]] = true
+			names = append(names, parts[0])
+		}
+	}
+
+	return names, nil
+}
+
+// defaultBaseFee is the base fee for networks that don't set one.
+var defaultBaseFee = build.DefaultBaseFee
+
+// baseFee returns the base fee (per operation) for the current network, or 0
+// if the network doesn't set one.
+func (cli *CLI) baseFee() uint32 {
+	if cli.networkDef == nil {
+		return 0
+	}
+
+	return cli.networkDef.baseFee
+}
+
+// fundWithFriendbot asks the current network's friendbot to fund address.
+func (cli *CLI) fundWithFriendbot(address string) (string, error) {
+	if cli.networkDef == nil {
+		if name, _, _ := parseNetworkSpec(cli.network); name != "test" {
+			return "", errors.Errorf("no friendbot on network: %s", name)
+		}
+
+		return microstellar.FundWithFriendBot(address)
+	}
+
+	if cli.networkDef.friendbot == "" {
+		return "", errors.Errorf("no friendbot configured for network: %s", cli.networkDef.name)
+	}
+
+	separator := "?"
+	if strings.Contains(cli.networkDef.friendbot, "?") {
+		separator = "&"
+	}
+
+	resp, err := http.DefaultClient.Get(cli.networkDef.friendbot + separator + "addr=" + url.QueryEscape(address))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return string(body), nil
+}
+
+func (cli *CLI) buildNetworkCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "network [add|list|remove|use]",
+		Short: "manage custom networks",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "network"}, "unrecognized network command: %s, expecting: add|list|remove|use", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildNetworkAddCmd())
+	cmd.AddCommand(cli.buildNetworkListCmd())
+	cmd.AddCommand(cli.buildNetworkRemoveCmd())
+	cmd.AddCommand(cli.buildNetworkUseCmd())
+
+	return cmd
+}
+
+func (cli *CLI) buildNetworkAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add [name] --horizon [url1,url2...] --passphrase [passphrase]",
+		Short: "add (or update) the network [name]",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "network", "subcmd": "add"}
+			name := args[0]
+
+			if builtinNetworks[name] || strings.ContainsAny(name, ";:,") {
+				cli.error(logFields, "invalid network name: %s", name)
+				return
+			}
+
+			def := &networkDef{name: name}
+			def.horizon, _ = cmd.Flags().GetStringSlice("horizon")
+			def.passphrase, _ = cli.rootCmd.Flags().GetString("passphrase")
+			def.friendbot, _ = cmd.Flags().GetString("friendbot")
+			def.baseFee, _ = cmd.Flags().GetUint32("fee")
+
+			if len(def.horizon) == 0 || def.passphrase == "" {
+				cli.error(logFields, "need --horizon and --passphrase")
+				return
+			}
+
+			for _, horizonURL := range append(def.horizon, def.friendbot) {
+				if horizonURL == "" {
+					continue
+				}
+
+				if u, err := url.Parse(horizonURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					cli.error(logFields, "bad URL: %s", horizonURL)
+					return
+				}
+			}
+
+			if err := cli.saveNetwork(def); err != nil {
+				cli.error(logFields, "could not save network: %v", err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().StringSlice("horizon", []string{}, "comma-separated list of horizon URLs")
+	cmd.Flags().String("friendbot", "", "friendbot URL")
+	cmd.Flags().Uint32("fee", 0, "base fee (in stroops) per operation")
+	return cmd
+}
+
+func (cli *CLI) buildNetworkListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "list custom networks",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "network", "subcmd": "list"}
+
+			names, err := cli.listNetworks()
+			if err != nil {
+				cli.error(logFields, "could not list networks: %v", err)
+				return
+			}
+
+			for _, name := range names {
+				def, err := cli.getNetwork(name)
+				if err != nil {
+					debugf(logFields, "skipping network %s: %v", name, err)
+					continue
+				}
+
+				line := fmt.Sprintf("%s horizon:%s passphrase:%q", name, strings.Join(def.horizon, ","), def.passphrase)
+				if def.friendbot != "" {
+					line += " friendbot:" + def.friendbot
+				}
+				if def.baseFee > 0 {
+					line += fmt.Sprintf(" fee:%d", def.baseFee)
+				}
+
+				showSuccess("%s", line)
+			}
+		},
+	}
+
+	return cmd
+}
+
+func (cli *CLI) buildNetworkRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove [name]",
+		Short: "remove the network [name]",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "network", "subcmd": "remove"}
+
+			if err := cli.deleteNetwork(args[0]); err != nil {
+				cli.error(logFields, "could not remove network: %v", err)
+				return
+			}
+		},
+	}
+
+	return cmd
+}
+
+func (cli *CLI) buildNetworkUseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "use [name]",
+		Short: "use the network [name] in the current namespace (same as: set config:network [name])",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "network", "subcmd": "use"}
+			name := args[0]
+
+			if !builtinNetworks[name] || name == "custom" {
+				if _, err := cli.getNetwork(name); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+			}
+
+			if err := cli.SetVar("vars:config:network", name); err != nil {
+				cli.error(logFields, "could not set network: %v", err)
+				return
+			}
+		},
+	}
+
+	return cmd
+}
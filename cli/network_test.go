@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/0xfe/microstellar"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestNetworks(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+
+	var funded string
+	friendbot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		funded = r.URL.Query().Get("addr")
+		w.Write([]byte("funded"))
+	}))
+	defer friendbot.Close()
+
+	expectOutput(t, cli, "error", "network add test --horizon http://localhost:8000 --passphrase foo")
+	expectOutput(t, cli, "error", "network add private --horizon localhost:8000 --passphrase foo")
+	expectOutput(t, cli, "error", "network add private --horizon http://localhost:8000")
+	expectOutput(t, cli, "", "network add private --horizon http://localhost:8000,http://localhost:8001 --passphrase standalone --friendbot "+friendbot.URL+" --fee 200")
+	expectOutput(t, cli, "", "network add other --horizon https://horizon.example.com --passphrase other")
+
+	expectOutput(t, cli, "other horizon:https://horizon.example.com passphrase:\"other\"\n"+
+		"private horizon:http://localhost:8000,http://localhost:8001 passphrase:\"standalone\" friendbot:"+friendbot.URL+" fee:200",
+		"network list")
+
+	expectOutput(t, cli, "error", "network use nowhere")
+	expectOutput(t, cli, "", "network use private")
+	expectOutput(t, cli, "private", "get config:network")
+
+	cli.TestCommand("version")
+	if cli.networkPassphrase() != "standalone" || cli.horizonURL() != "http://localhost:8000" {
+		t.Errorf("registered network not used: %s", cli.network)
+	}
+
+	// Override it with --network
+	cli.TestCommand("version --network other")
+	if cli.networkPassphrase() != "other" {
+		t.Errorf("--network ignored: %s", cli.network)
+	}
+
+	// Friendbot
+	expectOutput(t, cli, "friendbot says:\n funded", "friendbot kelly")
+	if funded != kelly {
+		t.Errorf("wrong friendbot address: want %s, got %s", kelly, funded)
+	}
+	expectOutput(t, cli, "error", "friendbot kelly --network other")
+	expectOutput(t, cli, "error", "friendbot kelly --network public")
+
+	// Base fee
+	dir, _ := ioutil.TempDir("", "lumen-network")
+	defer os.RemoveAll(dir)
+	bundleFile := dir + string(os.PathSeparator) + "bundle.json"
+
+	envelope := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --seq 100 --nosign --nosubmit --offline"))
+	if txe, _ := microstellar.DecodeTx(envelope); txe == nil || txe.Tx.Fee != 200 {
+		t.Errorf("network base fee not used for payment: %v", envelope)
+	}
+	other := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --seq 100 --nosign --nosubmit --offline --network test"))
+	if txe, _ := microstellar.DecodeTx(other); txe == nil || txe.Tx.Fee != 100 {
+		t.Errorf("base fee used on another network: %v", other)
+	}
+
+	out := cli.TestCommand("tx prepare " + envelope + " --bundle " + bundleFile + " --seq 101")
+	if !strings.Contains(out, "fee: 200 stroops") || !strings.Contains(out, "network: standalone") {
+		t.Errorf("network base fee not used: %v", out)
+	}
+
+	bundle, _ := readBundle(bundleFile)
+	txe, _ := microstellar.DecodeTx(bundle.Envelope)
+	if txe.Tx.Fee != 200 {
+		t.Errorf("wrong fee: want 200, got %d", txe.Tx.Fee)
+	}
+
+	expectOutput(t, cli, "", "network remove other")
+	expectOutput(t, cli, "error", "network remove other")
+	if out := strings.TrimSpace(cli.TestCommand("network list")); !strings.HasPrefix(out, "private ") || strings.Contains(out, "\n") {
+		t.Errorf("network not removed: %v", out)
+	}
+}
@@ -0,0 +1,380 @@
+package cli
+
+// This file moves namespaces between stores and machines. A namespace is
+// exported as JSON, optionally with its keys encrypted with a passphrase
+// (AES-256-GCM, with the key derived by PBKDF2-SHA256.)
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	nsExportVersion   = 1
+	nsExportKDFRounds = 600000
+)
+
+// nsExport is the file format of "ns export".
+type nsExport struct {
+	Version   int                  `json:"version"`
+	Namespace string               `json:"namespace"`
+	Parent    string               `json:"parent,omitempty"`
+	Keys      map[string]string    `json:"keys,omitempty"`
+	Expires   map[string]time.Time `json:"expires,omitempty"` // keys that have a TTL
+	Encrypted *nsCiphertext        `json:"encrypted,omitempty"`
+}
+
+// nsSecrets is the part of an export that's encrypted.
+type nsSecrets struct {
+	Keys    map[string]string    `json:"keys"`
+	Expires map[string]time.Time `json:"expires,omitempty"`
+}
+
+// nsCiphertext is the JSON-encoded keys (and expiry times) of an export, sealed with a key
+// derived from a passphrase.
+type nsCiphertext struct {
+	Salt   []byte `json:"salt"`
+	Rounds int    `json:"rounds"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+func nsExportCipher(passphrase string, salt []byte, rounds int) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, rounds, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encrypt replaces the keys and expiry times of export with their ciphertext.
+func (export *nsExport) encrypt(passphrase string) error {
+	sealed := &nsCiphertext{Salt: make([]byte, 16), Rounds: nsExportKDFRounds}
+	if _, err := rand.Read(sealed.Salt); err != nil {
+		return err
+	}
+
+	aead, err := nsExportCipher(passphrase, sealed.Salt, sealed.Rounds)
+	if err != nil {
+		return err
+	}
+
+	sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(nsSecrets{Keys: export.Keys, Expires: export.Expires})
+	if err != nil {
+		return err
+	}
+
+	// The namespace and parent are in the clear, so authenticate them too
+	sealed.Data = aead.Seal(nil, sealed.Nonce, data, []byte(export.Namespace+":"+export.Parent))
+	export.Keys = nil
+	export.Expires = nil
+	export.Encrypted = sealed
+	return nil
+}
+
+// decrypt restores the keys and expiry times of an encrypted export.
+func (export *nsExport) decrypt(passphrase string) error {
+	sealed := export.Encrypted
+	aead, err := nsExportCipher(passphrase, sealed.Salt, sealed.Rounds)
+	if err != nil {
+		return err
+	}
+
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return errors.Errorf("bad nonce")
+	}
+
+	data, err := aead.Open(nil, sealed.Nonce, sealed.Data, []byte(export.Namespace+":"+export.Parent))
+	if err != nil {
+		return errors.Errorf("wrong passphrase or corrupt file")
+	}
+
+	var secrets nsSecrets
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return err
+	}
+
+	export.Keys = secrets.Keys
+	export.Expires = secrets.Expires
+
+	export.Encrypted = nil
+	return nil
+}
+
+// isNSCacheKey returns true for keys that are derived from other keys, and so
+// aren't worth moving between namespaces.
+func isNSCacheKey(key string) bool {
+	return strings.HasPrefix(key, "rev:") || strings.HasPrefix(key, "fedcache:")
+}
+
+// nsKeys returns the keys set locally in namespace ns (without the namespace),
+// their values, and when the ones with a TTL expire. Seeds are left out unless
+// includeSeeds is set.
+func (cli *CLI) nsKeys(ns string, includeSeeds bool) (map[string]string, map[string]time.Time, error) {
+	prefix := ns + ":"
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vars := map[string]string{}
+	expires := map[string]time.Time{}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if isNSCacheKey(name) {
+			continue
+		}
+
+		value, err := cli.store.Get(key)
+		if err != nil {
+			// Expired since we listed it
+			continue
+		}
+
+		ttl, err := cli.store.TTL(key)
+		if err != nil {
+			continue
+		}
+
+		if !includeSeeds && (strings.HasSuffix(name, ":seed") || microstellar.ValidSeed(value) == nil) {
+			continue
+		}
+
+		vars[name] = value
+		if ttl > 0 {
+			expires[name] = time.Now().Add(ttl)
+		}
+	}
+
+	return vars, expires, nil
+}
+
+// writeNSKeys writes vars to namespace ns, with TTLs that end at the times in
+// expires. Keys that have already expired are left out. onConflict says what to do with
+// keys that ns already has: "fail" (before writing anything), "skip", or
+// "overwrite". It returns the number of keys written.
+func (cli *CLI) writeNSKeys(ns string, vars map[string]string, expires map[string]time.Time, onConflict string) (int, error) {
+	var names, conflicts []string
+	for name := range vars {
+		if expiry, ok := expires[name]; ok && !time.Now().Before(expiry) {
+			continue
+		}
+
+		if _, err := cli.store.Get(ns + ":" + name); err == nil {
+			conflicts = append(conflicts, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(conflicts)
+	switch onConflict {
+	case "fail":
+		if len(conflicts) > 0 {
+			return 0, errors.Errorf("%s already has %d of these keys (%s), use --on-conflict skip|overwrite", ns, len(conflicts), strings.Join(conflicts, ", "))
+		}
+	case "skip":
+	case "overwrite":
+		names = append(names, conflicts...)
+	default:
+		return 0, errors.Errorf("bad --on-conflict: %s, expecting: fail|skip|overwrite", onConflict)
+	}
+
+	// Update the alias indexes for just the aliases that change.
+	defer func(current string) { cli.ns = current }(cli.ns)
+	cli.ns = ns
+	accounts, assets := aliasNames(names)
+	for _, alias := range accounts {
+		cli.unindexAccount(alias)
+	}
+	for _, alias := range assets {
+		cli.unindexAsset(alias)
+	}
+
+	for _, name := range names {
+		var ttl time.Duration
+		if expiry, ok := expires[name]; ok {
+			// Don't let a key that expires now fall back to never expiring
+			if ttl = time.Until(expiry); ttl <= 0 {
+				ttl = time.Millisecond
+			}
+		}
+
+		if err := cli.store.Set(ns+":"+name, vars[name], ttl); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, alias := range accounts {
+		if err := cli.indexAccount(alias); err != nil {
+			return 0, err
+		}
+	}
+	for _, alias := range assets {
+		if err := cli.indexAsset(alias); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(names), nil
+}
+
+// aliasNames returns the names of the account and asset aliases that keys
+// (without the namespace) belong to.
+func aliasNames(keys []string) (accounts []string, assets []string) {
+	seen := map[string]bool{}
+	for _, key := range keys {
+		parts := strings.SplitN(key, ":", 3)
+		if len(parts) < 3 || seen[parts[0]+":"+parts[1]] {
+			continue
+		}
+		seen[parts[0]+":"+parts[1]] = true
+
+		switch parts[0] {
+		case "account":
+			accounts = append(accounts, parts[1])
+		case "asset":
+			assets = append(assets, parts[1])
+		}
+	}
+
+	return accounts, assets
+}
+
+func (cli *CLI) buildNSExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [namespace]",
+		Short: "print [namespace] as JSON, for ns import",
+		Long: `Print the keys in [namespace] as JSON, for "lumen ns import". Seeds are left out
+unless you use --include-seeds, in which case you probably want --passphrase to
+encrypt the keys. Keys with a TTL are exported with their expiry time, and
+imported with what's left of it. Cached federation lookups and the alias index
+aren't exported.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "export"}
+			ns := args[0]
+			includeSeeds, _ := cmd.Flags().GetBool("include-seeds")
+			passphrase, _ := cmd.Flags().GetString("passphrase")
+
+			vars, expires, err := cli.nsKeys(ns, includeSeeds)
+			if err != nil {
+				cli.error(logFields, "could not list keys: %v", err)
+				return
+			}
+
+			export := &nsExport{Version: nsExportVersion, Namespace: ns, Keys: vars, Expires: expires}
+			export.Parent, _ = cli.GetGlobalVar(nsParentKey(ns))
+
+			if passphrase != "" {
+				if err := export.encrypt(passphrase); err != nil {
+					cli.error(logFields, "could not encrypt: %v", err)
+					return
+				}
+			}
+
+			data, _ := json.MarshalIndent(export, "", "  ")
+			showSuccess("%s", data)
+		},
+	}
+
+	cmd.Flags().Bool("include-seeds", false, "export seeds too")
+	cmd.Flags().String("passphrase", "", "encrypt the keys with this passphrase")
+	return cmd
+}
+
+func (cli *CLI) buildNSImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "import a namespace from [file], written by ns export",
+		Long: `Import a namespace from [file], written by "lumen ns export". The keys go into the
+exported namespace, or the one named by --as. If the namespace already has some
+of the keys, import fails unless --on-conflict is skip or overwrite. The parent
+namespace is restored if the namespace doesn't already have one.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "ns", "subcmd": "import"}
+			ns, _ := cmd.Flags().GetString("as")
+			onConflict, _ := cmd.Flags().GetString("on-conflict")
+			passphrase, _ := cmd.Flags().GetString("passphrase")
+
+			data, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				cli.error(logFields, "could not read file: %v", err)
+				return
+			}
+
+			var export nsExport
+			if err := json.Unmarshal(data, &export); err != nil {
+				cli.error(logFields, "could not parse %s: %v", args[0], err)
+				return
+			}
+
+			if export.Version != nsExportVersion {
+				cli.error(logFields, "unsupported export version: %d", export.Version)
+				return
+			}
+
+			if export.Encrypted != nil {
+				if passphrase == "" {
+					cli.error(logFields, "%s is encrypted, use --passphrase", args[0])
+					return
+				}
+
+				if err := export.decrypt(passphrase); err != nil {
+					cli.error(logFields, "could not decrypt %s: %v", args[0], err)
+					return
+				}
+			}
+
+			if ns == "" {
+				ns = export.Namespace
+			}
+
+			if err := validNSName(ns); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			n, err := cli.writeNSKeys(ns, export.Keys, export.Expires, onConflict)
+			if err != nil {
+				cli.error(logFields, "could not import: %v", err)
+				return
+			}
+
+			if _, err := cli.GetGlobalVar(nsParentKey(ns)); err != nil && export.Parent != "" {
+				if err := cli.setNSParent(ns, export.Parent); err != nil {
+					cli.error(logFields, "imported %d keys, but could not set parent: %v", n, err)
+					return
+				}
+			}
+
+			showSuccess("imported %d keys into %s", n, ns)
+		},
+	}
+
+	cmd.Flags().String("as", "", "import into this namespace instead")
+	cmd.Flags().String("on-conflict", "fail", "what to do with keys the namespace already has: fail, skip, or overwrite")
+	cmd.Flags().String("passphrase", "", "passphrase for encrypted exports")
+	return cmd
+}
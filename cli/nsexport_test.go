@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xfe/lumen/store"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestNamespaceExport(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns company")
+	cli.TestCommand("ns create prod --parent company")
+	cli.TestCommand("ns prod")
+	cli.TestCommand("set config:network public")
+	cli.TestCommand("account new mo")
+	cli.TestCommand("asset set USD mo")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	seed := strings.TrimSpace(cli.TestCommand("account seed mo"))
+
+	dir, _ := ioutil.TempDir("", "lumen-ns")
+	defer os.RemoveAll(dir)
+	plainFile := dir + string(os.PathSeparator) + "plain.json"
+	sealedFile := dir + string(os.PathSeparator) + "sealed.json"
+
+	plain := cli.TestCommand("ns export prod")
+	var export nsExport
+	if err := json.Unmarshal([]byte(plain), &export); err != nil {
+		t.Fatalf("bad export: %v: %v", err, plain)
+	}
+
+	if export.Namespace != "prod" || export.Parent != "company" || export.Keys["account:mo:address"] != mo ||
+		export.Keys["vars:config:network"] != "public" || export.Keys["asset:USD:issuer"] != mo {
+		t.Errorf("unexpected export: %+v", export)
+	}
+
+	if strings.Contains(plain, seed) || strings.Contains(plain, "rev:") {
+		t.Errorf("export has seeds or the alias index: %v", plain)
+	}
+
+	sealed := cli.TestCommand("ns export prod --include-seeds --passphrase hunter2")
+	if strings.Contains(sealed, seed) || strings.Contains(sealed, "config") {
+		t.Errorf("encrypted export has keys in the clear: %v", sealed)
+	}
+
+	ioutil.WriteFile(plainFile, []byte(plain), 0600)
+	ioutil.WriteFile(sealedFile, []byte(sealed), 0600)
+
+	// Import into a file store
+	fileStore, err := store.NewStore("file", dir+string(os.PathSeparator)+"store.json")
+	if err != nil {
+		t.Fatalf("could not create store: %v", err)
+	}
+	other := NewCLI()
+	other.SetStore(fileStore)
+
+	expectOutput(t, other, "imported 5 keys into prod", "ns import "+plainFile)
+	other.TestCommand("ns prod")
+	expectOutput(t, other, mo, "account address mo")
+	expectOutput(t, other, "public", "get config:network")
+	expectOutput(t, other, "error", "account seed mo")
+	if out := other.TestCommand("ns show"); !strings.HasPrefix(out, "namespace: prod -> company\n") {
+		t.Errorf("want parent restored, got %v", out)
+	}
+
+	expectOutput(t, other, "error", "ns import "+sealedFile)
+	expectOutput(t, other, "error", "ns import "+sealedFile+" --passphrase wrong")
+	expectOutput(t, other, "error", "ns import "+sealedFile+" --passphrase hunter2")
+	expectOutput(t, other, "error", "ns import "+sealedFile+" --passphrase hunter2 --on-conflict bogus")
+	expectOutput(t, other, "imported 1 keys into prod", "ns import "+sealedFile+" --passphrase hunter2 --on-conflict skip")
+	expectOutput(t, other, seed, "account seed mo")
+
+	other.TestCommand("set config:network test")
+	expectOutput(t, other, "imported 0 keys into prod", "ns import "+plainFile+" --on-conflict skip")
+	expectOutput(t, other, "test", "get config:network")
+	expectOutput(t, other, "imported 5 keys into prod", "ns import "+plainFile+" --on-conflict overwrite")
+	expectOutput(t, other, "public", "get config:network")
+
+	expectOutput(t, other, "imported 6 keys into staging", "ns import "+sealedFile+" --passphrase hunter2 --as staging")
+	other.TestCommand("ns staging")
+	expectOutput(t, other, seed, "account seed mo")
+
+	// The alias index is rebuilt for imported namespaces
+	if names := other.namer().names(mo); strings.Join(names, ",") != "mo" {
+		t.Errorf("want imported alias, got %v", names)
+	}
+}
+
+func TestNamespaceExportTTL(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns prod")
+	cli.TestCommand("set config:network public")
+	cli.store.Set("prod:vars:session", "abc", time.Hour)
+
+	dir, _ := ioutil.TempDir("", "lumen-ns")
+	defer os.RemoveAll(dir)
+	file := dir + string(os.PathSeparator) + "prod.json"
+
+	expectTTL := func(cli *CLI, key string) {
+		ttl, err := cli.store.TTL(key)
+		if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Errorf("%s: want TTL of about an hour, got %v (%v)", key, ttl, err)
+		}
+	}
+
+	var export nsExport
+	json.Unmarshal([]byte(cli.TestCommand("ns export prod")), &export)
+	if expiry := export.Expires["vars:session"]; time.Until(expiry) <= 59*time.Minute || len(export.Expires) != 1 {
+		t.Errorf("unexpected expiry times: %v", export.Expires)
+	}
+
+	expectOutput(t, cli, "copied 2 keys from prod to staging", "ns copy prod staging")
+	expectTTL(cli, "staging:vars:session")
+	if ttl, err := cli.store.TTL("staging:vars:config:network"); err != nil || ttl != 0 {
+		t.Errorf("want no TTL, got %v (%v)", ttl, err)
+	}
+
+	// Encrypted exports carry the expiry times too
+	ioutil.WriteFile(file, []byte(cli.TestCommand("ns export prod --passphrase hunter2")), 0600)
+	expectOutput(t, cli, "imported 2 keys into qa", "ns import "+file+" --as qa --passphrase hunter2")
+	expectTTL(cli, "qa:vars:session")
+
+	// Keys that expired since the export aren't imported
+	export.Expires["vars:session"] = time.Now().Add(-time.Minute)
+	data, _ := json.Marshal(export)
+	ioutil.WriteFile(file, data, 0600)
+	expectOutput(t, cli, "imported 1 keys into dev", "ns import "+file+" --as dev")
+	cli.TestCommand("ns dev")
+	expectOutput(t, cli, "error", "get session")
+}
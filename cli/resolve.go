@@ -0,0 +1,220 @@
+package cli
+
+// This file resolves federation addresses, and caches the results (with a TTL)
+// in the namespace, so commands that use them don't hit the network every time.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stellar/go/clients/federation"
+	"github.com/stellar/go/clients/stellartoml"
+)
+
+// defaultFederationTTL is how long resolved federation addresses are cached,
+// unless config:federation_ttl says otherwise.
+const defaultFederationTTL = time.Hour
+
+// allowHTTPFederation lets tests use plain HTTP federation servers.
+var allowHTTPFederation = false
+
+// federationRecord is a resolved federation address.
+type federationRecord struct {
+	Address  string    `json:"address"`
+	MemoType string    `json:"memo_type,omitempty"`
+	Memo     string    `json:"memo,omitempty"`
+	Resolved time.Time `json:"resolved"`
+}
+
+// tomlResolver finds federation servers with fetchStellarToml.
+type tomlResolver struct{}
+
+func (tomlResolver) GetStellarToml(domain string) (*stellartoml.Response, error) {
+	st, err := fetchStellarToml(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stellartoml.Response{FederationServer: st.FederationServer, SigningKey: st.SigningKey}, nil
+}
+
+// federationTTL returns how long to cache resolved addresses for. Zero disables
+// the cache.
+func (cli *CLI) federationTTL() time.Duration {
+	value, err := cli.GetVar("vars:config:federation_ttl")
+	if err != nil {
+		return defaultFederationTTL
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		debugf(logrus.Fields{"method": "federationTTL"}, "bad config:federation_ttl %q, using %v", value, defaultFederationTTL)
+		return defaultFederationTTL
+	}
+
+	return ttl
+}
+
+// resolveFederation looks up the federation address addy, from the cache if
+// it's there (and --no-cache isn't set.) It returns true if the record was
+// cached.
+func (cli *CLI) resolveFederation(addy string) (*federationRecord, bool, error) {
+	logFields := logrus.Fields{"method": "resolveFederation", "address": addy}
+	key := "fedcache:" + strings.ToLower(addy)
+	ttl := cli.federationTTL()
+
+	if noCache, _ := cli.rootCmd.Flags().GetBool("no-cache"); !noCache && ttl > 0 {
+		if value, err := cli.GetVar(key); err == nil {
+			var record federationRecord
+			if err := json.Unmarshal([]byte(value), &record); err == nil {
+				debugf(logFields, "cached: %s", record.Address)
+				return &record, true, nil
+			}
+		}
+	}
+
+	client := &federation.Client{
+		HTTP:        http.DefaultClient,
+		StellarTOML: tomlResolver{},
+		AllowHTTP:   allowHTTPFederation,
+	}
+
+	resp, err := client.LookupByAddress(addy)
+	if err != nil {
+		return nil, false, errors.Errorf("could not resolve %s: %v", addy, err)
+	}
+
+	if microstellar.ValidAddress(resp.AccountID) != nil {
+		return nil, false, errors.Errorf("could not resolve %s: bad address: %s", addy, resp.AccountID)
+	}
+
+	record := &federationRecord{
+		Address:  resp.AccountID,
+		MemoType: resp.MemoType,
+		Memo:     resp.Memo.String(),
+		Resolved: time.Now().UTC(),
+	}
+
+	if ttl > 0 {
+		data, _ := json.Marshal(record)
+		if err := cli.store.Set(fmt.Sprintf("%s:%s", cli.ns, key), string(data), ttl); err != nil {
+			debugf(logFields, "could not cache: %v", err)
+		}
+	}
+
+	return record, false, nil
+}
+
+func (cli *CLI) buildResolveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resolve [name]",
+		Short: "show how [name] resolves to an address",
+		Long: `Show how [name] resolves to an address, one step per line: account aliases,
+federation lookups (and whether they came from the cache), and the memo that
+payments to a federation address must carry.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "resolve"}
+			name := args[0]
+			var memo string
+
+			seen := map[string]bool{}
+			for !seen[name] {
+				seen[name] = true
+				switch {
+				case microstellar.ValidAddress(name) == nil:
+					if memo != "" {
+						showSuccess("memo: %s", memo)
+					}
+					showSuccess("address: %s", name)
+					return
+
+				case microstellar.ValidSeed(name) == nil:
+					name, _ = addressOf(name)
+
+				case strings.Contains(name, "*"):
+					record, cached, err := cli.resolveFederation(name)
+					if err != nil {
+						cli.error(logFields, "%v", err)
+						return
+					}
+
+					source := "looked up"
+					if cached {
+						source = "cached"
+					}
+					showSuccess("federation: %s -> %s (%s)", name, record.Address, source)
+
+					memo = "none"
+					if record.MemoType != "" {
+						memo = fmt.Sprintf("%s %s (required)", record.MemoType, record.Memo)
+					}
+					name = record.Address
+
+				default:
+					value, err := cli.GetAccountOrSeed(name, "address")
+					if err != nil {
+						cli.error(logFields, "unknown account: %s", name)
+						return
+					}
+
+					if microstellar.ValidSeed(value) == nil {
+						showSuccess("alias: %s -> (seed)", name)
+					} else {
+						showSuccess("alias: %s -> %s", name, value)
+					}
+					name = value
+				}
+			}
+
+			cli.error(logFields, "alias loop: %s", name)
+		},
+	}
+}
+
+func (cli *CLI) buildCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache [clear]",
+		Short: "manage cached federation lookups",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "cache"}, "unrecognized cache command: %s, expecting: clear", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "clear",
+		Short: "forget cached federation lookups in this namespace",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "cache", "subcmd": "clear"}
+
+			keys, err := cli.store.Keys(fmt.Sprintf("%s:fedcache:", cli.ns))
+			if err != nil {
+				cli.error(logFields, "could not list cache: %v", err)
+				return
+			}
+
+			for _, key := range keys {
+				if err := cli.store.Delete(key); err != nil {
+					cli.error(logFields, "could not clear cache: %v", err)
+					return
+				}
+			}
+
+			debugf(logFields, "cleared %d entries", len(keys))
+		},
+	})
+
+	return cmd
+}
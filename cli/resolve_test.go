@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestResolve(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	moSeed := strings.TrimSpace(cli.TestCommand("account seed mo"))
+
+	var mutex sync.Mutex
+	lookups := 0
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.URL.Path == "/.well-known/stellar.toml":
+			fmt.Fprintf(w, "FEDERATION_SERVER = \"%s/federation\"\n", server.URL)
+		case r.URL.Path == "/federation" && r.URL.Query().Get("q") == "mo*example.com":
+			lookups++
+			fmt.Fprintf(w, `{"account_id": "%s", "memo_type": "id", "memo": "42"}`, mo)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"detail": "not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	oldURL := stellarTomlURL
+	stellarTomlURL = func(domain string) string { return server.URL + "/.well-known/stellar.toml" }
+	allowHTTPFederation = true
+	defer func() { stellarTomlURL, allowHTTPFederation = oldURL, false }()
+
+	expectLookups := func(want int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if lookups != want {
+			t.Errorf("want %d federation lookups, got %d", want, lookups)
+		}
+	}
+
+	chain := "federation: mo*example.com -> " + mo + " (%s)\nmemo: id 42 (required)\naddress: " + mo
+	expectOutput(t, cli, fmt.Sprintf(chain, "looked up"), "resolve mo*example.com")
+	expectOutput(t, cli, strings.Replace(fmt.Sprintf(chain, "cached"), "mo*", "MO*", 1), "resolve MO*example.com")
+	expectLookups(1)
+
+	expectOutput(t, cli, fmt.Sprintf(chain, "looked up"), "resolve mo*example.com --no-cache")
+	expectLookups(2)
+
+	// Aliases of federation addresses go through the cache too
+	cli.TestCommand("account set momo mo*example.com")
+	expectOutput(t, cli, "alias: momo -> mo*example.com\n"+fmt.Sprintf(chain, "cached"), "resolve momo")
+	if address, err := cli.ResolveAccount(logrus.Fields{}, "momo", "address"); err != nil || address != mo {
+		t.Errorf("want %s, got %s (%v)", mo, address, err)
+	}
+	expectLookups(2)
+
+	expectOutput(t, cli, "alias: mo -> "+mo+"\naddress: "+mo, "resolve mo")
+	expectOutput(t, cli, "address: "+mo, "resolve "+moSeed)
+
+	cli.TestCommand("cache clear")
+	expectOutput(t, cli, fmt.Sprintf(chain, "looked up"), "resolve mo*example.com")
+	expectLookups(3)
+
+	// Cached entries expire after config:federation_ttl
+	cli.TestCommand("set config:federation_ttl 0")
+	cli.TestCommand("cache clear")
+	cli.TestCommand("resolve mo*example.com")
+	cli.TestCommand("resolve mo*example.com")
+	expectLookups(5)
+
+	cli.TestCommand("set config:federation_ttl 50ms")
+	cli.TestCommand("resolve mo*example.com")
+	expectOutput(t, cli, fmt.Sprintf(chain, "cached"), "resolve mo*example.com")
+	time.Sleep(100 * time.Millisecond)
+	expectOutput(t, cli, fmt.Sprintf(chain, "looked up"), "resolve mo*example.com")
+	expectLookups(7)
+
+	expectOutput(t, cli, "error", "resolve nobody*example.com")
+	expectOutput(t, cli, "error", "resolve nobody")
+}
@@ -0,0 +1,561 @@
+package cli
+
+// This file contains scheduled jobs: lumen commands that run on a crontab
+// schedule, with a record of every run.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// scheduleNow returns the current time (replaced in tests.)
+var scheduleNow = time.Now
+
+// scheduleGrace is how late a run can start and still count as on time, for
+// jobs that skip missed runs.
+const scheduleGrace = 5 * time.Minute
+
+// scheduleMaxCatchUp limits how many missed runs a job catches up on at once.
+const scheduleMaxCatchUp = 100
+
+// Catch-up policies for runs missed while the scheduler wasn't running.
+const (
+	catchUpSkip = "skip" // don't run them
+	catchUpOnce = "once" // run the latest one
+	catchUpAll  = "all"  // run all of them, in order
+)
+
+// scheduledJob is a lumen command that runs on a schedule. It's stored as JSON
+// at schedule:job:NAME in the namespace.
+type scheduledJob struct {
+	Name      string    `json:"name"`
+	Command   string    `json:"command"` // without "lumen"
+	Cron      string    `json:"cron"`
+	TimeZone  string    `json:"tz"`
+	CatchUp   string    `json:"catch_up"`
+	Paused    bool      `json:"paused"`
+	CreatedOn time.Time `json:"created_on"`
+	LastRun   time.Time `json:"last_run"` // the scheduled time of the last run (or skip)
+}
+
+// Run statuses
+const (
+	runRunning = "running" // started, and never finished (e.g., lumen crashed)
+	runOK      = "ok"
+	runFailed  = "failed"
+	runSkipped = "skipped"
+)
+
+// scheduledRun is one run of a job, stored at schedule:run:NAME:TIME, where TIME
+// is when it was scheduled for.
+type scheduledRun struct {
+	Job          string    `json:"job"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+	StartedOn    time.Time `json:"started_on"`
+	FinishedOn   time.Time `json:"finished_on,omitempty"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Output       string    `json:"output,omitempty"`
+}
+
+func scheduledJobKey(name string) string {
+	return "schedule:job:" + name
+}
+
+func scheduledRunKey(name string, scheduledFor time.Time) string {
+	return fmt.Sprintf("schedule:run:%s:%s", name, scheduledFor.UTC().Format("20060102T1504Z"))
+}
+
+func (cli *CLI) getScheduledJob(name string) (*scheduledJob, error) {
+	data, err := cli.GetVar(scheduledJobKey(name))
+	if err != nil {
+		return nil, errors.Errorf("no such job: %s", name)
+	}
+
+	job := &scheduledJob{}
+	if err := json.Unmarshal([]byte(data), job); err != nil {
+		return nil, errors.Errorf("bad job %s: %v", name, err)
+	}
+
+	return job, nil
+}
+
+func (cli *CLI) saveScheduledJob(job *scheduledJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return cli.SetVar(scheduledJobKey(job.Name), string(data))
+}
+
+// scheduledJobs returns the namespace's jobs, by name.
+func (cli *CLI) scheduledJobs() ([]*scheduledJob, error) {
+	prefix := fmt.Sprintf("%s:%s", cli.ns, scheduledJobKey(""))
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	var jobs []*scheduledJob
+	for _, key := range keys {
+		job, err := cli.getScheduledJob(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// scheduledRuns returns the recorded runs of the job, oldest first.
+func (cli *CLI) scheduledRuns(name string) ([]*scheduledRun, error) {
+	keys, err := cli.store.Keys(fmt.Sprintf("%s:schedule:run:%s:", cli.ns, name))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	var runs []*scheduledRun
+	for _, key := range keys {
+		data, err := cli.store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		run := &scheduledRun{}
+		if err := json.Unmarshal([]byte(data), run); err != nil {
+			return nil, errors.Errorf("bad run %s: %v", key, err)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+func (cli *CLI) saveScheduledRun(run *scheduledRun) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	return cli.SetVar(scheduledRunKey(run.Job, run.ScheduledFor), string(data))
+}
+
+// claimScheduledRun records run if there's no record of its job running (or
+// skipping) at that time, and returns true if it did. The check and write are
+// atomic in Redis, so schedulers that share a Redis store never both claim a
+// run. File stores only make them atomic within one process.
+func (cli *CLI) claimScheduledRun(run *scheduledRun) (bool, error) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return false, err
+	}
+
+	key := fmt.Sprintf("%s:%s", cli.ns, scheduledRunKey(run.Job, run.ScheduledFor))
+	return cli.store.SetNX(key, string(data), 0)
+}
+
+// schedule returns the job's parsed schedule, and its time zone.
+func (job *scheduledJob) schedule() (*cronSchedule, *time.Location, error) {
+	schedule, err := parseCron(job.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	location, err := time.LoadLocation(job.TimeZone)
+	if err != nil {
+		return nil, nil, errors.Errorf("bad time zone: %s", job.TimeZone)
+	}
+
+	return schedule, location, nil
+}
+
+// due returns the times the job should have run after its last run, up to now,
+// and which of them to run (according to its catch-up policy.)
+func (job *scheduledJob) due(now time.Time) (runs []time.Time, skips []time.Time, err error) {
+	schedule, location, err := job.schedule()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	since := job.LastRun
+	if since.IsZero() {
+		since = job.CreatedOn
+	}
+
+	var missed []time.Time
+	for t := schedule.next(since.In(location)); !t.IsZero() && !t.After(now); t = schedule.next(t) {
+		missed = append(missed, t)
+	}
+
+	if len(missed) == 0 {
+		return nil, nil, nil
+	}
+
+	latest := missed[len(missed)-1]
+	switch job.CatchUp {
+	case catchUpAll:
+		if len(missed) > scheduleMaxCatchUp {
+			return missed[len(missed)-scheduleMaxCatchUp:], missed[:len(missed)-scheduleMaxCatchUp], nil
+		}
+		return missed, nil, nil
+	case catchUpSkip:
+		if now.Sub(latest) > scheduleGrace {
+			return nil, missed, nil
+		}
+	}
+
+	return []time.Time{latest}, missed[:len(missed)-1], nil
+}
+
+// runScheduledJobs runs every job that's due. Each scheduled time is claimed
+// before the command runs, so it never runs twice, even if lumen crashes or
+// another scheduler shares the store.
+func (cli *CLI) runScheduledJobs(logFields logrus.Fields) error {
+	jobs, err := cli.scheduledJobs()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, job := range jobs {
+		if job.Paused {
+			continue
+		}
+
+		runs, skips, err := job.due(scheduleNow())
+		if err != nil {
+			logrus.WithFields(logFields).Errorf("job %s: %v", job.Name, err)
+			failed++
+			continue
+		}
+
+		for _, t := range skips {
+			job.LastRun = t
+			claimed, err := cli.claimScheduledRun(&scheduledRun{Job: job.Name, ScheduledFor: t, StartedOn: scheduleNow(), Status: runSkipped})
+			if err != nil {
+				return errors.Wrapf(err, "could not record run")
+			}
+
+			if claimed {
+				showSuccess("job %s: skipped run for %s", job.Name, t.Format(time.RFC3339))
+			}
+		}
+
+		for _, t := range runs {
+			run := &scheduledRun{Job: job.Name, ScheduledFor: t, StartedOn: scheduleNow(), Status: runRunning}
+			job.LastRun = t
+			claimed, err := cli.claimScheduledRun(run)
+			if err != nil {
+				return errors.Wrapf(err, "could not record run")
+			}
+
+			if !claimed {
+				debugf(logFields, "job %s already ran for %s", job.Name, t)
+				continue
+			}
+
+			if err := cli.saveScheduledJob(job); err != nil {
+				return errors.Wrapf(err, "could not save job")
+			}
+
+			showSuccess("job %s: running for %s: %s", job.Name, t.Format(time.RFC3339), job.Command)
+			args, _ := splitCommand(job.Command)
+			var runErr error
+			run.Output = captureOutput(func() {
+				runErr = cli.runNested(args...)
+			})
+
+			if output := strings.TrimSpace(run.Output); output != "" {
+				showSuccess("%s", output)
+			}
+
+			run.FinishedOn = scheduleNow()
+			run.Status = runOK
+			if runErr != nil {
+				run.Status = runFailed
+				run.Error = runErr.Error()
+				failed++
+				showSuccess("job %s: failed: %v", job.Name, runErr)
+			} else {
+				showSuccess("job %s: ok", job.Name)
+			}
+
+			if err := cli.saveScheduledRun(run); err != nil {
+				return errors.Wrapf(err, "could not record run")
+			}
+		}
+
+		if err := cli.saveScheduledJob(job); err != nil {
+			return errors.Wrapf(err, "could not save job")
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d job(s) failed", failed)
+	}
+
+	return nil
+}
+
+func (cli *CLI) buildScheduleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schedule [add|list|history|pause|resume|remove|run]",
+		Short: "run lumen commands on a schedule",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "schedule"}, "unrecognized schedule command: %s, expecting: add|list|history|pause|resume|remove|run", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildScheduleAddCmd())
+	cmd.AddCommand(cli.buildScheduleListCmd())
+	cmd.AddCommand(cli.buildScheduleHistoryCmd())
+	cmd.AddCommand(cli.buildSchedulePauseCmd(true))
+	cmd.AddCommand(cli.buildSchedulePauseCmd(false))
+	cmd.AddCommand(cli.buildScheduleRemoveCmd())
+	cmd.AddCommand(cli.buildScheduleRunCmd())
+
+	return cmd
+}
+
+func (cli *CLI) buildScheduleAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add [name] [command] --cron \"0 9 1 * *\" [--catch-up skip|once|all] [--tz zone]",
+		Short: "run a lumen command on a schedule, e.g., add rent \"pay 100 USD --from ops --to landlord\" --cron \"0 9 1 * *\"",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "schedule", "subcmd": "add"}
+			name := args[0]
+
+			if strings.ContainsAny(name, ": ") {
+				cli.error(logFields, "bad job name: %s", name)
+				return
+			}
+
+			if _, err := cli.getScheduledJob(name); err == nil {
+				cli.error(logFields, "job already exists: %s", name)
+				return
+			}
+
+			command := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(args[1]), "lumen "))
+			commandArgs, err := splitCommand(command)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if len(commandArgs) == 0 || commandArgs[0] == "schedule" {
+				cli.error(logFields, "bad command: %s", command)
+				return
+			}
+
+			if found, _, err := cli.rootCmd.Find(commandArgs); err != nil || found == cli.rootCmd {
+				cli.error(logFields, "unknown command: %s", commandArgs[0])
+				return
+			}
+
+			job := &scheduledJob{Name: name, Command: command, CreatedOn: scheduleNow().UTC()}
+			job.Cron, _ = cmd.Flags().GetString("cron")
+			job.TimeZone, _ = cmd.Flags().GetString("tz")
+			job.CatchUp, _ = cmd.Flags().GetString("catch-up")
+
+			if job.CatchUp != catchUpSkip && job.CatchUp != catchUpOnce && job.CatchUp != catchUpAll {
+				cli.error(logFields, "bad --catch-up: %s, expecting: skip|once|all", job.CatchUp)
+				return
+			}
+
+			if _, _, err := job.schedule(); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if err := cli.saveScheduledJob(job); err != nil {
+				cli.error(logFields, "could not save job: %v", err)
+				return
+			}
+		},
+	}
+
+	cmd.Flags().String("cron", "", "crontab schedule (minute hour day-of-month month day-of-week), or @daily, @hourly, etc.")
+	cmd.Flags().String("tz", "Local", "time zone for the schedule (e.g., UTC, America/New_York)")
+	cmd.Flags().String("catch-up", catchUpOnce, "what to do with runs missed while the scheduler was down (skip, once, all)")
+	return cmd
+}
+
+func (cli *CLI) buildScheduleListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "list scheduled jobs",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "schedule", "subcmd": "list"}
+
+			jobs, err := cli.scheduledJobs()
+			if err != nil {
+				cli.error(logFields, "could not load jobs: %v", err)
+				return
+			}
+
+			for _, job := range jobs {
+				state := "active"
+				if job.Paused {
+					state = "paused"
+				}
+
+				next := "never"
+				if schedule, location, err := job.schedule(); err == nil {
+					if t := schedule.next(scheduleNow().In(location)); !t.IsZero() {
+						next = t.Format(time.RFC3339)
+					}
+				}
+
+				showSuccess("%s %s [%s] next:%s catch-up:%s %s", job.Name, state, job.Cron, next, job.CatchUp, job.Command)
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildScheduleHistoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history [name] [--limit n]",
+		Short: "show the runs of a job, oldest first",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "schedule", "subcmd": "history"}
+
+			runs, err := cli.scheduledRuns(args[0])
+			if err != nil {
+				cli.error(logFields, "could not load runs: %v", err)
+				return
+			}
+
+			if limit, _ := cmd.Flags().GetInt("limit"); limit > 0 && len(runs) > limit {
+				runs = runs[len(runs)-limit:]
+			}
+
+			for _, run := range runs {
+				line := fmt.Sprintf("%s %s", run.ScheduledFor.Format(time.RFC3339), run.Status)
+				if run.Error != "" {
+					line += ": " + run.Error
+				}
+				showSuccess("%s", line)
+			}
+		},
+	}
+
+	cmd.Flags().Int("limit", 0, "only show the last n runs")
+	return cmd
+}
+
+func (cli *CLI) buildSchedulePauseCmd(pause bool) *cobra.Command {
+	use, short := "pause", "stop running a job (until resumed)"
+	if !pause {
+		use, short = "resume", "resume a paused job (runs missed while paused are skipped)"
+	}
+
+	return &cobra.Command{
+		Use:   use + " [name]",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "schedule", "subcmd": use}
+
+			job, err := cli.getScheduledJob(args[0])
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if !pause && job.Paused {
+				job.LastRun = scheduleNow()
+			}
+
+			job.Paused = pause
+			if err := cli.saveScheduledJob(job); err != nil {
+				cli.error(logFields, "could not save job: %v", err)
+				return
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildScheduleRemoveCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove [name]",
+		Short: "remove a job and its history",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "schedule", "subcmd": "remove"}
+			name := args[0]
+
+			if _, err := cli.getScheduledJob(name); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			keys, err := cli.store.Keys(fmt.Sprintf("%s:schedule:run:%s:", cli.ns, name))
+			if err != nil {
+				cli.error(logFields, "could not load runs: %v", err)
+				return
+			}
+
+			for _, key := range keys {
+				cli.store.Delete(key)
+			}
+
+			if err := cli.DelVar(scheduledJobKey(name)); err != nil {
+				cli.error(logFields, "could not remove job: %v", err)
+				return
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildScheduleRunCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run [--interval 30s] [--once]",
+		Short: "run scheduled jobs as they come due",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "schedule", "subcmd": "run"}
+			interval, _ := cmd.Flags().GetDuration("interval")
+			once, _ := cmd.Flags().GetBool("once")
+
+			for {
+				err := cli.runScheduledJobs(logFields)
+				if once {
+					if err != nil {
+						cli.error(logFields, "%v", err)
+					}
+					return
+				}
+
+				if err != nil {
+					logrus.WithFields(logFields).Errorf("%v", err)
+				}
+
+				if !sleepContext(cli.ctx, interval) {
+					debugf(logFields, "stopped scheduler: %v", cli.ctx.Err())
+					return
+				}
+			}
+		},
+	}
+
+	cmd.Flags().Duration("interval", 30*time.Second, "how often to check for due jobs")
+	cmd.Flags().Bool("once", false, "run the jobs that are due, and exit")
+	return cmd
+}
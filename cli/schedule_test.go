@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestCron(t *testing.T) {
+	at := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02 15:04", s)
+		return t
+	}
+
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"0 9 1 * *", "2018-03-01 09:00", "2018-04-01 09:00"},
+		{"*/15 * * * *", "2018-03-01 09:07", "2018-03-01 09:15"},
+		{"30 8 * * mon-fri", "2018-03-02 09:00", "2018-03-05 08:30"},
+		{"0 0 13 * 5", "2018-03-01 00:00", "2018-03-02 00:00"},
+		{"@daily", "2018-12-31 12:00", "2019-01-01 00:00"},
+		{"0 0 29 feb *", "2018-01-01 00:00", "2020-02-29 00:00"},
+		{"0 12 * * 7", "2018-03-01 00:00", "2018-03-04 12:00"},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+
+		if got := schedule.next(at(test.from)); !got.Equal(at(test.want)) {
+			t.Errorf("%s after %s: want %s, got %s", test.spec, test.from, test.want, got)
+		}
+	}
+
+	if schedule, _ := parseCron("0 0 30 feb *"); !schedule.next(at("2018-01-01 00:00")).IsZero() {
+		t.Errorf("February 30th scheduled")
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@often"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("bad schedule parsed: %q", spec)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	cli, memStore := newTestCLI()
+	cli.TestCommand("ns test")
+	cli.TestCommand("set config:network fake")
+
+	cli.TestCommand("account new ops")
+	cli.TestCommand("account new landlord")
+
+	now := time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)
+	scheduleNow = func() time.Time { return now }
+	defer func() { scheduleNow = time.Now }()
+
+	// TestCommand splits on spaces, which the scheduled commands have.
+	add := func(args ...string) string {
+		cli.testing = true
+		defer func() { cli.testing = false }()
+		return cli.Run(append([]string{"schedule", "add"}, args...)...)
+	}
+
+	add("rent", "lumen pay 100 --from ops --to landlord --memotext rent", "--cron", "0 9 1 * *", "--tz", "UTC")
+	add("broken", "pay 1 --from nobody --to landlord", "--cron", "0 * * * *", "--tz", "UTC", "--catch-up", "skip")
+
+	if out := add("rent", "balance ops", "--cron", "@daily"); !strings.Contains(out, "error") {
+		t.Errorf("duplicate job allowed: %v", out)
+	}
+	if out := add("loop", "schedule run", "--cron", "@daily"); !strings.Contains(out, "error") {
+		t.Errorf("nested scheduler allowed: %v", out)
+	}
+	if out := add("bad", "frobnicate now", "--cron", "@daily"); !strings.Contains(out, "error") {
+		t.Errorf("unknown command allowed: %v", out)
+	}
+	if out := add("bad", "balance ops", "--cron", "0 25 * * *"); !strings.Contains(out, "error") {
+		t.Errorf("bad schedule allowed: %v", out)
+	}
+	if out := add("bad", "balance ops", "--cron", "@daily", "--catch-up", "never"); !strings.Contains(out, "error") {
+		t.Errorf("bad catch-up allowed: %v", out)
+	}
+
+	expectOutput(t, cli, "broken active [0 * * * *] next:2018-03-01T09:00:00Z catch-up:skip pay 1 --from nobody --to landlord\n"+
+		"rent active [0 9 1 * *] next:2018-03-01T09:00:00Z catch-up:once pay 100 --from ops --to landlord --memotext rent", "schedule list")
+
+	// Nothing is due yet
+	expectOutput(t, cli, "", "schedule run --once")
+
+	now = now.Add(62 * time.Minute)
+	out := cli.TestCommand("schedule run --once")
+	for _, want := range []string{
+		"job broken: running for 2018-03-01T09:00:00Z",
+		"job broken: failed",
+		"job rent: running for 2018-03-01T09:00:00Z: pay 100 --from ops --to landlord --memotext rent",
+		"job rent: ok",
+		"error",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output: %v", want, out)
+		}
+	}
+
+	// Each run happens exactly once
+	out = cli.TestCommand("schedule run --once")
+	if strings.Contains(out, "running") {
+		t.Errorf("job ran twice: %v", out)
+	}
+
+	expectOutput(t, cli, "2018-03-01T09:00:00Z ok", "schedule history rent")
+
+	// Even a scheduler sharing the store that missed the run (here, one that
+	// saved the job from before it ran) doesn't run it again.
+	job, _ := cli.getScheduledJob("rent")
+	job.LastRun = time.Time{}
+	cli.saveScheduledJob(job)
+	other := NewCLI()
+	other.SetStore(memStore)
+	out = other.TestCommand("schedule run --once")
+	if strings.Contains(out, "running") {
+		t.Errorf("job ran twice: %v", out)
+	}
+
+	// Missed runs are caught up according to the policy: rent runs once for the
+	// two months missed, and broken skips everything but the current hour.
+	now = time.Date(2018, 5, 10, 12, 3, 0, 0, time.UTC)
+	out = cli.TestCommand("schedule run --once")
+	if !strings.Contains(out, "job rent: running for 2018-05-01T09:00:00Z") || strings.Contains(out, "job rent: running for 2018-04-01") {
+		t.Errorf("unexpected catch-up: %v", out)
+	}
+	if !strings.Contains(out, "job broken: running for 2018-05-10T12:00:00Z") || !strings.Contains(out, "job broken: skipped run for 2018-05-10T11:00:00Z") {
+		t.Errorf("unexpected catch-up: %v", out)
+	}
+
+	expectOutput(t, cli, "2018-03-01T09:00:00Z ok\n2018-04-01T09:00:00Z skipped\n2018-05-01T09:00:00Z ok", "schedule history rent")
+	expectOutput(t, cli, "2018-05-01T09:00:00Z ok", "schedule history rent --limit 1")
+
+	// Paused jobs don't run, and skip what they missed when resumed
+	cli.TestCommand("schedule pause rent")
+	cli.TestCommand("schedule remove broken")
+	now = time.Date(2018, 6, 1, 9, 1, 0, 0, time.UTC)
+	expectOutput(t, cli, "", "schedule run --once")
+
+	cli.TestCommand("schedule resume rent")
+	expectOutput(t, cli, "", "schedule run --once")
+	expectOutput(t, cli, "rent active [0 9 1 * *] next:2018-07-01T09:00:00Z catch-up:once pay 100 --from ops --to landlord --memotext rent", "schedule list")
+
+	expectOutput(t, cli, "", "schedule history broken")
+	expectOutput(t, cli, "error", "schedule pause broken")
+	expectOutput(t, cli, "error", "schedule remove broken")
+}
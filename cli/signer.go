@@ -264,8 +264,9 @@ func (cli *CLI) buildSignerListCmd() *cobra.Command {
 
 				showSuccess(string(jsonSigners))
 			} else {
+				names := cli.namer()
 				for _, signer := range account.Signers {
-					showSuccess("address:%s weight:%d", signer.PublicKey, signer.Weight)
+					showSuccess("address:%s weight:%d", names.address(signer.PublicKey), signer.Weight)
 				}
 			}
 		},
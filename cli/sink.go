@@ -0,0 +1,269 @@
+package cli
+
+// This file contains the sinks that watch delivers events to, besides stdout.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// watchEvent is an entry from a horizon stream.
+type watchEvent struct {
+	Type        string      `json:"type"` // the watched entity, e.g., payments
+	Account     string      `json:"account,omitempty"`
+	Alias       string      `json:"alias,omitempty"` // the account name, for multiplexed streams
+	PagingToken string      `json:"paging_token"`
+	Data        interface{} `json:"data"`
+}
+
+// eventSink is somewhere watch sends events. deliver returns nil once the sink
+// has acknowledged the event.
+type eventSink interface {
+	name() string
+	deliver(ctx context.Context, event *watchEvent, payload []byte) error
+}
+
+// sinkBackoffBase is the delay before the first retry of a failed delivery.
+var sinkBackoffBase = time.Second
+
+// sinkDelivery sends events to a sink, with retries. Events that can't be
+// delivered are appended to the dead-letter file if there is one.
+type sinkDelivery struct {
+	sink       eventSink
+	retries    int
+	timeout    time.Duration // per attempt
+	deadLetter string        // file name, or "" for none
+}
+
+// deliver returns nil if the event was acknowledged by the sink, or written to
+// the dead-letter file.
+func (d *sinkDelivery) deliver(ctx context.Context, logFields logrus.Fields, event *watchEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "could not encode event")
+	}
+
+	delays := newBackoff(sinkBackoffBase, time.Minute)
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		err = d.sink.deliver(attemptCtx, event, payload)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= d.retries || ctx.Err() != nil {
+			break
+		}
+
+		delay := delays.next()
+		logrus.WithFields(logFields).Warnf("%s: delivery of %s failed: %v, retrying in %v", d.sink.name(), event.PagingToken, err, delay)
+		if !sleepContext(ctx, delay) {
+			break
+		}
+	}
+
+	if d.deadLetter == "" || ctx.Err() != nil {
+		return errors.Errorf("%s: could not deliver %s: %v", d.sink.name(), event.PagingToken, err)
+	}
+
+	logrus.WithFields(logFields).Errorf("%s: could not deliver %s: %v, writing to %s", d.sink.name(), event.PagingToken, err, d.deadLetter)
+	return writeDeadLetter(d.deadLetter, d.sink.name(), err, payload)
+}
+
+// writeDeadLetter appends an undeliverable event to fileName, one JSON object
+// per line.
+func writeDeadLetter(fileName string, sink string, deliveryErr error, payload []byte) error {
+	line, err := json.Marshal(map[string]interface{}{
+		"time":  time.Now().UTC(),
+		"sink":  sink,
+		"error": deliveryErr.Error(),
+		"event": json.RawMessage(payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "could not open dead-letter file")
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return errors.Wrapf(err, "could not write dead-letter file")
+	}
+
+	return nil
+}
+
+// buildFlagsForSinks adds the flags for watchSinks. onFailure is what happens
+// when an event can't be delivered and there's no dead-letter file.
+func buildFlagsForSinks(cmd *cobra.Command, onFailure string) {
+	cmd.Flags().StringSlice("webhook", []string{}, "POST each event as JSON to these URLs")
+	cmd.Flags().String("webhook-secret", "", "sign webhook requests with HMAC-SHA256 using this secret (X-Lumen-Signature header)")
+	cmd.Flags().StringSlice("exec", []string{}, "run these shell commands for each event (JSON on stdin, fields in LUMEN_* variables)")
+	cmd.Flags().Int("sink-retries", 3, "retries for failed webhook and exec deliveries")
+	cmd.Flags().Duration("sink-timeout", 30*time.Second, "timeout for each webhook or exec delivery")
+	cmd.Flags().String("dead-letter", "", "append events that can't be delivered to this file (default: "+onFailure+")")
+}
+
+// watchSinks returns the webhook and exec sinks requested on the command line.
+func (cli *CLI) watchSinks(cmd *cobra.Command) ([]*sinkDelivery, error) {
+	webhooks, _ := cmd.Flags().GetStringSlice("webhook")
+	commands, _ := cmd.Flags().GetStringSlice("exec")
+	secret, _ := cmd.Flags().GetString("webhook-secret")
+	retries, _ := cmd.Flags().GetInt("sink-retries")
+	timeout, _ := cmd.Flags().GetDuration("sink-timeout")
+	deadLetter, _ := cmd.Flags().GetString("dead-letter")
+
+	var sinks []eventSink
+	for _, webhook := range webhooks {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("bad webhook URL: %s", webhook)
+		}
+		sinks = append(sinks, &webhookSink{url: webhook, secret: secret})
+	}
+
+	for _, command := range commands {
+		sinks = append(sinks, &execSink{command: command})
+	}
+
+	var deliveries []*sinkDelivery
+	for _, sink := range sinks {
+		deliveries = append(deliveries, &sinkDelivery{sink: sink, retries: retries, timeout: timeout, deadLetter: deadLetter})
+	}
+
+	return deliveries, nil
+}
+
+// webhookSink POSTs events as JSON. If secret is set, the body is signed with
+// HMAC-SHA256 in the X-Lumen-Signature header.
+type webhookSink struct {
+	url    string
+	secret string
+}
+
+func (s *webhookSink) name() string {
+	return "webhook " + s.url
+}
+
+func (s *webhookSink) deliver(ctx context.Context, event *watchEvent, payload []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Lumen-Event", event.Type)
+	req.Header.Set("X-Lumen-Delivery", event.PagingToken)
+	if s.secret != "" {
+		req.Header.Set("X-Lumen-Signature", "sha256="+signPayload(s.secret, payload))
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("got %s", resp.Status)
+	}
+
+	return nil
+}
+
+// signPayload returns the hex-encoded HMAC-SHA256 of payload.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// execSink runs a shell command for each event. The event is sent as JSON on
+// stdin, and its fields are in LUMEN_* environment variables.
+type execSink struct {
+	command string
+}
+
+func (s *execSink) name() string {
+	return "exec " + s.command
+}
+
+func (s *execSink) deliver(ctx context.Context, event *watchEvent, payload []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = os.Stderr // stdout is for watch's own output
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), eventEnv(payload)...)
+
+	return cmd.Run()
+}
+
+var envUnsafe = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// eventEnv flattens the JSON payload of an event into LUMEN_* environment
+// variables, e.g., {"data": {"amount": "10"}} becomes LUMEN_AMOUNT=10. Fields
+// of the event itself (like LUMEN_TYPE) win over fields in its data.
+func eventEnv(payload []byte) []string {
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		return nil
+	}
+
+	vars := map[string]string{}
+	var flatten func(prefix string, value interface{})
+	flatten = func(prefix string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				if strings.HasPrefix(key, "_") {
+					continue // e.g., _links
+				}
+				flatten(prefix+"_"+envUnsafe.ReplaceAllString(strings.ToUpper(key), "_"), child)
+			}
+		case nil, []interface{}:
+			// skipped
+		default:
+			if _, ok := vars[prefix]; !ok {
+				vars[prefix] = fmt.Sprintf("%v", v)
+			}
+		}
+	}
+
+	data := event["data"]
+	delete(event, "data")
+	flatten("LUMEN", event)
+	flatten("LUMEN", data)
+
+	var env []string
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+
+	sort.Strings(env)
+	return env
+}
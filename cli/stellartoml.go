@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/stellartoml"
+)
+
+// stellarTomlURL returns the location of domain's stellar.toml file. Tests
+// point this at a local server.
+var stellarTomlURL = func(domain string) string {
+	return "https://" + domain + stellartoml.WellKnownPath
+}
+
+// stellarToml holds the parts of a SEP-1 stellar.toml file that lumen uses. The
+// vendored stellartoml client only knows about a few fields.
+type stellarToml struct {
+	NetworkPassphrase    string                `toml:"NETWORK_PASSPHRASE,omitempty"`
+	FederationServer     string                `toml:"FEDERATION_SERVER,omitempty"`
+	SigningKey           string                `toml:"SIGNING_KEY,omitempty"`
+	URIRequestSigningKey string                `toml:"URI_REQUEST_SIGNING_KEY,omitempty"`
+	Accounts             []string              `toml:"ACCOUNTS,omitempty"`
+	Currencies           []stellarTomlCurrency `toml:"CURRENCIES,omitempty"`
+}
+
+// stellarTomlCurrency is an entry in the CURRENCIES list of a stellar.toml file.
+type stellarTomlCurrency struct {
+	Code                   string `toml:"code"`
+	Issuer                 string `toml:"issuer"`
+	Status                 string `toml:"status,omitempty"`
+	Name                   string `toml:"name,omitempty"`
+	Desc                   string `toml:"desc,omitempty"`
+	Conditions             string `toml:"conditions,omitempty"`
+	Image                  string `toml:"image,omitempty"`
+	FixedNumber            int64  `toml:"fixed_number,omitzero"`
+	IsUnlimited            *bool  `toml:"is_unlimited"` // nil if unspecified
+	IsAssetAnchored        bool   `toml:"is_asset_anchored,omitempty"`
+	AnchorAssetType        string `toml:"anchor_asset_type,omitempty"`
+	AnchorAsset            string `toml:"anchor_asset,omitempty"`
+	RedemptionInstructions string `toml:"redemption_instructions,omitempty"`
+	Regulated              bool   `toml:"regulated,omitempty"`
+}
+
+// fixedSupply returns true if the currency claims that no more can be issued.
+func (c *stellarTomlCurrency) fixedSupply() bool {
+	return c.FixedNumber > 0 || (c.IsUnlimited != nil && !*c.IsUnlimited)
+}
+
+// fetchStellarToml downloads and parses the stellar.toml file for domain.
+func fetchStellarToml(domain string) (*stellarToml, error) {
+	resp, err := http.DefaultClient.Get(stellarTomlURL(domain))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not fetch stellar.toml for %s", domain)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("could not fetch stellar.toml for %s: %s", domain, resp.Status)
+	}
+
+	var result stellarToml
+	if _, err := toml.DecodeReader(io.LimitReader(resp.Body, stellartoml.StellarTomlMaxSize), &result); err != nil {
+		return nil, errors.Wrapf(err, "invalid stellar.toml for %s", domain)
+	}
+
+	return &result, nil
+}
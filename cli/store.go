@@ -0,0 +1,275 @@
+package cli
+
+// This file implements commands to inspect storage backends and move data
+// between them.
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0xfe/lumen/store"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// parseStoreSpec splits a store spec like "file,/path" or "redis,host:port"
+// into its driver and parameters.
+func parseStoreSpec(spec string) (string, string) {
+	parts := strings.Split(spec, ",")
+	driver := strings.TrimSpace(parts[0])
+	if len(parts) > 1 {
+		return driver, strings.TrimSpace(parts[1])
+	}
+
+	return driver, ""
+}
+
+func openStore(spec string) (store.API, error) {
+	driver, params := parseStoreSpec(spec)
+	s, err := store.NewStore(driver, params)
+	if err != nil {
+		return nil, errors.Errorf("could not open store %s: %v", spec, err)
+	}
+
+	return s, nil
+}
+
+// storeMigration is what migrateStore did (or would do.)
+type storeMigration struct {
+	copied    int      // keys written to the target
+	expiring  int      // copied keys that have a TTL
+	unchanged int      // keys the target already had
+	conflicts []string // keys the target has with different values
+}
+
+// migrateStore copies every unexpired key in from, with its remaining TTL,
+// to to, and then checks that to has them. If to already has some keys with
+// different values, nothing is written unless overwrite is set. If dryRun is
+// set, nothing is written.
+func migrateStore(from store.API, to store.API, overwrite bool, dryRun bool) (*storeMigration, error) {
+	keys, err := from.Keys("")
+	if err != nil {
+		return nil, errors.Errorf("could not list keys: %v", err)
+	}
+
+	type pair struct {
+		key, value string
+		ttl        time.Duration
+	}
+
+	result := &storeMigration{}
+	var pending []pair
+	for _, key := range keys {
+		value, err := from.Get(key)
+		if err != nil {
+			// Expired since we listed it
+			continue
+		}
+
+		ttl, err := from.TTL(key)
+		if err != nil {
+			continue
+		}
+
+		if old, err := to.Get(key); err == nil {
+			if old == value {
+				result.unchanged++
+				continue
+			}
+			result.conflicts = append(result.conflicts, key)
+		}
+
+		pending = append(pending, pair{key, value, ttl})
+		result.copied++
+		if ttl != 0 {
+			result.expiring++
+		}
+	}
+
+	if len(result.conflicts) > 0 && !overwrite {
+		return result, errors.Errorf("%d keys have different values in the target (%s), use --overwrite",
+			len(result.conflicts), strings.Join(result.conflicts, ", "))
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	for _, p := range pending {
+		if err := to.Set(p.key, p.value, p.ttl); err != nil {
+			return nil, errors.Errorf("could not write %s: %v", p.key, err)
+		}
+	}
+
+	var bad []string
+	for _, p := range pending {
+		value, err := to.Get(p.key)
+		if err != nil && p.ttl != 0 {
+			// Expired since we copied it
+			continue
+		}
+
+		if err != nil || value != p.value {
+			bad = append(bad, p.key)
+			continue
+		}
+
+		// Keys that expire in one store must expire in the other
+		if ttl, err := to.TTL(p.key); err == nil && (ttl == 0) != (p.ttl == 0) {
+			bad = append(bad, p.key)
+		}
+	}
+
+	if len(bad) > 0 {
+		return result, errors.Errorf("verification failed for %d keys: %s", len(bad), strings.Join(bad, ", "))
+	}
+
+	return result, nil
+}
+
+func (cli *CLI) buildStoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "store [info|migrate]",
+		Short: "inspect and migrate storage backends",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "store"}, "unrecognized store command: %s, expecting: info|migrate", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildStoreInfoCmd())
+	cmd.AddCommand(cli.buildStoreMigrateCmd())
+	return cmd
+}
+
+func (cli *CLI) buildStoreInfoCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "info [driver,params]",
+		Short: "show the driver and number of keys per namespace of the store (default: the current store)",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "store", "subcmd": "info"}
+
+			s := cli.store
+			if len(args) > 0 {
+				var err error
+				if s, err = openStore(args[0]); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+			}
+
+			if described, ok := s.(interface {
+				Driver() string
+				Parameters() string
+			}); ok {
+				showSuccess("driver: %s", described.Driver())
+				if params := described.Parameters(); params != "" {
+					showSuccess("parameters: %s", params)
+				}
+			}
+
+			if fs, ok := s.(*store.FileStore); ok {
+				version, seq := fs.Version()
+				showSuccess("version: %s", version)
+				showSuccess("seq: %d", seq)
+			}
+
+			keys, err := s.Keys("")
+			if err != nil {
+				cli.error(logFields, "could not list keys: %v", err)
+				return
+			}
+
+			counts := map[string]int{}
+			var namespaces []string
+			for _, key := range keys {
+				ns := strings.SplitN(key, ":", 2)[0]
+				if counts[ns] == 0 {
+					namespaces = append(namespaces, ns)
+				}
+				counts[ns]++
+			}
+			sort.Strings(namespaces)
+
+			showSuccess("keys: %d", len(keys))
+			for _, ns := range namespaces {
+				showSuccess("%s: %d keys", ns, counts[ns])
+			}
+		},
+	}
+}
+
+func (cli *CLI) buildStoreMigrateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate --from [driver,params] --to [driver,params]",
+		Short: "copy every key (with its remaining TTL) from one store to another",
+		Long: `Copy every key, with its remaining TTL, from one store to another, and then
+check that the target has them. Stores are specified like --store, e.g.,
+file,/home/mo/.lumen-data.json or redis,localhost:6379. If the target already
+has some keys with different values, nothing is copied unless you use
+--overwrite.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "store", "subcmd": "migrate"}
+			fromSpec, _ := cmd.Flags().GetString("from")
+			toSpec, _ := cmd.Flags().GetString("to")
+			overwrite, _ := cmd.Flags().GetBool("overwrite")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			fromDriver, fromParams := parseStoreSpec(fromSpec)
+			toDriver, toParams := parseStoreSpec(toSpec)
+			if fromDriver == toDriver && fromParams == toParams {
+				cli.error(logFields, "can't migrate %s to itself", fromSpec)
+				return
+			}
+
+			from, err := openStore(fromSpec)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			to, err := openStore(toSpec)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			result, err := migrateStore(from, to, overwrite, dryRun)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			copied, overwrote := "copied", "overwrote"
+			if dryRun {
+				copied, overwrote = "would copy", "would overwrite"
+			}
+
+			showSuccess("%s %d keys (%d expiring) from %s to %s", copied, result.copied, result.expiring, fromSpec, toSpec)
+			if result.unchanged > 0 {
+				showSuccess("%d keys were already there", result.unchanged)
+			}
+			if len(result.conflicts) > 0 {
+				showSuccess("%s %d keys: %s", overwrote, len(result.conflicts), strings.Join(result.conflicts, ", "))
+			}
+			if !dryRun {
+				showSuccess("verified %d keys", result.copied)
+			}
+		},
+	}
+
+	cmd.Flags().String("from", "", "store to copy from, e.g., file,/home/mo/.lumen-data.json")
+	cmd.Flags().String("to", "", "store to copy to, e.g., redis,localhost:6379")
+	cmd.Flags().Bool("overwrite", false, "overwrite keys that the target has with different values")
+	cmd.Flags().Bool("dry-run", false, "show what would be copied without writing anything")
+	cmd.MarkFlagRequired("from")
+	cmd.MarkFlagRequired("to")
+	return cmd
+}
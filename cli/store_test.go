@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xfe/lumen/store"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestStoreMigrate(t *testing.T) {
+	cli, _ := newTestCLI()
+
+	dir, _ := ioutil.TempDir("", "lumen-store")
+	defer os.RemoveAll(dir)
+	fromFile := dir + string(os.PathSeparator) + "from.json"
+	toFile := dir + string(os.PathSeparator) + "to.json"
+	from, to := "file,"+fromFile, "file,"+toFile
+
+	source, _ := store.NewStore("file", fromFile)
+	source.Set("global:ns", "prod", 0)
+	source.Set("prod:account:mo:address", "GAUYTZ24ATLEBIV63MXMPOPQO2T6NHI6TQYEXRTFYXWYZ3JOCVO6UYUM", 0)
+	source.Set("prod:fedcache:mo*qubit.sh", "{}", time.Hour)
+	source.Set("default:vars:config:network", "test", 0)
+
+	expectOutput(t, cli, "driver: file\nparameters: "+fromFile+"\nversion: 1\nseq: 4\nkeys: 4\n"+
+		"default: 1 keys\nglobal: 1 keys\nprod: 2 keys", "store info "+from)
+
+	expectOutput(t, cli, "error", "store migrate --from "+from+" --to "+from)
+	expectOutput(t, cli, "error", "store migrate --from bogus --to "+to)
+	expectOutput(t, cli, "would copy 4 keys (1 expiring) from "+from+" to "+to, "store migrate --from "+from+" --to "+to+" --dry-run")
+	if out := cli.TestCommand("store info " + to); !strings.Contains(out, "keys: 0") {
+		t.Errorf("dry run wrote keys: %v", out)
+	}
+
+	expectOutput(t, cli, "copied 4 keys (1 expiring) from "+from+" to "+to+"\nverified 4 keys", "store migrate --from "+from+" --to "+to)
+
+	target, _ := store.NewStore("file", toFile)
+	if ttl, err := target.TTL("prod:fedcache:mo*qubit.sh"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("want TTL copied, got %v (%v)", ttl, err)
+	}
+	if ttl, err := target.TTL("prod:account:mo:address"); err != nil || ttl != 0 {
+		t.Errorf("want no TTL, got %v (%v)", ttl, err)
+	}
+
+	// Keys that changed on both sides are conflicts
+	source.Set("default:vars:config:network", "public", 0)
+	source.Set("default:vars:config:new", "yes", 0)
+	expectOutput(t, cli, "error", "store migrate --from "+from+" --to "+to)
+	expectOutput(t, cli, "copied 2 keys (0 expiring) from "+from+" to "+to+"\n3 keys were already there\n"+
+		"overwrote 1 keys: default:vars:config:network\nverified 2 keys", "store migrate --from "+from+" --to "+to+" --overwrite")
+
+	target, _ = store.NewStore("file", toFile)
+	if value, _ := target.Get("default:vars:config:network"); value != "public" {
+		t.Errorf("want overwritten value, got %v", value)
+	}
+
+	out := cli.TestCommand("store info")
+	if !strings.HasPrefix(out, "driver: internal\nkeys: ") {
+		t.Errorf("unexpected info: %v", out)
+	}
+}
@@ -0,0 +1,470 @@
+package cli
+
+// This file contains the horizon streams behind watch, and the orderbook
+// poller. Lumen reads the streams itself, rather than with microstellar's
+// watchers, so it can stop them by cancelling their context.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// horizonRecord is an entry from a horizon stream that doesn't have its own
+// type, like an operation or an effect.
+type horizonRecord map[string]interface{}
+
+// summary returns the record on one line, e.g., "payment amount=10 ...". The
+// links and paging token are left out.
+func (r horizonRecord) summary(names *aliasNamer) string {
+	var keys []string
+	for key, value := range r {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			continue
+		}
+
+		if key != "type" && key != "type_i" && key != "paging_token" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var fields []string
+	if recordType, ok := r["type"].(string); ok {
+		fields = append(fields, recordType)
+	}
+
+	for _, key := range keys {
+		value := r[key]
+		if address, ok := value.(string); ok {
+			value = names.address(address)
+		}
+		fields = append(fields, fmt.Sprintf("%s=%v", key, value))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// streamEntries reads the server-sent events at endpoint, starting after cursor
+// (or from the beginning if cursor is ""), and calls handler with the paging
+// token and JSON of each entry. It returns when the stream ends or ctx is done.
+func streamEntries(ctx context.Context, endpoint string, cursor string, handler func(token string, data []byte)) error {
+	if cursor != "" {
+		separator := "?"
+		if strings.Contains(endpoint, "?") {
+			separator = "&"
+		}
+		endpoint += separator + "cursor=" + url.QueryEscape(cursor)
+	}
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got %s", resp.Status)
+	}
+
+	// Unblock the reader when we're stopped.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			resp.Body.Close()
+		case <-done:
+		}
+	}()
+
+	event := "message"
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// Events end with a blank line. Horizon also sends "open" and
+			// "close" events, which aren't entries.
+			if event == "message" && data.Len() > 0 {
+				var entry struct {
+					PagingToken string `json:"paging_token"`
+				}
+
+				if err := json.Unmarshal(data.Bytes(), &entry); err != nil {
+					return errors.Wrapf(err, "bad entry")
+				}
+				handler(entry.PagingToken, append([]byte{}, data.Bytes()...))
+			}
+
+			event = "message"
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return scanner.Err()
+}
+
+// endpoint returns the horizon URL for the stream's entries.
+func (s *watchStream) endpoint() string {
+	base := strings.TrimRight(s.horizon, "/")
+
+	if s.address != "" {
+		return fmt.Sprintf("%s/accounts/%s/%s", base, s.address, s.entity)
+	}
+
+	if s.entity == "ledger" {
+		return base + "/ledgers"
+	}
+
+	endpoint := base + "/" + s.entity
+	if s.entity == "trades" && s.base != nil {
+		query := url.Values{}
+		addAssetQuery(query, "base_", s.base)
+		addAssetQuery(query, "counter_", s.counter)
+		endpoint += "?" + query.Encode()
+	}
+
+	return endpoint
+}
+
+func addAssetQuery(query url.Values, prefix string, asset *microstellar.Asset) {
+	if asset.IsNative() {
+		query.Set(prefix+"asset_type", "native")
+		return
+	}
+
+	query.Set(prefix+"asset_type", string(asset.Type))
+	query.Set(prefix+"asset_code", asset.Code)
+	query.Set(prefix+"asset_issuer", asset.Issuer)
+}
+
+// decodeEntry returns the stream's entry in data: a microstellar.Payment (with
+// its memo), Transaction, Ledger or Offer for those streams, and a horizonRecord
+// for everything else.
+func (s *watchStream) decodeEntry(ctx context.Context, logFields logrus.Fields, data []byte) (interface{}, error) {
+	var entry interface{}
+	switch s.entity {
+	case "payments":
+		var payment microstellar.Payment
+		if err := json.Unmarshal(data, &payment); err != nil {
+			return nil, err
+		}
+
+		memoType, memo, err := loadMemo(ctx, s.horizon, payment.TransactionHash)
+		if err != nil {
+			logrus.WithFields(logFields).Warnf("can't load memo: %v", err)
+		}
+		payment.Memo.Type, payment.Memo.Value = memoType, memo
+		return &payment, nil
+	case "transactions":
+		entry = &microstellar.Transaction{}
+	case "ledger":
+		entry = &microstellar.Ledger{}
+	case "offers":
+		entry = &microstellar.Offer{}
+	default:
+		record := horizonRecord{}
+		err := json.Unmarshal(data, &record)
+		return record, err
+	}
+
+	err := json.Unmarshal(data, entry)
+	return entry, err
+}
+
+// priceLevelChange is a change to one price level of an orderbook.
+type priceLevelChange struct {
+	Side   string `json:"side"`   // bid or ask
+	Change string `json:"change"` // added, changed, or removed
+	Price  string `json:"price"`
+	Amount string `json:"amount"`
+	Was    string `json:"was,omitempty"` // the amount before the change
+}
+
+// orderBookDiff is what changed in an orderbook between two polls.
+type orderBookDiff struct {
+	Base    string             `json:"base"`
+	Counter string             `json:"counter"`
+	Changes []priceLevelChange `json:"changes"`
+}
+
+// diffOrderBooks returns the changes from old to new (either of which can be
+// nil), asks first, then bids, in the order of the book.
+func diffOrderBooks(old *microstellar.OrderBook, new *microstellar.OrderBook) []priceLevelChange {
+	var changes []priceLevelChange
+	diffSide := func(side string, before []microstellar.BidAsk, after []microstellar.BidAsk) {
+		amounts := map[string]string{}
+		for _, level := range before {
+			amounts[level.Price] = level.Amount
+		}
+
+		for _, level := range after {
+			was, ok := amounts[level.Price]
+			delete(amounts, level.Price)
+
+			if !ok {
+				changes = append(changes, priceLevelChange{Side: side, Change: "added", Price: level.Price, Amount: level.Amount})
+			} else if was != level.Amount {
+				changes = append(changes, priceLevelChange{Side: side, Change: "changed", Price: level.Price, Amount: level.Amount, Was: was})
+			}
+		}
+
+		for _, level := range before {
+			if was, ok := amounts[level.Price]; ok {
+				changes = append(changes, priceLevelChange{Side: side, Change: "removed", Price: level.Price, Amount: "0", Was: was})
+			}
+		}
+	}
+
+	var oldAsks, oldBids, newAsks, newBids []microstellar.BidAsk
+	if old != nil {
+		oldAsks, oldBids = old.Asks, old.Bids
+	}
+	if new != nil {
+		newAsks, newBids = new.Asks, new.Bids
+	}
+
+	diffSide("ask", oldAsks, newAsks)
+	diffSide("bid", oldBids, newBids)
+	return changes
+}
+
+// watchOrderBook polls the orderbook between the stream's assets every
+// stream.interval, and emits what changed. The first poll shows the whole book.
+func watchOrderBook(ctx context.Context, ms *microstellar.MicroStellar, logFields logrus.Fields, stream *watchStream) error {
+	var book *microstellar.OrderBook
+	delays := newBackoff(reconnectBackoffBase, time.Minute)
+
+	for {
+		delay := stream.interval
+		latest, err := ms.LoadOrderBook(stream.base, stream.counter)
+
+		if ctx.Err() != nil {
+			debugf(logFields, "stopped watching: %v", ctx.Err())
+			return nil
+		}
+
+		if err != nil {
+			delay = delays.next()
+			logrus.WithFields(logFields).Warnf("can't load orderbook: %v, retrying in %v", microstellar.ErrorString(err), delay)
+		} else {
+			delays.reset()
+			if changes := diffOrderBooks(book, latest); len(changes) > 0 {
+				diff := &orderBookDiff{Base: assetName(stream.base), Counter: assetName(stream.counter), Changes: changes}
+				if err := stream.emit(ctx, logFields, &watchEvent{Type: stream.entity, Data: diff}); err != nil {
+					return err
+				}
+			}
+			book = latest
+		}
+
+		if !sleepContext(ctx, delay) {
+			debugf(logFields, "stopped watching: %v", ctx.Err())
+			return nil
+		}
+	}
+}
+
+// assetName returns the asset's code, or "native" for lumens.
+func assetName(asset *microstellar.Asset) string {
+	if asset.IsNative() {
+		return "native"
+	}
+
+	return asset.Code
+}
+
+// showLine shows an entry in the "line" format.
+func showLine(logFields logrus.Fields, prefix string, entity string, entry interface{}, names *aliasNamer) {
+	switch entry := entry.(type) {
+	case *microstellar.Payment:
+		showPayment(logFields, prefix, entry, names)
+	case horizonRecord:
+		showSuccess("%s%s: %s", prefix, strings.TrimSuffix(entity, "s"), entry.summary(names))
+	case *microstellar.Offer:
+		selling, buying := entry.Selling.Code, entry.Buying.Code
+		if selling == "" {
+			selling = "xlm"
+		}
+
+		if buying == "" {
+			buying = "xlm"
+		}
+
+		showSuccess("%soffer: (%v) selling %s %s for %s at %s %s/%s",
+			prefix, entry.ID, entry.Amount, names.asset(selling, entry.Selling.Issuer), names.asset(buying, entry.Buying.Issuer),
+			entry.Price, buying, selling)
+	case *orderBookDiff:
+		for _, change := range entry.Changes {
+			was := ""
+			if change.Was != "" {
+				was = fmt.Sprintf(" (was %s)", change.Was)
+			}
+
+			// Asks are in the base asset, and bids in the counter asset.
+			unit := entry.Base
+			if change.Side == "bid" {
+				unit = entry.Counter
+			}
+
+			showSuccess("%s%s %s: %s %s at %s %s/%s%s", prefix, change.Side, change.Change,
+				change.Amount, unit, change.Price, entry.Counter, entry.Base, was)
+		}
+	default:
+		showEntry(logFields, prefix, entry, "line")
+	}
+}
+
+// paymentRecord is an entry from horizon's payments stream: a payment, path
+// payment, or account creation.
+type paymentRecord struct {
+	ID              string    `json:"id"`
+	PagingToken     string    `json:"paging_token"`
+	Type            string    `json:"type"`
+	From            string    `json:"from"`
+	To              string    `json:"to"`
+	Amount          string    `json:"amount"`
+	AssetType       string    `json:"asset_type"`
+	AssetCode       string    `json:"asset_code"`
+	AssetIssuer     string    `json:"asset_issuer"`
+	Funder          string    `json:"funder"`
+	Account         string    `json:"account"`
+	StartingBalance string    `json:"starting_balance"`
+	TxHash          string    `json:"transaction_hash"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// normalize fills in the payment fields of account creations.
+func (p *paymentRecord) normalize() {
+	if p.Type == "create_account" {
+		p.From, p.To, p.Amount, p.AssetType = p.Funder, p.Account, p.StartingBalance, "native"
+	}
+}
+
+// asset returns the code of the asset paid, or "native" for lumens.
+func (p *paymentRecord) asset() string {
+	if p.AssetType == "native" {
+		return "native"
+	}
+
+	return p.AssetCode
+}
+
+// loadMemo returns the memo type and memo of the transaction with hash.
+func loadMemo(ctx context.Context, horizon string, hash string) (string, string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/transactions/%s", strings.TrimRight(horizon, "/"), hash), nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.Errorf("could not load transaction %s: got %s", hash, resp.Status)
+	}
+
+	var tx struct {
+		MemoType string `json:"memo_type"`
+		Memo     string `json:"memo"`
+	}
+
+	if err := json.Unmarshal(body, &tx); err != nil {
+		return "", "", errors.Wrapf(err, "could not parse transaction %s", hash)
+	}
+
+	return tx.MemoType, tx.Memo, nil
+}
+
+// followPayments streams the payments to address, starting after cursor (or
+// now), and calls handler with each one until ctx is done or handler fails. It
+// reconnects (with backoff) when the stream drops.
+func followPayments(ctx context.Context, horizon string, address string, cursor string, handler func(token string, data []byte) error) error {
+	logFields := logrus.Fields{"method": "followPayments", "account": address}
+	endpoint := fmt.Sprintf("%s/accounts/%s/payments", strings.TrimRight(horizon, "/"), address)
+	delays := newBackoff(reconnectBackoffBase, time.Minute)
+
+	if cursor == "" {
+		cursor = "now"
+	}
+
+	for {
+		var handlerErr error
+		received := false
+
+		// Stop the stream as soon as a payment can't be handled.
+		streamCtx, cancel := context.WithCancel(ctx)
+		err := streamEntries(streamCtx, endpoint, cursor, func(token string, data []byte) {
+			received = true
+			if handlerErr != nil {
+				return
+			}
+
+			if handlerErr = handler(token, data); handlerErr == nil {
+				cursor = token
+			} else {
+				cancel()
+			}
+		})
+		cancel()
+
+		if handlerErr != nil && ctx.Err() == nil {
+			return handlerErr
+		}
+
+		if err != nil {
+			debugf(logFields, "connection closed: %v", err)
+		}
+
+		if received {
+			delays.reset()
+		}
+
+		if !sleepContext(ctx, delays.next()) {
+			return nil
+		}
+	}
+}
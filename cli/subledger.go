@@ -0,0 +1,642 @@
+package cli
+
+// This file contains the subledger: sub-accounts of a shared deposit account,
+// routed by memo ID.
+//
+// Every change to a sub-balance is an entry in the store, and balances are
+// summed from the entries. Entries for payments are keyed by operation ID and
+// written before the stream cursor moves, so replaying the stream after a crash
+// never credits (or bounces) a payment twice. Withdrawals and bounces are
+// written as pending before they're paid, and are never retried automatically.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Subledger entry kinds
+const (
+	entryDeposit    = "deposit"
+	entryWithdrawal = "withdrawal"
+	entryBounce     = "bounce"
+)
+
+// Subledger entry statuses
+const (
+	entryOK      = "ok"
+	entryPending = "pending" // being paid (or lumen crashed while paying)
+	entryFailed  = "failed"
+)
+
+// subledgerEntry is a deposit to, or withdrawal from, a sub-account, or a bounced
+// payment. It's stored as JSON at subledger:entry:ID.
+type subledgerEntry struct {
+	ID           string    `json:"id"` // the operation ID for payments
+	Kind         string    `json:"kind"`
+	Account      string    `json:"account,omitempty"`
+	Amount       string    `json:"amount"`
+	AssetCode    string    `json:"asset_code,omitempty"`
+	AssetIssuer  string    `json:"asset_issuer,omitempty"`
+	Counterparty string    `json:"counterparty"`
+	Memo         string    `json:"memo,omitempty"`
+	TxHash       string    `json:"tx_hash,omitempty"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+func subledgerEntryKey(id string) string {
+	return "subledger:entry:" + id
+}
+
+func subledgerAccountKey(name string) string {
+	return "subledger:account:" + name
+}
+
+func subledgerMemoKey(memo string) string {
+	return "subledger:memo:" + memo
+}
+
+// asset returns the entry's asset code, or "native" for lumens.
+func (e *subledgerEntry) asset() string {
+	if e.AssetIssuer == "" {
+		return "native"
+	}
+
+	return e.AssetCode
+}
+
+// debits returns true if the entry reduces the sub-balance. Pending withdrawals
+// count, so they can't be spent twice.
+func (e *subledgerEntry) debits() bool {
+	return e.Kind == entryWithdrawal && e.Status != entryFailed
+}
+
+func (e *subledgerEntry) describe(names *aliasNamer) string {
+	line := fmt.Sprintf("%s %s %s %s %s", e.Time.UTC().Format(time.RFC3339), e.Kind, e.Status, e.Amount, e.asset())
+	switch e.Kind {
+	case entryDeposit:
+		line += fmt.Sprintf(" to %s from %s", e.Account, names.address(e.Counterparty))
+	case entryWithdrawal:
+		line += fmt.Sprintf(" from %s to %s", e.Account, names.address(e.Counterparty))
+	case entryBounce:
+		line += fmt.Sprintf(" to %s", names.address(e.Counterparty))
+	}
+
+	if e.Memo != "" {
+		line += " memo:" + e.Memo
+	}
+
+	if e.Error != "" {
+		line += ": " + e.Error
+	}
+
+	return line
+}
+
+func (cli *CLI) getSubledgerEntry(id string) (*subledgerEntry, error) {
+	data, err := cli.GetVar(subledgerEntryKey(id))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &subledgerEntry{}
+	if err := json.Unmarshal([]byte(data), entry); err != nil {
+		return nil, errors.Errorf("bad subledger entry %s: %v", id, err)
+	}
+
+	return entry, nil
+}
+
+func (cli *CLI) saveSubledgerEntry(entry *subledgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return cli.SetVar(subledgerEntryKey(entry.ID), string(data))
+}
+
+// subledgerEntries returns the entries for the sub-account (or all of them if
+// account is ""), oldest first.
+func (cli *CLI) subledgerEntries(account string) ([]*subledgerEntry, error) {
+	prefix := fmt.Sprintf("%s:%s", cli.ns, subledgerEntryKey(""))
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*subledgerEntry
+	for _, key := range keys {
+		entry, err := cli.getSubledgerEntry(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			return nil, err
+		}
+
+		if account == "" || entry.Account == account {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	return entries, nil
+}
+
+// subledgerBalance is a sub-account's balance of one asset.
+type subledgerBalance struct {
+	AssetCode   string
+	AssetIssuer string
+	Amount      int64
+}
+
+func (b *subledgerBalance) asset() string {
+	return (&subledgerEntry{AssetCode: b.AssetCode, AssetIssuer: b.AssetIssuer}).asset()
+}
+
+// subledgerBalances sums the sub-account's entries, by asset.
+func (cli *CLI) subledgerBalances(account string) ([]*subledgerBalance, error) {
+	entries, err := cli.subledgerEntries(account)
+	if err != nil {
+		return nil, err
+	}
+
+	var balances []*subledgerBalance
+	byAsset := map[string]*subledgerBalance{}
+	for _, entry := range entries {
+		key := entry.AssetCode + ":" + entry.AssetIssuer
+		balance, ok := byAsset[key]
+		if !ok {
+			balance = &subledgerBalance{AssetCode: entry.AssetCode, AssetIssuer: entry.AssetIssuer}
+			byAsset[key] = balance
+			balances = append(balances, balance)
+		}
+
+		amount, _ := microstellar.ParseAmount(entry.Amount)
+		switch {
+		case entry.Kind == entryDeposit:
+			balance.Amount += amount
+		case entry.debits():
+			balance.Amount -= amount
+		}
+	}
+
+	sort.Slice(balances, func(i, j int) bool { return balances[i].asset() < balances[j].asset() })
+	return balances, nil
+}
+
+// subledgerAccounts returns the names of the sub-accounts.
+func (cli *CLI) subledgerAccounts() ([]string, error) {
+	prefix := fmt.Sprintf("%s:%s", cli.ns, subledgerAccountKey(""))
+	keys, err := cli.store.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, prefix))
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// subledgerDeposit returns the name and address of the deposit account.
+func (cli *CLI) subledgerDeposit(logFields logrus.Fields) (string, string, error) {
+	name, err := cli.GetVar("subledger:deposit")
+	if err != nil {
+		return "", "", errors.Errorf("no deposit account, see: lumen subledger init")
+	}
+
+	address, err := cli.ResolveAccount(logFields, name, "address")
+	if err == nil {
+		address, err = addressOf(address)
+	}
+
+	if err != nil {
+		return "", "", errors.Errorf("bad deposit account: %s", name)
+	}
+
+	return name, address, nil
+}
+
+// subledgerPay pays from the deposit account with the pay command, and records
+// the result in entry. The entry is saved as pending first, so a crash while
+// paying leaves a record of it.
+func (cli *CLI) subledgerPay(entry *subledgerEntry, payArgs ...string) error {
+	entry.Status = entryPending
+	if err := cli.saveSubledgerEntry(entry); err != nil {
+		return errors.Wrapf(err, "could not save entry")
+	}
+
+	if err := cli.runNested(append([]string{"pay"}, payArgs...)...); err != nil {
+		entry.Status = entryFailed
+		entry.Error = err.Error()
+	} else {
+		entry.Status = entryOK
+	}
+
+	if err := cli.saveSubledgerEntry(entry); err != nil {
+		return errors.Wrapf(err, "could not save entry")
+	}
+
+	if entry.Status == entryFailed {
+		return errors.Errorf("%s", entry.Error)
+	}
+
+	return nil
+}
+
+// applyDeposit credits the payment to the sub-account named by its memo ID, or
+// bounces it back to the sender if there isn't one.
+func (cli *CLI) applyDeposit(ctx context.Context, deposit string, address string, data []byte) error {
+	p := &paymentRecord{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return errors.Wrapf(err, "bad payment")
+	}
+
+	if p.normalize(); p.To != address || p.From == address {
+		return nil
+	}
+	from := cli.namer().address(p.From)
+
+	if _, err := cli.getSubledgerEntry(p.ID); err == nil {
+		debugf(logrus.Fields{"cmd": "subledger", "subcmd": "watch"}, "already recorded payment %s", p.ID)
+		return nil
+	}
+
+	memoType, memo, err := loadMemo(ctx, cli.horizonURL(), p.TxHash)
+	if err != nil {
+		return err
+	}
+
+	entry := &subledgerEntry{
+		ID:           p.ID,
+		Kind:         entryDeposit,
+		Amount:       p.Amount,
+		AssetCode:    p.AssetCode,
+		AssetIssuer:  p.AssetIssuer,
+		Counterparty: p.From,
+		Memo:         memo,
+		TxHash:       p.TxHash,
+		Status:       entryOK,
+		Time:         p.CreatedAt,
+	}
+
+	if memoType == "id" {
+		entry.Account, _ = cli.GetVar(subledgerMemoKey(memo))
+	}
+
+	if entry.Account != "" {
+		if err := cli.saveSubledgerEntry(entry); err != nil {
+			return errors.Wrapf(err, "could not save entry")
+		}
+
+		showSuccess("%s: credited %s %s from %s", entry.Account, p.Amount, p.asset(), from)
+		return nil
+	}
+
+	asset := "native"
+	if p.AssetType != "native" {
+		asset = p.AssetCode + ":" + p.AssetIssuer
+	}
+
+	entry.Kind = entryBounce
+	if err := cli.subledgerPay(entry, p.Amount, asset, "--from", deposit, "--to", p.From, "--memotext", "bounce: unknown memo"); err != nil {
+		showSuccess("could not bounce payment %s: %s %s to %s: %v", p.ID, p.Amount, p.asset(), from, err)
+		return nil
+	}
+
+	showSuccess("bounced payment %s: %s %s to %s (memo %q)", p.ID, p.Amount, p.asset(), from, memo)
+	return nil
+}
+
+func (cli *CLI) buildSubledgerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "subledger [init|add|list|balance|history|withdraw|watch]",
+		Short: "keep sub-accounts of a shared deposit account, routed by memo ID",
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "subledger"}, "unrecognized subledger command: %s, expecting: init|add|list|balance|history|withdraw|watch", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "init [account]",
+		Short: "use [account] as the deposit account",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "init"}
+
+			if _, err := cli.ResolveAccount(logFields, args[0], "seed"); err != nil {
+				cli.error(logFields, "no seed found for deposit account: %s", args[0])
+				return
+			}
+
+			if old, err := cli.GetVar("subledger:deposit"); err == nil && old != args[0] {
+				if entries, _ := cli.subledgerEntries(""); len(entries) > 0 {
+					cli.error(logFields, "subledger already has entries for deposit account: %s", old)
+					return
+				}
+			}
+
+			if err := cli.SetVar("subledger:deposit", args[0]); err != nil {
+				cli.error(logFields, "could not save deposit account: %v", err)
+				return
+			}
+		},
+	})
+
+	addCmd := &cobra.Command{
+		Use:   "add [name] [--memo id]",
+		Short: "add a sub-account, and show its memo ID",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "add"}
+			name := args[0]
+
+			if strings.ContainsAny(name, ": ") {
+				cli.error(logFields, "bad sub-account name: %s", name)
+				return
+			}
+
+			if _, err := cli.GetVar(subledgerAccountKey(name)); err == nil {
+				cli.error(logFields, "sub-account already exists: %s", name)
+				return
+			}
+
+			taken := func(id string) bool {
+				_, err := cli.GetVar(subledgerMemoKey(id))
+				return err == nil
+			}
+
+			memo, _ := cmd.Flags().GetString("memo")
+			if memo == "" {
+				var err error
+				if memo, err = newMemoID(taken); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+			} else if _, err := strconv.ParseUint(memo, 10, 64); err != nil {
+				cli.error(logFields, "bad memo ID: %s", memo)
+				return
+			} else if taken(memo) {
+				cli.error(logFields, "memo ID already used: %s", memo)
+				return
+			}
+
+			if err := cli.SetVar(subledgerMemoKey(memo), name); err != nil {
+				cli.error(logFields, "could not save sub-account: %v", err)
+				return
+			}
+
+			if err := cli.SetVar(subledgerAccountKey(name), memo); err != nil {
+				cli.error(logFields, "could not save sub-account: %v", err)
+				return
+			}
+
+			showSuccess("%s", memo)
+		},
+	}
+	addCmd.Flags().String("memo", "", "memo ID for deposits (default: random)")
+	cmd.AddCommand(addCmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "list sub-accounts, with their memo IDs and balances",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "list"}
+
+			names, err := cli.subledgerAccounts()
+			if err != nil {
+				cli.error(logFields, "could not load sub-accounts: %v", err)
+				return
+			}
+
+			for _, name := range names {
+				memo, _ := cli.GetVar(subledgerAccountKey(name))
+				line := fmt.Sprintf("%s memo:%s", name, memo)
+
+				balances, err := cli.subledgerBalances(name)
+				if err != nil {
+					cli.error(logFields, "could not load balances: %v", err)
+					return
+				}
+
+				for _, balance := range balances {
+					line += fmt.Sprintf(" %s:%s", balance.asset(), microstellar.ToAmountString(balance.Amount))
+				}
+
+				showSuccess("%s", line)
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "balance [name]",
+		Short: "show a sub-account's balances",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "balance"}
+
+			if _, err := cli.GetVar(subledgerAccountKey(args[0])); err != nil {
+				cli.error(logFields, "no such sub-account: %s", args[0])
+				return
+			}
+
+			balances, err := cli.subledgerBalances(args[0])
+			if err != nil {
+				cli.error(logFields, "could not load balances: %v", err)
+				return
+			}
+
+			for _, balance := range balances {
+				showSuccess("%s %s", balance.asset(), microstellar.ToAmountString(balance.Amount))
+			}
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "history [name]",
+		Short: "show a sub-account's deposits and withdrawals (or all entries, including bounces)",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "history"}
+			name := ""
+			if len(args) > 0 {
+				name = args[0]
+				if _, err := cli.GetVar(subledgerAccountKey(name)); err != nil {
+					cli.error(logFields, "no such sub-account: %s", name)
+					return
+				}
+			}
+
+			entries, err := cli.subledgerEntries(name)
+			if err != nil {
+				cli.error(logFields, "could not load entries: %v", err)
+				return
+			}
+
+			names := cli.namer()
+			for _, entry := range entries {
+				showSuccess("%s", entry.describe(names))
+			}
+		},
+	})
+
+	withdrawCmd := &cobra.Command{
+		Use:   "withdraw [name] [amount] [asset] --to [target]",
+		Short: "pay [amount] of [asset] from a sub-account's balance to [target]",
+		Args:  cobra.RangeArgs(2, 3),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "withdraw"}
+			name, amount := args[0], args[1]
+			assetName := "native"
+			if len(args) > 2 {
+				assetName = args[2]
+			}
+
+			deposit, _, err := cli.subledgerDeposit(logFields)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			if _, err := cli.GetVar(subledgerAccountKey(name)); err != nil {
+				cli.error(logFields, "no such sub-account: %s", name)
+				return
+			}
+
+			value, err := microstellar.ParseAmount(amount)
+			if err != nil || value <= 0 {
+				cli.error(logFields, "bad amount: %s", amount)
+				return
+			}
+
+			asset, err := cli.ResolveAsset(assetName)
+			if err != nil {
+				cli.error(logFields, "bad asset: %s", assetName)
+				return
+			}
+
+			to, _ := cmd.Flags().GetString("to")
+			target, err := cli.ResolveAccount(logFields, to, "address")
+			if err == nil {
+				target, err = addressOf(target)
+			}
+
+			if err != nil {
+				cli.error(logFields, "bad --to address: %s", to)
+				return
+			}
+
+			balances, err := cli.subledgerBalances(name)
+			if err != nil {
+				cli.error(logFields, "could not load balances: %v", err)
+				return
+			}
+
+			var available int64
+			for _, balance := range balances {
+				if balance.AssetIssuer == asset.Issuer && (asset.IsNative() || balance.AssetCode == asset.Code) {
+					available = balance.Amount
+				}
+			}
+
+			if value > available {
+				cli.error(logFields, "insufficient balance: %s has %s %s", name, microstellar.ToAmountString(available), assetName)
+				return
+			}
+
+			entry := &subledgerEntry{
+				ID:           fmt.Sprintf("w%d", time.Now().UnixNano()),
+				Kind:         entryWithdrawal,
+				Account:      name,
+				Amount:       microstellar.ToAmountString(value),
+				Counterparty: target,
+				Time:         time.Now().UTC(),
+			}
+
+			if !asset.IsNative() {
+				entry.AssetCode, entry.AssetIssuer = asset.Code, asset.Issuer
+			}
+
+			payArgs := []string{amount, assetName, "--from", deposit, "--to", target}
+			for _, flag := range []string{"memotext", "memoid"} {
+				if memo, _ := cmd.Flags().GetString(flag); memo != "" {
+					entry.Memo = memo
+					payArgs = append(payArgs, "--"+flag, memo)
+				}
+			}
+
+			if err := cli.subledgerPay(entry, payArgs...); err != nil {
+				cli.error(logFields, "withdrawal failed: %v", err)
+				return
+			}
+		},
+	}
+	withdrawCmd.Flags().String("to", "", "target account address or name")
+	withdrawCmd.Flags().String("memotext", "", "memo text")
+	withdrawCmd.Flags().String("memoid", "", "memo ID")
+	withdrawCmd.MarkFlagRequired("to")
+	cmd.AddCommand(withdrawCmd)
+
+	watchCmd := &cobra.Command{
+		Use:   "watch [--cursor token]",
+		Short: "credit deposits to sub-accounts as they arrive, and bounce payments with unknown memos",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "subledger", "subcmd": "watch"}
+
+			deposit, address, err := cli.subledgerDeposit(logFields)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			cursor, _ := cmd.Flags().GetString("cursor")
+			if cursor == "" {
+				cursor, _ = cli.GetVar("subledger:cursor")
+			}
+
+			ctx, cancel := context.WithCancel(cli.ctx)
+			defer cancel()
+			cli.setStopWatcher(cancel)
+
+			err = followPayments(ctx, cli.horizonURL(), address, cursor, func(token string, data []byte) error {
+				if err := cli.applyDeposit(ctx, deposit, address, data); err != nil {
+					return err
+				}
+				return cli.SetVar("subledger:cursor", token)
+			})
+
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+		},
+	}
+	watchCmd.Flags().String("cursor", "", "start after this paging token (default: where the last watch left off, or now)")
+	cmd.AddCommand(watchCmd)
+
+	return cmd
+}
@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestSubledger(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new deposit")
+	cli.TestCommand("account new customer")
+	cli.TestCommand("account new stranger")
+	cli.TestCommand("account new issuer")
+	cli.TestCommand("asset set USD issuer")
+	deposit := strings.TrimSpace(cli.TestCommand("account address deposit"))
+	customer := strings.TrimSpace(cli.TestCommand("account address customer"))
+	stranger := strings.TrimSpace(cli.TestCommand("account address stranger"))
+	issuer := strings.TrimSpace(cli.TestCommand("account address issuer"))
+	customerName, strangerName := customer+" (customer)", stranger+" (stranger)"
+
+	var mutex sync.Mutex
+	var payments []string
+	memos := map[string]string{}
+	submits := 0
+	failSubmits := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/transactions":
+			if failSubmits {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"title": "Transaction Failed", "status": 400, "extras": {"result_codes": {"transaction": "tx_failed"}}}`))
+				return
+			}
+			submits++
+			w.Write([]byte(`{"hash": "ok", "ledger": 10}`))
+		case r.URL.Path == "/accounts/"+deposit:
+			fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "100", "balances": [{"balance": "1000.0000000", "asset_type": "native"}]}`, deposit, deposit)
+		case r.URL.Path == "/accounts/"+deposit+"/payments":
+			if r.URL.Query().Get("cursor") == "now" {
+				for _, payment := range payments {
+					fmt.Fprintf(w, "data: %s\n\n", payment)
+				}
+				w.(http.Flusher).Flush()
+			}
+
+			mutex.Unlock()
+			<-r.Context().Done()
+			mutex.Lock()
+		case strings.HasPrefix(r.URL.Path, "/transactions/"):
+			memo := memos[strings.TrimPrefix(r.URL.Path, "/transactions/")]
+			if memo == "" {
+				fmt.Fprintf(w, `{"memo_type": "none"}`)
+			} else {
+				fmt.Fprintf(w, `{"memo_type": "id", "memo": "%s"}`, memo)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	expectOutput(t, cli, "error", "subledger watch")
+	cli.TestCommand("subledger init deposit")
+
+	expectOutput(t, cli, "100", "subledger add alice --memo 100")
+	bobMemo := strings.TrimSpace(cli.TestCommand("subledger add bob"))
+	expectOutput(t, cli, "error", "subledger add alice")
+	expectOutput(t, cli, "error", "subledger add carol --memo 100")
+	expectOutput(t, cli, "error", "subledger add carol --memo abc")
+
+	payment := func(id int, from string, amount string, asset string) string {
+		assetFields := `"asset_type": "native"`
+		if asset != "native" {
+			assetFields = fmt.Sprintf(`"asset_type": "credit_alphanum4", "asset_code": "%s", "asset_issuer": "%s"`, asset, issuer)
+		}
+		return fmt.Sprintf(`{"id": "%d", "paging_token": "%d", "type": "payment", "from": "%s", "to": "%s", "amount": "%s", %s, `+
+			`"transaction_hash": "tx%d", "created_at": "2018-03-01T00:00:0%dZ"}`, id, id, from, deposit, amount, assetFields, id, id)
+	}
+
+	mutex.Lock()
+	payments = []string{
+		payment(1, customer, "10.0000000", "USD"),
+		payment(2, customer, "5.0000000", "native"),
+		payment(3, stranger, "4.0000000", "USD"), // unknown memo
+		payment(4, stranger, "3.0000000", "USD"), // no memo
+		payment(5, customer, "2.0000000", "USD"),
+	}
+	memos = map[string]string{"tx1": "100", "tx2": "100", "tx3": "999", "tx5": bobMemo}
+	mutex.Unlock()
+
+	out := cli.TestCommand("subledger watch --timeout 300ms")
+	want := []string{
+		"alice: credited 10.0000000 USD from " + customerName,
+		"alice: credited 5.0000000 native from " + customerName,
+		"bounced payment 3: 4.0000000 USD to " + strangerName + ` (memo "999")`,
+		"bounced payment 4: 3.0000000 USD to " + strangerName + ` (memo "")`,
+		"bob: credited 2.0000000 USD from " + customerName,
+	}
+	if strings.TrimSpace(out) != strings.Join(want, "\n") {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if submits != 2 {
+		t.Errorf("want 2 bounces, got %d", submits)
+	}
+
+	// Replaying the stream doesn't credit or bounce anything twice
+	expectOutput(t, cli, "", "subledger watch --cursor now --timeout 200ms")
+	if submits != 2 {
+		t.Errorf("want 2 bounces, got %d", submits)
+	}
+
+	expectOutput(t, cli, "USD 10.0000000\nnative 5.0000000", "subledger balance alice")
+	expectOutput(t, cli, "alice memo:100 USD:10.0000000 native:5.0000000\nbob memo:"+bobMemo+" USD:2.0000000", "subledger list")
+
+	expectOutput(t, cli, "", "subledger withdraw alice 6 USD --to customer --memoid 7")
+	expectOutput(t, cli, "error", "subledger withdraw alice 5 USD --to customer")
+	expectOutput(t, cli, "error", "subledger withdraw alice 1 EUR --to customer")
+	expectOutput(t, cli, "error", "subledger withdraw nobody 1 USD --to customer")
+	expectOutput(t, cli, "USD 4.0000000\nnative 5.0000000", "subledger balance alice")
+
+	// Failed withdrawals are recorded, and don't touch the balance
+	mutex.Lock()
+	failSubmits = true
+	mutex.Unlock()
+	expectOutput(t, cli, "error", "subledger withdraw alice 2 native --to customer")
+	expectOutput(t, cli, "USD 4.0000000\nnative 5.0000000", "subledger balance alice")
+
+	lines := strings.Split(strings.TrimSpace(cli.TestCommand("subledger history alice")), "\n")
+	if len(lines) != 4 ||
+		lines[0] != "2018-03-01T00:00:01Z deposit ok 10.0000000 USD to alice from "+customerName+" memo:100" ||
+		!strings.Contains(lines[2], "withdrawal ok 6.0000000 USD from alice to "+customerName+" memo:7") ||
+		!strings.Contains(lines[3], "withdrawal failed 2.0000000 native from alice to "+customerName) {
+		t.Errorf("unexpected history: %v", lines)
+	}
+
+	out = cli.TestCommand("subledger history")
+	if !strings.Contains(out, "2018-03-01T00:00:03Z bounce ok 4.0000000 USD to "+strangerName+" memo:999") {
+		t.Errorf("unexpected history: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "subledger init stranger")
+}
@@ -0,0 +1,294 @@
+package cli
+
+// This file generates and verifies SEP-1 stellar.toml files for issuers.
+//
+// https://github.com/stellar/stellar-protocol/blob/master/ecosystem/sep-0001.md
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/0xfe/microstellar"
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// isLocked returns true if no key can sign for the account.
+func isLocked(account *microstellar.Account) bool {
+	for _, signer := range account.Signers {
+		if signer.Weight > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generateStellarToml builds a stellar.toml from the accounts in the current
+// namespace that lumen has seeds for, and the assets they issue.
+func (cli *CLI) generateStellarToml() (*stellarToml, error) {
+	result := &stellarToml{NetworkPassphrase: cli.networkPassphrase()}
+
+	names, err := cli.listAccounts()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list accounts")
+	}
+
+	controlled := map[string]bool{}
+	for _, name := range names {
+		seed, err := cli.GetVar(fmt.Sprintf("account:%s:seed", name))
+		if err != nil {
+			continue
+		}
+
+		address, err := addressOf(seed)
+		if err != nil || controlled[address] {
+			continue
+		}
+
+		controlled[address] = true
+		result.Accounts = append(result.Accounts, address)
+	}
+
+	assets, err := cli.listAssets()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list assets")
+	}
+
+	seen := map[string]bool{}
+	for _, name := range assets {
+		asset, err := cli.ResolveAsset(name)
+		if err != nil || asset.IsNative() || !controlled[asset.Issuer] || seen[asset.Code+":"+asset.Issuer] {
+			continue
+		}
+		seen[asset.Code+":"+asset.Issuer] = true
+
+		currency := stellarTomlCurrency{Code: asset.Code, Issuer: asset.Issuer}
+		if name != asset.Code {
+			currency.Name = name
+		}
+
+		account, err := cli.ms.LoadAccount(asset.Issuer)
+		if err != nil && !isNotFound(err) {
+			return nil, errors.Errorf("could not load issuer of %s: %v", name, microstellar.ErrorString(err))
+		}
+
+		if account != nil && isLocked(account) {
+			unlimited := false
+			currency.IsUnlimited = &unlimited
+		}
+
+		result.Currencies = append(result.Currencies, currency)
+	}
+
+	return result, nil
+}
+
+// verifyStellarToml checks the claims in domain's stellar.toml against the
+// network, and returns a list of mismatches.
+func (cli *CLI) verifyStellarToml(domain string, st *stellarToml) ([]string, error) {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// The keys that can sign for the listed accounts and issuers
+	loaded := 0
+	signers := map[string]bool{}
+	addSigners := func(account *microstellar.Account) {
+		loaded++
+		for _, signer := range account.Signers {
+			if signer.Weight > 0 {
+				signers[signer.PublicKey] = true
+			}
+		}
+	}
+
+	if st.NetworkPassphrase != "" && st.NetworkPassphrase != cli.networkPassphrase() {
+		problem("NETWORK_PASSPHRASE is %q, expecting %q", st.NetworkPassphrase, cli.networkPassphrase())
+	}
+
+	for _, key := range []struct{ name, value string }{
+		{"SIGNING_KEY", st.SigningKey},
+		{"URI_REQUEST_SIGNING_KEY", st.URIRequestSigningKey},
+	} {
+		if key.value != "" && microstellar.ValidAddress(key.value) != nil {
+			problem("%s is not a valid public key: %s", key.name, key.value)
+		}
+	}
+
+	for _, address := range st.Accounts {
+		if microstellar.ValidAddress(address) != nil {
+			problem("ACCOUNTS: invalid address: %s", address)
+			continue
+		}
+
+		account, err := cli.ms.LoadAccount(address)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, errors.Errorf("could not load account %s: %v", address, microstellar.ErrorString(err))
+			}
+			problem("ACCOUNTS: %s not found on the network", address)
+			continue
+		}
+
+		addSigners(account)
+	}
+
+	for _, currency := range st.Currencies {
+		name := currency.Code + ":" + currency.Issuer
+		if microstellar.ValidAddress(currency.Issuer) != nil {
+			problem("%s: invalid issuer", name)
+			continue
+		}
+
+		issuer, err := cli.ms.LoadAccount(currency.Issuer)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, errors.Errorf("could not load issuer of %s: %v", name, microstellar.ErrorString(err))
+			}
+			problem("%s: issuer not found on the network", name)
+			continue
+		}
+
+		addSigners(issuer)
+
+		if !strings.EqualFold(issuer.HomeDomain, domain) {
+			problem("%s: issuer home domain is %q, expecting %q", name, issuer.HomeDomain, domain)
+		}
+
+		if currency.Regulated && !(issuer.Flags.AuthRequired && issuer.Flags.AuthRevocable) {
+			problem("%s: regulated, but issuer doesn't have auth_required and auth_revocable set", name)
+		}
+
+		if currency.fixedSupply() && !isLocked(issuer) {
+			for _, signer := range issuer.Signers {
+				if signer.Weight > 0 {
+					problem("%s: fixed supply, but issuer can still be signed by %s (weight %d)", name, signer.PublicKey, signer.Weight)
+				}
+			}
+		}
+	}
+
+	if loaded > 0 && microstellar.ValidAddress(st.SigningKey) == nil && !signers[st.SigningKey] {
+		problem("SIGNING_KEY %s can't sign for any of the listed accounts or issuers", st.SigningKey)
+	}
+
+	return problems, nil
+}
+
+func (cli *CLI) buildTomlCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "toml [generate|verify]",
+		Short: "generate and verify stellar.toml files",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "toml"}, "unrecognized toml command: %s, expecting: generate|verify", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildTomlGenerateCmd())
+	cmd.AddCommand(cli.buildTomlVerifyCmd())
+
+	return cmd
+}
+
+func (cli *CLI) buildTomlGenerateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "generate a stellar.toml from the accounts and assets in this namespace",
+		Long: `Generate a stellar.toml from the accounts and assets in this namespace. ACCOUNTS
+lists the accounts that lumen has seeds for, and CURRENCIES lists the assets they
+issue. Assets whose issuer is locked are marked as not unlimited.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "toml", "subcmd": "generate"}
+
+			st, err := cli.generateStellarToml()
+			if err != nil {
+				cli.error(logFields, "could not generate stellar.toml: %v", err)
+				return
+			}
+
+			st.FederationServer, _ = cmd.Flags().GetString("federation-server")
+
+			for flag, field := range map[string]*string{
+				"signing-key":             &st.SigningKey,
+				"uri-request-signing-key": &st.URIRequestSigningKey,
+			} {
+				name, _ := cmd.Flags().GetString(flag)
+				if name == "" {
+					continue
+				}
+
+				address, err := cli.ResolveAccount(logFields, name, "address")
+				if err != nil || microstellar.ValidAddress(address) != nil {
+					cli.error(logFields, "invalid --%s: %s", flag, name)
+					return
+				}
+				*field = address
+			}
+
+			var buf bytes.Buffer
+			if err := toml.NewEncoder(&buf).Encode(st); err != nil {
+				cli.error(logFields, "could not encode stellar.toml: %v", err)
+				return
+			}
+
+			showSuccess("%s", strings.TrimSpace(buf.String()))
+		},
+	}
+
+	cmd.Flags().String("federation-server", "", "URL of the federation server (FEDERATION_SERVER)")
+	cmd.Flags().String("signing-key", "", "account whose public key is the SIGNING_KEY")
+	cmd.Flags().String("uri-request-signing-key", "", "account whose public key is the URI_REQUEST_SIGNING_KEY")
+
+	return cmd
+}
+
+func (cli *CLI) buildTomlVerifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify [domain]",
+		Short: "check the stellar.toml of [domain] against the network",
+		Long: `Fetch the stellar.toml of [domain] and check it against the network: each
+currency's issuer must exist and have [domain] as its home domain, regulated
+currencies must have auth_required and auth_revocable set, currencies with a
+fixed supply must have locked issuers, and SIGNING_KEY must be a signer on at
+least one of the listed accounts or issuers. URI_REQUEST_SIGNING_KEY is only
+checked for being a valid public key. Mismatches are listed, one per line.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "toml", "subcmd": "verify"}
+			domain := args[0]
+
+			st, err := fetchStellarToml(domain)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			problems, err := cli.verifyStellarToml(domain, st)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			for _, problem := range problems {
+				showSuccess("%s", problem)
+			}
+
+			if len(problems) > 0 {
+				cli.error(logFields, "stellar.toml for %s doesn't match the network: %d problem(s)", domain, len(problems))
+				return
+			}
+
+			debugf(logFields, "stellar.toml for %s: %d currencies ok", domain, len(st.Currencies))
+		},
+	}
+}
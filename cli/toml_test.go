@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestToml(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new issuer")
+	cli.TestCommand("account new gold-issuer")
+	cli.TestCommand("account new dist")
+	cli.TestCommand("asset set USD issuer")
+	cli.TestCommand("asset set dollars issuer --code USD")
+	cli.TestCommand("asset set gold gold-issuer --code GOLD")
+	cli.TestCommand("asset set EUR GAUYTZ24ATLEBIV63MXMPOPQO2T6NHI6TQYEXRTFYXWYZ3JOCVO6UYUM")
+	issuer := strings.TrimSpace(cli.TestCommand("account address issuer"))
+	goldIssuer := strings.TrimSpace(cli.TestCommand("account address gold-issuer"))
+	dist := strings.TrimSpace(cli.TestCommand("account address dist"))
+
+	type accountState struct {
+		domain string
+		flags  string
+		weight int
+	}
+
+	var mutex sync.Mutex
+	stellarTomlFile := ""
+	accounts := map[string]*accountState{
+		issuer:     {flags: "{}", weight: 1},
+		goldIssuer: {flags: "{}", weight: 0},
+		dist:       {flags: "{}", weight: 1},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if r.URL.Path == "/.well-known/stellar.toml" {
+			w.Write([]byte(stellarTomlFile))
+			return
+		}
+
+		address := strings.TrimPrefix(r.URL.Path, "/accounts/")
+		state, ok := accounts[address]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": 404, "title": "Resource Missing"}`))
+			return
+		}
+
+		fmt.Fprintf(w, `{"id": "%s", "account_id": "%s", "sequence": "100", "balances": [{"balance": "1000.0000000", "asset_type": "native"}], `+
+			`"signers": [{"public_key": "%s", "key": "%s", "weight": %d, "type": "ed25519_public_key"}], "flags": %s, "home_domain": "%s"}`,
+			address, address, address, address, state.weight, state.flags, state.domain)
+	}))
+	defer server.Close()
+
+	oldURL := stellarTomlURL
+	stellarTomlURL = func(domain string) string { return server.URL + "/.well-known/stellar.toml" }
+	defer func() { stellarTomlURL = oldURL }()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	out := cli.TestCommand("toml generate --federation-server https://example.com/federation --signing-key dist")
+	var st stellarToml
+	if _, err := toml.Decode(out, &st); err != nil {
+		t.Fatalf("could not decode stellar.toml: %v\n%s", err, out)
+	}
+
+	if st.NetworkPassphrase != "local" || st.FederationServer != "https://example.com/federation" || st.SigningKey != dist ||
+		strings.Join(st.Accounts, ",") != strings.Join([]string{dist, goldIssuer, issuer}, ",") {
+		t.Errorf("unexpected stellar.toml: %s", out)
+	}
+
+	if len(st.Currencies) != 2 ||
+		st.Currencies[0].Code != "USD" || st.Currencies[0].Issuer != issuer || st.Currencies[0].Name != "" || st.Currencies[0].IsUnlimited != nil ||
+		st.Currencies[1].Code != "GOLD" || st.Currencies[1].Issuer != goldIssuer || st.Currencies[1].Name != "gold" || !st.Currencies[1].fixedSupply() {
+		t.Errorf("unexpected currencies: %s", out)
+	}
+
+	expectOutput(t, cli, "error", "toml generate --signing-key nobody")
+
+	mutex.Lock()
+	stellarTomlFile = out
+	mutex.Unlock()
+
+	// The issuers don't point back at the domain yet
+	expectOutput(t, cli, `USD:`+issuer+`: issuer home domain is "", expecting "example.com"`+"\n"+
+		`GOLD:`+goldIssuer+`: issuer home domain is "", expecting "example.com"`+"\nerror", "toml verify example.com")
+
+	mutex.Lock()
+	accounts[issuer].domain = "example.com"
+	accounts[goldIssuer].domain = "example.com"
+	mutex.Unlock()
+	expectOutput(t, cli, "", "toml verify example.com")
+
+	// Claims that don't match the network
+	mutex.Lock()
+	accounts[goldIssuer].weight = 1
+	delete(accounts, dist)
+	stellarTomlFile = strings.Replace(out, `code = "USD"`, `code = "USD"`+"\n  regulated = true", 1)
+	mutex.Unlock()
+	expectOutput(t, cli, "ACCOUNTS: "+dist+" not found on the network\n"+
+		"USD:"+issuer+": regulated, but issuer doesn't have auth_required and auth_revocable set\n"+
+		"GOLD:"+goldIssuer+": fixed supply, but issuer can still be signed by "+goldIssuer+" (weight 1)\n"+
+		"SIGNING_KEY "+dist+" can't sign for any of the listed accounts or issuers\nerror", "toml verify example.com")
+
+	// Signers of any listed account or issuer are fine
+	mutex.Lock()
+	stellarTomlFile = strings.Replace(stellarTomlFile, dist, goldIssuer, -1)
+	mutex.Unlock()
+	expectOutput(t, cli, "USD:"+issuer+": regulated, but issuer doesn't have auth_required and auth_revocable set\n"+
+		"GOLD:"+goldIssuer+": fixed supply, but issuer can still be signed by "+goldIssuer+" (weight 1)\nerror", "toml verify example.com")
+
+	mutex.Lock()
+	accounts[issuer].flags = `{"auth_required": true, "auth_revocable": true}`
+	stellarTomlFile = `NETWORK_PASSPHRASE = "other"` + "\n" + `SIGNING_KEY = "bad"`
+	mutex.Unlock()
+	expectOutput(t, cli, `NETWORK_PASSPHRASE is "other", expecting "local"`+"\nSIGNING_KEY is not a valid public key: bad\nerror", "toml verify example.com")
+
+	mutex.Lock()
+	stellarTomlFile = "not toml"
+	mutex.Unlock()
+	expectOutput(t, cli, "error", "toml verify example.com")
+}
@@ -0,0 +1,428 @@
+package cli
+
+// This file contains the HTTP transports that lumen installs under microstellar's
+// horizon clients. They let lumen control how (and whether) the network is used
+// without changing microstellar.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// offlineTransport refuses all requests. Used for air-gapped operation.
+type offlineTransport struct{}
+
+func (t *offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logrus.WithFields(logrus.Fields{"type": "transport", "method": "offline"}).Debugf("blocked request: %s %s", req.Method, req.URL)
+	return nil, errors.Errorf("offline: refusing to contact %s", req.URL.Host)
+}
+
+// accountPath matches horizon's account endpoint (but not its sub-resources.)
+var accountPath = regexp.MustCompile(`^/accounts/([A-Z0-9]{56})/?$`)
+
+// sequenceTransport answers account lookups with a fixed sequence number so
+// that transactions can be built with --seq without loading the source account
+// from horizon. All other requests are passed on to next.
+type sequenceTransport struct {
+	next http.RoundTripper
+	seq  uint64 // sequence number to use for the next transaction
+}
+
+func (t *sequenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	matches := accountPath.FindStringSubmatch(req.URL.Path)
+	if req.Method != "GET" || matches == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	logrus.WithFields(logrus.Fields{"type": "transport", "method": "sequence"}).Debugf("using sequence %d for %s", t.seq, matches[1])
+
+	// Horizon returns the current sequence number, and the transaction builder
+	// adds one to it.
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":         matches[1],
+		"account_id": matches[1],
+		"sequence":   fmt.Sprintf("%d", t.seq-1),
+	})
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// horizonTransport adds per-request timeouts, retries with backoff, and
+// failover between horizon servers. Reads are retried on network errors, 429s
+// and 5xxs. Transaction submissions are retried too (resubmitting a signed
+// transaction is safe), but only after checking that an earlier attempt didn't
+// make it into the ledger, and never after the transaction's max time.
+type horizonTransport struct {
+	next        http.RoundTripper
+	ctx         context.Context // canceled by --timeout or Ctrl-C
+	hosts       []string        // horizon base URLs, for failover
+	current     int32           // index of the host that last worked
+	timeout     time.Duration   // per request, 0 for none
+	retries     int
+	backoffBase time.Duration
+	passphrase  string // network passphrase, for transaction hashes
+}
+
+// retryAfterLimit caps how long we honor Retry-After headers.
+const retryAfterLimit = time.Minute
+
+func (t *horizonTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logFields := logrus.Fields{"type": "transport", "method": "horizon"}
+
+	// Streams are long-lived, and reconnected by their callers. The horizon
+	// client streams without a context, so stop those with the command.
+	if req.Header.Get("Accept") == "text/event-stream" {
+		if req.Context() == context.Background() {
+			req = req.WithContext(t.ctx)
+		}
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostIndex, path := t.matchHost(req.URL.String())
+	submit := req.Method == "POST" && hostIndex >= 0 && strings.HasPrefix(path, "/transactions")
+
+	retries := 0
+	if req.Method == "GET" || req.Method == "HEAD" || submit {
+		retries = t.retries
+	}
+
+	var txHash string
+	var maxTime time.Time
+	if submit {
+		txHash, maxTime = t.txInfo(body)
+	}
+
+	delays := newBackoff(t.backoffBase, retryAfterLimit)
+	for attempt := 0; ; attempt++ {
+		target := req.URL.String()
+		host := ""
+		if hostIndex >= 0 {
+			index := (int(atomic.LoadInt32(&t.current)) + attempt) % len(t.hosts)
+			host = t.hosts[index]
+			target = host + path
+		}
+
+		// An earlier attempt may have been applied even though we didn't hear back.
+		if submit && attempt > 0 && txHash != "" {
+			if resp := t.findTransaction(host, txHash); resp != nil {
+				logrus.WithFields(logFields).Debugf("transaction %s already in ledger", txHash)
+				return resp, nil
+			}
+		}
+
+		// Don't cancel submissions half way, so we know their outcome.
+		parent := t.ctx
+		if submit {
+			parent = context.Background()
+		}
+
+		resp, err := t.send(parent, req, target, body)
+
+		if submit && attempt > 0 && err == nil && resp.StatusCode == http.StatusBadRequest && txHash != "" {
+			// e.g., tx_bad_seq because a previous attempt was applied
+			if found := t.findTransaction(host, txHash); found != nil {
+				resp.Body.Close()
+				return found, nil
+			}
+		}
+
+		retry, retryAfter := shouldRetry(resp, err)
+		if !retry {
+			if hostIndex >= 0 && err == nil && resp.StatusCode < 500 {
+				atomic.StoreInt32(&t.current, int32((int(atomic.LoadInt32(&t.current))+attempt)%len(t.hosts)))
+			}
+			return resp, err
+		}
+
+		if attempt >= retries || t.ctx.Err() != nil {
+			return resp, err
+		}
+
+		if submit && !maxTime.IsZero() && time.Now().Add(t.backoffBase).After(maxTime) {
+			logrus.WithFields(logFields).Debugf("not resubmitting %s, past its max time", txHash)
+			return resp, err
+		}
+
+		delay := delays.next()
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		if err != nil {
+			logrus.WithFields(logFields).Debugf("%s %s failed: %v, retrying in %v", req.Method, target, err, delay)
+		} else {
+			logrus.WithFields(logFields).Debugf("%s %s failed: %s, retrying in %v", req.Method, target, resp.Status, delay)
+			resp.Body.Close()
+		}
+
+		if !sleepContext(t.ctx, delay) {
+			return nil, t.ctx.Err()
+		}
+	}
+}
+
+// matchHost returns the index of the horizon server that rawURL belongs to, and
+// the rest of the URL. Returns -1 for other servers.
+func (t *horizonTransport) matchHost(rawURL string) (int, string) {
+	for i, host := range t.hosts {
+		if rest := strings.TrimPrefix(rawURL, host); rest != rawURL && (rest == "" || rest[0] == '/' || rest[0] == '?') {
+			return i, rest
+		}
+	}
+
+	return -1, rawURL
+}
+
+// send makes a single request to target, with the per-request timeout.
+func (t *horizonTransport) send(parent context.Context, req *http.Request, target string, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(parent)
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, t.timeout)
+	}
+
+	out := req.WithContext(ctx)
+	out.Header = cloneHeader(req.Header)
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	out.URL = targetURL
+	out.Host = targetURL.Host
+
+	if body != nil {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+
+	resp, err := t.next.RoundTrip(out)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cloneHeader returns a deep copy of header, so retries don't share it.
+func cloneHeader(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for k, v := range header {
+		out[k] = append([]string(nil), v...)
+	}
+
+	return out
+}
+
+// findTransaction looks up a submitted transaction by hash, returning the
+// response if it's in the ledger.
+func (t *horizonTransport) findTransaction(host string, hash string) *http.Response {
+	req, err := http.NewRequest("GET", host+"/transactions/"+hash, nil)
+	if err != nil {
+		return nil
+	}
+
+	resp, err := t.send(context.Background(), req, req.URL.String(), nil)
+	if err != nil {
+		return nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil
+	}
+
+	return resp
+}
+
+// txInfo returns the hash and max time of the transaction in a submission.
+func (t *horizonTransport) txInfo(body []byte) (string, time.Time) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil || values.Get("tx") == "" {
+		return "", time.Time{}
+	}
+
+	hash, txe, err := hashEnvelope(values.Get("tx"), t.passphrase)
+	if err != nil {
+		return "", time.Time{}
+	}
+
+	var maxTime time.Time
+	if txe.Tx.TimeBounds != nil && txe.Tx.TimeBounds.MaxTime != 0 {
+		maxTime = time.Unix(int64(txe.Tx.TimeBounds.MaxTime), 0)
+	}
+
+	return hash, maxTime
+}
+
+// shouldRetry returns true if the request can be retried, and how long the
+// server asked us to wait.
+func shouldRetry(resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		return true, 0
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return false, 0
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		delay := time.Duration(seconds) * time.Second
+		if delay > retryAfterLimit {
+			delay = retryAfterLimit
+		}
+		return true, delay
+	}
+
+	return true, 0
+}
+
+// cancelOnClose releases a request's context when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// baseTransport returns the transport that talks to the network, with the
+// proxy and CA settings from the configuration file.
+func baseTransport(config config) (http.RoundTripper, error) {
+	if config.proxy == "" && config.caFile == "" {
+		return http.DefaultTransport, nil
+	}
+
+	// The same settings as http.DefaultTransport
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if config.proxy != "" {
+		proxyURL, err := url.Parse(config.proxy)
+		if err != nil {
+			return nil, errors.Errorf("bad proxy: %s", config.proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.caFile != "" {
+		pem, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read CA file")
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in CA file: %s", config.caFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return transport, nil
+}
+
+// setupTransport installs the transports requested by the global flags and the
+// configuration file. Horizon clients in microstellar all share http.DefaultClient.
+func (cli *CLI) setupTransport(config config) {
+	transport, err := baseTransport(config)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"type": "setup"}).Fatalf("could not set up network: %v", err)
+		return
+	}
+
+	if offline, _ := cli.rootCmd.Flags().GetBool("offline"); offline {
+		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("offline mode, network disabled")
+		transport = &offlineTransport{}
+	} else {
+		servers := []string{cli.horizonURL()}
+		if cli.networkDef != nil {
+			servers = cli.networkDef.horizon
+		}
+
+		var hosts []string
+		for _, server := range servers {
+			hosts = append(hosts, strings.TrimRight(server, "/"))
+		}
+
+		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("horizon servers: %v, timeout: %v, retries: %d", hosts, config.horizonTimeout, config.horizonRetries)
+		transport = &horizonTransport{
+			next:        transport,
+			ctx:         cli.ctx,
+			hosts:       hosts,
+			timeout:     config.horizonTimeout,
+			retries:     config.horizonRetries,
+			backoffBase: 500 * time.Millisecond,
+			passphrase:  cli.networkPassphrase(),
+		}
+		transport = &journalTransport{next: transport, cli: cli}
+	}
+
+	if cli.rootCmd.Flag("seq").Changed {
+		seq, _ := cli.rootCmd.Flags().GetUint64("seq")
+		logrus.WithFields(logrus.Fields{"type": "setup"}).Debugf("using sequence number: %d", seq)
+		transport = &sequenceTransport{next: transport, seq: seq}
+	}
+
+	http.DefaultClient.Transport = transport
+}
+
+// goOffline disables network access for the rest of the command.
+func goOffline() {
+	http.DefaultClient.Transport = &offlineTransport{}
+}
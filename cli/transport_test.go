@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/network"
+)
+
+func newTestTransport(hosts ...string) *horizonTransport {
+	return &horizonTransport{
+		next:        http.DefaultTransport,
+		ctx:         context.Background(),
+		hosts:       hosts,
+		timeout:     time.Second,
+		retries:     3,
+		backoffBase: time.Millisecond,
+		passphrase:  network.TestNetworkPassphrase,
+	}
+}
+
+func get(t *testing.T, transport http.RoundTripper, target string) (int, string) {
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestTransportRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	status, body := get(t, newTestTransport(server.URL), server.URL+"/ledgers")
+	if status != http.StatusOK || body != "ok" || requests != 3 {
+		t.Errorf("want ok after 3 requests, got %d %q after %d", status, body, requests)
+	}
+
+	// Give up after the configured number of retries
+	requests = 0
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer down.Close()
+
+	transport := newTestTransport(down.URL)
+	transport.retries = 1
+	if status, _ := get(t, transport, down.URL+"/ledgers"); status != http.StatusTooManyRequests || requests != 2 {
+		t.Errorf("want 429 after 2 requests, got %d after %d", status, requests)
+	}
+
+	// Client errors aren't retried
+	requests = 0
+	notFound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer notFound.Close()
+
+	if status, _ := get(t, newTestTransport(notFound.URL), notFound.URL+"/accounts/foo"); status != http.StatusNotFound || requests != 1 {
+		t.Errorf("want one 404, got %d after %d", status, requests)
+	}
+}
+
+func TestTransportFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	var path string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.RequestURI()
+		w.Write([]byte("up"))
+	}))
+	defer up.Close()
+
+	transport := newTestTransport(down.URL, up.URL)
+	if status, body := get(t, transport, down.URL+"/ledgers?limit=1"); status != http.StatusOK || body != "up" || path != "/ledgers?limit=1" {
+		t.Errorf("no failover: %d %q %s", status, body, path)
+	}
+
+	// The server that worked is used first from now on.
+	down.Close()
+	transport.retries = 0
+	if status, body := get(t, transport, down.URL+"/ledgers"); status != http.StatusOK || body != "up" {
+		t.Errorf("last good server not used: %d %q", status, body)
+	}
+
+	// Requests to other servers are left alone.
+	if status, body := get(t, transport, up.URL+"/ledgers"); status != http.StatusOK || body != "up" {
+		t.Errorf("unexpected response: %d %q", status, body)
+	}
+}
+
+func TestTransportTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	transport := newTestTransport(slow.URL)
+	transport.timeout = 50 * time.Millisecond
+	transport.retries = 1
+
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	if _, err := client.Get(slow.URL + "/ledgers"); err == nil {
+		t.Errorf("expected timeout")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timeout not enforced: took %v", elapsed)
+	}
+
+	// Canceling the command's context stops everything
+	ctx, cancel := context.WithCancel(context.Background())
+	transport = newTestTransport(slow.URL)
+	transport.ctx = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start = time.Now()
+	if _, err := (&http.Client{Transport: transport}).Get(slow.URL + "/ledgers"); err == nil {
+		t.Errorf("expected cancellation")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cancellation ignored: took %v", elapsed)
+	}
+}
+
+func TestTransportResubmit(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+
+	envelope := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --seq 100 --nosubmit --offline"))
+	transport := newTestTransport()
+	hash, _ := transport.txInfo([]byte(url.Values{"tx": {envelope}}.Encode()))
+	if len(hash) != 64 {
+		t.Fatalf("bad transaction hash: %q", hash)
+	}
+
+	// The first submission makes it into the ledger, but the response is lost.
+	var submissions int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/transactions":
+			atomic.AddInt32(&submissions, 1)
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case r.URL.Path == "/transactions/"+hash && submissions > 0:
+			w.Write([]byte(`{"hash": "` + hash + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	transport.hosts = []string{server.URL}
+	client := &http.Client{Transport: transport}
+	resp, err := client.PostForm(server.URL+"/transactions", url.Values{"tx": {envelope}})
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), hash) || submissions != 1 {
+		t.Errorf("transaction resubmitted: %d %q after %d submissions", resp.StatusCode, body, submissions)
+	}
+}
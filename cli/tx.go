@@ -1,26 +1,34 @@
 package cli
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/0xfe/microstellar"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/stellar/go/xdr"
 )
 
 func (cli *CLI) buildTxCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "tx [sign|submit] [base64-encoded string] --signers seed1,seed2...",
+		Use:   "tx [prepare|sign|submit|decode] [base64-encoded string] --signers seed1,seed2...",
 		Short: "handle base64 encoded transactions",
 		Args:  cobra.MinimumNArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) > 0 {
-				showError(logrus.Fields{"cmd": "tx"}, "unrecognized tx command: %s, expecting: sign|submit", args[0])
+				showError(logrus.Fields{"cmd": "tx"}, "unrecognized tx command: %s, expecting: prepare|sign|submit|decode", args[0])
 				return
 			}
 		},
 	}
 
+	cmd.AddCommand(cli.buildTxPrepareCmd())
 	cmd.AddCommand(cli.buildTxSignCmd())
 	cmd.AddCommand(cli.buildTxSubmitCmd())
 	cmd.AddCommand(cli.buildTxDecodeCmd())
@@ -28,14 +36,108 @@ func (cli *CLI) buildTxCmd() *cobra.Command {
 	return cmd
 }
 
-func (cli *CLI) buildTxSignCmd() *cobra.Command {
+func (cli *CLI) buildTxPrepareCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "sign [base64-encoded transaction] --signers seed1,seed2...",
-		Short: "sign the supplied transaction (on the current network) with the given seeds (or accounts)",
-		Args:  cobra.MinimumNArgs(1),
+		Use:   "prepare [base64-encoded transaction] --bundle [file]",
+		Short: "load the current sequence number and signers for the transaction and write a bundle for offline signing",
+		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			b64tx := args[0]
 
+			logFields := logrus.Fields{"cmd": "tx", "subcmd": "prepare"}
+			bundleFile, _ := cmd.Flags().GetString("bundle")
+
+			txe, err := microstellar.DecodeTx(b64tx)
+			if err != nil {
+				cli.error(logFields, "decode error: %v", microstellar.ErrorString(err))
+				return
+			}
+
+			source := txe.Tx.SourceAccount.Address()
+			account := cli.LoadAccount(logFields, source)
+			if account == nil {
+				return
+			}
+
+			// Horizon has the last sequence number used by the account.
+			if seq, err := strconv.ParseUint(account.Sequence, 10, 64); err == nil {
+				txe.Tx.SeqNum = xdr.SequenceNumber(seq + 1)
+			} else {
+				debugf(logFields, "no sequence number for %s, keeping %d", source, txe.Tx.SeqNum)
+			}
+
+			fee, _ := cmd.Flags().GetUint32("fee")
+			if fee == 0 {
+				fee = cli.baseFee()
+			}
+
+			if fee > 0 {
+				txe.Tx.Fee = xdr.Uint32(fee * uint32(len(txe.Tx.Operations)))
+			}
+
+			// Any existing signatures are invalidated by the changes above.
+			if len(txe.Signatures) > 0 {
+				logrus.WithFields(logFields).Warnf("dropping %d existing signatures", len(txe.Signatures))
+				txe.Signatures = nil
+			}
+
+			envelope, err := xdr.MarshalBase64(txe)
+			if err != nil {
+				cli.error(logFields, "could not encode transaction: %v", err)
+				return
+			}
+
+			networkName, _, _ := parseNetworkSpec(cli.network)
+			bundle := &txBundle{
+				Version:    "1",
+				Network:    networkName,
+				Passphrase: cli.networkPassphrase(),
+				Envelope:   envelope,
+				Source:     source,
+				Sequence:   fmt.Sprintf("%d", txe.Tx.SeqNum),
+				Signers:    account.Signers,
+				Thresholds: account.Thresholds,
+				PreparedOn: time.Now().UTC(),
+			}
+
+			// With --seq the account isn't loaded, so there are no signers to record.
+			if cli.rootCmd.Flag("seq").Changed {
+				logrus.WithFields(logFields).Warnf("--seq skips loading %s, so the bundle has no signers or thresholds", source)
+				bundle.Signers = nil
+				bundle.Thresholds = microstellar.Thresholds{}
+				bundle.SignersUnknown = true
+			}
+
+			if err := bundle.write(bundleFile); err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			lines, _ := bundle.describe()
+			showSuccess("%s", strings.Join(lines, "\n"))
+		},
+	}
+
+	cmd.Flags().String("bundle", "", "write bundle to this file")
+	cmd.Flags().Uint32("fee", 0, "base fee (in stroops) per operation (default: the network's base fee)")
+	cmd.MarkFlagRequired("bundle")
+	return cmd
+}
+
+// confirm asks the user a yes/no question on the terminal.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func (cli *CLI) buildTxSignCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sign [base64-encoded transaction] --signers seed1,seed2... | --bundle [file]",
+		Short: "sign the supplied transaction (on the current network) with the given seeds (or accounts)",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
 			logFields := logrus.Fields{"cmd": "sign"}
 			signers, err := cmd.Flags().GetStringSlice("signers")
 
@@ -49,6 +151,45 @@ func (cli *CLI) buildTxSignCmd() *cobra.Command {
 				return
 			}
 
+			bundleFile, _ := cmd.Flags().GetString("bundle")
+			var bundle *txBundle
+			ms := cli.ms
+			b64tx := ""
+
+			if bundleFile != "" {
+				// Signing bundles is meant for air-gapped machines.
+				goOffline()
+
+				bundle, err = readBundle(bundleFile)
+				if err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+
+				lines, err := bundle.describe()
+				if err != nil {
+					cli.error(logFields, "bad transaction in bundle: %v", microstellar.ErrorString(err))
+					return
+				}
+
+				fmt.Fprintln(os.Stderr, strings.Join(lines, "\n"))
+				if bundle.SignersUnknown {
+					logrus.WithFields(logFields).Warnf("bundle was prepared with --seq: can't check the signers or thresholds for %s", bundle.Source)
+				}
+				if yes, _ := cmd.Flags().GetBool("yes"); !yes && !confirm("Sign this transaction?") {
+					cli.error(logFields, "not signing")
+					return
+				}
+
+				ms = microstellar.NewFromSpec(networkSpecWithPassphrase("custom", bundle.Passphrase))
+				b64tx = bundle.Envelope
+			} else if len(args) > 0 {
+				b64tx = args[0]
+			} else {
+				cli.error(logFields, "need a transaction or --bundle")
+				return
+			}
+
 			var seeds []string
 
 			for _, signer := range signers {
@@ -67,30 +208,60 @@ func (cli *CLI) buildTxSignCmd() *cobra.Command {
 				seeds = append(seeds, seed)
 			}
 
-			signedTx, err := cli.ms.SignTransaction(b64tx, seeds...)
+			signedTx, err := ms.SignTransaction(b64tx, seeds...)
 
 			if err != nil {
 				cli.error(logFields, "signing error: %v", err)
 				return
 			}
 
+			if bundle != nil {
+				bundle.Envelope = signedTx
+				if err := bundle.write(bundleFile); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+			}
+
 			showSuccess(signedTx)
 		},
 	}
 
 	buildFlagsForTxOptions(cmd)
+	cmd.Flags().String("bundle", "", "sign the transaction in this bundle (never uses the network)")
+	cmd.Flags().Bool("yes", false, "don't ask for confirmation before signing a bundle")
 	return cmd
 }
 
 func (cli *CLI) buildTxSubmitCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "submit [base64-encoded transaction]",
+		Use:   "submit [base64-encoded transaction] | --bundle [file]",
 		Short: "submit the supplied transaction to the current network",
-		Args:  cobra.MinimumNArgs(1),
+		Args:  cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			b64tx := args[0]
-
 			logFields := logrus.Fields{"cmd": "submit"}
+			b64tx := ""
+
+			if bundleFile, _ := cmd.Flags().GetString("bundle"); bundleFile != "" {
+				bundle, err := readBundle(bundleFile)
+				if err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+
+				if bundle.Passphrase != cli.networkPassphrase() {
+					cli.error(logFields, "bundle is for network %q, but lumen is on %q", bundle.Passphrase, cli.networkPassphrase())
+					return
+				}
+
+				b64tx = bundle.Envelope
+			} else if len(args) > 0 {
+				b64tx = args[0]
+			} else {
+				cli.error(logFields, "need a transaction or --bundle")
+				return
+			}
+
 			resp, err := cli.ms.SubmitTransaction(b64tx)
 
 			if err != nil {
@@ -103,6 +274,7 @@ func (cli *CLI) buildTxSubmitCmd() *cobra.Command {
 		},
 	}
 
+	cmd.Flags().String("bundle", "", "submit the transaction in this bundle")
 	return cmd
 }
 
@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/0xfe/microstellar"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestOfflineSigning(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+
+	dir, _ := ioutil.TempDir("", "lumen-tx")
+	defer os.RemoveAll(dir)
+	bundleFile := dir + string(os.PathSeparator) + "bundle.json"
+
+	// Build an unsigned transaction without touching the network
+	envelope := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --memotext rent --network test --seq 100 --nosign --nosubmit --offline"))
+	txe, err := microstellar.DecodeTx(envelope)
+	if err != nil {
+		t.Fatalf("bad envelope: %v", err)
+	}
+
+	if txe.Tx.SeqNum != 100 {
+		t.Errorf("wrong sequence number: want 100, got %v", txe.Tx.SeqNum)
+	}
+
+	expectOutput(t, cli, "error", "tx prepare "+envelope+" --bundle "+bundleFile+" --network test --offline")
+
+	out := cli.TestCommand("tx prepare " + envelope + " --bundle " + bundleFile + " --network test --seq 200 --fee 200")
+	if !strings.Contains(out, "sequence: 200") || !strings.Contains(out, "fee: 200 stroops") {
+		t.Errorf("unexpected bundle summary: %v", out)
+	}
+
+	// --seq skips loading the account, so the signers aren't known
+	if !strings.Contains(out, "signers: unknown (prepared with --seq)") || strings.Contains(out, "thresholds:") {
+		t.Errorf("want unknown signers in bundle summary, got: %v", out)
+	}
+
+	if bundle, err := readBundle(bundleFile); err != nil || !bundle.SignersUnknown || len(bundle.Signers) > 0 {
+		t.Errorf("want bundle with unknown signers: %+v %v", bundle, err)
+	}
+
+	expectOutput(t, cli, "error", "tx sign --bundle "+bundleFile+" --signers mo")
+
+	signed := strings.TrimSpace(cli.TestCommand("tx sign --bundle " + bundleFile + " --signers mo --yes"))
+	txe, err = microstellar.DecodeTx(signed)
+	if err != nil {
+		t.Fatalf("bad signed envelope: %v", err)
+	}
+
+	if len(txe.Signatures) != 1 || txe.Tx.SeqNum != 200 {
+		t.Errorf("unexpected signed transaction: %+v", txe)
+	}
+
+	bundle, err := readBundle(bundleFile)
+	if err != nil || bundle.Envelope != signed {
+		t.Errorf("bundle not updated: %v", err)
+	}
+
+	expectOutput(t, cli, "error", "tx submit --bundle "+bundleFile+" --network public")
+	expectOutput(t, cli, "error", "tx submit --bundle "+bundleFile+" --network test --offline")
+}
+
+func TestPassphrase(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+
+	envelope := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --seq 5 --nosubmit --offline"))
+	custom := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --seq 5 --nosubmit --offline --passphrase foobar"))
+
+	if envelope == custom {
+		t.Errorf("passphrase not used for signing")
+	}
+}
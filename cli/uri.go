@@ -0,0 +1,612 @@
+package cli
+
+// This file implements SEP-7 (web+stellar:) URIs, which ask a wallet to make a
+// payment or to sign a transaction.
+//
+// https://github.com/stellar/stellar-protocol/blob/master/ecosystem/sep-0007.md
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/0xfe/lumen/qr"
+	"github.com/0xfe/microstellar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+)
+
+const (
+	uriScheme          = "web+stellar"
+	uriSignaturePrefix = "stellar.sep.7 - URI Scheme"
+)
+
+// uriParam is a single query parameter. URIs are built from ordered lists so
+// that the signature covers a predictable string.
+type uriParam struct {
+	key   string
+	value string
+}
+
+// uriEscape URL-encodes a parameter value (with %20 for spaces, not +.)
+func uriEscape(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
+
+// buildURI returns a SEP-7 URI for operation ("pay" or "tx"). Empty parameters
+// are left out.
+func buildURI(operation string, params []uriParam) string {
+	var query []string
+	for _, param := range params {
+		if param.value != "" {
+			query = append(query, param.key+"="+uriEscape(param.value))
+		}
+	}
+
+	return uriScheme + ":" + operation + "?" + strings.Join(query, "&")
+}
+
+// uriSignaturePayload returns the bytes that are signed for uri: a 36 byte
+// prefix (35 zero bytes and 0x04), the SEP-7 prefix string, and the URI.
+func uriSignaturePayload(uri string) []byte {
+	payload := make([]byte, 36)
+	payload[35] = 4
+	payload = append(payload, []byte(uriSignaturePrefix)...)
+	return append(payload, []byte(uri)...)
+}
+
+// signURI signs uri with seed and appends the signature parameter.
+func signURI(uri string, seed string) (string, error) {
+	kp, err := keypair.Parse(seed)
+	if err != nil {
+		return "", errors.Errorf("invalid signing seed")
+	}
+
+	signature, err := kp.Sign(uriSignaturePayload(uri))
+	if err != nil {
+		return "", errors.Wrapf(err, "could not sign URI")
+	}
+
+	return uri + "&signature=" + uriEscape(base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// stellarURI is a parsed SEP-7 URI.
+type stellarURI struct {
+	operation string
+	params    url.Values
+	unsigned  string // the URI without the signature parameter
+	signature string
+}
+
+// parseURI parses and validates a SEP-7 URI.
+func parseURI(uri string) (*stellarURI, error) {
+	prefix := uriScheme + ":"
+	if !strings.HasPrefix(uri, prefix) {
+		return nil, errors.Errorf("not a %s URI", uriScheme)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(uri, prefix), "?", 2)
+	if len(parts) < 2 {
+		return nil, errors.Errorf("URI has no parameters")
+	}
+
+	result := &stellarURI{operation: parts[0], params: url.Values{}, unsigned: uri}
+	if result.operation != "pay" && result.operation != "tx" {
+		return nil, errors.Errorf("unsupported URI operation: %s", result.operation)
+	}
+
+	// Values are decoded by hand, because url.ParseQuery turns + into a space,
+	// and there are often unescaped +'s in base64 data.
+	fields := strings.Split(parts[1], "&")
+	for i, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) < 2 {
+			return nil, errors.Errorf("bad URI parameter: %s", field)
+		}
+
+		value, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, errors.Errorf("bad URI parameter: %s", field)
+		}
+
+		if kv[0] == "signature" {
+			if i != len(fields)-1 {
+				return nil, errors.Errorf("signature must be the last URI parameter")
+			}
+
+			result.signature = value
+			result.unsigned = strings.TrimSuffix(uri, "&"+field)
+		}
+
+		result.params.Add(kv[0], value)
+	}
+
+	return result, nil
+}
+
+// verify checks the URI's signature against the URI_REQUEST_SIGNING_KEY in
+// the stellar.toml of its origin domain. Unsigned URIs without an origin domain
+// verify, but have no origin.
+func (u *stellarURI) verify() error {
+	domain := u.params.Get("origin_domain")
+	if domain == "" {
+		return nil
+	}
+
+	if u.signature == "" {
+		return errors.Errorf("URI has an origin domain (%s), but no signature", domain)
+	}
+
+	toml, err := fetchStellarToml(domain)
+	if err != nil {
+		return err
+	}
+
+	if toml.URIRequestSigningKey == "" {
+		return errors.Errorf("stellar.toml for %s has no URI_REQUEST_SIGNING_KEY", domain)
+	}
+
+	kp, err := keypair.Parse(toml.URIRequestSigningKey)
+	if err != nil {
+		return errors.Errorf("bad URI_REQUEST_SIGNING_KEY for %s", domain)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(u.signature)
+	if err != nil {
+		return errors.Errorf("bad URI signature")
+	}
+
+	if err := kp.Verify(uriSignaturePayload(u.unsigned), signature); err != nil {
+		return errors.Errorf("URI signature does not match the signing key for %s", domain)
+	}
+
+	return nil
+}
+
+// passphrase returns the network the URI is meant for. SEP-7 defaults to the
+// public network.
+func (u *stellarURI) passphrase() string {
+	if passphrase := u.params.Get("network_passphrase"); passphrase != "" {
+		return passphrase
+	}
+
+	return network.PublicNetworkPassphrase
+}
+
+// describe returns a human readable summary of the request.
+func (u *stellarURI) describe() ([]string, error) {
+	var lines []string
+
+	if u.operation == "pay" {
+		lines = append(lines, "request: payment", "destination: "+u.params.Get("destination"))
+
+		amount := u.params.Get("amount")
+		if amount == "" {
+			amount = "(any)"
+		}
+
+		asset := "XLM"
+		if code := u.params.Get("asset_code"); code != "" {
+			asset = code + ":" + u.params.Get("asset_issuer")
+		}
+		lines = append(lines, fmt.Sprintf("amount: %s %s", amount, asset))
+
+		if memo := u.params.Get("memo"); memo != "" {
+			lines = append(lines, fmt.Sprintf("memo: %s %q", strings.ToLower(strings.TrimPrefix(u.params.Get("memo_type"), "MEMO_")), memo))
+		}
+	} else {
+		txe, err := microstellar.DecodeTx(u.params.Get("xdr"))
+		if err != nil {
+			return nil, errors.Errorf("bad transaction in URI: %v", microstellar.ErrorString(err))
+		}
+
+		lines = append(lines, "request: transaction")
+		lines = append(lines, describeTx(txe)...)
+
+		if pubkey := u.params.Get("pubkey"); pubkey != "" {
+			lines = append(lines, "signer: "+pubkey)
+		}
+	}
+
+	lines = append(lines, "network: "+u.passphrase())
+
+	if msg := u.params.Get("msg"); msg != "" {
+		lines = append(lines, "message: "+msg)
+	}
+
+	if callback := u.params.Get("callback"); callback != "" {
+		lines = append(lines, "callback: "+callback)
+	}
+
+	if domain := u.params.Get("origin_domain"); domain != "" {
+		lines = append(lines, fmt.Sprintf("origin: %s (verified)", domain))
+	} else {
+		lines = append(lines, "origin: none (unverified)")
+	}
+
+	return lines, nil
+}
+
+// postCallback sends a signed transaction to a URI's callback.
+func postCallback(callback string, envelope string) error {
+	if !strings.HasPrefix(callback, "url:") {
+		return errors.Errorf("unsupported callback: %s", callback)
+	}
+
+	resp, err := http.DefaultClient.PostForm(strings.TrimPrefix(callback, "url:"), url.Values{"xdr": []string{envelope}})
+	if err != nil {
+		return errors.Wrapf(err, "callback failed")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("callback failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// showQR renders text as a QR code on the terminal.
+func showQR(text string, invert bool) error {
+	code, err := qr.Encode([]byte(text), qr.Medium)
+	if err != nil {
+		// Long transactions may only fit with less error correction.
+		code, err = qr.Encode([]byte(text), qr.Low)
+		if err != nil {
+			return err
+		}
+	}
+
+	showSuccess("%s", strings.TrimRight(code.Terminal(invert), "\n"))
+	return nil
+}
+
+func (cli *CLI) buildURICmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "uri [pay|tx|open]",
+		Short: "generate and handle SEP-7 (web+stellar:) URIs",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 0 {
+				showError(logrus.Fields{"cmd": "uri"}, "unrecognized uri command: %s, expecting: pay|tx|open", args[0])
+				return
+			}
+		},
+	}
+
+	cmd.AddCommand(cli.buildURIPayCmd())
+	cmd.AddCommand(cli.buildURITxCmd())
+	cmd.AddCommand(cli.buildURIOpenCmd())
+
+	return cmd
+}
+
+// buildFlagsForURI adds the flags shared by the URI generators.
+func buildFlagsForURI(cmd *cobra.Command) {
+	cmd.Flags().String("msg", "", "message to show the user")
+	cmd.Flags().String("callback", "", "URL to POST the signed transaction to, instead of submitting it")
+	cmd.Flags().String("origin-domain", "", "sign the URI on behalf of this domain")
+	cmd.Flags().String("origin-signer", "", "seed or account with the domain's URI_REQUEST_SIGNING_KEY")
+	cmd.Flags().Bool("qr", false, "also show the URI as a QR code")
+	cmd.Flags().Bool("invert", false, "invert the QR code (for light terminals)")
+}
+
+// showURI adds the common parameters to params, signs the URI if requested,
+// and displays it.
+func (cli *CLI) showURI(cmd *cobra.Command, logFields logrus.Fields, operation string, params []uriParam) {
+	callback, _ := cmd.Flags().GetString("callback")
+	if callback != "" && !strings.HasPrefix(callback, "url:") {
+		callback = "url:" + callback
+	}
+
+	passphrase := cli.networkPassphrase()
+	if passphrase == network.PublicNetworkPassphrase {
+		passphrase = ""
+	}
+
+	msg, _ := cmd.Flags().GetString("msg")
+	domain, _ := cmd.Flags().GetString("origin-domain")
+
+	params = append(params,
+		uriParam{"callback", callback},
+		uriParam{"msg", msg},
+		uriParam{"network_passphrase", passphrase},
+		uriParam{"origin_domain", domain})
+
+	uri := buildURI(operation, params)
+
+	if domain != "" {
+		signer, _ := cmd.Flags().GetString("origin-signer")
+		if signer == "" {
+			cli.error(logFields, "--origin-domain needs --origin-signer")
+			return
+		}
+
+		seed, err := cli.ResolveAccount(logFields, signer, "seed")
+		if err != nil || microstellar.ValidSeed(seed) != nil {
+			cli.error(logFields, "no seed found in --origin-signer: %s", signer)
+			return
+		}
+
+		uri, err = signURI(uri, seed)
+		if err != nil {
+			cli.error(logFields, "%v", err)
+			return
+		}
+	}
+
+	showSuccess("%s", uri)
+
+	if showCode, _ := cmd.Flags().GetBool("qr"); showCode {
+		invert, _ := cmd.Flags().GetBool("invert")
+		if err := showQR(uri, invert); err != nil {
+			cli.error(logFields, "could not generate QR code: %v", err)
+			return
+		}
+	}
+}
+
+// uriMemo returns the SEP-7 memo and memo_type for the memo flags on cmd.
+func uriMemo(cmd *cobra.Command) (string, string, error) {
+	if memotext, _ := cmd.Flags().GetString("memotext"); memotext != "" {
+		return memotext, "MEMO_TEXT", nil
+	}
+
+	if memoid, _ := cmd.Flags().GetString("memoid"); memoid != "" {
+		if _, err := strconv.ParseUint(memoid, 10, 64); err != nil {
+			return "", "", errors.Errorf("bad memoid: %s", memoid)
+		}
+		return memoid, "MEMO_ID", nil
+	}
+
+	for _, flag := range []string{"memohash", "memoreturn"} {
+		if memo, _ := cmd.Flags().GetString(flag); memo != "" {
+			if hash, err := base64.StdEncoding.DecodeString(memo); err != nil || len(hash) != 32 {
+				return "", "", errors.Errorf("bad %s: %s", flag, memo)
+			}
+			return memo, "MEMO_" + strings.ToUpper(strings.TrimPrefix(flag, "memo")), nil
+		}
+	}
+
+	return "", "", nil
+}
+
+func (cli *CLI) buildURIPayCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pay [amount] [asset] --to [target]",
+		Short: "generate a URI requesting a payment of [amount] of [asset] to [target]",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "uri", "subcmd": "pay"}
+			amount := args[0]
+			assetName := ""
+			if len(args) > 1 {
+				assetName = args[1]
+			}
+
+			if _, err := microstellar.ParseAmount(amount); err != nil {
+				cli.error(logFields, "bad amount: %s", amount)
+				return
+			}
+
+			asset, err := cli.ResolveAsset(assetName)
+			if err != nil {
+				debugf(logFields, "could not get asset %s: %v", assetName, err)
+				cli.error(logFields, "bad asset: %s", assetName)
+				return
+			}
+
+			to, _ := cmd.Flags().GetString("to")
+			target, err := cli.ResolveAccount(logFields, to, "address")
+			if err == nil {
+				target, err = addressOf(target)
+			}
+
+			if err != nil {
+				cli.error(logFields, "bad --to address: %s", to)
+				return
+			}
+
+			memo, memoType, err := uriMemo(cmd)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			params := []uriParam{{"destination", target}, {"amount", amount}}
+			if !asset.IsNative() {
+				params = append(params, uriParam{"asset_code", asset.Code}, uriParam{"asset_issuer", asset.Issuer})
+			}
+			params = append(params, uriParam{"memo", memo}, uriParam{"memo_type", memoType})
+
+			cli.showURI(cmd, logFields, "pay", params)
+		},
+	}
+
+	buildFlagsForURI(cmd)
+	cmd.Flags().String("to", "", "target account address or name")
+	cmd.Flags().String("memotext", "", "memo text")
+	cmd.Flags().String("memoid", "", "memo ID")
+	cmd.Flags().String("memohash", "", "memo hash (base64-encoded)")
+	cmd.Flags().String("memoreturn", "", "memo return (base64-encoded)")
+	cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+func (cli *CLI) buildURITxCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tx [base64-encoded transaction]",
+		Short: "generate a URI requesting a signature on the transaction",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "uri", "subcmd": "tx"}
+
+			if _, err := microstellar.DecodeTx(args[0]); err != nil {
+				cli.error(logFields, "decode error: %v", microstellar.ErrorString(err))
+				return
+			}
+
+			pubkey := ""
+			if signer, _ := cmd.Flags().GetString("pubkey"); signer != "" {
+				address, err := cli.ResolveAccount(logFields, signer, "address")
+				if err == nil {
+					pubkey, err = addressOf(address)
+				}
+
+				if err != nil {
+					cli.error(logFields, "bad --pubkey: %s", signer)
+					return
+				}
+			}
+
+			cli.showURI(cmd, logFields, "tx", []uriParam{{"xdr", args[0]}, {"pubkey", pubkey}})
+		},
+	}
+
+	buildFlagsForURI(cmd)
+	cmd.Flags().String("pubkey", "", "account (or address) that should sign the transaction")
+
+	return cmd
+}
+
+func (cli *CLI) buildURIOpenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "open [uri] [--from source | --signers seed1,seed2...]",
+		Short: "verify and show a URI, then make the payment (with --from) or sign the transaction (with --signers)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logFields := logrus.Fields{"cmd": "uri", "subcmd": "open"}
+
+			uri, err := parseURI(args[0])
+			if err != nil {
+				cli.error(logFields, "bad URI: %v", err)
+				return
+			}
+
+			if err := uri.verify(); err != nil {
+				cli.error(logFields, "could not verify URI: %v", err)
+				return
+			}
+
+			lines, err := uri.describe()
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+			showSuccess("%s", strings.Join(lines, "\n"))
+
+			if uri.passphrase() != cli.networkPassphrase() {
+				cli.error(logFields, "URI is for network %q, but lumen is on %q (use --network or --passphrase)", uri.passphrase(), cli.networkPassphrase())
+				return
+			}
+
+			from, _ := cmd.Flags().GetString("from")
+			signers, _ := cmd.Flags().GetStringSlice("signers")
+
+			var command []string
+			switch {
+			case uri.operation == "pay" && from != "":
+				amount := uri.params.Get("amount")
+				if flagAmount, _ := cmd.Flags().GetString("amount"); flagAmount != "" {
+					if amount != "" && amount != flagAmount {
+						cli.error(logFields, "URI asks for %s, not %s", amount, flagAmount)
+						return
+					}
+					amount = flagAmount
+				}
+
+				if amount == "" {
+					cli.error(logFields, "URI has no amount, use --amount")
+					return
+				}
+
+				command = []string{"pay", amount}
+				if code := uri.params.Get("asset_code"); code != "" {
+					command = append(command, code+":"+uri.params.Get("asset_issuer"))
+				}
+				command = append(command, "--from", from, "--to", uri.params.Get("destination"))
+
+				if memo := uri.params.Get("memo"); memo != "" {
+					memoType := strings.ToLower(strings.TrimPrefix(uri.params.Get("memo_type"), "MEMO_"))
+					if memoType != "text" && memoType != "id" && memoType != "hash" && memoType != "return" {
+						cli.error(logFields, "bad memo_type: %s", uri.params.Get("memo_type"))
+						return
+					}
+					command = append(command, "--memo"+memoType, memo)
+				}
+			case uri.operation == "tx" && len(signers) > 0:
+				if uri.params.Get("replace") != "" {
+					cli.error(logFields, "URIs with replace parameters are not supported")
+					return
+				}
+
+				command = []string{"tx", "sign", uri.params.Get("xdr"), "--signers", strings.Join(signers, ",")}
+			default:
+				// Nothing to do but show the request.
+				return
+			}
+
+			if yes, _ := cmd.Flags().GetBool("yes"); !yes && !confirm("Proceed?") {
+				cli.error(logFields, "cancelled")
+				return
+			}
+
+			callback := uri.params.Get("callback")
+			if uri.operation == "pay" && callback == "" {
+				if err := cli.runNested(command...); err != nil {
+					cli.error(logFields, "payment failed: %v", err)
+				}
+				return
+			}
+
+			// The signed transaction is needed for the callback (or for submit.)
+			if uri.operation == "pay" {
+				command = append(command, "--nosubmit")
+			}
+
+			var nestedErr error
+			envelope := strings.TrimSpace(captureOutput(func() {
+				nestedErr = cli.runNested(command...)
+			}))
+
+			if nestedErr != nil {
+				cli.error(logFields, "could not sign transaction: %v", nestedErr)
+				return
+			}
+
+			if callback != "" {
+				if err := postCallback(callback, envelope); err != nil {
+					cli.error(logFields, "%v", err)
+					return
+				}
+
+				fmt.Fprintf(os.Stderr, "sent signed transaction to %s\n", strings.TrimPrefix(callback, "url:"))
+				return
+			}
+
+			if nosubmit, _ := cli.rootCmd.Flags().GetBool("nosubmit"); nosubmit {
+				showSuccess("%s", envelope)
+				return
+			}
+
+			if err := cli.runNested("tx", "submit", envelope); err != nil {
+				cli.error(logFields, "submit failed: %v", err)
+			}
+		},
+	}
+
+	cmd.Flags().String("from", "", "pay the request from this account")
+	cmd.Flags().StringSlice("signers", []string{}, "sign the requested transaction with these seeds or accounts")
+	cmd.Flags().String("amount", "", "amount to pay if the URI doesn't have one")
+	cmd.Flags().Bool("yes", false, "don't ask for confirmation")
+
+	return cmd
+}
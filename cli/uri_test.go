@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/0xfe/microstellar"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+func TestURIPay(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+	cli.TestCommand("set config:network fake")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	cli.TestCommand("asset set USD mo")
+
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+
+	uri := strings.TrimSpace(cli.TestCommand("uri pay 10 USD --to kelly --memotext rent --msg pay_me"))
+	want := "web+stellar:pay?destination=" + kelly + "&amount=10&asset_code=USD&asset_issuer=" + mo +
+		"&memo=rent&memo_type=MEMO_TEXT&msg=pay_me&network_passphrase=Test%20SDF%20Network%20%3B%20September%202015"
+	if uri != want {
+		t.Errorf("wrong URI: want %v, got %v", want, uri)
+	}
+
+	expectOutput(t, cli, "error", "uri pay 10 --to nobody")
+	expectOutput(t, cli, "error", "uri pay 10 --to kelly --memoid foo")
+	expectOutput(t, cli, "error", "uri pay 10 --to kelly --origin-domain example.com")
+
+	out := cli.TestCommand("uri open " + uri)
+	if !strings.Contains(out, "destination: "+kelly) || !strings.Contains(out, "amount: 10 USD:"+mo) || !strings.Contains(out, `memo: text "rent"`) {
+		t.Errorf("unexpected description: %v", out)
+	}
+
+	if strings.Contains(out, "error") {
+		t.Errorf("open failed: %v", out)
+	}
+
+	// Make the payment
+	out = cli.TestCommand("uri open " + uri + " --from mo --yes")
+	if strings.Contains(out, "error") {
+		t.Errorf("payment failed: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "uri open web+stellar:foo?bar=baz")
+	expectOutput(t, cli, "error", "uri open http://example.com")
+
+	// URIs without a network_passphrase are for the public network
+	out = cli.TestCommand("uri open web+stellar:pay?destination=" + kelly + "&amount=5 --from mo --yes")
+	if !strings.HasSuffix(strings.TrimSpace(out), "error") {
+		t.Errorf("expected network mismatch: %v", out)
+	}
+}
+
+func TestURISignatures(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+	cli.TestCommand("set config:network fake")
+
+	cli.TestCommand("account new signer")
+	cli.TestCommand("account new kelly")
+	signer := strings.TrimSpace(cli.TestCommand("account address signer"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("URI_REQUEST_SIGNING_KEY=\"" + signer + "\"\n"))
+	}))
+	defer server.Close()
+
+	oldURL := stellarTomlURL
+	stellarTomlURL = func(domain string) string { return server.URL }
+	defer func() { stellarTomlURL = oldURL }()
+
+	uri := strings.TrimSpace(cli.TestCommand("uri pay 10 --to kelly --origin-domain example.com --origin-signer signer"))
+	if !strings.Contains(uri, "&origin_domain=example.com&signature=") {
+		t.Fatalf("URI not signed: %v", uri)
+	}
+
+	out := cli.TestCommand("uri open " + uri)
+	if !strings.Contains(out, "origin: example.com (verified)") {
+		t.Errorf("URI not verified: %v", out)
+	}
+
+	tampered := strings.Replace(uri, "amount=10", "amount=1000", 1)
+	expectOutput(t, cli, "error", "uri open "+tampered)
+
+	unsigned := uri[:strings.Index(uri, "&signature=")]
+	expectOutput(t, cli, "error", "uri open "+unsigned)
+}
+
+func TestURITx(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+
+	envelope := strings.TrimSpace(cli.TestCommand("pay 10 --from mo --to kelly --seq 100 --nosign --nosubmit --offline"))
+	uri := strings.TrimSpace(cli.TestCommand("uri tx " + envelope + " --pubkey mo --qr --offline"))
+	lines := strings.Split(uri, "\n")
+	if !strings.HasPrefix(lines[0], "web+stellar:tx?xdr=") || len(lines) < 20 {
+		t.Fatalf("unexpected URI output: %v", uri)
+	}
+	uri = lines[0]
+
+	expectOutput(t, cli, "error", "uri tx foobar")
+
+	var posted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		posted = r.PostForm.Get("xdr")
+	}))
+	defer server.Close()
+
+	// Sign and send it to the callback
+	uri = strings.TrimSpace(cli.TestCommand("uri tx " + envelope + " --callback " + server.URL))
+	out := cli.TestCommand("uri open " + uri + " --signers mo --yes")
+	if strings.Contains(out, "error") {
+		t.Fatalf("open failed: %v", out)
+	}
+
+	txe, err := microstellar.DecodeTx(posted)
+	if err != nil || len(txe.Signatures) != 1 {
+		t.Errorf("callback didn't get a signed transaction: %v (%v)", posted, err)
+	}
+
+	// Without a callback, --nosubmit shows the signed transaction
+	uri = strings.TrimSpace(cli.TestCommand("uri tx " + envelope))
+	out = cli.TestCommand("uri open " + uri + " --signers mo --yes --nosubmit --offline")
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if lines[len(lines)-1] != posted {
+		t.Errorf("wrong signed transaction: %v", out)
+	}
+}
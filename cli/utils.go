@@ -1,7 +1,10 @@
 package cli
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"strconv"
@@ -13,6 +16,7 @@ import (
 	"github.com/0xfe/microstellar"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/stellar/go/keypair"
 )
 
 func showSuccess(msg string, args ...interface{}) {
@@ -26,7 +30,9 @@ func showError(fields logrus.Fields, msg string, args ...interface{}) {
 func (cli *CLI) help(cmd *cobra.Command, args []string) {
 	fmt.Fprint(os.Stderr, cmd.UsageString())
 
-	if !cli.testing {
+	if cli.nested > 0 {
+		cli.lastErr = errors.Errorf("bad command: %s", cmd.CommandPath())
+	} else if !cli.testing {
 		os.Exit(-1)
 	} else {
 		fmt.Println("error")
@@ -40,7 +46,9 @@ func debugf(fields logrus.Fields, msg string, args ...interface{}) {
 func (cli *CLI) error(logFields logrus.Fields, msg string, args ...interface{}) {
 	showError(logFields, msg, args...)
 
-	if !cli.testing {
+	if cli.nested > 0 {
+		cli.lastErr = errors.Errorf(msg, args...)
+	} else if !cli.testing {
 		os.Exit(-1)
 	} else {
 		fmt.Println("error")
@@ -59,7 +67,7 @@ func buildFlagsForTxOptions(cmd *cobra.Command) {
 }
 
 func (cli *CLI) genTxOptions(cmd *cobra.Command, logFields logrus.Fields) (*microstellar.Options, error) {
-	opts := microstellar.Opts()
+	opts := microstellar.Opts().WithContext(cli.ctx)
 
 	if memotext, err := cmd.Flags().GetString("memotext"); err == nil && memotext != "" {
 		opts = opts.WithMemoText(memotext)
@@ -140,16 +148,11 @@ func (cli *CLI) genTxOptions(cmd *cobra.Command, logFields logrus.Fields) (*micr
 		return nil, errors.Errorf("need both --mintime and --maxtime")
 	}
 
-	if nosubmit, _ := cli.rootCmd.Flags().GetBool("nosubmit"); nosubmit {
-		handler := func(args ...interface{}) (bool, error) {
-			showSuccess(args[0].(string))
-			return false, nil
-		}
-
-		txHandler := microstellar.TxHandler(handler)
+	nosubmit, _ := cli.rootCmd.Flags().GetBool("nosubmit")
+	if nosubmit {
 		logrus.WithFields(logFields).Debugf("sign-only transaction")
-		opts = opts.On(microstellar.EvBeforeSubmit, &txHandler)
 	}
+	opts = opts.On(microstellar.EvBeforeSubmit, cli.journalTx(nosubmit))
 
 	if nosign, err := cmd.Flags().GetBool("nosign"); err == nil && nosign {
 		opts = opts.SkipSignatures()
@@ -166,12 +169,12 @@ func (cli *CLI) ResolveAccount(fields logrus.Fields, lookupKey string, keyType s
 
 	if strings.Contains(lookupKey, "*") {
 		logrus.WithFields(fields).Debugf("resolving federation address: %s", lookupKey)
-		resolvedAddr, err := cli.ms.Resolve(lookupKey)
+		record, _, err := cli.resolveFederation(lookupKey)
 
 		if err == nil {
-			logrus.WithFields(fields).Debugf("got address: %s = %s", lookupKey, resolvedAddr)
-			addressOrSeed = resolvedAddr
-			lookupKey = resolvedAddr
+			logrus.WithFields(fields).Debugf("got address: %s = %s", lookupKey, record.Address)
+			addressOrSeed = record.Address
+			lookupKey = record.Address
 		}
 	}
 
@@ -311,3 +314,87 @@ func (cli *CLI) LoadAccount(logFields logrus.Fields, name string) *microstellar.
 
 	return account
 }
+
+// addressOf returns the address for addressOrSeed, deriving it if it's a seed.
+func addressOf(addressOrSeed string) (string, error) {
+	if microstellar.ValidAddress(addressOrSeed) == nil {
+		return addressOrSeed, nil
+	}
+
+	kp, err := keypair.Parse(addressOrSeed)
+	if err != nil {
+		return "", errors.Errorf("invalid address or seed: %s", addressOrSeed)
+	}
+
+	return kp.Address(), nil
+}
+
+// splitCommand splits a lumen command line into arguments, like a shell would:
+// on spaces, except in single or double quotes, with backslash escapes.
+func splitCommand(line string) ([]string, error) {
+	var args []string
+	var arg bytes.Buffer
+	inArg := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\\' && quote != '\'':
+			if i+1 == len(runes) {
+				return nil, errors.Errorf("trailing backslash in: %s", line)
+			}
+			i++
+			arg.WriteRune(runes[i])
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated quote in: %s", line)
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args, nil
+}
+
+// newMemoID returns a random memo ID that isn't taken. IDs fit in 53 bits, so
+// wallets that parse JSON numbers as doubles don't mangle them.
+func newMemoID(taken func(id string) bool) (string, error) {
+	for i := 0; i < 10; i++ {
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return "", err
+		}
+
+		id := strconv.FormatUint(binary.BigEndian.Uint64(buf[:])&(1<<53-1), 10)
+		if id != "0" && !taken(id) {
+			return id, nil
+		}
+	}
+
+	return "", errors.Errorf("could not generate a unique memo ID")
+}
@@ -1,8 +1,12 @@
 package cli
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/0xfe/microstellar"
@@ -11,118 +15,412 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func showEntry(logFields logrus.Fields, entry interface{}, format string) {
+// showEntry shows entry in format, starting with prefix (which tags the output
+// of multiplexed streams.)
+func showEntry(logFields logrus.Fields, prefix string, entry interface{}, format string) {
 	if format == "json" {
 		data, err := json.MarshalIndent(entry, "", "  ")
 
 		if err != nil {
 			logrus.WithFields(logFields).Errorf("skipping bad data: %v", err)
 		} else {
-			showSuccess("%v", string(data))
+			showSuccess("%s%v", prefix, string(data))
 		}
 	} else {
-		showSuccess("%+v", entry)
+		showSuccess("%s%+v", prefix, entry)
 	}
 }
 
-func showPayment(logFields logrus.Fields, payment *microstellar.Payment) {
+func showPayment(logFields logrus.Fields, prefix string, payment *microstellar.Payment, names *aliasNamer) {
 	memo := ""
-	if payment.Memo.Type != "none" {
+	if payment.Memo.Type != "none" && payment.Memo.Type != "" {
 		memo = fmt.Sprintf(" (memo: %v)", payment.Memo.Value)
 	}
 
 	if payment.Type == "create_account" {
-		showSuccess("create_account: %v funded with %v lumens %v", payment.Account, payment.StartingBalance, memo)
+		showSuccess("%screate_account: %v funded with %v lumens %v", prefix, names.address(payment.Account), payment.StartingBalance, memo)
 	} else if payment.Type == "payment" {
-		showSuccess("payment: %v %v from %v to %v %v", payment.Amount, payment.AssetCode, payment.From, payment.To, memo)
+		showSuccess("%spayment: %v %v from %v to %v %v", prefix, payment.Amount, names.asset(payment.AssetCode, payment.AssetIssuer),
+			names.address(payment.From), names.address(payment.To), memo)
 	}
 }
 
-func watch(ms *microstellar.MicroStellar, logFields logrus.Fields, entity string, address string, format string, stopFunc *func(), opts *microstellar.Options) error {
-	var watcher interface{}
-	var err error
-	var streamErr *error
-
-	for err == nil {
-		switch entity {
-		case "payments":
-			watcher, err = ms.WatchPayments(address, opts)
-			*stopFunc = watcher.(*microstellar.PaymentWatcher).Done
-			streamErr = watcher.(*microstellar.PaymentWatcher).Err
-			for entry := range watcher.(*microstellar.PaymentWatcher).Ch {
-				if format == "line" {
-					showPayment(logFields, entry)
-				} else {
-					showEntry(logFields, entry, format)
-				}
+// watchCheckpoint persists the paging token of the last entry shown by a
+// watcher, so it can pick up where it left off.
+type watchCheckpoint struct {
+	cli  *CLI
+	name string
+}
+
+func (c *watchCheckpoint) key() string {
+	return "watch:checkpoint:" + c.name
+}
+
+// load returns the saved paging token, or "" if there isn't one.
+func (c *watchCheckpoint) load() string {
+	token, err := c.cli.GetVar(c.key())
+	if err != nil {
+		return ""
+	}
+
+	return token
+}
+
+func (c *watchCheckpoint) save(token string) error {
+	return c.cli.SetVar(c.key(), token)
+}
+
+// watchStream is a stream being watched, and where its events go.
+type watchStream struct {
+	entity     string
+	address    string
+	tag        string // the account name, if multiplexed with other streams
+	format     string
+	cursor     string           // "" for the start
+	horizon    string           // the horizon URL
+	checkpoint *watchCheckpoint // nil for none
+	sinks      []*sinkDelivery
+	filter     *watchFilter // nil for none
+	lock       *sync.Mutex  // serializes emit across multiplexed streams
+	names      *aliasNamer  // for the "line" format, nil for raw addresses
+
+	// For trades between, and orderbooks of, an asset pair.
+	base     *microstellar.Asset
+	counter  *microstellar.Asset
+	interval time.Duration // between orderbook polls
+}
+
+// emit shows the event and delivers it to the stream's sinks, unless it's
+// filtered out. The stream's position is only advanced once every sink has the
+// event.
+func (s *watchStream) emit(ctx context.Context, logFields logrus.Fields, event *watchEvent) error {
+	if s.lock != nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+	}
+
+	if s.filter != nil && !s.filter.match(s.address, event.Data) {
+		debugf(logFields, "filtered out: %s", event.PagingToken)
+		s.advance(logFields, event.PagingToken)
+		return nil
+	}
+
+	prefix := ""
+	if s.tag != "" {
+		prefix = "[" + s.tag + "] "
+	}
+
+	if s.format == "line" {
+		showLine(logFields, prefix, s.entity, event.Data, s.names)
+	} else {
+		showEntry(logFields, prefix, event.Data, s.format)
+	}
+
+	for _, sink := range s.sinks {
+		if err := sink.deliver(ctx, logFields, event); err != nil {
+			return err
+		}
+	}
+
+	s.advance(logFields, event.PagingToken)
+	return nil
+}
+
+// advance moves the stream's position to just after token.
+func (s *watchStream) advance(logFields logrus.Fields, token string) {
+	if token == "" {
+		return
+	}
+
+	s.cursor = token
+	if s.checkpoint != nil {
+		if err := s.checkpoint.save(token); err != nil {
+			logrus.WithFields(logFields).Errorf("could not save checkpoint: %v", err)
+		}
+	}
+}
+
+// watch streams entries to stdout (and the stream's sinks) until ctx is done,
+// reconnecting (with backoff) when the stream drops. Reconnects resume after the
+// last entry emitted. If the stream has a checkpoint, the position is saved
+// after each entry, so entries are delivered at least once across restarts.
+func watch(ctx context.Context, ms *microstellar.MicroStellar, logFields logrus.Fields, stream *watchStream) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if stream.entity == "orderbook" {
+		return watchOrderBook(ctx, ms, logFields, stream)
+	}
+
+	delays := newBackoff(reconnectBackoffBase, time.Minute)
+
+	for {
+		received := false
+		var emitErr error
+
+		// Stop the stream at the first entry that can't be delivered.
+		err := streamEntries(ctx, stream.endpoint(), stream.cursor, func(token string, data []byte) {
+			received = true
+			if emitErr != nil {
+				return
+			}
+
+			entry, err := stream.decodeEntry(ctx, logFields, data)
+			if err != nil {
+				logrus.WithFields(logFields).Errorf("skipping bad data: %v", err)
+				stream.advance(logFields, token)
+				return
 			}
-		case "transactions":
-			watcher, err = ms.WatchTransactions(address, opts)
-			*stopFunc = watcher.(*microstellar.TransactionWatcher).Done
-			streamErr = watcher.(*microstellar.TransactionWatcher).Err
-			for entry := range watcher.(*microstellar.TransactionWatcher).Ch {
-				showEntry(logFields, entry, format)
-			}
-		case "ledger":
-			watcher, err = ms.WatchLedgers(opts)
-			*stopFunc = watcher.(*microstellar.LedgerWatcher).Done
-			streamErr = watcher.(*microstellar.LedgerWatcher).Err
-			for entry := range watcher.(*microstellar.LedgerWatcher).Ch {
-				showEntry(logFields, entry, format)
-			}
-		default:
-			return errors.Errorf("invalid watch entity: %s", entity)
+
+			event := &watchEvent{Type: stream.entity, Account: stream.address, Alias: stream.tag, PagingToken: token, Data: entry}
+			if emitErr = stream.emit(ctx, logFields, event); emitErr != nil {
+				cancel()
+			}
+		})
+
+		if emitErr != nil {
+			return emitErr
+		}
+
+		if err != nil {
+			debugf(logFields, "connection closed: %v", err)
 		}
 
-		if *streamErr != nil {
-			debugf(logFields, "connection closed: %v", *streamErr)
+		if received {
+			delays.reset()
 		}
 
+		delay := delays.next()
+		debugf(logFields, "retrying in %v...", delay)
+		if !sleepContext(ctx, delay) {
+			debugf(logFields, "stopped watching: %v", ctx.Err())
+			return nil
+		}
+	}
+}
+
+// watchAccounts returns the accounts to watch, from the command line, the
+// --accounts, --all-aliases, and --from-file flags, with duplicates removed.
+func (cli *CLI) watchAccounts(cmd *cobra.Command, args []string) ([]string, error) {
+	names := args
+	more, _ := cmd.Flags().GetStringSlice("accounts")
+	names = append(names, more...)
+
+	if all, _ := cmd.Flags().GetBool("all-aliases"); all {
+		aliases, err := cli.listAccounts()
 		if err != nil {
-			return errors.Wrapf(err, "can't watch address: %v", microstellar.ErrorString(err))
+			return nil, errors.Wrapf(err, "could not list accounts")
 		}
 
-		debugf(logFields, "retrying in 2s...")
-		time.Sleep(2 * time.Second)
+		if len(aliases) == 0 {
+			return nil, errors.Errorf("no accounts in namespace: %s", cli.ns)
+		}
+		names = append(names, aliases...)
 	}
 
-	return nil
+	if fileName, _ := cmd.Flags().GetString("from-file"); fileName != "" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read accounts")
+		}
+
+		// One account per line, with # comments.
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = line[:i]
+			}
+
+			if line = strings.TrimSpace(line); line != "" {
+				names = append(names, line)
+			}
+		}
+	}
+
+	var accounts []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			accounts = append(accounts, name)
+		}
+	}
+
+	return accounts, nil
 }
 
+// watchEntities are the things that can be watched.
+var watchEntities = []string{"payments", "transactions", "operations", "effects", "trades", "offers", "ledger", "orderbook"}
+
 func (cli *CLI) buildWatchCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "watch [payments|transactions|ledger] [account]",
+		Use:   "watch [payments|transactions|operations|effects|trades|offers|ledger|orderbook] [account | sell_asset buy_asset] [--accounts a,b,c] [--checkpoint name]",
 		Short: "watch the account on the ledger",
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			entity := args[0]
-			address := ""
 
 			logFields := logrus.Fields{"cmd": "watch"}
 
-			if len(args) > 1 {
-				name := args[1]
+			if !strings.Contains(","+strings.Join(watchEntities, ",")+",", ","+entity+",") {
+				cli.error(logFields, "invalid watch entity: %s, expecting: %s", entity, strings.Join(watchEntities, "|"))
+				return
+			}
+
+			// Orderbooks, and optionally trades, are for an asset pair.
+			var base, counter *microstellar.Asset
+			if entity == "orderbook" || (entity == "trades" && len(args) == 3) {
+				if len(args) != 3 {
+					cli.error(logFields, "usage: watch %s [sell_asset] [buy_asset]", entity)
+					return
+				}
+
 				var err error
-				address, err = cli.ResolveAccount(logFields, name, "address")
+				if base, err = cli.ResolveAsset(args[1]); err != nil {
+					cli.error(logFields, "invalid sell asset: %s", args[1])
+					return
+				}
 
-				if err != nil {
-					cli.error(logFields, "invalid address: %s", name)
+				if counter, err = cli.ResolveAsset(args[2]); err != nil {
+					cli.error(logFields, "invalid buy asset: %s", args[2])
 					return
 				}
+				args = args[:1]
 			}
 
-			opts := microstellar.Opts()
-			cursor, _ := cmd.Flags().GetString("cursor")
+			accounts, err := cli.watchAccounts(cmd, args[1:])
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
 
-			if cursor != "start" {
-				opts = opts.WithCursor(cursor)
+			if len(accounts) > 0 && (entity == "ledger" || base != nil) {
+				cli.error(logFields, "can't watch %s for accounts", entity)
+				return
 			}
 
-			format, _ := cmd.Flags().GetString("format")
-			err := watch(cli.ms, logFields, entity, address, format, &cli.stopWatcher, opts)
+			if len(accounts) == 0 && entity == "offers" {
+				cli.error(logFields, "can't watch offers without an account")
+				return
+			}
+
+			if len(accounts) == 0 {
+				accounts = []string{""}
+			}
 
+			sinks, err := cli.watchSinks(cmd)
 			if err != nil {
-				cli.error(logFields, "can't watch stream: %v", microstellar.ErrorString(err))
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			filter, err := cli.genWatchFilter(cmd, logFields, entity)
+			if err != nil {
+				cli.error(logFields, "%v", err)
+				return
+			}
+
+			format, _ := cmd.Flags().GetString("format")
+			checkpointName, _ := cmd.Flags().GetString("checkpoint")
+			interval, _ := cmd.Flags().GetDuration("interval")
+
+			// Multiplexed streams are tagged with their account names, and each
+			// one gets its own checkpoint.
+			multiplexed := len(accounts) > 1
+			lock := &sync.Mutex{}
+
+			var streams []*watchStream
+			for _, name := range accounts {
+				address := ""
+				if name != "" {
+					address, err = cli.ResolveAccount(logFields, name, "address")
+					if err == nil {
+						address, err = addressOf(address)
+					}
+
+					if err != nil {
+						cli.error(logFields, "invalid address: %s", name)
+						return
+					}
+				}
+
+				cursor, _ := cmd.Flags().GetString("cursor")
+
+				var checkpoint *watchCheckpoint
+				if checkpointName != "" {
+					checkpoint = &watchCheckpoint{cli: cli, name: checkpointName}
+					if multiplexed {
+						checkpoint.name += ":" + name
+					}
+
+					if token := checkpoint.load(); token != "" {
+						debugf(logFields, "resuming %s from checkpoint %s: %s", entity, checkpoint.name, token)
+						cursor = token
+					}
+				}
+
+				if cursor == "start" {
+					cursor = ""
+				}
+
+				stream := &watchStream{
+					entity:     entity,
+					address:    address,
+					format:     format,
+					cursor:     cursor,
+					horizon:    cli.horizonURL(),
+					checkpoint: checkpoint,
+					sinks:      sinks,
+					filter:     filter,
+					lock:       lock,
+					names:      cli.namer(),
+					base:       base,
+					counter:    counter,
+					interval:   interval,
+				}
+
+				if multiplexed {
+					stream.tag = name
+				}
+
+				streams = append(streams, stream)
+			}
+
+			// StopWatcher stops every stream.
+			ctx, cancel := context.WithCancel(cli.ctx)
+			defer cancel()
+			cli.setStopWatcher(cancel)
+
+			// The first stream to fail stops the others. MicroStellar isn't safe
+			// for concurrent use, so each stream gets its own.
+			var wg sync.WaitGroup
+			errs := make([]error, len(streams))
+			for i, stream := range streams {
+				wg.Add(1)
+				ms := microstellar.NewFromSpec(cli.network)
+				go func(i int, stream *watchStream, ms *microstellar.MicroStellar) {
+					defer wg.Done()
+					streamFields := logFields
+					if stream.tag != "" {
+						streamFields = logrus.Fields{"cmd": "watch", "account": stream.tag}
+					}
+
+					if errs[i] = watch(ctx, ms, streamFields, stream); errs[i] != nil {
+						cancel()
+					}
+				}(i, stream, ms)
+			}
+			wg.Wait()
+
+			for i, err := range errs {
+				if err == nil {
+					continue
+				}
+
+				if streams[i].tag != "" {
+					cli.error(logFields, "can't watch stream for %s: %v", streams[i].tag, microstellar.ErrorString(err))
+				} else {
+					cli.error(logFields, "can't watch stream: %v", microstellar.ErrorString(err))
+				}
 				return
 			}
 		},
@@ -130,6 +428,13 @@ func (cli *CLI) buildWatchCmd() *cobra.Command {
 
 	cmd.Flags().String("format", "line", "output format (json, yaml, struct)")
 	cmd.Flags().String("cursor", "now", "start watching from (now, start, paging_token)")
+	cmd.Flags().Duration("interval", 5*time.Second, "time between orderbook polls")
+	cmd.Flags().String("checkpoint", "", "save the position in the stream under this name, and resume from it (overrides --cursor)")
+	cmd.Flags().StringSlice("accounts", []string{}, "watch these accounts too, tagging each entry with its account")
+	cmd.Flags().Bool("all-aliases", false, "watch every account in the namespace")
+	cmd.Flags().String("from-file", "", "watch the accounts in this file (one per line)")
+	buildFlagsForSinks(cmd, "stop watching")
+	buildFlagsForWatchFilter(cmd)
 
 	return cmd
 }
@@ -0,0 +1,540 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Note: add -v to any of these commands to enable verbose logging
+
+// paymentStream is a fake horizon server that streams payments from one
+// account to another.
+type paymentStream struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	cursors []string // the cursor of each stream request
+	stop    func()   // stops the watcher once idle streams are waiting
+	idle    int
+}
+
+// newPaymentStream starts a fake horizon server. For each stream request,
+// respond returns the paging tokens of the payments to send before closing the
+// stream. It returns nil to keep the stream open without sending anything, and
+// false to fail the request.
+func newPaymentStream(from string, to string, respond func(cursor string, request int) ([]string, bool)) *paymentStream {
+	stream := &paymentStream{}
+	stream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transactions/tx" {
+			w.Write([]byte(`{"memo_type": "none"}`))
+			return
+		}
+
+		stream.mutex.Lock()
+		cursor := r.URL.Query().Get("cursor")
+		stream.cursors = append(stream.cursors, cursor)
+		request := len(stream.cursors)
+		stream.mutex.Unlock()
+
+		tokens, ok := respond(cursor, request)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if tokens == nil {
+			stream.mutex.Lock()
+			if stream.idle--; stream.idle == 0 && stream.stop != nil {
+				stream.stop()
+			}
+			stream.mutex.Unlock()
+
+			<-r.Context().Done()
+			return
+		}
+
+		for _, token := range tokens {
+			fmt.Fprintf(w, "event: message\ndata: {\"type\": \"payment\", \"paging_token\": \"%s\", \"from\": \"%s\", \"to\": \"%s\", "+
+				"\"amount\": \"%s\", \"asset_type\": \"native\", \"transaction_hash\": \"tx\"}\n\n",
+				token, from, to, token)
+		}
+	}))
+
+	return stream
+}
+
+// stopWhenIdle stops cli's next watch once that many of its streams are
+// waiting for more payments, so the command ends as soon as it's seen
+// everything.
+func (stream *paymentStream) stopWhenIdle(cli *CLI, streams int) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.stop = cli.StopWatcher
+	stream.idle = streams
+}
+
+func (stream *paymentStream) requests() []string {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	return stream.cursors
+}
+
+func (stream *paymentStream) reset() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.cursors = nil
+}
+
+// fastRetries makes streams reconnect, and sinks retry, right away. Call the
+// returned function to restore the delays.
+func fastRetries() func() {
+	reconnect, sink := reconnectBackoffBase, sinkBackoffBase
+	reconnectBackoffBase, sinkBackoffBase = time.Millisecond, time.Millisecond
+	return func() { reconnectBackoffBase, sinkBackoffBase = reconnect, sink }
+}
+
+func TestWatchCheckpoints(t *testing.T) {
+	defer fastRetries()()
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+
+	server := newPaymentStream(mo, kelly, func(cursor string, request int) ([]string, bool) {
+		switch {
+		case cursor == "now" && request == 1:
+			return []string{"1", "2"}, true
+		case cursor == "2" && request == 2:
+			return nil, false // drop the connection
+		case cursor == "2":
+			return []string{"3"}, true
+		}
+		return nil, true
+	})
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	// Reconnects pick up after the last payment
+	server.stopWhenIdle(cli, 1)
+	out := cli.TestCommand("watch payments mo --checkpoint mo --timeout 5s")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "payment: 1 ") || !strings.HasPrefix(lines[2], "payment: 3 ") {
+		t.Errorf("unexpected payments: %v (requests: %v)", out, server.requests())
+	}
+
+	if token, _ := cli.GetVar("watch:checkpoint:mo"); token != "3" {
+		t.Errorf("want checkpoint 3, got %q", token)
+	}
+
+	// Restarts resume from the checkpoint
+	server.reset()
+	server.stopWhenIdle(cli, 1)
+	expectOutput(t, cli, "", "watch payments mo --checkpoint mo --cursor start --timeout 5s")
+	if cursors := server.requests(); len(cursors) != 1 || cursors[0] != "3" {
+		t.Errorf("checkpoint not used: %v", cursors)
+	}
+
+	// Without a checkpoint, --cursor is used
+	server.reset()
+	server.stopWhenIdle(cli, 1)
+	expectOutput(t, cli, "", "watch payments mo --cursor 42 --timeout 5s")
+	if cursors := server.requests(); len(cursors) != 1 || cursors[0] != "42" {
+		t.Errorf("cursor not used: %v", cursors)
+	}
+}
+
+func TestWatchSinks(t *testing.T) {
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+
+	defer fastRetries()()
+
+	server := newPaymentStream(mo, kelly, func(cursor string, request int) ([]string, bool) {
+		if cursor == "now" {
+			return []string{"1", "2"}, true
+		}
+		return nil, true
+	})
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	// The webhook fails the first delivery of each event
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+	var delivered []watchEvent
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Lumen-Signature") != "sha256="+signPayload("secret", body) {
+			t.Errorf("bad signature: %s", r.Header.Get("X-Lumen-Signature"))
+		}
+
+		token := r.Header.Get("X-Lumen-Delivery")
+		if attempts[token]++; attempts[token] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var event watchEvent
+		json.Unmarshal(body, &event)
+		delivered = append(delivered, event)
+	}))
+	defer webhook.Close()
+
+	dir, _ := ioutil.TempDir("", "lumen-watch")
+	defer os.RemoveAll(dir)
+	execOut := filepath.Join(dir, "exec.out")
+
+	// TestCommand splits on spaces, which the shell command has.
+	server.stopWhenIdle(cli, 1)
+	cli.testing = true
+	out := cli.Run("watch", "payments", "mo", "--checkpoint", "mo", "--timeout", "5s",
+		"--webhook", webhook.URL, "--webhook-secret", "secret",
+		"--exec", `(printenv LUMEN_TYPE LUMEN_PAGING_TOKEN LUMEN_AMOUNT LUMEN_TO; cat; echo) >> `+execOut)
+	cli.testing = false
+
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if len(delivered) != 2 || delivered[0].PagingToken != "1" || delivered[1].Type != "payments" || delivered[1].Account != mo {
+		t.Errorf("bad webhook deliveries: %+v", delivered)
+	}
+
+	data, _ := ioutil.ReadFile(execOut)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 10 || lines[0] != "payments" || lines[1] != "1" || lines[2] != "1" || lines[3] != kelly || !strings.Contains(lines[4], `"paging_token":"1"`) {
+		t.Errorf("bad exec deliveries: %v", lines)
+	}
+
+	if token, _ := cli.GetVar("watch:checkpoint:mo"); token != "2" {
+		t.Errorf("want checkpoint 2, got %q", token)
+	}
+
+	// Without a dead-letter file, watch stops at the first event that can't be
+	// delivered, and doesn't move past it.
+	cli.DelVar("watch:checkpoint:mo")
+	out = cli.TestCommand("watch payments mo --checkpoint mo --timeout 5s --exec false --sink-retries 1")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "payment: 1 ") || lines[1] != "error" {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if token, err := cli.GetVar("watch:checkpoint:mo"); err == nil {
+		t.Errorf("checkpoint moved to %q", token)
+	}
+
+	// With one, it keeps going.
+	deadLetter := filepath.Join(dir, "dead-letter.json")
+	server.stopWhenIdle(cli, 1)
+	out = cli.TestCommand("watch payments mo --checkpoint mo --timeout 5s --exec false --sink-retries 1 --dead-letter " + deadLetter)
+	if strings.Contains(out, "error") {
+		t.Errorf("watch failed: %v", out)
+	}
+
+	if token, _ := cli.GetVar("watch:checkpoint:mo"); token != "2" {
+		t.Errorf("want checkpoint 2, got %q", token)
+	}
+
+	data, _ = ioutil.ReadFile(deadLetter)
+	lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+	var entry struct {
+		Sink  string     `json:"sink"`
+		Event watchEvent `json:"event"`
+	}
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &entry) != nil || entry.Sink != "exec false" || entry.Event.PagingToken != "2" {
+		t.Errorf("bad dead-letter file: %v", lines)
+	}
+
+	expectOutput(t, cli, "error", "watch payments mo --webhook ftp://example.com")
+}
+
+func TestWatchFilters(t *testing.T) {
+	defer fastRetries()()
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	cli.TestCommand("account new bob")
+	cli.TestCommand("asset set USD mo")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+	moSeed := strings.TrimSpace(cli.TestCommand("account seed mo"))
+	cli.TestCommand("account set mo-signer " + moSeed)
+
+	// Payments of 1, 2, and 3 XLM from mo to kelly
+	server := newPaymentStream(mo, kelly, func(cursor string, request int) ([]string, bool) {
+		if cursor == "now" {
+			return []string{"1", "2", "3"}, true
+		}
+		return nil, true
+	})
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	watch := func(filter string) []string {
+		server.stopWhenIdle(cli, 1)
+		out := strings.TrimSpace(cli.TestCommand("watch payments kelly --timeout 5s " + filter))
+		var amounts []string
+		for _, line := range strings.Split(out, "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 {
+				amounts = append(amounts, fields[1])
+			} else if line != "" {
+				amounts = append(amounts, line)
+			}
+		}
+		return amounts
+	}
+
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"", "1,2,3"},
+		{"--min-amount 2", "2,3"},
+		{"--min-amount 1.5 --max-amount 2.5", "2"},
+		{"--direction in", "1,2,3"},
+		{"--direction out", ""},
+		{"--counterparty mo --max-amount 1", "1"},
+		{"--counterparty bob", ""},
+		{"--counterparty mo-signer", "1,2,3"},
+		{"--counterparty " + moSeed, "1,2,3"},
+		{"--asset native --op-type payment,create_account", "1,2,3"},
+		{"--asset USD", ""},
+		{"--op-type create_account", ""},
+		{"--memo-type none", "1,2,3"},
+		{"--memo ^rent", ""},
+		{"--direction sideways", "error"},
+		{"--min-amount lots", "error"},
+		{"--memo-type foo", "error"},
+		{"--counterparty nobody", "error"},
+	}
+
+	for _, test := range tests {
+		if got := strings.Join(watch(test.filter), ","); got != test.want {
+			t.Errorf("watch %s: want %q, got %q", test.filter, test.want, got)
+		}
+	}
+
+	expectOutput(t, cli, "error", "watch ledger --direction in")
+	expectOutput(t, cli, "error", "watch transactions kelly --asset USD")
+
+	// Filtered entries still move the checkpoint
+	server.stopWhenIdle(cli, 1)
+	expectOutput(t, cli, "", "watch payments kelly --timeout 5s --min-amount 5 --checkpoint kelly")
+	if token, _ := cli.GetVar("watch:checkpoint:kelly"); token != "3" {
+		t.Errorf("want checkpoint 3, got %q", token)
+	}
+}
+
+func TestWatchAccounts(t *testing.T) {
+	defer fastRetries()()
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("account new kelly")
+	cli.TestCommand("account new bob")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+	kelly := strings.TrimSpace(cli.TestCommand("account address kelly"))
+
+	// Every account sees the same two payments.
+	server := newPaymentStream(mo, kelly, func(cursor string, request int) ([]string, bool) {
+		if cursor == "now" {
+			return []string{"1", "2"}, true
+		}
+		return nil, true
+	})
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	// watch returns the number of lines seen for each tag ("" for untagged.)
+	watch := func(streams int, command string) map[string]int {
+		server.stopWhenIdle(cli, streams)
+		out := strings.TrimSpace(cli.TestCommand(command))
+		seen := map[string]int{}
+		for _, line := range strings.Split(out, "\n") {
+			if strings.HasPrefix(line, "[") {
+				seen[strings.Fields(line)[0]]++
+			} else if line != "" {
+				seen[""]++
+			}
+		}
+		return seen
+	}
+
+	got := watch(2, "watch payments mo --accounts kelly,mo --checkpoint multi --timeout 5s")
+	if len(got) != 2 || got["[mo]"] != 2 || got["[kelly]"] != 2 {
+		t.Errorf("unexpected output: %v", got)
+	}
+
+	for _, name := range []string{"mo", "kelly"} {
+		if token, _ := cli.GetVar("watch:checkpoint:multi:" + name); token != "2" {
+			t.Errorf("want checkpoint 2 for %s, got %q", name, token)
+		}
+	}
+
+	got = watch(3, "watch payments --all-aliases --timeout 5s")
+	if len(got) != 3 || got["[bob]"] != 2 || got["[kelly]"] != 2 || got["[mo]"] != 2 {
+		t.Errorf("unexpected output: %v", got)
+	}
+
+	dir, _ := ioutil.TempDir("", "lumen-watch")
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "accounts")
+	ioutil.WriteFile(fileName, []byte("# watched accounts\nbob\n"+kelly+" # kelly\n\n"), 0600)
+
+	got = watch(2, "watch payments --from-file "+fileName+" --timeout 5s")
+	if len(got) != 2 || got["[bob]"] != 2 || got["["+kelly+"]"] != 2 {
+		t.Errorf("unexpected output: %v", got)
+	}
+
+	// A single account isn't tagged.
+	if got := watch(1, "watch payments mo --accounts mo --timeout 5s"); len(got) != 1 || got[""] != 2 {
+		t.Errorf("unexpected output: %v", got)
+	}
+
+	expectOutput(t, cli, "error", "watch payments --accounts mo,nobody")
+	expectOutput(t, cli, "error", "watch ledger --accounts mo,kelly")
+	expectOutput(t, cli, "error", "watch payments --from-file "+filepath.Join(dir, "missing"))
+}
+
+func TestWatchEntities(t *testing.T) {
+	defer fastRetries()()
+	cli, _ := newTestCLI()
+	cli.TestCommand("ns test")
+
+	cli.TestCommand("account new mo")
+	cli.TestCommand("asset set USD mo")
+	mo := strings.TrimSpace(cli.TestCommand("account address mo"))
+
+	var mutex sync.Mutex
+	var requests []string
+	books := []string{
+		`{"bids": [{"price": "0.5", "amount": "10"}], "asks": [{"price": "0.6", "amount": "5"}]}`,
+		`{"bids": [{"price": "0.5", "amount": "12"}], "asks": [{"price": "0.7", "amount": "3"}]}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.URL.String())
+		polls := len(requests)
+		mutex.Unlock()
+
+		// Stop once the book stops changing.
+		if r.URL.Path == "/order_book" {
+			if polls > len(books) {
+				polls = len(books)
+				cli.StopWatcher()
+			}
+			w.Write([]byte(books[polls-1]))
+			return
+		}
+
+		var entries []string
+		switch r.URL.Path {
+		case "/accounts/" + mo + "/operations":
+			entries = []string{`{"id": "1", "paging_token": "1", "type": "payment", "amount": "10", "_links": {}}`}
+		case "/accounts/" + mo + "/effects":
+			entries = []string{`{"id": "2", "paging_token": "2", "type": "trustline_authorized", "trustor": "bob"}`}
+		case "/accounts/" + mo + "/offers":
+			entries = []string{`{"id": 3, "paging_token": "3", "amount": "5", "price": "0.6", "selling": {"asset_type": "native"}, ` +
+				`"buying": {"asset_type": "credit_alphanum4", "asset_code": "USD", "asset_issuer": "` + mo + `"}}`}
+		case "/trades":
+			entries = []string{`{"id": "4", "paging_token": "4", "base_amount": "1", "counter_amount": "0.5"}`}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Send the entries, and stop when the watcher comes back for more.
+		if r.URL.Query().Get("cursor") == "now" {
+			fmt.Fprintf(w, "retry: 1000\nevent: open\ndata: \"hello\"\n\n")
+			for _, entry := range entries {
+				fmt.Fprintf(w, "event: message\nid: x\ndata: %s\n\n", entry)
+			}
+			return
+		}
+
+		cli.StopWatcher()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cli.TestCommand("network add local --horizon " + server.URL + " --passphrase local")
+	cli.TestCommand("network use local")
+
+	expectOutput(t, cli, "operation: payment amount=10 id=1", "watch operations mo --timeout 5s")
+	expectOutput(t, cli, "effect: trustline_authorized id=2 trustor=bob", "watch effects mo --timeout 5s")
+	expectOutput(t, cli, "offer: (3) selling 5 xlm for USD at 0.6 USD/xlm", "watch offers mo --timeout 5s")
+	expectOutput(t, cli, "trade: base_amount=1 counter_amount=0.5 id=4", "watch trades native USD --timeout 5s")
+
+	out := cli.TestCommand("watch operations mo --timeout 5s --format json --checkpoint ops")
+	if !strings.Contains(out, `"type": "payment"`) {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if token, _ := cli.GetVar("watch:checkpoint:ops"); token != "1" {
+		t.Errorf("want checkpoint 1, got %q", token)
+	}
+
+	mutex.Lock()
+	requests = nil
+	mutex.Unlock()
+
+	// Trades for a pair go to /trades with the assets in the query.
+	cli.TestCommand("watch trades native USD --cursor 42 --timeout 5s")
+	mutex.Lock()
+	if len(requests) != 1 || !strings.Contains(requests[0], "base_asset_type=native") ||
+		!strings.Contains(requests[0], "counter_asset_code=USD") || !strings.Contains(requests[0], "cursor=42") {
+		t.Errorf("bad trades request: %v", requests)
+	}
+
+	// The first poll shows the whole book, and the rest show what changed.
+	requests = nil
+	mutex.Unlock()
+
+	out = cli.TestCommand("watch orderbook native USD --interval 1ms --timeout 5s")
+	want := []string{
+		"ask added: 5 native at 0.6 USD/native",
+		"bid added: 10 USD at 0.5 USD/native",
+		"ask added: 3 native at 0.7 USD/native",
+		"ask removed: 0 native at 0.6 USD/native (was 5)",
+		"bid changed: 12 USD at 0.5 USD/native (was 10)",
+	}
+	if strings.TrimSpace(out) != strings.Join(want, "\n") {
+		t.Errorf("unexpected orderbook diffs: %v", out)
+	}
+
+	expectOutput(t, cli, "error", "watch orderbook native")
+	expectOutput(t, cli, "error", "watch orderbook native USD --accounts mo")
+	expectOutput(t, cli, "error", "watch offers")
+	expectOutput(t, cli, "error", "watch bananas")
+	expectOutput(t, cli, "error", "watch effects mo --min-amount 5")
+}
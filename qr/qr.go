@@ -0,0 +1,587 @@
+// Package qr implements a small QR code encoder (byte mode only), enough to
+// render Stellar URIs and addresses on a terminal.
+package qr
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the error correction level of a QR code.
+type Level int
+
+// Error correction levels, from lowest to highest redundancy.
+const (
+	Low Level = iota
+	Medium
+	Quartile
+	High
+)
+
+// formatBits are the two bits that identify each level in the format information.
+var formatBits = [4]int{1, 0, 3, 2}
+
+// eccCodewordsPerBlock and numBlocks are indexed by [level][version]. Version 0 is unused.
+var eccCodewordsPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var numBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// Code is an encoded QR symbol.
+type Code struct {
+	Version int
+	Size    int
+	Level   Level
+	Mask    int
+
+	modules    [][]bool // true is dark
+	isFunction [][]bool // finder, timing, alignment, format and version modules
+}
+
+// Encode returns the smallest QR code that holds data at the given error
+// correction level.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < Low || level > High {
+		return nil, errors.Errorf("invalid error correction level: %d", level)
+	}
+
+	version := 0
+	for v := 1; v <= 40; v++ {
+		if bitsNeeded(len(data), v) <= dataCodewords(v, level)*8 {
+			version = v
+			break
+		}
+	}
+
+	if version == 0 {
+		return nil, errors.Errorf("data too long for a QR code: %d bytes", len(data))
+	}
+
+	code := newCode(version, level)
+	code.drawFunctionPatterns()
+	code.drawCodewords(code.addECCAndInterleave(code.encodeData(data)))
+
+	// Pick the mask with the lowest penalty.
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		if penalty := code.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		code.applyMask(mask) // masks are XORs, so this undoes it
+	}
+
+	code.Mask = bestMask
+	code.applyMask(bestMask)
+	code.drawFormatBits(bestMask)
+
+	return code, nil
+}
+
+// Dark returns true if the module at column x and row y is dark. Coordinates
+// outside the symbol are light.
+func (code *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+		return false
+	}
+
+	return code.modules[y][x]
+}
+
+// Terminal renders the code with Unicode half blocks, two rows per line, with
+// a quiet zone around it. Dark modules are drawn with the terminal's background
+// color, so this works on dark terminals. Set invert for light terminals.
+func (code *Code) Terminal(invert bool) string {
+	const quiet = 2
+	blocks := [4]string{"█", "▄", "▀", " "} // indexed by top dark | bottom dark << 1
+
+	var sb bytes.Buffer
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := code.Dark(x, y), code.Dark(x, y+1)
+			if invert {
+				top, bottom = !top, !bottom
+			}
+
+			index := 0
+			if top {
+				index |= 1
+			}
+			if bottom {
+				index |= 2
+			}
+
+			sb.WriteString(blocks[index])
+		}
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	code := &Code{Version: version, Size: size, Level: level}
+
+	code.modules = make([][]bool, size)
+	code.isFunction = make([][]bool, size)
+	for i := range code.modules {
+		code.modules[i] = make([]bool, size)
+		code.isFunction[i] = make([]bool, size)
+	}
+
+	return code
+}
+
+// charCountBits returns the width of the byte mode character count field.
+func charCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+
+	return 16
+}
+
+// bitsNeeded returns the size of a byte mode segment.
+func bitsNeeded(length int, version int) int {
+	if length >= 1<<uint(charCountBits(version)) {
+		return 1 << 30
+	}
+
+	return 4 + charCountBits(version) + length*8
+}
+
+// rawDataModules returns the number of modules available for data and ECC
+// after all function patterns are placed.
+func rawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+
+	return result
+}
+
+// dataCodewords returns the number of 8-bit data codewords (excluding ECC.)
+func dataCodewords(version int, level Level) int {
+	return rawDataModules(version)/8 - eccCodewordsPerBlock[level][version]*numBlocks[level][version]
+}
+
+// alignmentPositions returns the centers of the alignment patterns along each axis.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+
+	return result
+}
+
+func (code *Code) setFunction(x, y int, dark bool) {
+	code.modules[y][x] = dark
+	code.isFunction[y][x] = true
+}
+
+func (code *Code) drawFunctionPatterns() {
+	// Timing patterns
+	for i := 0; i < code.Size; i++ {
+		code.setFunction(6, i, i%2 == 0)
+		code.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with separators
+	code.drawFinder(3, 3)
+	code.drawFinder(code.Size-4, 3)
+	code.drawFinder(3, code.Size-4)
+
+	// Alignment patterns, except where they would overlap the finders
+	positions := alignmentPositions(code.Version)
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			code.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format areas, the real bits are drawn after masking.
+	code.drawFormatBits(0)
+	code.drawVersion()
+}
+
+func (code *Code) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+				continue
+			}
+
+			dist := max(abs(dx), abs(dy))
+			code.setFunction(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (code *Code) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			code.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+func (code *Code) drawFormatBits(mask int) {
+	// 5 data bits protected by a (15, 5) BCH code
+	data := formatBits[code.Level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// First copy, around the top-left finder
+	for i := 0; i <= 5; i++ {
+		code.setFunction(8, i, bit(i))
+	}
+	code.setFunction(8, 7, bit(6))
+	code.setFunction(8, 8, bit(7))
+	code.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		code.setFunction(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the other two finders
+	for i := 0; i < 8; i++ {
+		code.setFunction(code.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		code.setFunction(8, code.Size-15+i, bit(i))
+	}
+	code.setFunction(8, code.Size-8, true) // always dark
+}
+
+func (code *Code) drawVersion() {
+	if code.Version < 7 {
+		return
+	}
+
+	// 6 data bits protected by a (18, 6) Golay code
+	rem := code.Version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := code.Version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := code.Size-11+i%3, i/3
+		code.setFunction(a, b, dark)
+		code.setFunction(b, a, dark)
+	}
+}
+
+// encodeData returns the padded data codewords for a single byte mode segment.
+func (code *Code) encodeData(data []byte) []byte {
+	capacity := dataCodewords(code.Version, code.Level) * 8
+
+	var bits []bool
+	appendBits := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (val>>uint(i))&1 != 0)
+		}
+	}
+
+	appendBits(0x4, 4) // byte mode
+	appendBits(len(data), charCountBits(code.Version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	// Terminator, then pad to a byte boundary
+	appendBits(0, min(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+
+	result := make([]byte, 0, capacity/8)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		result = append(result, b)
+	}
+
+	for pad := byte(0xEC); len(result) < capacity/8; pad ^= 0xEC ^ 0x11 {
+		result = append(result, pad)
+	}
+
+	return result
+}
+
+// addECCAndInterleave splits data into blocks, appends the Reed-Solomon
+// codewords for each block, and interleaves them.
+func (code *Code) addECCAndInterleave(data []byte) []byte {
+	blocks := numBlocks[code.Level][code.Version]
+	eccLen := eccCodewordsPerBlock[code.Level][code.Version]
+	rawCodewords := rawDataModules(code.Version) / 8
+	numShortBlocks := blocks - rawCodewords%blocks
+	shortBlockLen := rawCodewords / blocks
+
+	divisor := rsDivisor(eccLen)
+	var all [][]byte
+	for i, k := 0, 0; i < blocks; i++ {
+		length := shortBlockLen - eccLen
+		if i >= numShortBlocks {
+			length++
+		}
+
+		block := append([]byte{}, data[k:k+length]...)
+		k += length
+		ecc := rsRemainder(block, divisor)
+		if i < numShortBlocks {
+			block = append(block, 0) // placeholder, skipped below
+		}
+		all = append(all, append(block, ecc...))
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range all[0] {
+		for j, block := range all {
+			if i != shortBlockLen-eccLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+
+	return result
+}
+
+// drawCodewords places the data in the zigzag pattern, two columns at a time
+// from the bottom-right corner.
+func (code *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+
+		for vert := 0; vert < code.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = code.Size - 1 - vert // upwards
+				}
+
+				if !code.isFunction[y][x] && i < len(data)*8 {
+					code.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func maskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (code *Code) applyMask(mask int) {
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.isFunction[y][x] && maskBit(mask, x, y) {
+				code.modules[y][x] = !code.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four rules in the QR specification.
+// Lower is better.
+func (code *Code) penalty() int {
+	result := 0
+	size := code.Size
+
+	line := func(i, j int, vertical bool) bool {
+		if vertical {
+			return code.modules[j][i]
+		}
+		return code.modules[i][j]
+	}
+
+	finderLike := [2][11]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for i := 0; i < size; i++ {
+			// Rule 1: runs of five or more modules of the same color
+			run := 1
+			for j := 1; j < size; j++ {
+				if line(i, j, vertical) == line(i, j-1, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				result += run - 2
+			}
+
+			// Rule 3: patterns that look like finders
+			for j := 0; j+11 <= size; j++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k := 0; k < 11 && match; k++ {
+						match = line(i, j+k, vertical) == pattern[k]
+					}
+					if match {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+
+	// Rule 2: 2x2 blocks of the same color
+	for y := 0; y < size-1; y++ {
+		for x := 0; x < size-1; x++ {
+			c := code.modules[y][x]
+			if c == code.modules[y][x+1] && c == code.modules[y+1][x] && c == code.modules[y+1][x+1] {
+				result += 3
+			}
+		}
+	}
+
+	// Rule 4: balance of dark and light modules
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if code.modules[y][x] {
+				dark++
+			}
+		}
+	}
+	total := size * size
+	if k := (abs(dark*20-total*10)+total-1)/total - 1; k > 0 {
+		result += k * 10
+	}
+
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree
+// over GF(2^8/0x11D), with the leading coefficient dropped.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords for data.
+func rsRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+
+	return result
+}
+
+// gfMultiply multiplies two elements of GF(2^8/0x11D).
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+
+	return byte(z)
+}
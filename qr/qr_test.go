@@ -0,0 +1,269 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// readCodewords reverses drawCodewords and the mask, returning the interleaved
+// codewords in the symbol.
+func readCodewords(code *Code) []byte {
+	var result []byte
+	var b byte
+	n := 0
+
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		for vert := 0; vert < code.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = code.Size - 1 - vert
+				}
+
+				if code.isFunction[y][x] {
+					continue
+				}
+
+				b <<= 1
+				if code.modules[y][x] != maskBit(code.Mask, x, y) {
+					b |= 1
+				}
+				n++
+				if n%8 == 0 {
+					result = append(result, b)
+					b = 0
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// decode extracts the data from a symbol, checking the error correction
+// codewords of every block.
+func decode(t *testing.T, code *Code) []byte {
+	blocks := numBlocks[code.Level][code.Version]
+	eccLen := eccCodewordsPerBlock[code.Level][code.Version]
+	rawCodewords := rawDataModules(code.Version) / 8
+	numShortBlocks := blocks - rawCodewords%blocks
+	shortDataLen := rawCodewords/blocks - eccLen
+
+	codewords := readCodewords(code)[:rawCodewords]
+
+	// De-interleave
+	dataBlocks := make([][]byte, blocks)
+	eccBlocks := make([][]byte, blocks)
+	k := 0
+	for i := 0; i < shortDataLen+1; i++ {
+		for j := 0; j < blocks; j++ {
+			if i == shortDataLen && j < numShortBlocks {
+				continue
+			}
+			dataBlocks[j] = append(dataBlocks[j], codewords[k])
+			k++
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for j := 0; j < blocks; j++ {
+			eccBlocks[j] = append(eccBlocks[j], codewords[k])
+			k++
+		}
+	}
+
+	var data []byte
+	for j := 0; j < blocks; j++ {
+		if ecc := rsRemainder(dataBlocks[j], rsDivisor(eccLen)); !bytes.Equal(ecc, eccBlocks[j]) {
+			t.Errorf("bad ecc in block %d", j)
+		}
+		data = append(data, dataBlocks[j]...)
+	}
+
+	// Parse the byte mode segment
+	bit := func(i int) int { return int(data[i/8]>>uint(7-i%8)) & 1 }
+	bits := func(start, n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v = v<<1 | bit(start+i)
+		}
+		return v
+	}
+
+	if mode := bits(0, 4); mode != 4 {
+		t.Fatalf("wrong mode: %d", mode)
+	}
+
+	countBits := charCountBits(code.Version)
+	length := bits(4, countBits)
+	result := make([]byte, length)
+	for i := range result {
+		result[i] = byte(bits(4+countBits+i*8, 8))
+	}
+
+	return result
+}
+
+func TestRoundTrip(t *testing.T) {
+	uri := "web+stellar:pay?destination=GCALNQQBXAPZ2WIRSDDBMSTAKCUH5SG6U76YBFLQLIXJTF7FE5AX7AOO&amount=120.1234567&memo=skdjfasf&msg=pay%20me%20with%20lumens"
+
+	for _, data := range []string{"", "lumen", uri, strings.Repeat("x", 1000)} {
+		for level := Low; level <= High; level++ {
+			code, err := Encode([]byte(data), level)
+			if err != nil {
+				t.Fatalf("could not encode %d bytes at level %d: %v", len(data), level, err)
+			}
+
+			if code.Size != code.Version*4+17 {
+				t.Errorf("wrong size %d for version %d", code.Size, code.Version)
+			}
+
+			if got := decode(t, code); string(got) != data {
+				t.Errorf("round trip failed: want %q, got %q", data, got)
+			}
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	// Byte mode capacities from the QR specification
+	tests := []struct {
+		level    Level
+		version  int
+		capacity int
+	}{
+		{Low, 1, 17}, {Medium, 1, 14}, {Quartile, 1, 11}, {High, 1, 7},
+		{Quartile, 5, 60}, {Medium, 10, 213}, {Medium, 20, 666},
+		{Low, 40, 2953}, {High, 40, 1273},
+	}
+
+	for _, test := range tests {
+		code, err := Encode(make([]byte, test.capacity), test.level)
+		if err != nil || code.Version != test.version {
+			t.Errorf("want version %d for %d bytes at level %d, got %+v (%v)", test.version, test.capacity, test.level, code, err)
+			continue
+		}
+
+		code, err = Encode(make([]byte, test.capacity+1), test.level)
+		if err == nil && code.Version == test.version {
+			t.Errorf("%d bytes should not fit in version %d at level %d", test.capacity+1, test.version, test.level)
+		}
+	}
+
+	if _, err := Encode(make([]byte, 3000), Low); err == nil {
+		t.Errorf("expected error for oversized data")
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		32: {6, 34, 60, 86, 112, 138},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+
+	for version, want := range tests {
+		got := alignmentPositions(version)
+		if len(got) != len(want) {
+			t.Errorf("version %d: want %v, got %v", version, want, got)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("version %d: want %v, got %v", version, want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	// The degree 7 generator is x^7 + a^87 x^6 + a^229 x^5 + a^146 x^4 +
+	// a^149 x^3 + a^238 x^2 + a^102 x + a^21
+	power := func(n int) byte {
+		v := byte(1)
+		for i := 0; i < n; i++ {
+			v = gfMultiply(v, 2)
+		}
+		return v
+	}
+
+	want := []byte{power(87), power(229), power(146), power(149), power(238), power(102), power(21)}
+	if got := rsDivisor(7); !bytes.Equal(got, want) {
+		t.Errorf("wrong generator: want %v, got %v", want, got)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	code, _ := Encode([]byte("lumen"), Medium)
+
+	// Both copies of the format information must agree.
+	var first, second int
+	for i := 0; i <= 5; i++ {
+		first |= boolBit(code.Dark(8, i)) << uint(i)
+	}
+	first |= boolBit(code.Dark(8, 7))<<6 | boolBit(code.Dark(8, 8))<<7 | boolBit(code.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		first |= boolBit(code.Dark(14-i, 8)) << uint(i)
+	}
+
+	for i := 0; i < 8; i++ {
+		second |= boolBit(code.Dark(code.Size-1-i, 8)) << uint(i)
+	}
+	for i := 8; i < 15; i++ {
+		second |= boolBit(code.Dark(8, code.Size-15+i)) << uint(i)
+	}
+
+	if first != second {
+		t.Errorf("format copies differ: %015b != %015b", first, second)
+	}
+
+	data := (first ^ 0x5412) >> 10
+	if data>>3 != formatBits[Medium] || data&7 != code.Mask {
+		t.Errorf("wrong format information: %05b (mask %d)", data, code.Mask)
+	}
+
+	if !code.Dark(8, code.Size-8) {
+		t.Errorf("missing dark module")
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	code, _ := Encode([]byte("lumen"), Low)
+	lines := strings.Split(strings.TrimRight(code.Terminal(false), "\n"), "\n")
+
+	// 21 modules plus a quiet zone of 2 on each side, two rows per line.
+	if len(lines) != 13 {
+		t.Errorf("wrong number of lines: %d", len(lines))
+	}
+
+	for _, line := range lines {
+		if n := len([]rune(line)); n != 25 {
+			t.Errorf("wrong line width: %d", n)
+		}
+	}
+
+	// The quiet zone is light, so it's drawn as full blocks.
+	if lines[0] != strings.Repeat("█", 25) {
+		t.Errorf("bad quiet zone: %q", lines[0])
+	}
+
+	inverted := code.Terminal(true)
+	if strings.Split(inverted, "\n")[0] != strings.Repeat(" ", 25) {
+		t.Errorf("bad inverted quiet zone")
+	}
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -3,6 +3,10 @@ package store
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -58,6 +62,8 @@ func newFileDataFromFile(fileName string) (*fileData, error) {
 	return fileData, nil
 }
 
+// sync writes data to fileName. It writes a temporary file and renames it
+// over fileName, so other processes never read a partial file.
 func (data *fileData) sync(fileName string) error {
 	jsonData, err := json.Marshal(*data)
 
@@ -66,8 +72,28 @@ func (data *fileData) sync(fileName string) error {
 		return errors.Errorf("could not marshall json: %v", err)
 	}
 
+	// Replace the file a symlink points to, not the symlink.
+	if target, err := filepath.EvalSymlinks(fileName); err == nil {
+		fileName = target
+	}
+
 	logrus.WithFields(logrus.Fields{"type": "filestore", "method": "sync"}).Debugf("writing to file: %s", fileName)
-	err = ioutil.WriteFile(fileName, jsonData, 0600)
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err == nil {
+		_, err = tmp.Write(jsonData)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err == nil {
+			err = os.Rename(tmp.Name(), fileName)
+		}
+
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"type": "filestore", "method": "sync"}).Errorf("write error: %v", err)
 		return errors.Errorf("could not write to file: %v", err)
@@ -76,12 +102,16 @@ func (data *fileData) sync(fileName string) error {
 	return nil
 }
 
-// DataStore represents the conntection to the Google Cloud Datastore.
+// FileStore keeps the data in a JSON file. Several processes can share the
+// file: each one rereads it when it has changed before every read and write,
+// so writes aren't lost unless they happen at the same moment. SetNX is only
+// atomic within a process.
 type FileStore struct {
 	*Store
 	path string
-	mu   *sync.RWMutex // protects data
+	mu   *sync.Mutex // protects data and stat
 	data *fileData
+	stat os.FileInfo // the file as of the last read or write, nil if unknown
 }
 
 func NewFileStore(path string) (*FileStore, error) {
@@ -98,21 +128,55 @@ func NewFileStore(path string) (*FileStore, error) {
 			parameters: path,
 		},
 		path: path,
-		mu:   &sync.RWMutex{},
+		mu:   &sync.Mutex{},
 		data: fileData,
 	}
+
+	fileStore.stat, _ = os.Stat(path)
 	return fileStore, nil
 }
 
+// reload rereads the file if another process has written it since the last
+// read or write. It must be called under mu.
+func (fs *FileStore) reload() error {
+	stat, err := os.Stat(fs.path)
+	if err != nil {
+		// Keep what we have, the next write recreates the file.
+		return nil
+	}
+
+	if fs.stat != nil && os.SameFile(stat, fs.stat) && stat.ModTime().Equal(fs.stat.ModTime()) && stat.Size() == fs.stat.Size() {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{"type": "filestore", "method": "reload"}).Debugf("file changed, rereading: %s", fs.path)
+	data, err := newFileDataFromFile(fs.path)
+	if err != nil {
+		return errors.Wrap(err, "can't reread file store")
+	}
+
+	fs.data, fs.stat = data, stat
+	return nil
+}
+
 // sync must be called under mu
 func (fs *FileStore) sync() error {
-	return fs.data.sync(fs.path)
+	if err := fs.data.sync(fs.path); err != nil {
+		return err
+	}
+
+	fs.stat, _ = os.Stat(fs.path)
+	return nil
 }
 
 func (fs *FileStore) Set(k string, v string, ttl time.Duration) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	if err := fs.reload(); err != nil {
+		return err
+	}
+
 	logrus.WithFields(logrus.Fields{"type": "filestore", "method": "set", "key": k}).Debugf("writing val: %s (ttl: %v)", v, ttl)
 	fs.data.Pairs[k] = fileEntry{
 		Value:     v,
@@ -124,9 +188,39 @@ func (fs *FileStore) Set(k string, v string, ttl time.Duration) error {
 	return fs.sync()
 }
 
+// SetNX sets k to v if k isn't set (or has expired), and returns true if it
+// did.
+func (fs *FileStore) SetNX(k string, v string, ttl time.Duration) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.reload(); err != nil {
+		return false, err
+	}
+
+	if val, ok := fs.data.Pairs[k]; ok && !val.expired() {
+		logrus.WithFields(logrus.Fields{"type": "filestore", "method": "setnx", "key": k}).Debugf("already set")
+		return false, nil
+	}
+
+	logrus.WithFields(logrus.Fields{"type": "filestore", "method": "setnx", "key": k}).Debugf("writing val: %s (ttl: %v)", v, ttl)
+	fs.data.Pairs[k] = fileEntry{
+		Value:     v,
+		NoExpire:  ttl == 0,
+		ExpiresOn: time.Now().Add(ttl),
+	}
+
+	fs.data.Seq++
+	return true, fs.sync()
+}
+
 func (fs *FileStore) Get(k string) (string, error) {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.reload(); err != nil {
+		return "", err
+	}
 
 	val, ok := fs.data.Pairs[k]
 	if !ok || val.expired() {
@@ -138,11 +232,66 @@ func (fs *FileStore) Get(k string) (string, error) {
 	return val.Value, nil
 }
 
+func (fs *FileStore) TTL(k string) (time.Duration, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.reload(); err != nil {
+		return 0, err
+	}
+
+	val, ok := fs.data.Pairs[k]
+	if !ok || val.expired() {
+		return 0, errors.Errorf("not found: %s", k)
+	}
+
+	if val.NoExpire {
+		return 0, nil
+	}
+
+	return time.Until(val.ExpiresOn), nil
+}
+
+// Version returns the version and sequence number (incremented on every
+// write) of the file.
+func (fs *FileStore) Version() (string, uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.reload()
+
+	return fs.data.Version, fs.data.Seq
+}
+
 func (fs *FileStore) Delete(k string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	if err := fs.reload(); err != nil {
+		return err
+	}
+
 	logrus.WithFields(logrus.Fields{"type": "filestore", "method": "delete", "key": k}).Debugf("deleting")
 	delete(fs.data.Pairs, k)
 	return fs.sync()
 }
+
+func (fs *FileStore) Keys(prefix string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.reload(); err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for k, val := range fs.data.Pairs {
+		if strings.HasPrefix(k, prefix) && !val.expired() {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	logrus.WithFields(logrus.Fields{"type": "filestore", "method": "keys", "prefix": prefix}).Debugf("found %d keys", len(keys))
+	return keys, nil
+}
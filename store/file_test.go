@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -41,3 +42,88 @@ func TestFileStore_TTL(t *testing.T) {
 
 	testTTL(t, store)
 }
+
+func TestFileStore_Keys(t *testing.T) {
+	tmpDir, tmpFile := getTempFile()
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore("file", tmpFile)
+
+	if err != nil {
+		t.Errorf("couldn't setup internal store, want %v, got %v", nil, err)
+	}
+
+	testKeys(t, store)
+}
+
+func TestFileStore_TTLLookup(t *testing.T) {
+	tmpDir, tmpFile := getTempFile()
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore("file", tmpFile)
+
+	if err != nil {
+		t.Errorf("couldn't setup internal store, want %v, got %v", nil, err)
+	}
+
+	testTTLLookup(t, store)
+}
+
+func TestFileStore_SetNX(t *testing.T) {
+	tmpDir, tmpFile := getTempFile()
+	defer os.RemoveAll(tmpDir)
+
+	store, err := NewStore("file", tmpFile)
+
+	if err != nil {
+		t.Errorf("couldn't setup internal store, want %v, got %v", nil, err)
+	}
+
+	testSetNX(t, store)
+}
+
+func TestFileStore_SharedFile(t *testing.T) {
+	tmpDir, tmpFile := getTempFile()
+	defer os.RemoveAll(tmpDir)
+
+	// Two processes with the same file see, and keep, each other's writes.
+	first, err := NewFileStore(tmpFile)
+	if err != nil {
+		t.Fatalf("couldn't setup file store: %v", err)
+	}
+
+	second, err := NewFileStore(tmpFile)
+	if err != nil {
+		t.Fatalf("couldn't setup file store: %v", err)
+	}
+
+	first.Set("a", "1", 0)
+	second.Set("b", "2", 0)
+	first.Set("c", "3", 0)
+
+	for _, store := range []*FileStore{first, second} {
+		if keys, _ := store.Keys(""); strings.Join(keys, ",") != "a,b,c" {
+			t.Errorf("want keys a,b,c, got %v", keys)
+		}
+	}
+
+	second.Set("a", "4", 0)
+	if val, _ := first.Get("a"); val != "4" {
+		t.Errorf("want 4, got %v", val)
+	}
+
+	first.Delete("b")
+	if _, err := second.Get("b"); err == nil {
+		t.Errorf("deleted key found")
+	}
+
+	if ok, _ := second.SetNX("c", "5", 0); ok {
+		t.Errorf("SetNX overwrote a key set by another store")
+	}
+
+	// Nothing is left behind
+	files, _ := ioutil.ReadDir(tmpDir)
+	if len(files) != 1 {
+		t.Errorf("want one file, got %d", len(files))
+	}
+}
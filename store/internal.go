@@ -4,6 +4,8 @@ package store
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -98,6 +100,20 @@ func (store *Internal) Set(k string, v string, ttl time.Duration) error {
 	return nil
 }
 
+// SetNX adds an entry to the store if there isn't one (or it has expired), and
+// returns true if it did.
+func (store *Internal) SetNX(k string, v string, ttl time.Duration) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if e, ok := store.entries[k]; ok && !e.expired() {
+		return false, nil
+	}
+
+	store.entries[k] = &entry{v, time.Now().Add(ttl), ttl == 0}
+	return true, nil
+}
+
 // Get looks up an entry in the store.
 func (store *Internal) Get(k string) (string, error) {
 	store.mu.RLock()
@@ -111,6 +127,23 @@ func (store *Internal) Get(k string) (string, error) {
 	return "", fmt.Errorf("No value in store for key: %v", k)
 }
 
+// TTL returns the time left before entry k expires, or 0 if it never expires.
+func (store *Internal) TTL(k string) (time.Duration, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	v, ok := store.entries[k]
+	if !ok || v.expired() {
+		return 0, fmt.Errorf("No value in store for key: %v", k)
+	}
+
+	if v.noexpire {
+		return 0, nil
+	}
+
+	return time.Until(v.expiresOn), nil
+}
+
 // Delete removes an entry in the store.
 func (store *Internal) Delete(k string) error {
 	store.mu.Lock()
@@ -123,3 +156,19 @@ func (store *Internal) Delete(k string) error {
 
 	return fmt.Errorf("No value in store for key: %v", k)
 }
+
+// Keys returns the (sorted) keys of all unexpired entries that start with prefix.
+func (store *Internal) Keys(prefix string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	keys := []string{}
+	for k, v := range store.entries {
+		if strings.HasPrefix(k, prefix) && !v.expired() {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -21,3 +21,33 @@ func TestInternalStore_TTL(t *testing.T) {
 
 	testTTL(t, store)
 }
+
+func TestInternalStore_Keys(t *testing.T) {
+	store, err := NewStore("internal", "")
+
+	if err != nil {
+		t.Errorf("couldn't setup internal store, want %v, got %v", nil, err)
+	}
+
+	testKeys(t, store)
+}
+
+func TestInternalStore_TTLLookup(t *testing.T) {
+	store, err := NewStore("internal", "")
+
+	if err != nil {
+		t.Errorf("couldn't setup internal store, want %v, got %v", nil, err)
+	}
+
+	testTTLLookup(t, store)
+}
+
+func TestInternalStore_SetNX(t *testing.T) {
+	store, err := NewStore("internal", "")
+
+	if err != nil {
+		t.Errorf("couldn't setup internal store, want %v, got %v", nil, err)
+	}
+
+	testSetNX(t, store)
+}
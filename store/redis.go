@@ -2,6 +2,8 @@ package store
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -47,6 +49,14 @@ func (store *Redis) Set(k string, v string, ttl time.Duration) error {
 	return err
 }
 
+func (store *Redis) SetNX(k string, v string, ttl time.Duration) (bool, error) {
+	ok, err := store.client.SetNX(store.prefix+k, v, ttl).Result()
+	if err != nil {
+		log.WithFields(log.Fields{"type": "redis", "method": "setnx"}).Errorf("SetNX: %v", err)
+	}
+	return ok, err
+}
+
 func (store *Redis) Get(k string) (string, error) {
 	val, err := store.client.Get(store.prefix + k).Result()
 	if err != nil {
@@ -55,6 +65,24 @@ func (store *Redis) Get(k string) (string, error) {
 	return val, err
 }
 
+func (store *Redis) TTL(k string) (time.Duration, error) {
+	ttl, err := store.client.PTTL(store.prefix + k).Result()
+	if err != nil {
+		log.WithFields(log.Fields{"type": "redis", "method": "ttl"}).Errorf("PTTL: %v", err)
+		return 0, err
+	}
+
+	// PTTL returns -2 for missing keys, and -1 for keys with no TTL
+	switch ttl {
+	case -2 * time.Millisecond:
+		return 0, fmt.Errorf("not found: %s", k)
+	case -1 * time.Millisecond:
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
 func (store *Redis) Delete(k string) error {
 	err := store.client.Del(store.prefix + k).Err()
 	if err != nil {
@@ -62,3 +90,24 @@ func (store *Redis) Delete(k string) error {
 	}
 	return err
 }
+
+// globEscaper escapes the characters that are special in redis MATCH patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (store *Redis) Keys(prefix string) ([]string, error) {
+	keys := []string{}
+	pattern := globEscaper.Replace(store.prefix+prefix) + "*"
+
+	iter := store.client.Scan(0, pattern, 100).Iterator()
+	for iter.Next() {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), store.prefix))
+	}
+
+	if err := iter.Err(); err != nil {
+		log.WithFields(log.Fields{"type": "redis", "method": "keys"}).Errorf("Scan: %v", err)
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -31,3 +31,36 @@ func TestRedisStore_TTL(t *testing.T) {
 
 	testTTL(t, store)
 }
+
+func TestRedisStore_Keys(t *testing.T) {
+	store, err := NewStore("redis", "localhost:6379")
+
+	if err != nil {
+		log.Printf("skipping tests: couldn't setup internal store, want %v, got %v", nil, err)
+		return
+	}
+
+	testKeys(t, store)
+}
+
+func TestRedisStore_TTLLookup(t *testing.T) {
+	store, err := NewStore("redis", "localhost:6379")
+
+	if err != nil {
+		log.Printf("skipping tests: couldn't setup internal store, want %v, got %v", nil, err)
+		return
+	}
+
+	testTTLLookup(t, store)
+}
+
+func TestRedisStore_SetNX(t *testing.T) {
+	store, err := NewStore("redis", "localhost:6379")
+
+	if err != nil {
+		log.Printf("skipping tests: couldn't setup internal store, want %v, got %v", nil, err)
+		return
+	}
+
+	testSetNX(t, store)
+}
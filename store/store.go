@@ -12,6 +12,9 @@ type API interface {
 	Set(k string, v string, ttl time.Duration) error
 	Get(k string) (string, error)
 	Delete(k string) error
+	Keys(prefix string) ([]string, error)
+	TTL(k string) (time.Duration, error)                       // remaining TTL, or 0 if k never expires
+	SetNX(k string, v string, ttl time.Duration) (bool, error) // Set, only if k isn't set; returns true if it was set
 }
 
 // Store represents the storage backend. Currently, only "internal" and "redis" are supported.
@@ -36,6 +39,17 @@ func NewStore(driver, parameters string) (API, error) {
 	return nil, errors.Errorf("Driver not found: %s", driver)
 }
 
+// Driver returns the name of the storage driver, e.g., "file".
+func (store *Store) Driver() string {
+	return store.driver
+}
+
+// Parameters returns the parameters the store was created with, e.g., the
+// file name or redis address.
+func (store *Store) Parameters() string {
+	return store.parameters
+}
+
 type DummyStore struct {
 	store *Store
 }
@@ -53,3 +67,15 @@ func (store *DummyStore) Get(k string) (string, error) {
 func (store *DummyStore) Delete(k string) error {
 	return errors.Errorf("Dummy store stores nothing!")
 }
+
+func (store *DummyStore) Keys(prefix string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (store *DummyStore) TTL(k string) (time.Duration, error) {
+	return 0, errors.Errorf("Dummy store stores nothing!")
+}
+
+func (store *DummyStore) SetNX(k string, v string, ttl time.Duration) (bool, error) {
+	return false, errors.Errorf("Dummy store stores nothing!")
+}
@@ -51,3 +51,73 @@ func testTTL(t *testing.T, store API) {
 
 	store.Delete("mo")
 }
+
+func testKeys(t *testing.T, store API) {
+	store.Set("ns1:foo", "bar", 0)
+	store.Set("ns1:baz", "bar", 0)
+	store.Set("ns2:foo", "bar", 0)
+	store.Set("ns1:gone", "bar", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	keys, err := store.Keys("ns1:")
+	if err != nil {
+		t.Errorf("couldn't get keys: %v", err)
+	}
+
+	if len(keys) != 2 || keys[0] != "ns1:baz" || keys[1] != "ns1:foo" {
+		t.Errorf("wrong keys: want [ns1:baz ns1:foo], got %v", keys)
+	}
+
+	keys, _ = store.Keys("ns3:")
+	if len(keys) != 0 {
+		t.Errorf("wrong keys: want [], got %v", keys)
+	}
+
+	store.Delete("ns1:foo")
+	store.Delete("ns1:baz")
+	store.Delete("ns2:foo")
+	store.Delete("ns1:gone")
+}
+
+func testTTLLookup(t *testing.T, store API) {
+	store.Set("forever", "bar", 0)
+	store.Set("soon", "bar", time.Minute)
+
+	if ttl, err := store.TTL("forever"); err != nil || ttl != 0 {
+		t.Errorf("wrong TTL for 'forever': want 0, got %v (%v)", ttl, err)
+	}
+
+	if ttl, err := store.TTL("soon"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("wrong TTL for 'soon': want (0, 1m], got %v (%v)", ttl, err)
+	}
+
+	if ttl, err := store.TTL("missing"); err == nil {
+		t.Errorf("TTL for missing key: want error, got %v", ttl)
+	}
+
+	store.Delete("forever")
+	store.Delete("soon")
+}
+
+func testSetNX(t *testing.T, store API) {
+	if ok, err := store.SetNX("claim", "a", 0); err != nil || !ok {
+		t.Errorf("SetNX on missing key: want true, got %v (%v)", ok, err)
+	}
+
+	if ok, err := store.SetNX("claim", "b", 0); err != nil || ok {
+		t.Errorf("SetNX on existing key: want false, got %v (%v)", ok, err)
+	}
+
+	if v, _ := store.Get("claim"); v != "a" {
+		t.Errorf("SetNX overwrote existing key: want a, got %v", v)
+	}
+
+	store.SetNX("expiring", "a", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if ok, err := store.SetNX("expiring", "b", 0); err != nil || !ok {
+		t.Errorf("SetNX on expired key: want true, got %v (%v)", ok, err)
+	}
+
+	store.Delete("claim")
+	store.Delete("expiring")
+}